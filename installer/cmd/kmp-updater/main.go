@@ -1,9 +1,17 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
+	"path/filepath"
+	"time"
+	_ "time/tzdata" // maintenance windows name IANA zones; the image has no zoneinfo
 
+	"github.com/jhandel/KMP/installer/internal/config"
+	"github.com/jhandel/KMP/installer/internal/notify"
+	"github.com/jhandel/KMP/installer/internal/providers"
+	"github.com/jhandel/KMP/installer/internal/registry"
 	"github.com/jhandel/KMP/installer/internal/updater"
 )
 
@@ -15,6 +23,91 @@ func main() {
 		HealthURL:      envOrDefault("HEALTH_URL", "http://kmp-app/health"),
 		ListenAddr:     envOrDefault("LISTEN_ADDR", ":8484"),
 		ImageRepo:      envOrDefault("IMAGE_REPO", "ghcr.io/jhandel/kmp"),
+		MigrateCommand: envOrDefault("MIGRATE_COMMAND", updater.DefaultMigrateCommand),
+		DockerHost:     os.Getenv("DOCKER_HOST"),
+	}
+	cfg.StateDir = envOrDefault("STATE_DIR", filepath.Join(cfg.ComposeDir, updater.DefaultStateDir))
+
+	// The token lives in the mounted .env so `kmp updater rotate-token`
+	// applies without recreating the sidecar
+	cfg.Token = func() string {
+		if token := providers.UpdaterToken(cfg.ComposeDir); token != "" {
+			return token
+		}
+		return os.Getenv(providers.UpdaterTokenKey)
+	}
+
+	// Backup, update and webhook settings live in sidecar.env, written by
+	// the kmp CLI; it is parsed again only when it changes
+	settings := providers.NewSidecarSettings(cfg.ComposeDir)
+	cfg.BackupPlan = func() (bool, string) {
+		dep := settings.Deployment()
+		return dep.BackupEnabled, dep.BackupSchedule
+	}
+	cfg.RunBackup = func(ctx context.Context) (updater.BackupOutcome, error) {
+		return runBackup(ctx, settings.Deployment())
+	}
+	cfg.LastBackup = func(ctx context.Context) (time.Time, error) {
+		entries, err := providers.NewDockerProvider(settings.Deployment()).ListBackups(ctx)
+		var newest time.Time
+		for _, e := range entries {
+			if e.CreatedAt.After(newest) {
+				newest = e.CreatedAt
+			}
+		}
+		return newest, err
+	}
+	cfg.PreUpdateBackup = func(ctx context.Context, reason string) (updater.BackupOutcome, error) {
+		provider := providers.NewDockerProvider(settings.Deployment())
+		result, err := provider.Backup(ctx, providers.BackupOptions{Reason: reason})
+		if result == nil {
+			return updater.BackupOutcome{}, err
+		}
+		return updater.BackupOutcome{ID: result.ID, Size: result.Size, Location: result.Location, Remote: result.Remote}, err
+	}
+	cfg.RestoreBackup = func(ctx context.Context, id string) error {
+		provider := providers.NewDockerProvider(settings.Deployment())
+		return provider.Restore(ctx, id, providers.RestoreOptions{})
+	}
+	cfg.RestoreOnFailure = func() bool {
+		return settings.Deployment().UpdateRestorePolicy == config.RestorePolicyAuto
+	}
+	cfg.BlueGreen = func() bool {
+		return settings.Deployment().UpdateStrategy == config.UpdateStrategyBlueGreen
+	}
+	cfg.AutoUpdate = func() config.AutoUpdatePolicy {
+		return settings.Deployment().AutoUpdate
+	}
+	tags := registry.NewGHCRClient()
+	tags.Image = cfg.ImageRepo
+	cfg.ListTags = func(ctx context.Context, channel string) ([]string, error) {
+		all, err := tags.GetTags()
+		if err != nil {
+			return nil, err
+		}
+		var names []string
+		for _, t := range all {
+			if t.Channel == channel {
+				names = append(names, t.Name)
+			}
+		}
+		return names, nil
+	}
+	cfg.ResolveTag = func(ctx context.Context, tag string) (registry.Tag, error) {
+		return tags.ResolveTag(tag)
+	}
+	cfg.Channel = func() string {
+		return settings.Deployment().Channel
+	}
+
+	// Webhooks are looked up per event, so changes apply without a restart
+	notifications := notify.NewQueue(notify.NewSender(), func() []config.Webhook {
+		return settings.Deployment().Webhooks
+	})
+	go notifications.Run(context.Background())
+	cfg.Notify = func(ev notify.Event) {
+		ev.Deployment = settings.Deployment().Name
+		notifications.Post(ev)
 	}
 
 	log.Printf("kmp-updater starting on %s (compose: %s, project: %s, service: %s)",
@@ -26,6 +119,34 @@ func main() {
 	}
 }
 
+// runBackup takes a database backup of the compose project and, once it has
+// succeeded, prunes backups outside the retention policy.
+func runBackup(ctx context.Context, dep *config.Deployment) (updater.BackupOutcome, error) {
+	provider := providers.NewDockerProvider(dep)
+
+	var outcome updater.BackupOutcome
+	result, err := provider.Backup(ctx, providers.BackupOptions{})
+	if result != nil {
+		outcome.ID = result.ID
+		outcome.Size = result.Size
+		outcome.Location = result.Location
+		outcome.Remote = result.Remote
+	}
+	if err != nil {
+		return outcome, err
+	}
+
+	policy := providers.RetentionPolicyFor(dep)
+	if policy.IsZero() {
+		return outcome, nil
+	}
+	pruned, err := provider.PruneBackups(ctx, providers.PruneOptions{Policy: policy})
+	if pruned != nil {
+		outcome.Pruned = len(pruned.Pruned)
+	}
+	return outcome, err
+}
+
 func envOrDefault(key, fallback string) string {
 	if v := os.Getenv(key); v != "" {
 		return v
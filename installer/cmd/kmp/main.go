@@ -2,23 +2,36 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"os/signal"
+	"sort"
 	"strings"
+	"syscall"
+	"time"
 
 	tea "github.com/charmbracelet/bubbletea"
+	"github.com/jhandel/KMP/installer/internal/backupcrypt"
 	"github.com/jhandel/KMP/installer/internal/config"
+	"github.com/jhandel/KMP/installer/internal/cron"
+	"github.com/jhandel/KMP/installer/internal/notify"
 	"github.com/jhandel/KMP/installer/internal/providers"
 	"github.com/jhandel/KMP/installer/internal/registry"
 	"github.com/jhandel/KMP/installer/internal/selfupdate"
 	"github.com/jhandel/KMP/installer/internal/tui"
+	"github.com/jhandel/KMP/installer/internal/updater"
 	"github.com/spf13/cobra"
 )
 
 var version = "dev"
 
+// deploymentName is set by the persistent --deployment flag.
+var deploymentName string
+
 func main() {
 	rootCmd := &cobra.Command{
 		Use:   "kmp",
@@ -32,6 +45,8 @@ func main() {
 		},
 	}
 
+	rootCmd.PersistentFlags().StringVarP(&deploymentName, "deployment", "d", "", "Deployment to operate on (default: current deployment)")
+
 	rootCmd.AddCommand(
 		newInstallCmd(),
 		newUpdateCmd(),
@@ -40,7 +55,11 @@ func main() {
 		newBackupCmd(),
 		newRestoreCmd(),
 		newRollbackCmd(),
+		newUpdaterCmd(),
+		newHistoryCmd(),
+		newNotifyCmd(),
 		newConfigCmd(),
+		newDeploymentsCmd(),
 		newSelfUpdateCmd(),
 		newVersionCmd(),
 	)
@@ -50,18 +69,21 @@ func main() {
 	}
 }
 
-// loadDeployment loads the default deployment config and its provider.
+// loadDeployment loads the selected deployment config and its provider.
+// The --deployment flag wins over the current deployment stored in config.
 func loadDeployment() (*config.Deployment, providers.Provider, error) {
 	cfg, err := config.Load()
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to load config: %w", err)
 	}
 
-	// For now, use "default" deployment. Later: support multiple deployments via --name flag
-	dep, ok := cfg.Deployments["default"]
-	if !ok {
+	if len(cfg.Deployments) == 0 {
 		return nil, nil, fmt.Errorf("no deployment found. New installs via `kmp install` are retired; use the archived self-hosted deployment docs if you need to reconstruct a legacy environment")
 	}
+	dep, err := cfg.Resolve(deploymentName)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w (available: %s)", err, strings.Join(cfg.Names(), ", "))
+	}
 
 	provider, err := providers.GetProvider(dep.Provider, dep)
 	if err != nil {
@@ -71,6 +93,58 @@ func loadDeployment() (*config.Deployment, providers.Provider, error) {
 	return dep, provider, nil
 }
 
+// interruptContext returns a context cancelled on Ctrl-C or SIGTERM so
+// long-running operations can abort cleanly.
+func interruptContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
+
+// progressPrinter renders byte progress on a single, rewritten terminal line.
+type progressPrinter struct {
+	label   string
+	last    time.Time
+	printed bool
+}
+
+func newProgressPrinter(label string) *progressPrinter {
+	return &progressPrinter{label: label}
+}
+
+// Update prints progress at most a few times per second.
+func (p *progressPrinter) Update(done, total int64) {
+	if time.Since(p.last) < 250*time.Millisecond {
+		return
+	}
+	p.last = time.Now()
+	p.printed = true
+	if total > 0 {
+		fmt.Printf("\r  %s %s of %s (%d%%)   ", p.label, formatBytes(done), formatBytes(total), done*100/total)
+		return
+	}
+	fmt.Printf("\r  %s %s   ", p.label, formatBytes(done))
+}
+
+// Done ends the progress line.
+func (p *progressPrinter) Done() {
+	if p.printed {
+		fmt.Println()
+	}
+}
+
+// formatBytes renders a byte count in human-readable units.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
 // confirmPrompt asks the user to confirm an action. Returns true if confirmed.
 func confirmPrompt(msg string) bool {
 	fmt.Printf("%s [y/N]: ", msg)
@@ -99,6 +173,7 @@ func newUpdateCmd() *cobra.Command {
 		channel     string
 		yes         bool
 		checkOnly   bool
+		restore     bool
 	)
 
 	cmd := &cobra.Command{
@@ -106,7 +181,7 @@ func newUpdateCmd() *cobra.Command {
 		Short: "Check and apply updates",
 		RunE: func(cmd *cobra.Command, args []string) error {
 			if interactive {
-				p := tea.NewProgram(tui.NewUpdateModel(), tea.WithAltScreen())
+				p := tea.NewProgram(tui.NewUpdateModel(deploymentName), tea.WithAltScreen())
 				if _, err := p.Run(); err != nil {
 					return fmt.Errorf("update TUI error: %w", err)
 				}
@@ -159,7 +234,17 @@ func newUpdateCmd() *cobra.Command {
 				}
 			}
 
-			fmt.Printf("⠋ Updating to %s...\n", latest.Tag)
+			if restore {
+				dep.UpdateRestorePolicy = config.RestorePolicyAuto
+			}
+			if prompter, ok := provider.(providers.RestorePrompter); ok && !yes {
+				prompter.SetRestorePrompt(func(backupID string) bool {
+					fmt.Println("✗ The new version failed its health check.")
+					return confirmPrompt(fmt.Sprintf("Restore the database from pre-update backup %s before rolling back to %s?", backupID, currentTag))
+				})
+			}
+
+			fmt.Printf("⠋ Backing up and updating to %s...\n", latest.Tag)
 			if err := provider.Update(latest.Tag); err != nil {
 				fmt.Println("✗ Update failed:", err)
 				return err
@@ -174,6 +259,7 @@ func newUpdateCmd() *cobra.Command {
 	cmd.Flags().StringVar(&channel, "channel", "", "Release channel (release, beta, dev, nightly)")
 	cmd.Flags().BoolVarP(&yes, "yes", "y", false, "Auto-confirm update")
 	cmd.Flags().BoolVar(&checkOnly, "check", false, "Only check for updates, don't apply")
+	cmd.Flags().BoolVar(&restore, "restore-on-failure", false, "Restore the pre-update database backup if the update fails (update_restore_policy: auto)")
 
 	return cmd
 }
@@ -189,7 +275,7 @@ func newStatusCmd() *cobra.Command {
 		Short: "Show deployment health",
 		RunE: func(cmd *cobra.Command, args []string) error {
 			if interactive {
-				p := tea.NewProgram(tui.NewStatusModel(), tea.WithAltScreen())
+				p := tea.NewProgram(tui.NewStatusModel(deploymentName), tea.WithAltScreen())
 				if _, err := p.Run(); err != nil {
 					return fmt.Errorf("status TUI error: %w", err)
 				}
@@ -248,6 +334,12 @@ func newStatusCmd() *cobra.Command {
 			if st.LastBackup != "" {
 				fmt.Printf("  Last Backup: %s\n", st.LastBackup)
 			}
+			if st.NextBackup != "" {
+				fmt.Printf("  Next Backup: %s\n", st.NextBackup)
+			}
+			if st.LastVerify != "" {
+				fmt.Printf("  Last Verify: %s\n", st.LastVerify)
+			}
 			if st.LastUpdate != "" {
 				fmt.Printf("  Last Update: %s\n", st.LastUpdate)
 			}
@@ -295,13 +387,17 @@ func newLogsCmd() *cobra.Command {
 }
 
 func newBackupCmd() *cobra.Command {
-	var now bool
+	var (
+		now   bool
+		full  bool
+		prune bool
+	)
 
 	cmd := &cobra.Command{
 		Use:   "backup",
 		Short: "Create a backup",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			_, provider, err := loadDeployment()
+			dep, provider, err := loadDeployment()
 			if err != nil {
 				return err
 			}
@@ -313,126 +409,1417 @@ func newBackupCmd() *cobra.Command {
 				}
 			}
 
-			fmt.Println("⠋ Creating backup...")
-			result, err := provider.Backup()
+			ctx, stop := interruptContext()
+			defer stop()
+
+			if full {
+				fmt.Println("⠋ Creating full backup (database, uploads, certificates, config)...")
+			} else {
+				fmt.Println("⠋ Creating backup...")
+			}
+			progress := newProgressPrinter("Archived")
+			result, err := provider.Backup(ctx, providers.BackupOptions{Progress: progress.Update, Full: full})
+			progress.Done()
 			if err != nil {
-				fmt.Println("✗ Backup failed:", err)
-				return err
+				if ctx.Err() != nil {
+					fmt.Println("✗ Backup aborted; no backup file was written.")
+					return ctx.Err()
+				}
+				if result == nil {
+					fmt.Println("✗ Backup failed:", err)
+					notifyWebhooks(ctx, dep, notify.Event{Type: notify.EventBackupFailed, Error: err.Error()})
+					return err
+				}
+				// Written locally, but the off-host copy failed
+				fmt.Println("⚠", err)
+			} else {
+				fmt.Println("✓ Backup created successfully!")
 			}
-
-			fmt.Println("✓ Backup created successfully!")
 			fmt.Printf("  ID:       %s\n", result.ID)
-			fmt.Printf("  Size:     %d bytes\n", result.Size)
+			fmt.Printf("  Size:     %s\n", formatBytes(result.Size))
+			if result.Dialect != "" {
+				fmt.Printf("  Database: %s\n", result.Dialect)
+			}
+			if result.Encrypted {
+				fmt.Println("  Encrypted: yes")
+			}
 			fmt.Printf("  Location: %s\n", result.Location)
-			return nil
+			if result.Remote != "" {
+				fmt.Printf("  Remote:   %s\n", result.Remote)
+			}
+			ev := notify.Event{Type: notify.EventBackupSucceeded, BackupID: result.ID, Message: result.Location}
+			if err != nil {
+				ev.Error = err.Error()
+			}
+			notifyWebhooks(ctx, dep, ev)
+			if err != nil || !prune {
+				return err
+			}
+			return runPrune(ctx, provider, providers.PruneOptions{Policy: providers.RetentionPolicyFor(dep)})
 		},
 	}
 
 	cmd.Flags().BoolVar(&now, "now", false, "Skip confirmation prompt")
+	cmd.Flags().BoolVar(&full, "full", false, "Include uploaded documents, Caddy certificates and config files")
+	cmd.Flags().BoolVar(&prune, "prune", false, "Apply the retention policy after a successful backup (for cron jobs)")
+
+	cmd.AddCommand(newBackupListCmd(), newBackupShowCmd(), newBackupDeleteCmd(), newBackupVerifyCmd(),
+		newBackupKeygenCmd(), newBackupRekeyCmd(), newBackupPruneCmd(), newBackupScheduleCmd())
 
 	return cmd
 }
 
-func newRestoreCmd() *cobra.Command {
+func newBackupKeygenCmd() *cobra.Command {
 	return &cobra.Command{
-		Use:   "restore [backup-id]",
-		Short: "Restore from backup",
-		Args:  cobra.ExactArgs(1),
+		Use:   "keygen",
+		Short: "Generate a key pair for encrypting backups",
+		Long: "Generate an X25519 key pair. Configure the public key with 'kmp backup rekey --new-key'\n" +
+			"and keep the private key off the host; it is only needed to restore.",
+		Args: cobra.NoArgs,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			backupID := args[0]
+			identity, recipient, err := backupcrypt.GenerateKeyPair()
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Public key (safe to store on the host):\n  %s\n\n", recipient)
+			fmt.Printf("Private key (store it somewhere safe, NOT on this host):\n  %s\n", identity)
+			return nil
+		},
+	}
+}
+
+func newBackupRekeyCmd() *cobra.Command {
+	var (
+		newKey       string
+		identityFile string
+		yes          bool
+	)
 
+	cmd := &cobra.Command{
+		Use:   "rekey",
+		Short: "Re-encrypt existing backups with a new key",
+		Long: "Re-encrypt every local backup with --new-key (a passphrase or a kmp-pub- public key)\n" +
+			"and make it the deployment's backup key. Plaintext backups are encrypted as well, and\n" +
+			"off-host copies are replaced. An interrupted rekey can be re-run with the same --new-key.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if newKey == "" {
+				return fmt.Errorf("--new-key is required")
+			}
 			_, provider, err := loadDeployment()
 			if err != nil {
 				return err
 			}
+			manager, ok := provider.(providers.BackupManager)
+			if !ok {
+				return fmt.Errorf("the %s provider does not manage backup files", provider.Name())
+			}
+			identity, err := readIdentity(identityFile)
+			if err != nil {
+				return err
+			}
 
-			if !confirmPrompt(fmt.Sprintf("This will restore from backup %s. Current data will be lost. Continue?", backupID)) {
-				fmt.Println("Restore cancelled.")
+			if !yes && !confirmPrompt("Re-encrypt all backups with the new key?") {
+				fmt.Println("Rekey cancelled.")
 				return nil
 			}
 
-			fmt.Printf("⠋ Restoring from backup %s...\n", backupID)
-			if err := provider.Restore(backupID); err != nil {
-				fmt.Println("✗ Restore failed:", err)
+			ctx, stop := interruptContext()
+			defer stop()
+
+			n, err := manager.RekeyBackups(ctx, newKey, identity)
+			if errors.Is(err, providers.ErrRemoteCopiesStale) {
+				fmt.Printf("✓ Re-encrypted %d backup(s); new backups will use the new key.\n", n)
+				fmt.Printf("⚠ %v\n", err)
+				return nil
+			}
+			if err != nil {
+				fmt.Printf("✗ Rekey stopped after %d backup(s): %v\n", n, err)
 				return err
 			}
-
-			fmt.Println("✓ Restore completed successfully!")
+			fmt.Printf("✓ Re-encrypted %d backup(s); new backups will use the new key.\n", n)
 			return nil
 		},
 	}
+
+	cmd.Flags().StringVar(&newKey, "new-key", "", "Passphrase or kmp-pub- public key to encrypt with")
+	cmd.Flags().StringVar(&identityFile, "identity-file", "", "File holding the current private key or passphrase (default $KMP_BACKUP_IDENTITY)")
+	cmd.Flags().BoolVarP(&yes, "yes", "y", false, "Skip confirmation prompt")
+
+	return cmd
 }
 
-func newRollbackCmd() *cobra.Command {
-	return &cobra.Command{
-		Use:   "rollback",
-		Short: "Revert to previous version",
+func newBackupPruneCmd() *cobra.Command {
+	var (
+		dryRun bool
+		yes    bool
+		policy providers.RetentionPolicy
+	)
+
+	cmd := &cobra.Command{
+		Use:   "prune",
+		Short: "Delete backups outside the retention policy",
+		Long: "Delete local and off-host backups older than backup_retention_days, keeping the newest\n" +
+			"backup of each of the last --keep-daily days, --keep-weekly weeks and --keep-monthly months.\n" +
+			"Flags override the deployment's configured policy; the newest backup is always kept.",
+		Args: cobra.NoArgs,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			_, provider, err := loadDeployment()
+			dep, provider, err := loadDeployment()
 			if err != nil {
 				return err
 			}
 
-			if !confirmPrompt("This will revert to the previous version. Continue?") {
-				fmt.Println("Rollback cancelled.")
+			configured := providers.RetentionPolicyFor(dep)
+			flags := cmd.Flags()
+			if !flags.Changed("days") {
+				policy.Days = configured.Days
+			}
+			if !flags.Changed("keep-daily") {
+				policy.Daily = configured.Daily
+			}
+			if !flags.Changed("keep-weekly") {
+				policy.Weekly = configured.Weekly
+			}
+			if !flags.Changed("keep-monthly") {
+				policy.Monthly = configured.Monthly
+			}
+			if policy.IsZero() {
+				fmt.Println("No retention policy configured; nothing to prune.")
 				return nil
 			}
 
-			fmt.Println("⠋ Rolling back to previous version...")
-			if err := provider.Rollback(); err != nil {
-				fmt.Println("✗ Rollback failed:", err)
+			if !dryRun && !yes && !confirmPrompt("Delete backups outside the retention policy?") {
+				fmt.Println("Prune cancelled.")
+				return nil
+			}
+
+			ctx, stop := interruptContext()
+			defer stop()
+			return runPrune(ctx, provider, providers.PruneOptions{Policy: policy, DryRun: dryRun})
+		},
+	}
+
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "Show what would be deleted without deleting anything")
+	cmd.Flags().BoolVarP(&yes, "yes", "y", false, "Skip confirmation prompt")
+	cmd.Flags().IntVar(&policy.Days, "days", 0, "Keep every backup newer than this many days (default backup_retention_days)")
+	cmd.Flags().IntVar(&policy.Daily, "keep-daily", 0, "Keep the newest backup of each of the last N days")
+	cmd.Flags().IntVar(&policy.Weekly, "keep-weekly", 0, "Keep the newest backup of each of the last N weeks")
+	cmd.Flags().IntVar(&policy.Monthly, "keep-monthly", 0, "Keep the newest backup of each of the last N months")
+
+	return cmd
+}
+
+func newBackupScheduleCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "schedule [cron-expression|off]",
+		Short: "Show or change the updater sidecar's backup schedule",
+		Long: "Without arguments, show the last and next scheduled backups. With a cron expression\n" +
+			"(e.g. \"0 3 * * *\" or @daily), enable scheduled backups; \"off\" disables them.",
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			dep, provider, err := loadDeployment()
+			if err != nil {
 				return err
 			}
+			manager, ok := provider.(providers.BackupManager)
+			if !ok {
+				return fmt.Errorf("the %s provider does not run scheduled backups", provider.Name())
+			}
 
-			fmt.Println("✓ Rollback completed successfully!")
+			if len(args) == 1 {
+				enabled, schedule := true, args[0]
+				if schedule == "off" {
+					enabled, schedule = false, dep.BackupSchedule
+				} else if _, err := cron.Parse(schedule); err != nil {
+					return err
+				}
+				if err := config.UpdateDeployment(dep.Name, func(d *config.Deployment) {
+					d.BackupEnabled = enabled
+					d.BackupSchedule = schedule
+				}); err != nil {
+					return err
+				}
+				if err := providers.SyncSidecarEnv(dep.Name); err != nil {
+					return err
+				}
+				if enabled {
+					fmt.Printf("✓ Scheduled backups enabled: %s\n", schedule)
+				} else {
+					fmt.Println("✓ Scheduled backups disabled.")
+				}
+				return nil
+			}
+
+			ctx, stop := interruptContext()
+			defer stop()
+			status, err := manager.BackupSchedule(ctx)
+			if err != nil {
+				return fmt.Errorf("querying kmp-updater (is it running?): %w", err)
+			}
+
+			state := "disabled"
+			if status.Enabled {
+				state = "enabled"
+			}
+			fmt.Printf("  Schedule: %s (%s)\n", valueOrDash(status.Schedule), state)
+			if status.Error != "" {
+				fmt.Printf("  Error:    %s\n", status.Error)
+			}
+			if status.NextRun != nil {
+				fmt.Printf("  Next run: %s\n", status.NextRun.Local().Format("2006-01-02 15:04 MST"))
+			}
+			if len(status.Runs) == 0 {
+				fmt.Println("  No scheduled backups have run yet.")
+				return nil
+			}
+			fmt.Println("  Recent runs:")
+			for _, run := range status.Runs {
+				line := fmt.Sprintf("    %s  %-9s %s", run.StartedAt.Local().Format("2006-01-02 15:04"), run.Status, run.BackupID)
+				if run.Error != "" {
+					line += "  " + run.Error
+				}
+				fmt.Println(line)
+			}
 			return nil
 		},
 	}
 }
 
-func newConfigCmd() *cobra.Command {
-	cmd := &cobra.Command{
-		Use:   "config",
-		Short: "View/edit deployment config",
+// loadBackupManager loads the selected deployment's provider as a
+// BackupManager.
+func loadBackupManager() (providers.BackupManager, error) {
+	_, provider, err := loadDeployment()
+	if err != nil {
+		return nil, err
+	}
+	manager, ok := provider.(providers.BackupManager)
+	if !ok {
+		return nil, fmt.Errorf("the %s provider does not manage backup files", provider.Name())
 	}
+	return manager, nil
+}
 
-	showCmd := &cobra.Command{
-		Use:   "show",
-		Short: "Show current configuration",
+// backupKind describes what a catalogued backup holds.
+func backupKind(e providers.CatalogEntry) string {
+	kind := valueOrDash(e.Dialect)
+	if e.Full {
+		kind = "full"
+	}
+	if e.Encrypted {
+		kind += "+enc"
+	}
+	return kind
+}
+
+// backupWhere says where copies of a catalogued backup are kept.
+func backupWhere(e providers.CatalogEntry) string {
+	switch {
+	case e.Location != "" && e.Remote != "":
+		return "local+remote"
+	case e.Remote != "":
+		return "remote"
+	default:
+		return "local"
+	}
+}
+
+func newBackupListCmd() *cobra.Command {
+	var asJSON bool
+
+	cmd := &cobra.Command{
+		Use:     "list",
+		Aliases: []string{"ls"},
+		Short:   "List backups recorded in the catalog",
+		Args:    cobra.NoArgs,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			path := config.ConfigPath()
-			data, err := os.ReadFile(path)
+			manager, err := loadBackupManager()
 			if err != nil {
-				if os.IsNotExist(err) {
-					fmt.Println("No configuration file found. New installs via `kmp install` are retired.")
-					return nil
+				return err
+			}
+			ctx, stop := interruptContext()
+			defer stop()
+
+			entries, err := manager.ListBackups(ctx)
+			if err != nil {
+				return err
+			}
+			if asJSON {
+				if entries == nil {
+					entries = []providers.CatalogEntry{}
 				}
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				return enc.Encode(entries)
+			}
+			if len(entries) == 0 {
+				fmt.Println("No backups found.")
+				return nil
+			}
+			fmt.Printf("%-16s %-17s %10s  %-14s %-12s %s\n", "ID", "CREATED", "SIZE", "TYPE", "WHERE", "IMAGE")
+			for _, e := range entries {
+				fmt.Printf("%-16s %-17s %10s  %-14s %-12s %s\n", e.ID, e.CreatedAt.Local().Format("2006-01-02 15:04"),
+					formatBytes(e.Size), backupKind(e), backupWhere(e), valueOrDash(e.ImageTag))
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().BoolVar(&asJSON, "json", false, "Print the catalog as JSON")
+
+	return cmd
+}
+
+func newBackupShowCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "show <backup-id|latest>",
+		Short: "Show a backup's catalog entry",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			manager, err := loadBackupManager()
+			if err != nil {
 				return err
 			}
-			fmt.Printf("# %s\n", path)
-			fmt.Println(string(data))
+			ctx, stop := interruptContext()
+			defer stop()
+
+			e, err := manager.ShowBackup(ctx, args[0])
+			if err != nil {
+				return err
+			}
+			encrypted := "no"
+			if e.Encrypted {
+				encrypted = "yes"
+			}
+			fmt.Printf("  ID:        %s\n", e.ID)
+			fmt.Printf("  Created:   %s\n", e.CreatedAt.Local().Format("2006-01-02 15:04:05 MST"))
+			fmt.Printf("  Type:      %s\n", backupKind(*e))
+			fmt.Printf("  Database:  %s\n", valueOrDash(e.Dialect))
+			fmt.Printf("  Image tag: %s\n", valueOrDash(e.ImageTag))
+			fmt.Printf("  Size:      %s\n", formatBytes(e.Size))
+			fmt.Printf("  SHA-256:   %s\n", valueOrDash(e.SHA256))
+			fmt.Printf("  Encrypted: %s\n", encrypted)
+			fmt.Printf("  Location:  %s\n", valueOrDash(e.Location))
+			fmt.Printf("  Remote:    %s\n", valueOrDash(e.Remote))
+			if e.RemoteStale {
+				fmt.Println("             (still encrypted to the previous key)")
+			}
+			if e.Reason != "" {
+				fmt.Printf("  Reason:    %s\n", e.Reason)
+			}
+			if v := e.Verification; v != nil {
+				fmt.Printf("  Verified:  %s\n", describeVerification(v))
+			}
 			return nil
 		},
 	}
+}
 
-	pathCmd := &cobra.Command{
-		Use:   "path",
-		Short: "Show config file path",
-		Run: func(cmd *cobra.Command, args []string) {
-			fmt.Println(config.ConfigPath())
+func newBackupDeleteCmd() *cobra.Command {
+	var yes bool
+
+	cmd := &cobra.Command{
+		Use:     "delete <backup-id|latest>",
+		Aliases: []string{"rm"},
+		Short:   "Delete a backup locally and from the off-host target",
+		Args:    cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			manager, err := loadBackupManager()
+			if err != nil {
+				return err
+			}
+			ctx, stop := interruptContext()
+			defer stop()
+
+			e, err := manager.ShowBackup(ctx, args[0])
+			if err != nil {
+				return err
+			}
+			if !yes && !confirmPrompt(fmt.Sprintf("Delete backup %s (%s)?", e.ID, backupWhere(*e))) {
+				fmt.Println("Delete cancelled.")
+				return nil
+			}
+			if _, err := manager.DeleteBackup(ctx, e.ID); err != nil {
+				fmt.Println("✗ Delete failed:", err)
+				return err
+			}
+			fmt.Printf("✓ Deleted backup %s\n", e.ID)
+			return nil
 		},
 	}
 
-	cmd.AddCommand(showCmd, pathCmd)
+	cmd.Flags().BoolVarP(&yes, "yes", "y", false, "Skip confirmation prompt")
 
-	// Default to "show" when no subcommand given
-	cmd.RunE = func(cmd *cobra.Command, args []string) error {
-		return showCmd.RunE(showCmd, args)
+	return cmd
+}
+
+func newBackupVerifyCmd() *cobra.Command {
+	var identityFile string
+
+	cmd := &cobra.Command{
+		Use:   "verify <backup-id|latest>",
+		Short: "Test-restore a backup into a throwaway database",
+		Long: "Check the backup's checksum against the catalog, restore it into a temporary database\n" +
+			"container running the deployment's database image and run sanity queries against it.\n" +
+			"The container is removed afterwards and the result is recorded in the catalog.",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			manager, err := loadBackupManager()
+			if err != nil {
+				return err
+			}
+			identity, err := readIdentity(identityFile)
+			if err != nil {
+				return err
+			}
+			ctx, stop := interruptContext()
+			defer stop()
+
+			fmt.Printf("⠋ Verifying backup %s...\n", args[0])
+			progress := newProgressPrinter("Restored")
+			v, err := manager.VerifyBackup(ctx, args[0], providers.VerifyOptions{Progress: progress.Update, Identity: identity})
+			progress.Done()
+			if v == nil {
+				fmt.Println("✗ Verification did not run:", err)
+				return err
+			}
+			if v.Image != "" {
+				fmt.Printf("  Image:    %s\n", v.Image)
+			}
+			if v.Tables > 0 {
+				fmt.Printf("  Tables:   %d\n", v.Tables)
+			}
+			for _, table := range sortedKeys(v.RowCounts) {
+				fmt.Printf("  %-9s %d rows\n", table+":", v.RowCounts[table])
+			}
+			if err != nil {
+				fmt.Println("✗ Verification failed:", err)
+				return err
+			}
+			fmt.Println("✓ Backup verified.")
+			return nil
+		},
 	}
 
+	cmd.Flags().StringVar(&identityFile, "identity-file", "", "Private key or passphrase file for encrypted backups (default $KMP_BACKUP_IDENTITY)")
+
 	return cmd
 }
 
+// describeVerification summarises a recorded backup verification.
+func describeVerification(v *providers.BackupVerification) string {
+	when := v.VerifiedAt.Local().Format("2006-01-02 15:04")
+	if !v.Passed {
+		return fmt.Sprintf("FAILED %s: %s", when, v.Error)
+	}
+	return fmt.Sprintf("passed %s (%d tables, %d members)", when, v.Tables, v.RowCounts["members"])
+}
+
+// sortedKeys returns m's keys in order.
+func sortedKeys(m map[string]int64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// runPrune applies a retention policy and prints what was removed.
+func runPrune(ctx context.Context, provider providers.Provider, opts providers.PruneOptions) error {
+	manager, ok := provider.(providers.BackupManager)
+	if !ok {
+		return fmt.Errorf("the %s provider does not manage backup files", provider.Name())
+	}
+	if opts.Policy.IsZero() {
+		return nil
+	}
+
+	result, err := manager.PruneBackups(ctx, opts)
+	if result != nil {
+		verb := "Deleted"
+		if opts.DryRun {
+			verb = "Would delete"
+		}
+		for _, b := range result.Pruned {
+			fmt.Printf("  %s %s (%s)\n", verb, b.ID, b.Location)
+		}
+		fmt.Printf("✓ %s %d backup file(s), kept %d.\n", verb, len(result.Pruned), result.Kept)
+	}
+	if err != nil {
+		fmt.Println("✗ Prune failed:", err)
+	}
+	return err
+}
+
+// readIdentity returns the decryption key for encrypted backups, read from
+// path when given and otherwise from $KMP_BACKUP_IDENTITY.
+func readIdentity(path string) (string, error) {
+	if path == "" {
+		return os.Getenv("KMP_BACKUP_IDENTITY"), nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("reading identity file: %w", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func newRestoreCmd() *cobra.Command {
+	var (
+		file         string
+		identityFile string
+	)
+
+	cmd := &cobra.Command{
+		Use:   "restore [backup-id|latest]",
+		Short: "Restore from backup",
+		Long:  "Restore from a backup ID, or rebuild a deployment on a fresh host from a full backup archive with --file.",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if file == "" && len(args) == 0 {
+				return fmt.Errorf("a backup ID or --file is required")
+			}
+			identity, err := readIdentity(identityFile)
+			if err != nil {
+				return err
+			}
+
+			if file != "" {
+				if !confirmPrompt(fmt.Sprintf("This will rebuild the deployment from %s. Current data will be lost. Continue?", file)) {
+					fmt.Println("Restore cancelled.")
+					return nil
+				}
+				ctx, stop := interruptContext()
+				defer stop()
+
+				fmt.Printf("⠋ Rebuilding the deployment from %s...\n", file)
+				progress := newProgressPrinter("Restored")
+				dep, err := providers.ImportFullBackup(ctx, file, deploymentName, providers.RestoreOptions{Progress: progress.Update, Identity: identity})
+				progress.Done()
+				if err != nil {
+					if ctx.Err() != nil {
+						fmt.Println("✗ Restore aborted; the deployment may be partially restored.")
+						return ctx.Err()
+					}
+					fmt.Println("✗ Restore failed:", err)
+					return fmt.Errorf("importing backup archive: %w", err)
+				}
+				fmt.Printf("✓ Deployment %s rebuilt from %s\n", dep.Name, file)
+				return nil
+			}
+
+			backupID := args[0]
+			_, provider, err := loadDeployment()
+			if err != nil {
+				return err
+			}
+			if !confirmPrompt(fmt.Sprintf("This will restore from backup %s. Current data will be lost. Continue?", backupID)) {
+				fmt.Println("Restore cancelled.")
+				return nil
+			}
+
+			ctx, stop := interruptContext()
+			defer stop()
+
+			fmt.Printf("⠋ Restoring from backup %s...\n", backupID)
+			progress := newProgressPrinter("Restored")
+			err = provider.Restore(ctx, backupID, providers.RestoreOptions{Progress: progress.Update, Identity: identity})
+			progress.Done()
+			if err != nil {
+				if ctx.Err() != nil {
+					fmt.Println("✗ Restore aborted; the database may be partially restored.")
+					return ctx.Err()
+				}
+				fmt.Println("✗ Restore failed:", err)
+				return err
+			}
+
+			fmt.Println("✓ Restore completed successfully!")
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&file, "file", "", "Full backup archive to rebuild the deployment from")
+	cmd.Flags().StringVar(&identityFile, "identity-file", "", "Private key or passphrase file for encrypted backups (default $KMP_BACKUP_IDENTITY)")
+
+	return cmd
+}
+
+func newRollbackCmd() *cobra.Command {
+	var opts providers.RollbackOptions
+
+	cmd := &cobra.Command{
+		Use:   "rollback",
+		Short: "Revert to previous version",
+		Long: `Go back to the version the last update replaced, or with --to to an
+earlier one. Every completed update, from kmp update or the updater sidecar,
+records the tag it replaced; rolling back removes that tag and any newer
+ones from the list.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			_, provider, err := loadDeployment()
+			if err != nil {
+				return err
+			}
+
+			question := "This will revert to the previous version. Continue?"
+			if opts.To != "" {
+				question = fmt.Sprintf("This will revert to %s. Continue?", opts.To)
+			}
+			if !confirmPrompt(question) {
+				fmt.Println("Rollback cancelled.")
+				return nil
+			}
+
+			fmt.Println("⠋ Rolling back to previous version...")
+			if err := provider.Rollback(opts); err != nil {
+				fmt.Println("✗ Rollback failed:", err)
+				return err
+			}
+
+			if dep, _, err := loadDeployment(); err == nil && dep.ImageTag != "" {
+				fmt.Printf("✓ Rolled back to %s\n", dep.ImageTag)
+				return nil
+			}
+			fmt.Println("✓ Rollback completed successfully!")
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&opts.To, "to", "", "Previous tag to go back to (default: the one the last update replaced)")
+
+	return cmd
+}
+
+func newUpdaterCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "updater",
+		Short: "Manage the kmp-updater sidecar",
+	}
+	cmd.AddCommand(newUpdaterWatchCmd(), newUpdaterCancelCmd(), newUpdaterStrategyCmd(), newUpdaterAutoCmd(), newUpdaterRotateTokenCmd())
+	return cmd
+}
+
+// loadUpdaterManager loads the selected deployment's provider as an
+// UpdaterManager.
+func loadUpdaterManager() (providers.UpdaterManager, error) {
+	_, provider, err := loadDeployment()
+	if err != nil {
+		return nil, err
+	}
+	manager, ok := provider.(providers.UpdaterManager)
+	if !ok {
+		return nil, fmt.Errorf("the %s provider does not run the updater sidecar", provider.Name())
+	}
+	return manager, nil
+}
+
+func newUpdaterWatchCmd() *cobra.Command {
+	var (
+		interactive bool
+		follow      bool
+		quiet       bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "watch",
+		Short: "Follow the progress of an update run by the sidecar",
+		Long: `Stream the updater sidecar's progress events: state changes and, unless
+--quiet, docker compose output. Without --follow the command exits when the
+running update finishes, failing if it failed.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if interactive {
+				p := tea.NewProgram(tui.NewWatchModel(deploymentName), tea.WithAltScreen())
+				if _, err := p.Run(); err != nil {
+					return fmt.Errorf("watch TUI error: %w", err)
+				}
+				return nil
+			}
+
+			manager, err := loadUpdaterManager()
+			if err != nil {
+				return err
+			}
+			ctx, stop := interruptContext()
+			defer stop()
+
+			var (
+				started bool
+				final   *updater.State
+			)
+			err = manager.WatchUpdater(ctx, func(ev updater.Event) bool {
+				if ev.Type == updater.EventLog {
+					if !quiet {
+						fmt.Println("    " + ev.Line)
+					}
+					return true
+				}
+				st := ev.State
+				if st.Busy() {
+					started = true
+					fmt.Printf("⠋ [%3d%%] %s: %s\n", st.Progress, st.Status, st.Message)
+					return true
+				}
+				if !started {
+					if !follow {
+						fmt.Printf("ℹ No update in progress (%s: %s)\n", st.Status, st.Message)
+					}
+					return follow
+				}
+				started, final = false, st
+				switch st.Status {
+				case "failed":
+					fmt.Println("✗", st.Message)
+				case "cancelled":
+					fmt.Println("ℹ", st.Message)
+				default:
+					fmt.Println("✓", st.Message)
+				}
+				return follow
+			})
+			if err != nil && ctx.Err() == nil {
+				return err
+			}
+			if final != nil && final.Status == "failed" {
+				return fmt.Errorf("update failed: %s", final.Message)
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().BoolVar(&interactive, "interactive", false, "Use interactive TUI mode")
+	cmd.Flags().BoolVarP(&follow, "follow", "f", false, "Keep watching after the current update finishes")
+	cmd.Flags().BoolVarP(&quiet, "quiet", "q", false, "Only show state changes, not docker compose output")
+
+	return cmd
+}
+
+func newUpdaterCancelCmd() *cobra.Command {
+	var yes bool
+
+	cmd := &cobra.Command{
+		Use:   "cancel",
+		Short: "Cancel the update the sidecar is running",
+		Long: `Stop the sidecar's in-flight update. A backup or image pull is abandoned
+with the running version untouched; once the new version has been started
+the deployment is rolled back to the previous tag.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			manager, err := loadUpdaterManager()
+			if err != nil {
+				return err
+			}
+
+			if !yes && !confirmPrompt("Cancel the running update?") {
+				return nil
+			}
+			ctx, stop := interruptContext()
+			defer stop()
+
+			if err := manager.CancelUpdate(ctx); err != nil {
+				fmt.Println("✗ Cancel failed:", err)
+				return err
+			}
+			fmt.Println("✓ Cancel requested; run `kmp updater watch` to follow the rollback")
+			return nil
+		},
+	}
+
+	cmd.Flags().BoolVarP(&yes, "yes", "y", false, "Skip confirmation prompt")
+
+	return cmd
+}
+
+func newUpdaterStrategyCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "strategy [recreate|blue-green]",
+		Short: "Show or change how the sidecar swaps in a new version",
+		Long: `Without arguments, show the deployment's update strategy.
+
+recreate (default) stops the app and starts the new tag in its place, so the
+site is down until the new version passes its health check. blue-green starts
+the new tag alongside the running app and switches Caddy to it only once it is
+healthy; a version that never gets healthy never receives traffic.`,
+		Args:      cobra.MaximumNArgs(1),
+		ValidArgs: []string{config.UpdateStrategyRecreate, config.UpdateStrategyBlueGreen},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			dep, provider, err := loadDeployment()
+			if err != nil {
+				return err
+			}
+			if _, ok := provider.(providers.UpdaterManager); !ok {
+				return fmt.Errorf("the %s provider does not run the updater sidecar", provider.Name())
+			}
+
+			if len(args) == 0 {
+				strategy := dep.UpdateStrategy
+				if strategy == "" {
+					strategy = config.UpdateStrategyRecreate
+				}
+				fmt.Printf("  Update strategy: %s\n", strategy)
+				return nil
+			}
+
+			strategy := args[0]
+			if strategy != config.UpdateStrategyRecreate && strategy != config.UpdateStrategyBlueGreen {
+				return fmt.Errorf("unknown update strategy %q (want %s or %s)", strategy, config.UpdateStrategyRecreate, config.UpdateStrategyBlueGreen)
+			}
+			if err := config.UpdateDeployment(dep.Name, func(d *config.Deployment) {
+				d.UpdateStrategy = strategy
+			}); err != nil {
+				return err
+			}
+			if err := providers.SyncSidecarEnv(dep.Name); err != nil {
+				return err
+			}
+			fmt.Printf("✓ Update strategy set to %s\n", strategy)
+			return nil
+		},
+	}
+}
+
+func newUpdaterAutoCmd() *cobra.Command {
+	var policy config.AutoUpdatePolicy
+
+	cmd := &cobra.Command{
+		Use:   "auto [on|off]",
+		Short: "Show or change the policy under which the sidecar updates by itself",
+		Long: `Without arguments or flags, show the deployment's auto-update policy.
+
+When on, the sidecar checks the registry every 15 minutes while the
+maintenance window is open and updates to the newest release on the channel
+that is at most a --max-bump step (patch, minor or major) from the running
+version. Newer releases it leaves alone are recorded in kmp history as
+skipped. The window is a cron expression matched against the minute an update
+would start, in --timezone: "* 2-4 * * sat,sun" allows 02:00-04:59 at weekends.`,
+		Example: `  kmp updater auto on --max-bump minor --window "* 2-4 * * *" --timezone Europe/London
+  kmp updater auto --require-backup
+  kmp updater auto off`,
+		Args:      cobra.MaximumNArgs(1),
+		ValidArgs: []string{"on", "off"},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			dep, provider, err := loadDeployment()
+			if err != nil {
+				return err
+			}
+			if _, ok := provider.(providers.UpdaterManager); !ok {
+				return fmt.Errorf("the %s provider does not run the updater sidecar", provider.Name())
+			}
+
+			if len(args) == 0 && cmd.Flags().NFlag() == 0 {
+				printAutoUpdatePolicy(dep)
+				return nil
+			}
+
+			flags := cmd.Flags()
+			if flags.Changed("max-bump") {
+				switch policy.MaxBump {
+				case config.BumpPatch, config.BumpMinor, config.BumpMajor:
+				default:
+					return fmt.Errorf("unknown --max-bump %q (want %s, %s or %s)", policy.MaxBump, config.BumpPatch, config.BumpMinor, config.BumpMajor)
+				}
+			}
+			if flags.Changed("window") && policy.Window != "" {
+				if _, err := cron.Parse(policy.Window); err != nil {
+					return fmt.Errorf("invalid --window: %w", err)
+				}
+			}
+			if flags.Changed("timezone") {
+				if _, err := time.LoadLocation(policy.Timezone); err != nil {
+					return fmt.Errorf("invalid --timezone: %w", err)
+				}
+			}
+
+			if len(args) == 1 && args[0] != "on" && args[0] != "off" {
+				return fmt.Errorf("expected on or off, got %q", args[0])
+			}
+			if err := config.UpdateDeployment(dep.Name, func(d *config.Deployment) {
+				if len(args) == 1 {
+					d.AutoUpdate.Enabled = args[0] == "on"
+				}
+				if flags.Changed("channel") {
+					d.AutoUpdate.Channel = policy.Channel
+				}
+				if flags.Changed("max-bump") {
+					d.AutoUpdate.MaxBump = policy.MaxBump
+				}
+				if flags.Changed("window") {
+					d.AutoUpdate.Window = policy.Window
+				}
+				if flags.Changed("timezone") {
+					d.AutoUpdate.Timezone = policy.Timezone
+				}
+				if flags.Changed("require-backup") {
+					d.AutoUpdate.RequireBackup = policy.RequireBackup
+				}
+				*dep = *d
+			}); err != nil {
+				return err
+			}
+			if err := providers.SyncSidecarEnv(dep.Name); err != nil {
+				return err
+			}
+			if dep.AutoUpdate.Enabled {
+				fmt.Println("✓ Auto-update policy saved")
+			} else {
+				fmt.Println("✓ Auto-update policy saved (auto-updates are off)")
+			}
+			printAutoUpdatePolicy(dep)
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&policy.Channel, "channel", "", "Release channel to follow (default: the deployment's channel)")
+	cmd.Flags().StringVar(&policy.MaxBump, "max-bump", "", "Largest version step applied automatically: patch, minor or major")
+	cmd.Flags().StringVar(&policy.Window, "window", "", "Cron expression of the minutes an update may start in (empty: any time)")
+	cmd.Flags().StringVar(&policy.Timezone, "timezone", "", "IANA timezone of --window (default UTC)")
+	cmd.Flags().BoolVar(&policy.RequireBackup, "require-backup", false, "Skip the update unless the pre-update backup, off-host copy included, succeeds")
+	return cmd
+}
+
+// printAutoUpdatePolicy shows dep's auto-update policy with defaults filled in.
+func printAutoUpdatePolicy(dep *config.Deployment) {
+	p := dep.AutoUpdate
+	state := "off"
+	if p.Enabled {
+		state = "on"
+	}
+	fmt.Printf("  Auto-update:    %s\n", state)
+	fmt.Printf("  Channel:        %s\n", valueOr(p.Channel, valueOr(dep.Channel, "release")))
+	fmt.Printf("  Max bump:       %s\n", valueOr(p.MaxBump, config.BumpPatch))
+	fmt.Printf("  Window:         %s\n", valueOr(p.Window, "any time"))
+	fmt.Printf("  Timezone:       %s\n", valueOr(p.Timezone, "UTC"))
+	fmt.Printf("  Require backup: %t\n", p.RequireBackup)
+}
+
+func newUpdaterRotateTokenCmd() *cobra.Command {
+	var yes bool
+
+	cmd := &cobra.Command{
+		Use:   "rotate-token",
+		Short: "Replace the bearer token that guards the updater API",
+		Long: `Generate a new updater token, write it to the deployment's .env and
+recreate the app so both sides use it. The sidecar re-reads the token on
+every request, so the old token stops working immediately.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			manager, err := loadUpdaterManager()
+			if err != nil {
+				return err
+			}
+
+			if !yes && !confirmPrompt("Rotate the updater token? The app will be recreated.") {
+				fmt.Println("Rotation cancelled.")
+				return nil
+			}
+			ctx, stop := interruptContext()
+			defer stop()
+
+			fmt.Println("⠋ Rotating updater token...")
+			if _, err := manager.RotateUpdaterToken(ctx); err != nil {
+				fmt.Println("✗ Rotation failed:", err)
+				return err
+			}
+			fmt.Println("✓ Updater token rotated")
+			return nil
+		},
+	}
+
+	cmd.Flags().BoolVarP(&yes, "yes", "y", false, "Skip confirmation prompt")
+
+	return cmd
+}
+
+func newHistoryCmd() *cobra.Command {
+	var (
+		limit  int
+		page   int
+		asJSON bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "history",
+		Short: "Show past updates and rollbacks",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if page < 1 {
+				return fmt.Errorf("--page must be at least 1")
+			}
+			manager, err := loadUpdaterManager()
+			if err != nil {
+				return err
+			}
+			ctx, stop := interruptContext()
+			defer stop()
+
+			history, err := manager.UpdateHistory(ctx, limit, (page-1)*limit)
+			if err != nil {
+				return err
+			}
+			if asJSON {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				return enc.Encode(history)
+			}
+			if len(history.Entries) == 0 {
+				fmt.Println("No updates recorded.")
+				return nil
+			}
+			fmt.Printf("%-17s %-8s %-12s %-25s %-20s %s\n", "STARTED", "TOOK", "STATUS", "TAGS", "BY", "DETAIL")
+			for _, e := range history.Entries {
+				detail := e.Message
+				if e.Error != "" {
+					detail = e.Error
+				}
+				fmt.Printf("%-17s %-8s %-12s %-25s %-20s %s\n", e.StartedAt.Local().Format("2006-01-02 15:04"),
+					e.FinishedAt.Sub(e.StartedAt).Round(time.Second), e.Status,
+					valueOrDash(e.PreviousTag)+" -> "+e.TargetTag, valueOrDash(e.RequestedBy), detail)
+			}
+			if shown := history.Offset + len(history.Entries); shown < history.Total {
+				fmt.Printf("\nShowing %d-%d of %d; use --page %d for older entries.\n", history.Offset+1, shown, history.Total, page+1)
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().IntVarP(&limit, "limit", "n", 20, "Entries per page")
+	cmd.Flags().IntVar(&page, "page", 1, "Page to show, 1 being the most recent")
+	cmd.Flags().BoolVar(&asJSON, "json", false, "Print the history page as JSON")
+
+	return cmd
+}
+
+// notifyWebhooks sends ev to dep's webhooks. A failed notification is
+// reported but does not fail the command.
+func notifyWebhooks(ctx context.Context, dep *config.Deployment, ev notify.Event) {
+	if len(dep.Webhooks) == 0 {
+		return
+	}
+	ev.Deployment = dep.Name
+	if err := notify.NewSender().Send(ctx, dep.Webhooks, ev); err != nil {
+		fmt.Println("⚠ Webhook notification failed:", err)
+	}
+}
+
+func newNotifyCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "notify",
+		Short: "Manage webhook notifications for updates and backups",
+		Long: `Webhooks receive a POST for every update started, completed, failed,
+rolled back or cancelled, and every backup that succeeded or failed, from
+both the CLI and the updater sidecar. Payloads are JSON, or a chat message
+for Slack and Discord incoming webhooks; with a secret they are signed in the
+X-KMP-Signature header.`,
+	}
+	cmd.AddCommand(newNotifyListCmd(), newNotifyAddCmd(), newNotifyRemoveCmd(), newNotifyTestCmd())
+	return cmd
+}
+
+func newNotifyListCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:     "list",
+		Aliases: []string{"ls"},
+		Short:   "List the deployment's webhooks",
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			dep, _, err := loadDeployment()
+			if err != nil {
+				return err
+			}
+			if len(dep.Webhooks) == 0 {
+				fmt.Println("No webhooks configured. Add one with `kmp notify add <url>`.")
+				return nil
+			}
+			for _, hook := range dep.Webhooks {
+				format := hook.Format
+				if format == "" {
+					format = notify.FormatJSON
+				}
+				events := "all events"
+				if len(hook.Events) > 0 {
+					events = strings.Join(hook.Events, ", ")
+				}
+				signed := ""
+				if hook.Secret != "" {
+					signed = ", signed"
+				}
+				fmt.Printf("  %s (%s%s; %s)\n", hook.URL, format, signed, events)
+			}
+			return nil
+		},
+	}
+}
+
+func newNotifyAddCmd() *cobra.Command {
+	var hook config.Webhook
+
+	cmd := &cobra.Command{
+		Use:   "add <url>",
+		Short: "Add a webhook, or replace the one with the same URL",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			dep, _, err := loadDeployment()
+			if err != nil {
+				return err
+			}
+			hook.URL = args[0]
+			if !strings.HasPrefix(hook.URL, "http://") && !strings.HasPrefix(hook.URL, "https://") {
+				return fmt.Errorf("webhook URL must start with http:// or https://")
+			}
+			if _, err := notify.Payload(hook, notify.Event{Type: notify.EventTest}); err != nil {
+				return err
+			}
+
+			if err := config.UpdateDeployment(dep.Name, func(d *config.Deployment) {
+				hooks := d.Webhooks[:0]
+				for _, h := range d.Webhooks {
+					if h.URL != hook.URL {
+						hooks = append(hooks, h)
+					}
+				}
+				d.Webhooks = append(hooks, hook)
+			}); err != nil {
+				return err
+			}
+			if err := providers.SyncSidecarEnv(dep.Name); err != nil {
+				return err
+			}
+			fmt.Println("✓ Webhook added; run `kmp notify test` to try it")
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&hook.Format, "format", notify.FormatJSON, "Payload format: json, slack or discord")
+	cmd.Flags().StringVar(&hook.Secret, "secret", "", "Sign payloads with this secret (X-KMP-Signature)")
+	cmd.Flags().StringSliceVar(&hook.Events, "events", nil, "Only send these events, e.g. update.failed,backup (default: all)")
+
+	return cmd
+}
+
+func newNotifyRemoveCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "remove <url>",
+		Short: "Remove a webhook",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			dep, _, err := loadDeployment()
+			if err != nil {
+				return err
+			}
+			found := false
+			if err := config.UpdateDeployment(dep.Name, func(d *config.Deployment) {
+				hooks := d.Webhooks[:0]
+				for _, h := range d.Webhooks {
+					if h.URL == args[0] {
+						found = true
+						continue
+					}
+					hooks = append(hooks, h)
+				}
+				d.Webhooks = hooks
+			}); err != nil {
+				return err
+			}
+			if !found {
+				return fmt.Errorf("no webhook with URL %s", args[0])
+			}
+			if err := providers.SyncSidecarEnv(dep.Name); err != nil {
+				return err
+			}
+			fmt.Println("✓ Webhook removed")
+			return nil
+		},
+	}
+}
+
+func newNotifyTestCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "test",
+		Short: "Send a test event to every webhook",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			dep, _, err := loadDeployment()
+			if err != nil {
+				return err
+			}
+			if len(dep.Webhooks) == 0 {
+				return fmt.Errorf("no webhooks configured; add one with `kmp notify add <url>`")
+			}
+			ctx, stop := interruptContext()
+			defer stop()
+
+			sender := notify.NewSender()
+			ev := notify.Event{Type: notify.EventTest, Deployment: dep.Name, Message: "Sent by kmp notify test"}
+			failed := 0
+			for _, hook := range dep.Webhooks {
+				if err := sender.Deliver(ctx, hook, ev); err != nil {
+					fmt.Println("✗", err)
+					failed++
+					continue
+				}
+				fmt.Printf("✓ %s\n", hook.URL)
+			}
+			if failed > 0 {
+				return fmt.Errorf("%d of %d webhooks failed", failed, len(dep.Webhooks))
+			}
+			return nil
+		},
+	}
+}
+
+func newConfigCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "config",
+		Short: "View/edit deployment config",
+	}
+
+	showCmd := &cobra.Command{
+		Use:   "show",
+		Short: "Show current configuration",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			path := config.ConfigPath()
+			data, err := os.ReadFile(path)
+			if err != nil {
+				if os.IsNotExist(err) {
+					fmt.Println("No configuration file found. New installs via `kmp install` are retired.")
+					return nil
+				}
+				return err
+			}
+			fmt.Printf("# %s\n", path)
+			fmt.Println(string(data))
+			return nil
+		},
+	}
+
+	pathCmd := &cobra.Command{
+		Use:   "path",
+		Short: "Show config file path",
+		Run: func(cmd *cobra.Command, args []string) {
+			fmt.Println(config.ConfigPath())
+		},
+	}
+
+	cmd.AddCommand(showCmd, pathCmd)
+
+	// Default to "show" when no subcommand given
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		return showCmd.RunE(showCmd, args)
+	}
+
+	return cmd
+}
+
+func newDeploymentsCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "deployments",
+		Aliases: []string{"deployment"},
+		Short:   "List and select named deployments",
+	}
+
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List configured deployments",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := config.Load()
+			if err != nil {
+				return fmt.Errorf("failed to load config: %w", err)
+			}
+			if len(cfg.Deployments) == 0 {
+				fmt.Println("No deployments configured.")
+				return nil
+			}
+
+			current := cfg.CurrentName()
+			for _, name := range cfg.Names() {
+				dep := cfg.Deployments[name]
+				marker := " "
+				if name == current {
+					marker = "*"
+				}
+				fmt.Printf("%s %-16s %-10s %-12s %s\n", marker, name, dep.Provider, valueOrDash(dep.ImageTag), valueOrDash(dep.Domain))
+			}
+			return nil
+		},
+	}
+
+	useCmd := &cobra.Command{
+		Use:   "use <name>",
+		Short: "Set the current deployment",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := config.Load()
+			if err != nil {
+				return fmt.Errorf("failed to load config: %w", err)
+			}
+			if _, ok := cfg.Deployments[args[0]]; !ok {
+				return fmt.Errorf("deployment %q not found (available: %s)", args[0], strings.Join(cfg.Names(), ", "))
+			}
+			cfg.Current = args[0]
+			if err := cfg.Save(); err != nil {
+				return err
+			}
+			fmt.Printf("✓ Current deployment is now %s\n", args[0])
+			return nil
+		},
+	}
+
+	var yes bool
+	removeCmd := &cobra.Command{
+		Use:   "remove <name>",
+		Short: "Forget a deployment (does not touch its containers or data)",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			name := args[0]
+			cfg, err := config.Load()
+			if err != nil {
+				return fmt.Errorf("failed to load config: %w", err)
+			}
+			if _, ok := cfg.Deployments[name]; !ok {
+				return fmt.Errorf("deployment %q not found", name)
+			}
+			if !yes && !confirmPrompt(fmt.Sprintf("Remove deployment %s from the config?", name)) {
+				fmt.Println("Remove cancelled.")
+				return nil
+			}
+			delete(cfg.Deployments, name)
+			if cfg.Current == name {
+				cfg.Current = ""
+			}
+			if err := cfg.Save(); err != nil {
+				return err
+			}
+			fmt.Printf("✓ Removed deployment %s\n", name)
+			return nil
+		},
+	}
+	removeCmd.Flags().BoolVarP(&yes, "yes", "y", false, "Skip confirmation prompt")
+
+	cmd.AddCommand(listCmd, useCmd, removeCmd)
+
+	// Default to "list" when no subcommand given
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		return listCmd.RunE(listCmd, args)
+	}
+
+	return cmd
+}
+
+// valueOr returns v, or fallback when v is empty.
+func valueOr(v, fallback string) string {
+	if v == "" {
+		return fallback
+	}
+	return v
+}
+
+func valueOrDash(v string) string {
+	if v == "" {
+		return "-"
+	}
+	return v
+}
+
 func newSelfUpdateCmd() *cobra.Command {
 	return &cobra.Command{
 		Use:   "self-update",
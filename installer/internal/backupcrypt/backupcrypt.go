@@ -0,0 +1,452 @@
+// Package backupcrypt encrypts backup streams at rest.
+//
+// A random 256-bit file key encrypts the payload in 64 KiB AES-256-GCM chunks
+// (STREAM construction: the nonce carries a chunk counter and a final-chunk
+// flag, so reordering and truncation are detected). The file key itself is
+// wrapped either with a PBKDF2-derived passphrase key or, for public-key
+// recipients, with an X25519 key agreement so the host that writes backups
+// never needs the decryption key.
+package backupcrypt
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	// Extension is appended to the name of every encrypted backup file.
+	Extension = ".enc"
+
+	magic = "KMPENC1\n"
+
+	modePassphrase byte = 1
+	modeX25519     byte = 2
+
+	// RecipientPrefix marks a public key that backups are encrypted to.
+	RecipientPrefix = "kmp-pub-"
+	// IdentityPrefix marks the private key that decrypts recipient backups.
+	IdentityPrefix = "kmp-key-"
+
+	pbkdf2Iterations = 600000
+	chunkSize        = 64 * 1024
+	hkdfInfo         = "kmp-backup-v1"
+)
+
+// ErrNoIdentity is returned when an encrypted stream needs a key that was not supplied.
+var ErrNoIdentity = errors.New("backup is encrypted but no matching decryption key was provided")
+
+// Recipient wraps file keys for a passphrase or public key.
+type Recipient interface {
+	wrap(fileKey []byte) (header []byte, err error)
+}
+
+// Identity unwraps file keys produced for a matching Recipient.
+type Identity interface {
+	unwrap(mode byte, header *bufio.Reader) (fileKey []byte, err error)
+}
+
+// ParseRecipient accepts a "kmp-pub-" public key or any other non-empty
+// string, which is treated as a passphrase. A "kmp-key-" private key is
+// refused: it belongs off the host, not in the deployment's config.
+func ParseRecipient(key string) (Recipient, error) {
+	key = strings.TrimSpace(key)
+	if key == "" {
+		return nil, errors.New("empty encryption key")
+	}
+	if strings.HasPrefix(key, RecipientPrefix) {
+		raw, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(key, RecipientPrefix))
+		if err != nil {
+			return nil, fmt.Errorf("invalid recipient key: %w", err)
+		}
+		pub, err := ecdh.X25519().NewPublicKey(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid recipient key: %w", err)
+		}
+		return x25519Recipient{pub: pub}, nil
+	}
+	if strings.HasPrefix(key, IdentityPrefix) {
+		// Saving the private key next to the backups would defeat the key pair
+		return nil, errors.New("a kmp-key- private key must not be used to encrypt backups; supply the matching kmp-pub- key")
+	}
+	return passphrase(key), nil
+}
+
+// ParseIdentity accepts a "kmp-key-" private key or a passphrase.
+func ParseIdentity(key string) (Identity, error) {
+	key = strings.TrimSpace(key)
+	if key == "" {
+		return nil, errors.New("empty decryption key")
+	}
+	if strings.HasPrefix(key, IdentityPrefix) {
+		raw, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(key, IdentityPrefix))
+		if err != nil {
+			return nil, fmt.Errorf("invalid identity key: %w", err)
+		}
+		priv, err := ecdh.X25519().NewPrivateKey(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid identity key: %w", err)
+		}
+		return x25519Identity{priv: priv}, nil
+	}
+	if strings.HasPrefix(key, RecipientPrefix) {
+		return nil, errors.New("a public recipient key cannot decrypt backups; supply the matching kmp-key- identity")
+	}
+	return passphrase(key), nil
+}
+
+// GenerateKeyPair returns a new identity (private) and recipient (public) key.
+func GenerateKeyPair() (identity, recipient string, err error) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	return IdentityPrefix + base64.RawURLEncoding.EncodeToString(priv.Bytes()),
+		RecipientPrefix + base64.RawURLEncoding.EncodeToString(priv.PublicKey().Bytes()), nil
+}
+
+// IsEncrypted reports whether r starts with the encrypted-backup header
+// without consuming it.
+func IsEncrypted(r *bufio.Reader) bool {
+	head, err := r.Peek(len(magic))
+	return err == nil && string(head) == magic
+}
+
+// Encrypt returns a writer that encrypts everything written to it into w.
+// Close must be called to emit the final chunk; it does not close w.
+func Encrypt(w io.Writer, r Recipient) (io.WriteCloser, error) {
+	fileKey := make([]byte, 32)
+	if _, err := rand.Read(fileKey); err != nil {
+		return nil, err
+	}
+	header, err := r.wrap(fileKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(fileKey)
+	if err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, 7)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(append(append([]byte(magic), header...), prefix...)); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{w: w, aead: aead, prefix: prefix, buf: make([]byte, 0, chunkSize)}, nil
+}
+
+// Decrypt returns a reader yielding the plaintext of the encrypted stream r,
+// trying each identity in turn to unwrap the file key.
+func Decrypt(r io.Reader, ids ...Identity) (io.Reader, error) {
+	br := bufio.NewReaderSize(r, chunkSize+64)
+	if !IsEncrypted(br) {
+		return nil, errors.New("not an encrypted backup")
+	}
+	if _, err := br.Discard(len(magic)); err != nil {
+		return nil, err
+	}
+	mode, err := br.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	// The wrapped key section has a fixed size per mode, so buffer it once
+	// and let each identity try it.
+	size, ok := headerSizes[mode]
+	if !ok {
+		return nil, fmt.Errorf("unsupported encryption mode %d", mode)
+	}
+	header := make([]byte, size)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, fmt.Errorf("reading encryption header: %w", err)
+	}
+
+	var fileKey []byte
+	for _, id := range ids {
+		if id == nil {
+			continue
+		}
+		if key, err := id.unwrap(mode, bufio.NewReader(bytes.NewReader(header))); err == nil {
+			fileKey = key
+			break
+		}
+	}
+	if fileKey == nil {
+		return nil, ErrNoIdentity
+	}
+
+	aead, err := newAEAD(fileKey)
+	if err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, 7)
+	if _, err := io.ReadFull(br, prefix); err != nil {
+		return nil, fmt.Errorf("reading encryption header: %w", err)
+	}
+	return &decryptReader{r: br, aead: aead, prefix: prefix}, nil
+}
+
+// --- passphrase -------------------------------------------------------------
+
+type passphrase string
+
+const passphraseHeaderSize = 16 + 4 + 12 + 32 + 16 // salt, iterations, nonce, sealed key
+
+func (p passphrase) wrap(fileKey []byte) ([]byte, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	kek, err := pbkdf2.Key(sha256.New, string(p), salt, pbkdf2Iterations, 32)
+	if err != nil {
+		return nil, err
+	}
+	header := append([]byte{modePassphrase}, salt...)
+	header = binary.BigEndian.AppendUint32(header, pbkdf2Iterations)
+	return sealKey(header, kek, fileKey)
+}
+
+func (p passphrase) unwrap(mode byte, r *bufio.Reader) ([]byte, error) {
+	if mode != modePassphrase {
+		return nil, errors.New("not a passphrase-encrypted backup")
+	}
+	salt := make([]byte, 16)
+	if _, err := io.ReadFull(r, salt); err != nil {
+		return nil, err
+	}
+	var iter uint32
+	if err := binary.Read(r, binary.BigEndian, &iter); err != nil {
+		return nil, err
+	}
+	kek, err := pbkdf2.Key(sha256.New, string(p), salt, int(iter), 32)
+	if err != nil {
+		return nil, err
+	}
+	aad := append([]byte{modePassphrase}, salt...)
+	aad = binary.BigEndian.AppendUint32(aad, iter)
+	return openKey(aad, kek, r)
+}
+
+// --- X25519 -----------------------------------------------------------------
+
+type x25519Recipient struct{ pub *ecdh.PublicKey }
+
+type x25519Identity struct{ priv *ecdh.PrivateKey }
+
+const x25519HeaderSize = 32 + 12 + 32 + 16 // ephemeral key, nonce, sealed key
+
+func (x x25519Recipient) wrap(fileKey []byte) ([]byte, error) {
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := eph.ECDH(x.pub)
+	if err != nil {
+		return nil, err
+	}
+	kek, err := x25519KEK(shared, eph.PublicKey(), x.pub)
+	if err != nil {
+		return nil, err
+	}
+	header := append([]byte{modeX25519}, eph.PublicKey().Bytes()...)
+	return sealKey(header, kek, fileKey)
+}
+
+func (x x25519Identity) unwrap(mode byte, r *bufio.Reader) ([]byte, error) {
+	if mode != modeX25519 {
+		return nil, errors.New("not a public-key-encrypted backup")
+	}
+	raw := make([]byte, 32)
+	if _, err := io.ReadFull(r, raw); err != nil {
+		return nil, err
+	}
+	ephPub, err := ecdh.X25519().NewPublicKey(raw)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := x.priv.ECDH(ephPub)
+	if err != nil {
+		return nil, err
+	}
+	kek, err := x25519KEK(shared, ephPub, x.priv.PublicKey())
+	if err != nil {
+		return nil, err
+	}
+	return openKey(append([]byte{modeX25519}, raw...), kek, r)
+}
+
+// x25519KEK derives the key-encryption key from an X25519 shared secret,
+// binding it to both the ephemeral and the recipient public keys.
+func x25519KEK(shared []byte, ephPub, recipient *ecdh.PublicKey) ([]byte, error) {
+	salt := append(append([]byte{}, ephPub.Bytes()...), recipient.Bytes()...)
+	return hkdf.Key(sha256.New, shared, salt, hkdfInfo, 32)
+}
+
+// --- shared helpers ---------------------------------------------------------
+
+// headerSizes is the size of the key section that follows the mode byte.
+var headerSizes = map[byte]int{
+	modePassphrase: passphraseHeaderSize,
+	modeX25519:     x25519HeaderSize,
+}
+
+// sealKey appends nonce and the wrapped file key to header; header (which
+// starts with the mode byte) is authenticated as additional data.
+func sealKey(header, kek, fileKey []byte) ([]byte, error) {
+	aead, err := newAEAD(kek)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := aead.Seal(nil, nonce, fileKey, header)
+	return append(append(header, nonce...), sealed...), nil
+}
+
+func openKey(aad, kek []byte, r io.Reader) ([]byte, error) {
+	aead, err := newAEAD(kek)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(r, nonce); err != nil {
+		return nil, err
+	}
+	sealed := make([]byte, 32+aead.Overhead())
+	if _, err := io.ReadFull(r, sealed); err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, nonce, sealed, aad)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[7:11], counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+type encryptWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	buf     []byte
+	closed  bool
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	if e.closed {
+		return 0, errors.New("write to closed encrypter")
+	}
+	n := 0
+	for len(p) > 0 {
+		// A full buffer is only flushed once more data arrives, so the
+		// final chunk is always the one sealed by Close.
+		if len(e.buf) == chunkSize {
+			if err := e.flush(false); err != nil {
+				return n, err
+			}
+		}
+		take := min(chunkSize-len(e.buf), len(p))
+		e.buf = append(e.buf, p[:take]...)
+		p = p[take:]
+		n += take
+	}
+	return n, nil
+}
+
+func (e *encryptWriter) flush(last bool) error {
+	sealed := e.aead.Seal(nil, chunkNonce(e.prefix, e.counter, last), e.buf, nil)
+	e.counter++
+	e.buf = e.buf[:0]
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+func (e *encryptWriter) Close() error {
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+	return e.flush(true)
+}
+
+type decryptReader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	plain   []byte
+	done    bool
+	err     error
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		if d.done {
+			return 0, io.EOF
+		}
+		d.err = d.next()
+	}
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+func (d *decryptReader) next() error {
+	sealed := make([]byte, chunkSize+d.aead.Overhead())
+	n, err := io.ReadFull(d.r, sealed)
+	last := false
+	switch {
+	case err == io.ErrUnexpectedEOF || err == io.EOF:
+		last = true
+	case err != nil:
+		return err
+	default:
+		if _, peekErr := d.r.Peek(1); peekErr == io.EOF {
+			last = true
+		}
+	}
+	plain, err := d.aead.Open(nil, chunkNonce(d.prefix, d.counter, last), sealed[:n], nil)
+	if err != nil {
+		if last {
+			return errors.New("encrypted backup is truncated or corrupt")
+		}
+		return errors.New("encrypted backup is corrupt")
+	}
+	d.counter++
+	d.plain = plain
+	d.done = last
+	return nil
+}
@@ -0,0 +1,103 @@
+package backupcrypt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func encryptBytes(t *testing.T, recipient Recipient, plain []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := Encrypt(&buf, recipient)
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+	if _, err := w.Write(plain); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestPassphraseRoundTripAcrossChunks(t *testing.T) {
+	plain := make([]byte, 3*chunkSize+17)
+	_, _ = rand.Read(plain)
+
+	recipient, err := ParseRecipient("correct horse battery staple")
+	if err != nil {
+		t.Fatalf("ParseRecipient: %v", err)
+	}
+	sealed := encryptBytes(t, recipient, plain)
+
+	identity, _ := ParseIdentity("correct horse battery staple")
+	r, err := Decrypt(bytes.NewReader(sealed), identity)
+	if err != nil {
+		t.Fatalf("Decrypt: %v", err)
+	}
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("read plaintext: %v", err)
+	}
+	if !bytes.Equal(got, plain) {
+		t.Fatalf("plaintext mismatch (%d vs %d bytes)", len(got), len(plain))
+	}
+}
+
+func TestRecipientKeyRoundTripAndWrongKey(t *testing.T) {
+	identityKey, recipientKey, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("GenerateKeyPair: %v", err)
+	}
+	recipient, err := ParseRecipient(recipientKey)
+	if err != nil {
+		t.Fatalf("ParseRecipient: %v", err)
+	}
+	sealed := encryptBytes(t, recipient, []byte("member PII"))
+
+	if _, err := ParseIdentity(recipientKey); err == nil {
+		t.Fatalf("expected a public key to be rejected as an identity")
+	}
+	if _, err := ParseRecipient(identityKey); err == nil || !strings.Contains(err.Error(), "kmp-pub-") {
+		t.Fatalf("expected a private key to be rejected as a recipient, got %v", err)
+	}
+
+	otherKey, _, _ := GenerateKeyPair()
+	other, _ := ParseIdentity(otherKey)
+	if _, err := Decrypt(bytes.NewReader(sealed), other); !errors.Is(err, ErrNoIdentity) {
+		t.Fatalf("expected ErrNoIdentity for wrong key, got %v", err)
+	}
+
+	identity, _ := ParseIdentity(identityKey)
+	r, err := Decrypt(bytes.NewReader(sealed), other, identity)
+	if err != nil {
+		t.Fatalf("Decrypt: %v", err)
+	}
+	got, _ := io.ReadAll(r)
+	if string(got) != "member PII" {
+		t.Fatalf("unexpected plaintext %q", got)
+	}
+}
+
+func TestDecryptDetectsTruncation(t *testing.T) {
+	identityKey, recipientKey, _ := GenerateKeyPair()
+	recipient, _ := ParseRecipient(recipientKey)
+	plain := make([]byte, 2*chunkSize+5)
+	sealed := encryptBytes(t, recipient, plain)
+
+	// Drop the final chunk so the stream ends on a full, non-final chunk.
+	truncated := sealed[:len(sealed)-(5+16)]
+	identity, _ := ParseIdentity(identityKey)
+	r, err := Decrypt(bytes.NewReader(truncated), identity)
+	if err != nil {
+		t.Fatalf("Decrypt: %v", err)
+	}
+	if _, err := io.ReadAll(r); err == nil {
+		t.Fatalf("expected truncated stream to fail authentication")
+	}
+}
@@ -0,0 +1,289 @@
+package backuptarget
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	azureAPIVersion = "2021-08-06"
+
+	// Well-known Azurite / storage emulator account, used for
+	// UseDevelopmentStorage=true connection strings.
+	azuriteAccount  = "devstoreaccount1"
+	azuriteKey      = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+	azuriteEndpoint = "http://127.0.0.1:10000/devstoreaccount1"
+)
+
+// AzureTarget stores backups as block blobs, authenticating with the
+// account's Shared Key. Single Put Blob requests limit objects to 5000 MiB.
+type AzureTarget struct {
+	Account    string
+	Key        []byte
+	Endpoint   string // blob service URL, e.g. https://acct.blob.core.windows.net
+	Container  string
+	Prefix     string
+	HTTPClient *http.Client
+
+	now func() time.Time // overridden in tests
+}
+
+// NewAzureTarget parses a storage account connection string such as the
+// install TUI's azure_connection_string.
+func NewAzureTarget(connectionString, container, prefix string) (*AzureTarget, error) {
+	values := map[string]string{}
+	for _, part := range strings.Split(connectionString, ";") {
+		key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if ok {
+			values[key] = value
+		}
+	}
+
+	if strings.EqualFold(values["UseDevelopmentStorage"], "true") {
+		values["AccountName"] = azuriteAccount
+		values["AccountKey"] = azuriteKey
+		if values["BlobEndpoint"] == "" {
+			values["BlobEndpoint"] = azuriteEndpoint
+		}
+	}
+
+	account := values["AccountName"]
+	if account == "" || values["AccountKey"] == "" {
+		return nil, fmt.Errorf("azure connection string must include AccountName and AccountKey")
+	}
+	key, err := base64.StdEncoding.DecodeString(values["AccountKey"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid AccountKey in azure connection string: %w", err)
+	}
+
+	endpoint := values["BlobEndpoint"]
+	if endpoint == "" {
+		protocol := values["DefaultEndpointsProtocol"]
+		if protocol == "" {
+			protocol = "https"
+		}
+		suffix := values["EndpointSuffix"]
+		if suffix == "" {
+			suffix = "core.windows.net"
+		}
+		endpoint = protocol + "://" + account + ".blob." + suffix
+	}
+
+	return &AzureTarget{
+		Account:   account,
+		Key:       key,
+		Endpoint:  strings.TrimSuffix(endpoint, "/"),
+		Container: container,
+		Prefix:    prefix,
+	}, nil
+}
+
+func (a *AzureTarget) String() string {
+	return "azure://" + a.Container + "/" + a.Prefix
+}
+
+func (a *AzureTarget) Upload(ctx context.Context, name string, r io.Reader, size int64) error {
+	req, err := a.newRequest(ctx, http.MethodPut, a.Prefix+name, nil, r)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("x-ms-blob-type", "BlockBlob")
+	a.sign(req)
+
+	resp, err := httpClient(a.HTTPClient).Do(req)
+	if err != nil {
+		return fmt.Errorf("uploading %s: %w", name, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return responseError("uploading "+name, resp)
+	}
+	return nil
+}
+
+func (a *AzureTarget) Download(ctx context.Context, name string, w io.Writer) error {
+	req, err := a.newRequest(ctx, http.MethodGet, a.Prefix+name, nil, nil)
+	if err != nil {
+		return err
+	}
+	a.sign(req)
+
+	resp, err := httpClient(a.HTTPClient).Do(req)
+	if err != nil {
+		return fmt.Errorf("downloading %s: %w", name, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%s: %w", name, ErrNotFound)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return responseError("downloading "+name, resp)
+	}
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		return fmt.Errorf("downloading %s: %w", name, err)
+	}
+	return nil
+}
+
+func (a *AzureTarget) List(ctx context.Context) ([]Object, error) {
+	var objects []Object
+	marker := ""
+	for {
+		query := url.Values{"restype": {"container"}, "comp": {"list"}, "prefix": {a.Prefix}}
+		if marker != "" {
+			query.Set("marker", marker)
+		}
+		req, err := a.newRequest(ctx, http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		a.sign(req)
+
+		resp, err := httpClient(a.HTTPClient).Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("listing backups: %w", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			err := responseError("listing backups", resp)
+			resp.Body.Close()
+			return nil, err
+		}
+		var result struct {
+			Blobs []struct {
+				Name       string `xml:"Name"`
+				Properties struct {
+					ContentLength int64  `xml:"Content-Length"`
+					LastModified  string `xml:"Last-Modified"`
+				} `xml:"Properties"`
+			} `xml:"Blobs>Blob"`
+			NextMarker string `xml:"NextMarker"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("parsing container listing: %w", err)
+		}
+
+		for _, b := range result.Blobs {
+			name := strings.TrimPrefix(b.Name, a.Prefix)
+			if name == "" || strings.Contains(name, "/") {
+				continue
+			}
+			modified, _ := time.Parse(http.TimeFormat, b.Properties.LastModified)
+			objects = append(objects, Object{Name: name, Size: b.Properties.ContentLength, Modified: modified})
+		}
+		if result.NextMarker == "" {
+			return objects, nil
+		}
+		marker = result.NextMarker
+	}
+}
+
+func (a *AzureTarget) Delete(ctx context.Context, name string) error {
+	req, err := a.newRequest(ctx, http.MethodDelete, a.Prefix+name, nil, nil)
+	if err != nil {
+		return err
+	}
+	a.sign(req)
+
+	resp, err := httpClient(a.HTTPClient).Do(req)
+	if err != nil {
+		return fmt.Errorf("deleting %s: %w", name, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusOK {
+		return responseError("deleting "+name, resp)
+	}
+	return nil
+}
+
+// newRequest builds a request for blob (empty = the container itself).
+func (a *AzureTarget) newRequest(ctx context.Context, method, blob string, query url.Values, body io.Reader) (*http.Request, error) {
+	raw := a.Endpoint + "/" + url.PathEscape(a.Container)
+	if blob != "" {
+		segments := strings.Split(blob, "/")
+		for i, seg := range segments {
+			segments[i] = url.PathEscape(seg)
+		}
+		raw += "/" + strings.Join(segments, "/")
+	}
+	if len(query) > 0 {
+		raw += "?" + query.Encode()
+	}
+	return http.NewRequestWithContext(ctx, method, raw, body)
+}
+
+// sign adds the Shared Key Authorization header.
+func (a *AzureTarget) sign(req *http.Request) {
+	now := time.Now
+	if a.now != nil {
+		now = a.now
+	}
+	req.Header.Set("x-ms-date", now().UTC().Format(http.TimeFormat))
+	req.Header.Set("x-ms-version", azureAPIVersion)
+
+	contentLength := ""
+	if req.ContentLength > 0 {
+		contentLength = strconv.FormatInt(req.ContentLength, 10)
+	}
+
+	var msHeaders []string
+	for k := range req.Header {
+		if lk := strings.ToLower(k); strings.HasPrefix(lk, "x-ms-") {
+			msHeaders = append(msHeaders, lk)
+		}
+	}
+	sort.Strings(msHeaders)
+	var canonical strings.Builder
+	for _, k := range msHeaders {
+		canonical.WriteString(k + ":" + strings.TrimSpace(req.Header.Get(k)) + "\n")
+	}
+
+	// The account name is prefixed even when it is already in the path, as
+	// with Azurite's http://host:10000/devstoreaccount1 endpoints
+	canonical.WriteString("/" + a.Account + req.URL.EscapedPath())
+	query := req.URL.Query()
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		canonical.WriteString("\n" + strings.ToLower(k) + ":" + strings.Join(values, ","))
+	}
+
+	stringToSign := strings.Join([]string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		contentLength,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		"", // Date: x-ms-date is used instead
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+		canonical.String(),
+	}, "\n")
+
+	mac := hmac.New(sha256.New, a.Key)
+	mac.Write([]byte(stringToSign))
+	req.Header.Set("Authorization", "SharedKey "+a.Account+":"+base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+}
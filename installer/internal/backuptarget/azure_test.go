@@ -0,0 +1,132 @@
+package backuptarget
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestNewAzureTargetParsesConnectionStrings(t *testing.T) {
+	target, err := NewAzureTarget("DefaultEndpointsProtocol=https;AccountName=kmpstore;AccountKey=a2V5;EndpointSuffix=core.windows.net", "backups", "")
+	if err != nil {
+		t.Fatalf("NewAzureTarget: %v", err)
+	}
+	if target.Endpoint != "https://kmpstore.blob.core.windows.net" || string(target.Key) != "key" {
+		t.Fatalf("unexpected target %+v", target)
+	}
+
+	dev, err := NewAzureTarget("UseDevelopmentStorage=true", "backups", "")
+	if err != nil {
+		t.Fatalf("NewAzureTarget(dev): %v", err)
+	}
+	if dev.Account != azuriteAccount || dev.Endpoint != azuriteEndpoint {
+		t.Fatalf("unexpected development target %+v", dev)
+	}
+
+	if _, err := NewAzureTarget("AccountName=kmpstore", "backups", ""); err == nil {
+		t.Fatalf("expected an error without AccountKey")
+	}
+}
+
+// fakeAzurite is a minimal in-memory stand-in for Azurite's blob service.
+func fakeAzurite(t *testing.T) *httptest.Server {
+	t.Helper()
+	var mu sync.Mutex
+	blobs := map[string][]byte{}
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "SharedKey "+azuriteAccount+":") || r.Header.Get("x-ms-date") == "" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		blob, ok := strings.CutPrefix(r.URL.Path, "/"+azuriteAccount+"/backups")
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		blob = strings.TrimPrefix(blob, "/")
+		mu.Lock()
+		defer mu.Unlock()
+
+		switch {
+		case r.Method == http.MethodGet && r.URL.Query().Get("comp") == "list":
+			type props struct {
+				ContentLength int64 `xml:"Content-Length"`
+			}
+			type item struct {
+				Name       string
+				Properties props
+			}
+			result := struct {
+				XMLName xml.Name `xml:"EnumerationResults"`
+				Blobs   []item   `xml:"Blobs>Blob"`
+			}{}
+			for name, data := range blobs {
+				if strings.HasPrefix(name, r.URL.Query().Get("prefix")) {
+					result.Blobs = append(result.Blobs, item{Name: name, Properties: props{ContentLength: int64(len(data))}})
+				}
+			}
+			_ = xml.NewEncoder(w).Encode(result)
+		case r.Method == http.MethodPut:
+			if r.Header.Get("x-ms-blob-type") != "BlockBlob" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			data, _ := io.ReadAll(r.Body)
+			blobs[blob] = data
+			w.WriteHeader(http.StatusCreated)
+		case r.Method == http.MethodGet:
+			data, ok := blobs[blob]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			_, _ = w.Write(data)
+		case r.Method == http.MethodDelete:
+			delete(blobs, blob)
+			w.WriteHeader(http.StatusAccepted)
+		}
+	}))
+}
+
+func TestAzureTargetRoundTripAgainstAzurite(t *testing.T) {
+	server := fakeAzurite(t)
+	defer server.Close()
+
+	target, err := New("azure", map[string]string{
+		"azure_connection_string": "UseDevelopmentStorage=true;BlobEndpoint=" + server.URL + "/" + azuriteAccount,
+		"azure_container":         "backups",
+	}, "kmp-backups/default/")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	ctx := context.Background()
+	payload := []byte("full archive")
+	if err := target.Upload(ctx, "20240101-000000.full.tar", bytes.NewReader(payload), int64(len(payload))); err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	objects, err := target.List(ctx)
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(objects) != 1 || objects[0].Name != "20240101-000000.full.tar" {
+		t.Fatalf("unexpected listing %+v", objects)
+	}
+	var buf bytes.Buffer
+	if err := target.Download(ctx, objects[0].Name, &buf); err != nil {
+		t.Fatalf("Download: %v", err)
+	}
+	if !bytes.Equal(buf.Bytes(), payload) {
+		t.Fatalf("downloaded %q, want %q", buf.Bytes(), payload)
+	}
+	if err := target.Delete(ctx, objects[0].Name); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+}
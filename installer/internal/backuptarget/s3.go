@@ -0,0 +1,279 @@
+package backuptarget
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// emptyPayloadHash is the SHA-256 of an empty request body.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// S3Target stores backups in an S3-compatible bucket, signing requests with
+// AWS Signature Version 4. A custom Endpoint (MinIO, R2, Wasabi...) switches
+// to path-style addressing. Single PUTs limit objects to 5 GB.
+type S3Target struct {
+	Bucket     string
+	Region     string // default us-east-1
+	AccessKey  string
+	SecretKey  string
+	Endpoint   string // empty = AWS
+	Prefix     string
+	HTTPClient *http.Client
+
+	now func() time.Time // overridden in tests
+}
+
+func (s *S3Target) String() string {
+	return "s3://" + s.Bucket + "/" + s.Prefix
+}
+
+// Upload streams r to the bucket; the payload is sent unsigned so the file
+// does not have to be hashed (and so read twice) before the request.
+func (s *S3Target) Upload(ctx context.Context, name string, r io.Reader, size int64) error {
+	req, err := s.newRequest(ctx, http.MethodPut, s.Prefix+name, nil, r)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	s.sign(req, "UNSIGNED-PAYLOAD")
+
+	resp, err := httpClient(s.HTTPClient).Do(req)
+	if err != nil {
+		return fmt.Errorf("uploading %s: %w", name, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return responseError("uploading "+name, resp)
+	}
+	return nil
+}
+
+func (s *S3Target) Download(ctx context.Context, name string, w io.Writer) error {
+	req, err := s.newRequest(ctx, http.MethodGet, s.Prefix+name, nil, nil)
+	if err != nil {
+		return err
+	}
+	s.sign(req, emptyPayloadHash)
+
+	resp, err := httpClient(s.HTTPClient).Do(req)
+	if err != nil {
+		return fmt.Errorf("downloading %s: %w", name, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%s: %w", name, ErrNotFound)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return responseError("downloading "+name, resp)
+	}
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		return fmt.Errorf("downloading %s: %w", name, err)
+	}
+	return nil
+}
+
+func (s *S3Target) List(ctx context.Context) ([]Object, error) {
+	var objects []Object
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {s.Prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		req, err := s.newRequest(ctx, http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		s.sign(req, emptyPayloadHash)
+
+		resp, err := httpClient(s.HTTPClient).Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("listing backups: %w", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			err := responseError("listing backups", resp)
+			resp.Body.Close()
+			return nil, err
+		}
+		var result struct {
+			Contents []struct {
+				Key          string    `xml:"Key"`
+				Size         int64     `xml:"Size"`
+				LastModified time.Time `xml:"LastModified"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("parsing bucket listing: %w", err)
+		}
+
+		for _, c := range result.Contents {
+			name := strings.TrimPrefix(c.Key, s.Prefix)
+			if name == "" || strings.Contains(name, "/") {
+				continue
+			}
+			objects = append(objects, Object{Name: name, Size: c.Size, Modified: c.LastModified})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (s *S3Target) Delete(ctx context.Context, name string) error {
+	req, err := s.newRequest(ctx, http.MethodDelete, s.Prefix+name, nil, nil)
+	if err != nil {
+		return err
+	}
+	s.sign(req, emptyPayloadHash)
+
+	resp, err := httpClient(s.HTTPClient).Do(req)
+	if err != nil {
+		return fmt.Errorf("deleting %s: %w", name, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return responseError("deleting "+name, resp)
+	}
+	return nil
+}
+
+func (s *S3Target) region() string {
+	if s.Region == "" {
+		return "us-east-1"
+	}
+	return s.Region
+}
+
+// newRequest builds a request for key (empty = the bucket itself).
+func (s *S3Target) newRequest(ctx context.Context, method, key string, query url.Values, body io.Reader) (*http.Request, error) {
+	scheme, host, path := "https", s.Bucket+".s3."+s.region()+".amazonaws.com", "/"+awsEscapePath(key)
+	if s.Endpoint != "" {
+		endpoint := s.Endpoint
+		if !strings.Contains(endpoint, "://") {
+			endpoint = "https://" + endpoint
+		}
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("invalid s3_endpoint: %w", err)
+		}
+		scheme, host = u.Scheme, u.Host
+		path = strings.TrimSuffix(u.Path, "/") + "/" + awsEscape(s.Bucket) + path
+	}
+
+	raw := scheme + "://" + host + path
+	if q := awsCanonicalQuery(query); q != "" {
+		raw += "?" + q
+	}
+	return http.NewRequestWithContext(ctx, method, raw, body)
+}
+
+// sign adds the SigV4 Authorization header, covering the host and every
+// header already set on req.
+func (s *S3Target) sign(req *http.Request, payloadHash string) {
+	now := time.Now
+	if s.now != nil {
+		now = s.now
+	}
+	t := now().UTC()
+	amzDate := t.Format("20060102T150405Z")
+	date := t.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		awsCanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.region() + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), date)
+	key = hmacSHA256(key, s.region())
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, scope, signedHeaders, signature))
+}
+
+// awsEscape percent-encodes everything except the RFC 3986 unreserved set,
+// as SigV4 requires.
+func awsEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// awsEscapePath escapes each segment of an object key, keeping the slashes.
+func awsEscapePath(key string) string {
+	segments := strings.Split(key, "/")
+	for i, seg := range segments {
+		segments[i] = awsEscape(seg)
+	}
+	return strings.Join(segments, "/")
+}
+
+func awsCanonicalQuery(query url.Values) string {
+	var pairs []string
+	for k, vs := range query {
+		for _, v := range vs {
+			pairs = append(pairs, awsEscape(k)+"="+awsEscape(v))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,97 @@
+// Package backuptarget copies finished backup files to off-host storage so a
+// lost VM disk does not take the backups with it.
+package backuptarget
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned when a requested object does not exist remotely.
+var ErrNotFound = errors.New("backup not found on remote target")
+
+// Object is one backup file stored on a target.
+type Object struct {
+	Name     string // file name relative to the target prefix
+	Size     int64
+	Modified time.Time
+}
+
+// Target is an off-host destination for backup files.
+type Target interface {
+	// String describes the destination, e.g. "s3://bucket/kmp-backups/".
+	String() string
+	// Upload stores size bytes from r under name.
+	Upload(ctx context.Context, name string, r io.Reader, size int64) error
+	// Download writes the object stored under name to w.
+	Download(ctx context.Context, name string, w io.Writer) error
+	// List returns every object under the target prefix.
+	List(ctx context.Context) ([]Object, error)
+	// Delete removes the object stored under name.
+	Delete(ctx context.Context, name string) error
+}
+
+// New builds the target for a backup storage type using the same keys the
+// install TUI collects for document storage (s3_bucket, s3_region, s3_key,
+// s3_secret, s3_endpoint, azure_connection_string, azure_container).
+// "local" and "" mean backups stay on the host, and New returns nil.
+// Objects are stored under cfg["backup_prefix"], or defaultPrefix if unset.
+func New(storageType string, cfg map[string]string, defaultPrefix string) (Target, error) {
+	prefix := cfg["backup_prefix"]
+	if prefix == "" {
+		prefix = defaultPrefix
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	switch storageType {
+	case "", "local":
+		return nil, nil
+	case "s3":
+		if cfg["s3_bucket"] == "" {
+			return nil, fmt.Errorf("s3 backup target requires s3_bucket")
+		}
+		return &S3Target{
+			Bucket:    cfg["s3_bucket"],
+			Region:    cfg["s3_region"],
+			AccessKey: cfg["s3_key"],
+			SecretKey: cfg["s3_secret"],
+			Endpoint:  cfg["s3_endpoint"],
+			Prefix:    prefix,
+		}, nil
+	case "azure":
+		container := cfg["azure_container"]
+		if container == "" {
+			container = "backups"
+		}
+		return NewAzureTarget(cfg["azure_connection_string"], container, prefix)
+	default:
+		return nil, fmt.Errorf("unsupported backup storage type %q", storageType)
+	}
+}
+
+// httpClient has no overall timeout: uploads of large archives are bounded
+// by the caller's context instead.
+func httpClient(c *http.Client) *http.Client {
+	if c != nil {
+		return c
+	}
+	return http.DefaultClient
+}
+
+// responseError turns an unexpected response into an error, including the
+// start of the body where storage services put their error code.
+func responseError(op string, resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	msg := strings.TrimSpace(string(body))
+	if msg == "" {
+		return fmt.Errorf("%s: HTTP %d", op, resp.StatusCode)
+	}
+	return fmt.Errorf("%s: HTTP %d: %s", op, resp.StatusCode, msg)
+}
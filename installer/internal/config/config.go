@@ -1,38 +1,109 @@
 package config
 
 import (
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
+// DefaultDeploymentName is the deployment used when none has been selected.
+const DefaultDeploymentName = "default"
+
+// ErrDeploymentNotFound is returned when a named deployment is not in the
+// config file.
+var ErrDeploymentNotFound = errors.New("deployment not found")
+
 // Config represents the KMP CLI configuration file
 type Config struct {
 	Version     int                    `yaml:"version"`
+	Current     string                 `yaml:"current,omitempty"` // deployment used when --deployment is not given
 	Deployments map[string]*Deployment `yaml:"deployments"`
 }
 
 // Deployment represents a single KMP deployment
 type Deployment struct {
-	Provider        string            `yaml:"provider"`
-	Channel         string            `yaml:"channel"`
-	Domain          string            `yaml:"domain"`
-	Image           string            `yaml:"image"`
-	ImageTag        string            `yaml:"image_tag"`
-	ComposeDir      string            `yaml:"compose_dir,omitempty"`
-	DatabaseDSN     string            `yaml:"database_dsn,omitempty"`
-	MySQLSSL        bool              `yaml:"mysql_ssl,omitempty"`
-	LocalDBType     string            `yaml:"local_db_type,omitempty"` // "mariadb" or "postgres"
-	StorageType     string            `yaml:"storage_type"`
-	StorageConfig   map[string]string `yaml:"storage_config,omitempty"`
-	CacheEngine     string            `yaml:"cache_engine,omitempty"` // "apcu" or "redis"
-	RedisURL        string            `yaml:"redis_url,omitempty"`    // empty = bundled local Redis
-	BackupEnabled   bool              `yaml:"backup_enabled"`
-	BackupSchedule  string            `yaml:"backup_schedule,omitempty"`
-	BackupRetention int               `yaml:"backup_retention_days,omitempty"`
+	Name                string            `yaml:"-"` // map key in Config.Deployments, filled in by Load
+	Provider            string            `yaml:"provider"`
+	Channel             string            `yaml:"channel"`
+	Domain              string            `yaml:"domain"`
+	Image               string            `yaml:"image"`
+	ImageTag            string            `yaml:"image_tag"`
+	ComposeDir          string            `yaml:"compose_dir,omitempty"`
+	DatabaseDSN         string            `yaml:"database_dsn,omitempty"`
+	MySQLSSL            bool              `yaml:"mysql_ssl,omitempty"`
+	LocalDBType         string            `yaml:"local_db_type,omitempty"` // "mariadb" or "postgres"
+	StorageType         string            `yaml:"storage_type"`
+	StorageConfig       map[string]string `yaml:"storage_config,omitempty"`
+	CacheEngine         string            `yaml:"cache_engine,omitempty"` // "apcu" or "redis"
+	RedisURL            string            `yaml:"redis_url,omitempty"`    // empty = bundled local Redis
+	BackupEnabled       bool              `yaml:"backup_enabled"`
+	BackupSchedule      string            `yaml:"backup_schedule,omitempty"`
+	BackupRetention     int               `yaml:"backup_retention_days,omitempty"`
+	BackupKeepDaily     int               `yaml:"backup_keep_daily,omitempty"`
+	BackupKeepWeekly    int               `yaml:"backup_keep_weekly,omitempty"`
+	BackupKeepMonthly   int               `yaml:"backup_keep_monthly,omitempty"`
+	BackupEncryptionKey string            `yaml:"backup_encryption_key,omitempty"` // passphrase or kmp-pub- recipient
+	BackupStorageType   string            `yaml:"backup_storage_type,omitempty"`   // local (default), s3, azure
+	BackupStorageConfig map[string]string `yaml:"backup_storage_config,omitempty"`
+	UpdateRestorePolicy string            `yaml:"update_restore_policy,omitempty"` // offer (default), auto, never
+	UpdateStrategy      string            `yaml:"update_strategy,omitempty"`       // recreate (default), blue-green
+	Webhooks            []Webhook         `yaml:"webhooks,omitempty"`
+	AutoUpdate          AutoUpdatePolicy  `yaml:"auto_update,omitempty"`
+	VersionHistory      []DeployedVersion `yaml:"version_history,omitempty"` // tags replaced by updates, newest last
+}
+
+// DeployedVersion is an image tag the deployment ran before an update
+// replaced it; kmp rollback goes back to it.
+type DeployedVersion struct {
+	Tag        string    `yaml:"tag" json:"tag"`
+	Digest     string    `yaml:"digest,omitempty" json:"digest,omitempty"` // sha256:... the tag pointed at
+	ReplacedAt time.Time `yaml:"replaced_at" json:"replacedAt"`
+}
+
+// AutoUpdatePolicy lets the updater sidecar apply new releases by itself.
+type AutoUpdatePolicy struct {
+	Enabled       bool   `yaml:"enabled"`
+	Channel       string `yaml:"channel,omitempty"`        // empty = the deployment's channel
+	MaxBump       string `yaml:"max_bump,omitempty"`       // patch (default), minor, major
+	Window        string `yaml:"window,omitempty"`         // cron expression of the minutes an update may start in; empty = any time
+	Timezone      string `yaml:"timezone,omitempty"`       // IANA zone Window is read in; empty = UTC
+	RequireBackup bool   `yaml:"require_backup,omitempty"` // stop unless the pre-update backup fully succeeds, off-host copy included
+}
+
+// Webhook is an endpoint notified of update, rollback and backup events.
+type Webhook struct {
+	URL    string   `yaml:"url" json:"url"`
+	Format string   `yaml:"format,omitempty" json:"format,omitempty"` // json (default), slack, discord
+	Secret string   `yaml:"secret,omitempty" json:"secret,omitempty"` // signs json payloads
+	Events []string `yaml:"events,omitempty" json:"events,omitempty"` // empty = all events
 }
 
+// Restore policies for the pre-update backup when an update fails its
+// health check.
+const (
+	RestorePolicyOffer = "offer" // ask when interactive, otherwise only report the backup
+	RestorePolicyAuto  = "auto"  // restore the database before starting the previous tag
+	RestorePolicyNever = "never"
+)
+
+// Update strategies for the updater sidecar.
+const (
+	UpdateStrategyRecreate  = "recreate"   // stop the app, start the new tag in its place
+	UpdateStrategyBlueGreen = "blue-green" // start the new tag alongside and switch Caddy once healthy
+)
+
+// Version bumps an automatic update may make, each allowing the ones before.
+const (
+	BumpPatch = "patch"
+	BumpMinor = "minor"
+	BumpMajor = "major"
+)
+
 // DefaultConfigDir returns ~/.kmp
 func DefaultConfigDir() string {
 	home, _ := os.UserHomeDir()
@@ -62,6 +133,16 @@ func Load() (*Config, error) {
 	if err := yaml.Unmarshal(data, cfg); err != nil {
 		return nil, err
 	}
+	if cfg.Deployments == nil {
+		cfg.Deployments = make(map[string]*Deployment)
+	}
+	for name, dep := range cfg.Deployments {
+		if dep == nil {
+			delete(cfg.Deployments, name)
+			continue
+		}
+		dep.Name = name
+	}
 	return cfg, nil
 }
 
@@ -79,3 +160,63 @@ func (c *Config) Save() error {
 
 	return os.WriteFile(ConfigPath(), data, 0600)
 }
+
+// CurrentName returns the name of the selected deployment, falling back to
+// "default" or, when only one deployment exists, to that deployment.
+func (c *Config) CurrentName() string {
+	if c.Current != "" {
+		return c.Current
+	}
+	if _, ok := c.Deployments[DefaultDeploymentName]; ok {
+		return DefaultDeploymentName
+	}
+	if len(c.Deployments) == 1 {
+		for name := range c.Deployments {
+			return name
+		}
+	}
+	return DefaultDeploymentName
+}
+
+// Resolve returns the named deployment, or the current one when name is empty.
+func (c *Config) Resolve(name string) (*Deployment, error) {
+	if name == "" {
+		name = c.CurrentName()
+	}
+	dep, ok := c.Deployments[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrDeploymentNotFound, name)
+	}
+	dep.Name = name
+	return dep, nil
+}
+
+// Names returns the configured deployment names in sorted order.
+func (c *Config) Names() []string {
+	names := make([]string, 0, len(c.Deployments))
+	for name := range c.Deployments {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// UpdateDeployment loads the config file, applies fn to the named deployment
+// (the current one when name is empty, as with Resolve) and saves the
+// result. It returns ErrDeploymentNotFound when the deployment does not
+// exist.
+func UpdateDeployment(name string, fn func(*Deployment)) error {
+	cfg, err := Load()
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		name = cfg.CurrentName()
+	}
+	dep, ok := cfg.Deployments[name]
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrDeploymentNotFound, name)
+	}
+	fn(dep)
+	return cfg.Save()
+}
@@ -0,0 +1,118 @@
+package config
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestCurrentNameFallsBackToDefaultOrTheOnlyDeployment(t *testing.T) {
+	cases := []struct {
+		name string
+		cfg  Config
+		want string
+	}{
+		{"selected", Config{Current: "staging", Deployments: map[string]*Deployment{"default": {}, "staging": {}}}, "staging"},
+		{"default exists", Config{Deployments: map[string]*Deployment{"default": {}, "staging": {}}}, "default"},
+		{"only one", Config{Deployments: map[string]*Deployment{"staging": {}}}, "staging"},
+		{"several without default", Config{Deployments: map[string]*Deployment{"prod": {}, "staging": {}}}, "default"},
+		{"none", Config{}, "default"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.cfg.CurrentName(); got != tc.want {
+				t.Fatalf("CurrentName() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestResolveReturnsNamedOrCurrentDeployment(t *testing.T) {
+	cfg := &Config{Current: "staging", Deployments: map[string]*Deployment{
+		"prod":    {Provider: "docker"},
+		"staging": {Provider: "railway"},
+	}}
+
+	dep, err := cfg.Resolve("")
+	if err != nil || dep.Name != "staging" || dep.Provider != "railway" {
+		t.Fatalf("Resolve(\"\") = %+v, %v", dep, err)
+	}
+	dep, err = cfg.Resolve("prod")
+	if err != nil || dep.Name != "prod" || dep.Provider != "docker" {
+		t.Fatalf("Resolve(prod) = %+v, %v", dep, err)
+	}
+	if _, err := cfg.Resolve("missing"); !errors.Is(err, ErrDeploymentNotFound) {
+		t.Fatalf("expected ErrDeploymentNotFound for a missing deployment, got %v", err)
+	}
+}
+
+func TestNamesAreSorted(t *testing.T) {
+	cfg := &Config{Deployments: map[string]*Deployment{"staging": {}, "default": {}, "prod": {}}}
+	if got, want := cfg.Names(), []string{"default", "prod", "staging"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("Names() = %v, want %v", got, want)
+	}
+	if got := (&Config{}).Names(); len(got) != 0 {
+		t.Fatalf("expected no names, got %v", got)
+	}
+}
+
+func TestUpdateDeploymentSavesChangesAndRejectsMissingDeployments(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	cfg := &Config{Version: 1, Deployments: map[string]*Deployment{
+		"default": {ImageTag: "v1.4.2"},
+		"staging": {ImageTag: "v1.4.2"},
+	}}
+	if err := cfg.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := UpdateDeployment("", func(d *Deployment) { d.ImageTag = "v1.5.0" }); err != nil {
+		t.Fatalf("UpdateDeployment(default): %v", err)
+	}
+	called := false
+	err := UpdateDeployment("missing", func(*Deployment) { called = true })
+	if !errors.Is(err, ErrDeploymentNotFound) || called {
+		t.Fatalf("expected ErrDeploymentNotFound without calling fn, got %v (called %v)", err, called)
+	}
+
+	loaded, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Deployments["default"].ImageTag != "v1.5.0" || loaded.Deployments["staging"].ImageTag != "v1.4.2" {
+		t.Fatalf("unexpected deployments after update: default %+v, staging %+v", loaded.Deployments["default"], loaded.Deployments["staging"])
+	}
+	if _, ok := loaded.Deployments["missing"]; ok {
+		t.Fatalf("a missing deployment must not be created")
+	}
+}
+
+func TestUpdateDeploymentWithoutANameUsesTheCurrentDeployment(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	for _, tc := range []struct {
+		name string
+		cfg  *Config
+		want string
+	}{
+		{"only one", &Config{Version: 1, Deployments: map[string]*Deployment{"prod": {}}}, "prod"},
+		{"selected", &Config{Version: 1, Current: "staging", Deployments: map[string]*Deployment{"default": {}, "staging": {}}}, "staging"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.cfg.Save(); err != nil {
+				t.Fatal(err)
+			}
+			if err := UpdateDeployment("", func(d *Deployment) { d.ImageTag = "v1.5.0" }); err != nil {
+				t.Fatalf("UpdateDeployment: %v", err)
+			}
+			loaded, err := Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, dep := range loaded.Deployments {
+				if updated := dep.ImageTag == "v1.5.0"; updated != (name == tc.want) {
+					t.Fatalf("expected only %s to be updated, got %s with tag %q", tc.want, name, dep.ImageTag)
+				}
+			}
+		})
+	}
+}
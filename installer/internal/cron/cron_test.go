@@ -0,0 +1,82 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNext(t *testing.T) {
+	base := time.Date(2024, 3, 15, 10, 30, 0, 0, time.UTC) // a Friday
+	cases := []struct {
+		expr string
+		want time.Time
+	}{
+		{"0 3 * * *", time.Date(2024, 3, 16, 3, 0, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2024, 3, 15, 10, 45, 0, 0, time.UTC)},
+		{"30 10 * * *", time.Date(2024, 3, 16, 10, 30, 0, 0, time.UTC)},
+		{"0 9-17/4 * * mon-fri", time.Date(2024, 3, 15, 13, 0, 0, 0, time.UTC)},
+		{"0 0 * * 0", time.Date(2024, 3, 17, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2024, 3, 17, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 feb *", time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// Both day fields restricted: the 1st of the month OR a Monday
+		{"0 0 1 * mon", time.Date(2024, 3, 18, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tc := range cases {
+		s, err := Parse(tc.expr)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", tc.expr, err)
+		}
+		if got := s.Next(base); !got.Equal(tc.want) {
+			t.Errorf("Next(%q) = %s, want %s", tc.expr, got, tc.want)
+		}
+	}
+}
+
+func TestNextHonoursLocation(t *testing.T) {
+	loc := time.FixedZone("UTC-5", -5*3600)
+	s, _ := Parse("0 3 * * *")
+	// 07:00 UTC is 02:00 locally, so 03:00 local is still ahead today
+	got := s.Next(time.Date(2024, 3, 15, 7, 0, 0, 0, time.UTC).In(loc))
+	if want := time.Date(2024, 3, 15, 3, 0, 0, 0, loc); !got.Equal(want) {
+		t.Fatalf("Next = %s, want %s", got, want)
+	}
+}
+
+func TestMatchesTreatsTheScheduleAsAWindow(t *testing.T) {
+	s, err := Parse("* 2-4 * * sat,sun")
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	for _, tc := range []struct {
+		t    time.Time
+		want bool
+	}{
+		{time.Date(2024, 3, 16, 2, 0, 0, 0, time.UTC), true},   // Saturday, start of the window
+		{time.Date(2024, 3, 17, 4, 59, 59, 0, time.UTC), true}, // Sunday, last minute
+		{time.Date(2024, 3, 16, 5, 0, 0, 0, time.UTC), false},
+		{time.Date(2024, 3, 15, 3, 0, 0, 0, time.UTC), false}, // Friday
+	} {
+		if got := s.Matches(tc.t); got != tc.want {
+			t.Errorf("Matches(%s) = %t, want %t", tc.t, got, tc.want)
+		}
+	}
+}
+
+func TestParseRejectsInvalidExpressions(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "5-1 * * * *", "*/0 * * * *", "* * * foo *"} {
+		if _, err := Parse(expr); err == nil {
+			t.Errorf("Parse(%q) succeeded, want error", expr)
+		}
+	}
+}
+
+func TestNextReturnsZeroForImpossibleSchedule(t *testing.T) {
+	s, err := Parse("0 0 30 2 *")
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if got := s.Next(time.Now()); !got.IsZero() {
+		t.Fatalf("expected zero time, got %s", got)
+	}
+}
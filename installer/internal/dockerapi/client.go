@@ -0,0 +1,172 @@
+// Package dockerapi is a small Docker Engine API client over the daemon's
+// unix socket, covering what the installer and updater need: container
+// inspect, create, start, stop, remove and label queries, and image pulls
+// with layer progress.
+package dockerapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// DefaultHost is the daemon address used when DOCKER_HOST is not set.
+const DefaultHost = "unix:///var/run/docker.sock"
+
+// apiVersion is the Engine API version requested, supported since Docker
+// 20.10.
+const apiVersion = "v1.41"
+
+var (
+	// ErrUnavailable means the daemon could not be reached.
+	ErrUnavailable = errors.New("docker engine unavailable")
+	// ErrNotFound means the container or image does not exist.
+	ErrNotFound = errors.New("not found")
+	// ErrConflict means the request clashes with existing state, such as a
+	// container name already in use.
+	ErrConflict = errors.New("conflict")
+)
+
+// Error is an error reported by the daemon. Use errors.Is with ErrNotFound
+// or ErrConflict rather than comparing status codes.
+type Error struct {
+	Op         string // what was attempted, e.g. "inspect container kmp-app"
+	StatusCode int    // 0 for errors reported inside a progress stream
+	Message    string
+}
+
+func (e *Error) Error() string {
+	if e.StatusCode == 0 {
+		return fmt.Sprintf("%s: %s", e.Op, e.Message)
+	}
+	return fmt.Sprintf("%s: %s (HTTP %d)", e.Op, e.Message, e.StatusCode)
+}
+
+// Is maps the response status to ErrNotFound and ErrConflict.
+func (e *Error) Is(target error) bool {
+	switch target {
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrConflict:
+		return e.StatusCode == http.StatusConflict
+	}
+	return false
+}
+
+// Client talks to one Docker daemon. It is safe for concurrent use.
+type Client struct {
+	http *http.Client
+	err  error // set when the host is not usable; returned by every call
+}
+
+// New creates a client for host, either a unix:// URL or a socket path. An
+// empty host means DefaultHost. Only unix sockets are supported; a client
+// for any other host fails every call with ErrUnavailable.
+func New(host string) *Client {
+	if host == "" {
+		host = DefaultHost
+	}
+	socket, ok := strings.CutPrefix(host, "unix://")
+	if !ok && strings.Contains(host, "://") {
+		return &Client{err: fmt.Errorf("%w: unsupported host %s (only unix sockets are)", ErrUnavailable, host)}
+	}
+
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		},
+	}
+	return &Client{http: &http.Client{Transport: transport}}
+}
+
+// FromEnv creates a client for DOCKER_HOST, or DefaultHost when it is unset.
+func FromEnv() *Client {
+	return New(os.Getenv("DOCKER_HOST"))
+}
+
+// Ping checks that the daemon answers.
+func (c *Client) Ping(ctx context.Context) error {
+	resp, err := c.do(ctx, "ping", http.MethodGet, "/_ping", nil, nil)
+	if err != nil {
+		return err
+	}
+	return drain(resp)
+}
+
+// do sends one request and returns the response when its status is below
+// 400; the caller closes the body. Other responses become an *Error.
+func (c *Client) do(ctx context.Context, op, method, path string, query url.Values, body any) (*http.Response, error) {
+	if c.err != nil {
+		return nil, fmt.Errorf("%s: %w", op, c.err)
+	}
+
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	u := "http://docker/" + apiVersion + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, reader)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("%s: %w", op, ctx.Err())
+		}
+		return nil, fmt.Errorf("%s: %w: %w", op, ErrUnavailable, err)
+	}
+	if resp.StatusCode < 400 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	return nil, &Error{Op: op, StatusCode: resp.StatusCode, Message: errorMessage(resp.Body)}
+}
+
+// errorMessage reads the {"message": ...} body of an error response.
+func errorMessage(r io.Reader) string {
+	data, _ := io.ReadAll(io.LimitReader(r, 4096))
+	var body struct {
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(data, &body) == nil && body.Message != "" {
+		return body.Message
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// decode reads a JSON response body into v.
+func decode(op string, resp *http.Response, v any) error {
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("%s: decoding response: %w", op, err)
+	}
+	return nil
+}
+
+// drain discards a response body so the connection can be reused.
+func drain(resp *http.Response) error {
+	defer resp.Body.Close()
+	_, err := io.Copy(io.Discard, resp.Body)
+	return err
+}
@@ -0,0 +1,327 @@
+package dockerapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeDaemon is an in-process Engine API server on a unix socket that keeps
+// containers in memory.
+type fakeDaemon struct {
+	mu         sync.Mutex
+	containers map[string]*Container
+	images     map[string]*Image
+	requests   []string
+}
+
+func newFakeDaemon(t *testing.T, pull http.HandlerFunc) (*fakeDaemon, *Client) {
+	t.Helper()
+	socket := filepath.Join(t.TempDir(), "docker.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("listen on %s: %v", socket, err)
+	}
+	d := &fakeDaemon{containers: map[string]*Container{}, images: map[string]*Image{}}
+
+	mux := http.NewServeMux()
+	if pull != nil {
+		mux.HandleFunc("POST /v1.41/images/create", pull)
+	}
+	mux.HandleFunc("POST /v1.41/images/{ref...}", func(w http.ResponseWriter, r *http.Request) {
+		ref := strings.TrimSuffix(r.PathValue("ref"), "/tag")
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		img, ok := d.images[ref]
+		if !ok {
+			writeError(w, http.StatusNotFound, "No such image: "+ref)
+			return
+		}
+		name := r.URL.Query().Get("repo") + ":" + r.URL.Query().Get("tag")
+		img.RepoTags = append(img.RepoTags, name)
+		d.images[name] = img
+		w.WriteHeader(http.StatusCreated)
+	})
+	mux.HandleFunc("GET /v1.41/images/{ref...}", func(w http.ResponseWriter, r *http.Request) {
+		ref := strings.TrimSuffix(r.PathValue("ref"), "/json")
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		img, ok := d.images[ref]
+		if !ok {
+			writeError(w, http.StatusNotFound, "No such image: "+ref)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(img)
+	})
+	mux.HandleFunc("POST /v1.41/containers/create", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			ContainerConfig
+			HostConfig HostConfig
+		}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		name := r.URL.Query().Get("name")
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if _, ok := d.containers[name]; ok {
+			writeError(w, http.StatusConflict, fmt.Sprintf(`Conflict. The container name "/%s" is already in use by container "abc123".`, name))
+			return
+		}
+		d.containers[name] = &Container{ID: "id-" + name, Name: "/" + name, Config: body.ContainerConfig, State: ContainerState{Status: "created"}}
+		_ = json.NewEncoder(w).Encode(map[string]string{"Id": "id-" + name})
+	})
+	mux.HandleFunc("GET /v1.41/containers/json", func(w http.ResponseWriter, r *http.Request) {
+		var filters map[string][]string
+		_ = json.Unmarshal([]byte(r.URL.Query().Get("filters")), &filters)
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		list := []ContainerSummary{}
+		for _, c := range d.containers {
+			if !c.State.Running && r.URL.Query().Get("all") != "1" {
+				continue
+			}
+			match := true
+			for _, label := range filters["label"] {
+				k, v, hasValue := strings.Cut(label, "=")
+				got, ok := c.Config.Labels[k]
+				match = match && ok && (!hasValue || got == v)
+			}
+			if match {
+				list = append(list, ContainerSummary{ID: c.ID, Names: []string{c.Name}, Image: c.Config.Image, State: c.State.Status, Labels: c.Config.Labels})
+			}
+		}
+		_ = json.NewEncoder(w).Encode(list)
+	})
+	mux.HandleFunc("/v1.41/containers/{name}/{action...}", func(w http.ResponseWriter, r *http.Request) {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		name := r.PathValue("name")
+		action := r.PathValue("action")
+		d.requests = append(d.requests, strings.Join(strings.Fields(r.Method+" "+name+" "+action+" "+r.URL.RawQuery), " "))
+		c, ok := d.containers[name]
+		if !ok {
+			writeError(w, http.StatusNotFound, "No such container: "+name)
+			return
+		}
+		switch {
+		case r.Method == http.MethodGet && action == "json":
+			_ = json.NewEncoder(w).Encode(c)
+		case r.Method == http.MethodPost && action == "start":
+			if c.State.Running {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			c.State = ContainerState{Status: "running", Running: true}
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == http.MethodPost && action == "stop":
+			c.State = ContainerState{Status: "exited"}
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == http.MethodDelete && action == "":
+			if c.State.Running && r.URL.Query().Get("force") != "1" {
+				writeError(w, http.StatusConflict, "You cannot remove a running container")
+				return
+			}
+			delete(d.containers, name)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+
+	server := httptest.NewUnstartedServer(mux)
+	server.Listener = ln
+	server.Start()
+	t.Cleanup(server.Close)
+	return d, New("unix://" + socket)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"message": message})
+}
+
+func TestContainerLifecycleAndLabelQueries(t *testing.T) {
+	d, client := newFakeDaemon(t, nil)
+	ctx := context.Background()
+	labels := map[string]string{LabelComposeProject: "kmp", LabelComposeService: "app"}
+
+	id, err := client.CreateContainer(ctx, "kmp-app", ContainerConfig{Image: "ghcr.io/jhandel/kmp:v1.2.3", Labels: labels}, HostConfig{NetworkMode: "kmp_default"})
+	if err != nil || id != "id-kmp-app" {
+		t.Fatalf("CreateContainer = %q, %v", id, err)
+	}
+	_, err = client.CreateContainer(ctx, "kmp-app", ContainerConfig{Image: "ghcr.io/jhandel/kmp:v1.2.3"}, HostConfig{})
+	var apiErr *Error
+	if !errors.Is(err, ErrConflict) || !errors.As(err, &apiErr) || !strings.Contains(apiErr.Message, "already in use") {
+		t.Fatalf("expected a typed conflict for a duplicate name, got %v", err)
+	}
+
+	if err := client.StartContainer(ctx, "kmp-app"); err != nil {
+		t.Fatalf("StartContainer: %v", err)
+	}
+	if err := client.StartContainer(ctx, "kmp-app"); err != nil {
+		t.Fatalf("starting a running container should not fail, got %v", err)
+	}
+	c, err := client.InspectContainer(ctx, "kmp-app")
+	if err != nil || c.Name != "kmp-app" || !c.State.Running || c.Config.Image != "ghcr.io/jhandel/kmp:v1.2.3" || c.Config.Labels[LabelComposeProject] != "kmp" {
+		t.Fatalf("InspectContainer = %+v, %v", c, err)
+	}
+
+	for _, tt := range []struct {
+		labels map[string]string
+		want   []string
+	}{
+		{map[string]string{LabelComposeProject: "kmp", LabelComposeService: "app"}, []string{"kmp-app"}},
+		{map[string]string{LabelComposeProject: ""}, []string{"kmp-app"}},
+		{map[string]string{LabelComposeProject: "other"}, nil},
+	} {
+		list, err := client.ListContainers(ctx, ListOptions{Labels: tt.labels})
+		if err != nil {
+			t.Fatalf("ListContainers(%v): %v", tt.labels, err)
+		}
+		var names []string
+		for _, c := range list {
+			names = append(names, c.Name())
+		}
+		if !reflect.DeepEqual(names, tt.want) {
+			t.Fatalf("ListContainers(%v) = %q, want %q", tt.labels, names, tt.want)
+		}
+	}
+
+	if err := client.RemoveContainer(ctx, "kmp-app", RemoveOptions{}); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected removing a running container without force to conflict, got %v", err)
+	}
+	if err := client.StopContainer(ctx, "kmp-app", 0); err != nil {
+		t.Fatalf("StopContainer: %v", err)
+	}
+	if err := client.RemoveContainer(ctx, "kmp-app", RemoveOptions{Force: true, Volumes: true}); err != nil {
+		t.Fatalf("RemoveContainer: %v", err)
+	}
+	if _, err := client.InspectContainer(ctx, "kmp-app"); !errors.Is(err, ErrNotFound) || errors.Is(err, ErrConflict) {
+		t.Fatalf("expected ErrNotFound after removal, got %v", err)
+	}
+
+	want := []string{
+		"POST kmp-app start", "POST kmp-app start", "GET kmp-app json",
+		"DELETE kmp-app", "POST kmp-app stop t=0", "DELETE kmp-app force=1&v=1", "GET kmp-app json",
+	}
+	if !reflect.DeepEqual(d.requests, want) {
+		t.Fatalf("unexpected requests:\n got %q\nwant %q", d.requests, want)
+	}
+}
+
+func TestPullImageReportsLayerProgressAndStreamErrors(t *testing.T) {
+	var query string
+	_, client := newFakeDaemon(t, func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.RawQuery
+		enc := json.NewEncoder(w)
+		if r.URL.Query().Get("tag") == "missing" {
+			writeError(w, http.StatusNotFound, "manifest unknown")
+			return
+		}
+		_ = enc.Encode(map[string]string{"status": "Pulling from jhandel/kmp", "id": r.URL.Query().Get("tag")})
+		_ = enc.Encode(map[string]any{"status": "Downloading", "id": "a1b2", "progressDetail": map[string]int64{"current": 512, "total": 2048}})
+		if r.URL.Query().Get("tag") == "broken" {
+			_ = enc.Encode(map[string]any{"error": "unexpected EOF", "errorDetail": map[string]string{"message": "unexpected EOF"}})
+			return
+		}
+		_ = enc.Encode(map[string]any{"status": "Pull complete", "id": "a1b2", "progressDetail": map[string]int64{}})
+		_ = enc.Encode(map[string]string{"status": "Status: Downloaded newer image for ghcr.io/jhandel/kmp:v1.2.3"})
+	})
+	ctx := context.Background()
+
+	var got []PullProgress
+	if err := client.PullImage(ctx, "ghcr.io/jhandel/kmp:v1.2.3", func(p PullProgress) { got = append(got, p) }); err != nil {
+		t.Fatalf("PullImage: %v", err)
+	}
+	if query != "fromImage=ghcr.io%2Fjhandel%2Fkmp&tag=v1.2.3" {
+		t.Fatalf("unexpected pull query %q", query)
+	}
+	want := []PullProgress{
+		{Layer: "v1.2.3", Status: "Pulling from jhandel/kmp"},
+		{Layer: "a1b2", Status: "Downloading", Current: 512, Total: 2048},
+		{Layer: "a1b2", Status: "Pull complete"},
+		{Status: "Status: Downloaded newer image for ghcr.io/jhandel/kmp:v1.2.3"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected progress:\n got %+v\nwant %+v", got, want)
+	}
+
+	err := client.PullImage(ctx, "ghcr.io/jhandel/kmp:broken", nil)
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.Message != "unexpected EOF" || apiErr.StatusCode != 0 {
+		t.Fatalf("expected the stream error to be returned, got %v", err)
+	}
+	if err := client.PullImage(ctx, "ghcr.io/jhandel/kmp:missing", nil); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound for an unknown tag, got %v", err)
+	}
+
+	for ref, want := range map[string][2]string{
+		"localhost:5000/kmp":                  {"localhost:5000/kmp", "latest"},
+		"localhost:5000/kmp:v1":               {"localhost:5000/kmp", "v1"},
+		"ghcr.io/jhandel/kmp@sha256:abcdef01": {"ghcr.io/jhandel/kmp", "sha256:abcdef01"},
+	} {
+		if repo, tag := splitReference(ref); repo != want[0] || tag != want[1] {
+			t.Fatalf("splitReference(%q) = %q, %q; want %q", ref, repo, tag, want)
+		}
+	}
+}
+
+func TestUnreachableDaemonIsUnavailable(t *testing.T) {
+	for _, host := range []string{
+		"unix://" + filepath.Join(t.TempDir(), "missing.sock"),
+		"tcp://127.0.0.1:2375",
+	} {
+		err := New(host).Ping(context.Background())
+		if !errors.Is(err, ErrUnavailable) {
+			t.Fatalf("%s: expected ErrUnavailable, got %v", host, err)
+		}
+	}
+}
+
+func TestInspectImageFindsTheRegistryDigest(t *testing.T) {
+	d, client := newFakeDaemon(t, nil)
+	d.images["ghcr.io/jhandel/kmp:v1.2.3"] = &Image{
+		ID:          "sha256:0123",
+		RepoTags:    []string{"ghcr.io/jhandel/kmp:v1.2.3"},
+		RepoDigests: []string{"mirror.example.org/kmp@sha256:ffff", "ghcr.io/jhandel/kmp@sha256:abcd"},
+	}
+
+	img, err := client.InspectImage(context.Background(), "ghcr.io/jhandel/kmp:v1.2.3")
+	if err != nil {
+		t.Fatalf("InspectImage: %v", err)
+	}
+	if got := img.RepoDigest("ghcr.io/jhandel/kmp"); got != "sha256:abcd" {
+		t.Fatalf("RepoDigest = %q, want sha256:abcd", got)
+	}
+	if got := img.RepoDigest("docker.io/library/kmp"); got != "" {
+		t.Fatalf("expected no digest for another repository, got %q", got)
+	}
+	if _, err := client.InspectImage(context.Background(), "ghcr.io/jhandel/kmp:v0.0.1"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound for a missing image, got %v", err)
+	}
+}
+
+func TestTagImageNamesAPulledDigest(t *testing.T) {
+	d, client := newFakeDaemon(t, nil)
+	d.images["ghcr.io/jhandel/kmp@sha256:abcd"] = &Image{ID: "sha256:0123", RepoDigests: []string{"ghcr.io/jhandel/kmp@sha256:abcd"}}
+
+	if err := client.TagImage(context.Background(), "ghcr.io/jhandel/kmp@sha256:abcd", "ghcr.io/jhandel/kmp", "nightly"); err != nil {
+		t.Fatalf("TagImage: %v", err)
+	}
+	img, err := client.InspectImage(context.Background(), "ghcr.io/jhandel/kmp:nightly")
+	if err != nil || img.ID != "sha256:0123" {
+		t.Fatalf("expected the tag to name the pulled image, got %+v (%v)", img, err)
+	}
+	if err := client.TagImage(context.Background(), "ghcr.io/jhandel/kmp@sha256:ffff", "ghcr.io/jhandel/kmp", "nightly"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound for a missing image, got %v", err)
+	}
+}
@@ -0,0 +1,201 @@
+package dockerapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Compose labels on the containers of a compose project.
+const (
+	LabelComposeProject = "com.docker.compose.project"
+	LabelComposeService = "com.docker.compose.service"
+)
+
+// Container is the inspect data of one container.
+type Container struct {
+	ID     string          `json:"Id"`
+	Name   string          `json:"Name"`  // without the leading slash
+	Image  string          `json:"Image"` // image ID
+	Config ContainerConfig `json:"Config"`
+	State  ContainerState  `json:"State"`
+}
+
+// ContainerConfig is the part of a container's configuration this package
+// reads and sets. Config.Image is the reference the container was created
+// from, e.g. ghcr.io/jhandel/kmp:v1.2.3.
+type ContainerConfig struct {
+	Image  string            `json:"Image"`
+	Cmd    []string          `json:"Cmd,omitempty"`
+	Env    []string          `json:"Env,omitempty"`
+	Labels map[string]string `json:"Labels,omitempty"`
+}
+
+// HostConfig is the part of a container's host configuration that can be
+// set on create.
+type HostConfig struct {
+	Binds       []string `json:"Binds,omitempty"`
+	NetworkMode string   `json:"NetworkMode,omitempty"`
+	AutoRemove  bool     `json:"AutoRemove,omitempty"`
+}
+
+// ContainerState is the runtime state of a container.
+type ContainerState struct {
+	Status    string    `json:"Status"` // created, running, exited, ...
+	Running   bool      `json:"Running"`
+	ExitCode  int       `json:"ExitCode"`
+	StartedAt time.Time `json:"StartedAt"`
+	Health    *struct {
+		Status string `json:"Status"` // starting, healthy, unhealthy
+	} `json:"Health,omitempty"`
+}
+
+// ContainerSummary is one entry of a container list.
+type ContainerSummary struct {
+	ID     string            `json:"Id"`
+	Names  []string          `json:"Names"`
+	Image  string            `json:"Image"`
+	State  string            `json:"State"`
+	Status string            `json:"Status"` // e.g. "Up 2 hours"
+	Labels map[string]string `json:"Labels"`
+}
+
+// Name returns the container's name without the leading slash.
+func (c ContainerSummary) Name() string {
+	if len(c.Names) == 0 {
+		return ""
+	}
+	return strings.TrimPrefix(c.Names[0], "/")
+}
+
+// ListOptions selects the containers ListContainers returns.
+type ListOptions struct {
+	All    bool              // include stopped containers
+	Labels map[string]string // every label must match; an empty value matches any
+}
+
+// InspectContainer returns the container with the given name or ID.
+func (c *Client) InspectContainer(ctx context.Context, name string) (*Container, error) {
+	op := "inspect container " + name
+	resp, err := c.do(ctx, op, http.MethodGet, "/containers/"+url.PathEscape(name)+"/json", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var container Container
+	if err := decode(op, resp, &container); err != nil {
+		return nil, err
+	}
+	container.Name = strings.TrimPrefix(container.Name, "/")
+	return &container, nil
+}
+
+// ListContainers returns the containers matching opts.
+func (c *Client) ListContainers(ctx context.Context, opts ListOptions) ([]ContainerSummary, error) {
+	query := url.Values{}
+	if opts.All {
+		query.Set("all", "1")
+	}
+	if len(opts.Labels) > 0 {
+		var labels []string
+		for k, v := range opts.Labels {
+			if v == "" {
+				labels = append(labels, k)
+			} else {
+				labels = append(labels, k+"="+v)
+			}
+		}
+		sort.Strings(labels)
+		filters, err := json.Marshal(map[string][]string{"label": labels})
+		if err != nil {
+			return nil, err
+		}
+		query.Set("filters", string(filters))
+	}
+
+	op := "list containers"
+	resp, err := c.do(ctx, op, http.MethodGet, "/containers/json", query, nil)
+	if err != nil {
+		return nil, err
+	}
+	var containers []ContainerSummary
+	if err := decode(op, resp, &containers); err != nil {
+		return nil, err
+	}
+	return containers, nil
+}
+
+// CreateContainer creates a container called name and returns its ID. A
+// name already in use fails with ErrConflict.
+func (c *Client) CreateContainer(ctx context.Context, name string, config ContainerConfig, host HostConfig) (string, error) {
+	query := url.Values{}
+	if name != "" {
+		query.Set("name", name)
+	}
+	body := struct {
+		ContainerConfig
+		HostConfig HostConfig `json:"HostConfig"`
+	}{config, host}
+
+	op := fmt.Sprintf("create container %s from %s", name, config.Image)
+	resp, err := c.do(ctx, op, http.MethodPost, "/containers/create", query, body)
+	if err != nil {
+		return "", err
+	}
+	var created struct {
+		ID string `json:"Id"`
+	}
+	if err := decode(op, resp, &created); err != nil {
+		return "", err
+	}
+	return created.ID, nil
+}
+
+// StartContainer starts a container; starting a running one is not an
+// error.
+func (c *Client) StartContainer(ctx context.Context, name string) error {
+	resp, err := c.do(ctx, "start container "+name, http.MethodPost, "/containers/"+url.PathEscape(name)+"/start", nil, nil)
+	if err != nil {
+		return err
+	}
+	return drain(resp)
+}
+
+// StopContainer stops a container, killing it after timeout; stopping a
+// stopped one is not an error.
+func (c *Client) StopContainer(ctx context.Context, name string, timeout time.Duration) error {
+	query := url.Values{"t": {strconv.Itoa(int(timeout.Seconds()))}}
+	resp, err := c.do(ctx, "stop container "+name, http.MethodPost, "/containers/"+url.PathEscape(name)+"/stop", query, nil)
+	if err != nil {
+		return err
+	}
+	return drain(resp)
+}
+
+// RemoveOptions controls what RemoveContainer does besides removing the
+// container.
+type RemoveOptions struct {
+	Force   bool // kill a running container first
+	Volumes bool // also remove its anonymous volumes
+}
+
+// RemoveContainer removes a container.
+func (c *Client) RemoveContainer(ctx context.Context, name string, opts RemoveOptions) error {
+	query := url.Values{}
+	if opts.Force {
+		query.Set("force", "1")
+	}
+	if opts.Volumes {
+		query.Set("v", "1")
+	}
+	resp, err := c.do(ctx, "remove container "+name, http.MethodDelete, "/containers/"+url.PathEscape(name), query, nil)
+	if err != nil {
+		return err
+	}
+	return drain(resp)
+}
@@ -0,0 +1,133 @@
+package dockerapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// PullProgress is one progress message of an image pull. Layer is empty for
+// messages about the image as a whole, such as the final digest.
+type PullProgress struct {
+	Layer   string
+	Status  string // e.g. "Downloading", "Pull complete"
+	Current int64  // bytes of the layer done so far, when known
+	Total   int64  // size of the layer, when known
+}
+
+// Image is the part of an image inspection the updater reads.
+type Image struct {
+	ID          string
+	RepoTags    []string
+	RepoDigests []string // repository@sha256:... for each registry it came from
+}
+
+// RepoDigest returns the digest, sha256:..., under which repo published the
+// image, or "" for an image that was built locally.
+func (img *Image) RepoDigest(repo string) string {
+	for _, ref := range img.RepoDigests {
+		if name, digest, ok := strings.Cut(ref, "@"); ok && name == repo {
+			return digest
+		}
+	}
+	return ""
+}
+
+// InspectImage returns the local image ref (repository:tag or an image ID)
+// names.
+func (c *Client) InspectImage(ctx context.Context, ref string) (*Image, error) {
+	op := "inspect image " + ref
+	resp, err := c.do(ctx, op, http.MethodGet, "/images/"+ref+"/json", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var img Image
+	if err := decode(op, resp, &img); err != nil {
+		return nil, err
+	}
+	return &img, nil
+}
+
+// PullImage pulls ref (repository:tag or repository@digest; the tag
+// defaults to latest) and calls progress, if not nil, for every progress
+// message. It returns once the pull has finished; a failure reported part
+// way through is returned as an *Error.
+func (c *Client) PullImage(ctx context.Context, ref string, progress func(PullProgress)) error {
+	repo, tag := splitReference(ref)
+	query := url.Values{"fromImage": {repo}, "tag": {tag}}
+
+	op := "pull " + ref
+	resp, err := c.do(ctx, op, http.MethodPost, "/images/create", query, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var msg struct {
+			ID             string `json:"id"`
+			Status         string `json:"status"`
+			ProgressDetail struct {
+				Current int64 `json:"current"`
+				Total   int64 `json:"total"`
+			} `json:"progressDetail"`
+			Error       string `json:"error"`
+			ErrorDetail struct {
+				Message string `json:"message"`
+			} `json:"errorDetail"`
+		}
+		if err := dec.Decode(&msg); errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			if ctx.Err() != nil {
+				return fmt.Errorf("%s: %w", op, ctx.Err())
+			}
+			return fmt.Errorf("%s: reading progress: %w", op, err)
+		}
+		if msg.ErrorDetail.Message != "" {
+			return &Error{Op: op, Message: msg.ErrorDetail.Message}
+		}
+		if msg.Error != "" {
+			return &Error{Op: op, Message: msg.Error}
+		}
+		if progress != nil {
+			progress(PullProgress{
+				Layer:   msg.ID,
+				Status:  msg.Status,
+				Current: msg.ProgressDetail.Current,
+				Total:   msg.ProgressDetail.Total,
+			})
+		}
+	}
+}
+
+// TagImage gives the local image source (repository:tag, repository@digest
+// or an image ID) the name repo:tag, moving the tag off any other image.
+func (c *Client) TagImage(ctx context.Context, source, repo, tag string) error {
+	query := url.Values{"repo": {repo}, "tag": {tag}}
+	resp, err := c.do(ctx, "tag image "+source, http.MethodPost, "/images/"+source+"/tag", query, nil)
+	if err != nil {
+		return err
+	}
+	return drain(resp)
+}
+
+// splitReference splits an image reference into the fromImage and tag
+// parameters of a pull; a digest goes in tag.
+func splitReference(ref string) (repo, tag string) {
+	if repo, digest, ok := strings.Cut(ref, "@"); ok {
+		return repo, digest
+	}
+	// A colon after the last slash starts the tag; one before it is a
+	// registry port
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		return ref[:i], ref[i+1:]
+	}
+	return ref, "latest"
+}
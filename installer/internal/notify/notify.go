@@ -0,0 +1,259 @@
+// Package notify posts update, rollback and backup events to webhooks.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jhandel/KMP/installer/internal/config"
+)
+
+// Event types.
+const (
+	EventUpdateStarted    = "update.started"
+	EventUpdateCompleted  = "update.completed"
+	EventUpdateFailed     = "update.failed"
+	EventUpdateRolledBack = "update.rolled_back"
+	EventUpdateCancelled  = "update.cancelled"
+	EventBackupSucceeded  = "backup.succeeded"
+	EventBackupFailed     = "backup.failed"
+	EventTest             = "test"
+)
+
+// Webhook formats.
+const (
+	FormatJSON    = "json"
+	FormatSlack   = "slack"
+	FormatDiscord = "discord"
+)
+
+// Signature headers sent with every delivery. The signature is
+// "sha256=" + hex(HMAC-SHA256(secret, timestamp + "." + body)).
+const (
+	HeaderEvent     = "X-KMP-Event"
+	HeaderTimestamp = "X-KMP-Timestamp"
+	HeaderSignature = "X-KMP-Signature"
+)
+
+const (
+	// DefaultAttempts is how many times a delivery is tried.
+	DefaultAttempts = 4
+	// DefaultBackoff is the wait before the first retry; it doubles after.
+	DefaultBackoff = time.Second
+)
+
+// Event is the JSON payload of a webhook.
+type Event struct {
+	Type        string    `json:"type"`
+	Deployment  string    `json:"deployment,omitempty"`
+	Time        time.Time `json:"time"`
+	Operation   string    `json:"operation,omitempty"` // update, rollback
+	PreviousTag string    `json:"previousTag,omitempty"`
+	TargetTag   string    `json:"targetTag,omitempty"`
+	BackupID    string    `json:"backupId,omitempty"`
+	RequestedBy string    `json:"requestedBy,omitempty"`
+	Message     string    `json:"message,omitempty"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// Text summarises the event in one line for chat webhooks.
+func (e Event) Text() string {
+	name := "KMP"
+	if e.Deployment != "" {
+		name += " (" + e.Deployment + ")"
+	}
+	tags := e.TargetTag
+	if e.PreviousTag != "" {
+		tags = e.PreviousTag + " → " + e.TargetTag
+	}
+
+	var text string
+	switch e.Type {
+	case EventUpdateStarted:
+		text = fmt.Sprintf("🔄 %s: %s started, %s", name, e.Operation, tags)
+	case EventUpdateCompleted:
+		text = fmt.Sprintf("✅ %s: %s completed, %s", name, e.Operation, tags)
+	case EventUpdateFailed:
+		text = fmt.Sprintf("❌ %s: %s failed, %s", name, e.Operation, tags)
+	case EventUpdateRolledBack:
+		text = fmt.Sprintf("⚠️ %s: %s to %s failed and was rolled back to %s", name, e.Operation, e.TargetTag, e.PreviousTag)
+	case EventUpdateCancelled:
+		text = fmt.Sprintf("⚠️ %s: %s cancelled, %s", name, e.Operation, tags)
+	case EventBackupSucceeded:
+		text = fmt.Sprintf("✅ %s: backup %s succeeded", name, e.BackupID)
+	case EventBackupFailed:
+		text = fmt.Sprintf("❌ %s: backup failed", name)
+	case EventTest:
+		text = fmt.Sprintf("🔔 %s: test notification", name)
+	default:
+		text = fmt.Sprintf("%s: %s", name, e.Type)
+	}
+	if e.Error != "" {
+		text += ": " + e.Error
+	} else if e.Message != "" && e.Type != EventUpdateStarted {
+		text += ": " + e.Message
+	}
+	if e.RequestedBy != "" {
+		text += " (by " + e.RequestedBy + ")"
+	}
+	return text
+}
+
+// Subscribed reports whether hook wants events of type eventType. A hook
+// with no event list gets everything; "update" or "backup" select a whole
+// category.
+func Subscribed(hook config.Webhook, eventType string) bool {
+	if len(hook.Events) == 0 || eventType == EventTest {
+		return true
+	}
+	category, _, _ := strings.Cut(eventType, ".")
+	for _, e := range hook.Events {
+		if e == eventType || e == category {
+			return true
+		}
+	}
+	return false
+}
+
+// Payload renders ev in hook's format.
+func Payload(hook config.Webhook, ev Event) ([]byte, error) {
+	switch hook.Format {
+	case "", FormatJSON:
+		return json.Marshal(ev)
+	case FormatSlack:
+		return json.Marshal(map[string]string{"text": ev.Text()})
+	case FormatDiscord:
+		return json.Marshal(map[string]string{"content": ev.Text()})
+	default:
+		return nil, fmt.Errorf("unknown webhook format %q (want json, slack or discord)", hook.Format)
+	}
+}
+
+// Sign returns the HeaderSignature value for body sent at timestamp.
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Sender delivers events to webhooks, retrying failed deliveries.
+type Sender struct {
+	HTTPClient *http.Client
+	Attempts   int           // 0 = DefaultAttempts
+	Backoff    time.Duration // 0 = DefaultBackoff
+}
+
+// NewSender creates a sender with the default retry policy.
+func NewSender() *Sender {
+	return &Sender{HTTPClient: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Send delivers ev to every hook subscribed to it and returns the
+// deliveries that failed.
+func (s *Sender) Send(ctx context.Context, hooks []config.Webhook, ev Event) error {
+	var errs []error
+	for _, hook := range hooks {
+		if !Subscribed(hook, ev.Type) {
+			continue
+		}
+		if err := s.Deliver(ctx, hook, ev); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Deliver posts ev to one hook. Network errors, 429 and 5xx responses are
+// retried with exponential backoff; other responses are final.
+func (s *Sender) Deliver(ctx context.Context, hook config.Webhook, ev Event) error {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now().UTC()
+	}
+	body, err := Payload(hook, ev)
+	if err != nil {
+		return err
+	}
+
+	attempts, backoff := s.Attempts, s.Backoff
+	if attempts <= 0 {
+		attempts = DefaultAttempts
+	}
+	if backoff <= 0 {
+		backoff = DefaultBackoff
+	}
+
+	var lastErr error
+	for attempt := 1; ; attempt++ {
+		retry, err := s.post(ctx, hook, ev.Type, body)
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+		if !retry || attempt >= attempts {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("webhook %s: %w (last error: %v)", redact(hook.URL), ctx.Err(), lastErr)
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+	return fmt.Errorf("webhook %s: %w", redact(hook.URL), lastErr)
+}
+
+// post makes one delivery attempt and reports whether a failure is worth
+// retrying.
+func (s *Sender) post(ctx context.Context, hook config.Webhook, eventType string, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "kmp-notify")
+	req.Header.Set(HeaderEvent, eventType)
+	req.Header.Set(HeaderTimestamp, timestamp)
+	if hook.Secret != "" {
+		req.Header.Set(HeaderSignature, Sign(hook.Secret, timestamp, body))
+	}
+
+	client := s.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return ctx.Err() == nil, err
+	}
+	defer resp.Body.Close()
+	snippet, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, fmt.Errorf("HTTP %d: %s", resp.StatusCode, strings.TrimSpace(string(snippet)))
+}
+
+// redact hides the path of a webhook URL, which for Slack and Discord is
+// the credential.
+func redact(rawURL string) string {
+	if i := strings.Index(rawURL, "://"); i >= 0 {
+		if j := strings.IndexByte(rawURL[i+3:], '/'); j >= 0 {
+			return rawURL[:i+3+j] + "/…"
+		}
+	}
+	return rawURL
+}
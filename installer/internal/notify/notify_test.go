@@ -0,0 +1,165 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jhandel/KMP/installer/internal/config"
+)
+
+func TestDeliverSignsPayloadAndRetriesServerErrors(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		attempts int
+		got      Event
+		headers  http.Header
+		body     []byte
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		if attempts < 3 {
+			http.Error(w, "try again", http.StatusBadGateway)
+			return
+		}
+		headers = r.Header.Clone()
+		body, _ = io.ReadAll(r.Body)
+		_ = json.Unmarshal(body, &got)
+	}))
+	defer server.Close()
+
+	sender := &Sender{HTTPClient: server.Client(), Backoff: time.Millisecond}
+	hook := config.Webhook{URL: server.URL + "/hooks/kmp", Secret: "s3cret"}
+	ev := Event{Type: EventUpdateRolledBack, Deployment: "prod", Operation: "update", PreviousTag: "v1.0.0", TargetTag: "v1.1.0", Error: "Health check failed"}
+	if err := sender.Deliver(context.Background(), hook, ev); err != nil {
+		t.Fatalf("Deliver: %v", err)
+	}
+
+	if attempts != 3 {
+		t.Fatalf("expected two retries, got %d attempts", attempts)
+	}
+	if got.Type != EventUpdateRolledBack || got.TargetTag != "v1.1.0" || got.Time.IsZero() {
+		t.Fatalf("unexpected payload %+v", got)
+	}
+	if headers.Get(HeaderEvent) != EventUpdateRolledBack {
+		t.Fatalf("expected %s header, got %q", HeaderEvent, headers.Get(HeaderEvent))
+	}
+	if want := Sign("s3cret", headers.Get(HeaderTimestamp), body); headers.Get(HeaderSignature) != want {
+		t.Fatalf("expected signature %s, got %q", want, headers.Get(HeaderSignature))
+	}
+}
+
+func TestDeliverGivesUpOnClientErrorsAndAfterAttempts(t *testing.T) {
+	for _, tt := range []struct {
+		status       int
+		wantAttempts int
+	}{
+		{status: http.StatusNotFound, wantAttempts: 1},
+		{status: http.StatusServiceUnavailable, wantAttempts: 2},
+	} {
+		attempts := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			attempts++
+			w.WriteHeader(tt.status)
+		}))
+
+		sender := &Sender{HTTPClient: server.Client(), Attempts: 2, Backoff: time.Millisecond}
+		err := sender.Deliver(context.Background(), config.Webhook{URL: server.URL + "/T000/B000/XXXX"}, Event{Type: EventTest})
+		server.Close()
+
+		if err == nil || attempts != tt.wantAttempts {
+			t.Fatalf("HTTP %d: expected failure after %d attempts, got %d (%v)", tt.status, tt.wantAttempts, attempts, err)
+		}
+		if strings.Contains(err.Error(), "XXXX") {
+			t.Fatalf("expected the webhook path to be redacted, got %v", err)
+		}
+	}
+}
+
+func TestSendFormatsChatPayloadsAndHonoursEventFilters(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		received = map[string]map[string]string{}
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]string
+		_ = json.NewDecoder(r.Body).Decode(&payload)
+		mu.Lock()
+		received[r.URL.Path] = payload
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	hooks := []config.Webhook{
+		{URL: server.URL + "/slack", Format: FormatSlack},
+		{URL: server.URL + "/discord", Format: FormatDiscord, Events: []string{"update"}},
+		{URL: server.URL + "/backups-only", Events: []string{"backup.failed"}},
+	}
+	ev := Event{Type: EventUpdateFailed, Deployment: "prod", Operation: "update", PreviousTag: "v1.0.0", TargetTag: "v1.1.0", Error: "Pull failed"}
+	if err := NewSender().Send(context.Background(), hooks, ev); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	if text := received["/slack"]["text"]; !strings.Contains(text, "update failed") || !strings.Contains(text, "Pull failed") {
+		t.Fatalf("unexpected Slack payload %v", received["/slack"])
+	}
+	if content := received["/discord"]["content"]; content != received["/slack"]["text"] {
+		t.Fatalf("expected the Discord payload to carry the same text, got %v", received["/discord"])
+	}
+	if _, ok := received["/backups-only"]; ok {
+		t.Fatalf("expected the backup-only hook to be skipped")
+	}
+}
+
+func TestQueueWaitReturnsOnceQueuedEventsAreDelivered(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		got  []string
+		hang = make(chan struct{})
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(HeaderEvent) == EventUpdateFailed {
+			<-hang
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		got = append(got, r.Header.Get(HeaderEvent))
+	}))
+	defer server.Close()
+	defer close(hang)
+
+	q := NewQueue(&Sender{HTTPClient: server.Client()}, func() []config.Webhook {
+		return []config.Webhook{{URL: server.URL}}
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go q.Run(ctx)
+
+	q.Post(Event{Type: EventUpdateStarted})
+	q.Post(Event{Type: EventUpdateCompleted})
+	if err := q.Wait(context.Background()); err != nil {
+		t.Fatalf("Wait: %v", err)
+	}
+	mu.Lock()
+	delivered := strings.Join(got, ",")
+	mu.Unlock()
+	if delivered != EventUpdateStarted+","+EventUpdateCompleted {
+		t.Fatalf("expected both events delivered in order, got %q", delivered)
+	}
+
+	// A webhook that does not answer holds up Wait only until its deadline
+	q.Post(Event{Type: EventUpdateFailed})
+	waitCtx, waitCancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer waitCancel()
+	if err := q.Wait(waitCtx); err == nil {
+		t.Fatal("expected Wait to give up on a webhook that does not answer")
+	}
+}
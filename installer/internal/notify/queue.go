@@ -0,0 +1,71 @@
+package notify
+
+import (
+	"context"
+	"log"
+	"sync"
+
+	"github.com/jhandel/KMP/installer/internal/config"
+)
+
+// queueSize bounds the events waiting for delivery; beyond it new events are
+// dropped rather than holding up the caller.
+const queueSize = 64
+
+// Queue delivers events in the background, one at a time and in the order
+// they were posted, so a slow or retrying webhook never blocks an update.
+type Queue struct {
+	sender  *Sender
+	hooks   func() []config.Webhook
+	events  chan Event
+	pending sync.WaitGroup // events posted and not yet delivered
+}
+
+// NewQueue creates a queue that sends to the webhooks returned by hooks,
+// which is called per event so configuration changes apply without a
+// restart.
+func NewQueue(sender *Sender, hooks func() []config.Webhook) *Queue {
+	return &Queue{sender: sender, hooks: hooks, events: make(chan Event, queueSize)}
+}
+
+// Post queues ev for delivery.
+func (q *Queue) Post(ev Event) {
+	q.pending.Add(1)
+	select {
+	case q.events <- ev:
+	default:
+		q.pending.Done()
+		log.Printf("[notify] queue full, dropping %s event", ev.Type)
+	}
+}
+
+// Run delivers queued events until ctx is cancelled.
+func (q *Queue) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-q.events:
+			if err := q.sender.Send(ctx, q.hooks(), ev); err != nil {
+				log.Printf("[notify] %s: %v", ev.Type, err)
+			}
+			q.pending.Done()
+		}
+	}
+}
+
+// Wait blocks until every event posted so far has been delivered or ctx is
+// done, for a process that is about to exit. Call it once posting is over.
+func (q *Queue) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		q.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -1,6 +1,7 @@
 package providers
 
 import (
+	"context"
 	"fmt"
 	"io"
 
@@ -74,17 +75,17 @@ func (a *AWSProvider) Logs(follow bool) (io.ReadCloser, error) {
 	return nil, fmt.Errorf("%s: not yet implemented — coming in a future release", a.Name())
 }
 
-func (a *AWSProvider) Backup() (*BackupResult, error) {
+func (a *AWSProvider) Backup(ctx context.Context, opts BackupOptions) (*BackupResult, error) {
 	// TODO: aws rds create-db-snapshot
 	return nil, fmt.Errorf("%s: not yet implemented — coming in a future release", a.Name())
 }
 
-func (a *AWSProvider) Restore(backupID string) error {
+func (a *AWSProvider) Restore(ctx context.Context, backupID string, opts RestoreOptions) error {
 	// TODO: aws rds restore-db-instance-from-db-snapshot
 	return fmt.Errorf("%s: not yet implemented — coming in a future release", a.Name())
 }
 
-func (a *AWSProvider) Rollback() error {
+func (a *AWSProvider) Rollback(opts RollbackOptions) error {
 	// TODO: Retrieve previous task definition and update service
 	return fmt.Errorf("%s: not yet implemented — coming in a future release", a.Name())
 }
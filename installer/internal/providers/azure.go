@@ -1,6 +1,7 @@
 package providers
 
 import (
+	"context"
 	"fmt"
 	"io"
 
@@ -72,17 +73,17 @@ func (a *AzureProvider) Logs(follow bool) (io.ReadCloser, error) {
 	return nil, fmt.Errorf("%s: not yet implemented — coming in a future release", a.Name())
 }
 
-func (a *AzureProvider) Backup() (*BackupResult, error) {
+func (a *AzureProvider) Backup(ctx context.Context, opts BackupOptions) (*BackupResult, error) {
 	// TODO: az mysql flexible-server backup create
 	return nil, fmt.Errorf("%s: not yet implemented — coming in a future release", a.Name())
 }
 
-func (a *AzureProvider) Restore(backupID string) error {
+func (a *AzureProvider) Restore(ctx context.Context, backupID string, opts RestoreOptions) error {
 	// TODO: az mysql flexible-server backup restore
 	return fmt.Errorf("%s: not yet implemented — coming in a future release", a.Name())
 }
 
-func (a *AzureProvider) Rollback() error {
+func (a *AzureProvider) Rollback(opts RollbackOptions) error {
 	// TODO: Retrieve previous image tag and run Update
 	return fmt.Errorf("%s: not yet implemented — coming in a future release", a.Name())
 }
@@ -0,0 +1,405 @@
+package providers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/jhandel/KMP/installer/internal/backuptarget"
+)
+
+const (
+	// backupCatalogFile sits next to the backups it describes.
+	backupCatalogFile = "catalog.json"
+	// catalogLockFile is held while the catalog is read, changed and
+	// written, by the CLI and the sidecar alike.
+	catalogLockFile = ".catalog.lock"
+	// catalogLockWait is how long to wait for another writer; a lock older
+	// than catalogLockStale was left by a process that died holding it.
+	catalogLockWait  = 30 * time.Second
+	catalogLockStale = 2 * time.Minute
+	// LatestBackupID can be passed wherever a backup ID is expected.
+	LatestBackupID = "latest"
+)
+
+// CatalogEntry is what the catalog records about one backup.
+type CatalogEntry struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	File      string    `json:"file"`
+	Size      int64     `json:"size"`
+	SHA256    string    `json:"sha256"`
+	Dialect   string    `json:"dialect,omitempty"`
+	ImageTag  string    `json:"image_tag,omitempty"`
+	Full      bool      `json:"full"`
+	Encrypted bool      `json:"encrypted"`
+	Location  string    `json:"location,omitempty"` // local path; empty once only the off-host copy is left
+	Remote    string    `json:"remote,omitempty"`
+	// RemoteStale marks an off-host copy a rekey could not replace; it is
+	// still encrypted to the previous key.
+	RemoteStale bool   `json:"remote_stale,omitempty"`
+	Reason      string `json:"reason,omitempty"` // why it was taken, when not on request
+
+	Verification *BackupVerification `json:"verification,omitempty"` // latest `kmp backup verify`
+}
+
+// backupCatalog is the on-disk catalog. Local locations are stored relative
+// to the catalog so the host and the updater sidecar, which mount the
+// deployment directory at different paths, can share it.
+type backupCatalog struct {
+	dir     string
+	Backups []CatalogEntry `json:"backups"`
+}
+
+// loadCatalog reads dir's catalog; a missing catalog is empty.
+func loadCatalog(dir string) (*backupCatalog, error) {
+	c := &backupCatalog{dir: dir}
+	data, err := os.ReadFile(filepath.Join(dir, backupCatalogFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return c, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("parsing backup catalog: %w", err)
+	}
+	for i := range c.Backups {
+		if loc := c.Backups[i].Location; loc != "" && !filepath.IsAbs(loc) {
+			c.Backups[i].Location = filepath.Join(dir, loc)
+		}
+	}
+	return c, nil
+}
+
+// save writes the catalog atomically, oldest backup first.
+func (c *backupCatalog) save() error {
+	sort.Slice(c.Backups, func(i, j int) bool { return c.Backups[i].ID < c.Backups[j].ID })
+	stored := backupCatalog{Backups: make([]CatalogEntry, len(c.Backups))}
+	for i, e := range c.Backups {
+		if e.Location != "" {
+			e.Location = filepath.Base(e.Location)
+		}
+		stored.Backups[i] = e
+	}
+	data, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(c.dir, 0750); err != nil {
+		return fmt.Errorf("creating backup directory: %w", err)
+	}
+	_, err = writeFileAtomic(filepath.Join(c.dir, backupCatalogFile), 0640, func(w io.Writer) error {
+		_, err := w.Write(append(data, '\n'))
+		return err
+	})
+	return err
+}
+
+// find returns the entry for id, or nil.
+func (c *backupCatalog) find(id string) *CatalogEntry {
+	for i := range c.Backups {
+		if c.Backups[i].ID == id {
+			return &c.Backups[i]
+		}
+	}
+	return nil
+}
+
+// put adds e or replaces the entry with the same ID.
+func (c *backupCatalog) put(e CatalogEntry) {
+	if existing := c.find(e.ID); existing != nil {
+		*existing = e
+		return
+	}
+	c.Backups = append(c.Backups, e)
+}
+
+// remove drops the entry for id.
+func (c *backupCatalog) remove(id string) {
+	kept := c.Backups[:0]
+	for _, e := range c.Backups {
+		if e.ID != id {
+			kept = append(kept, e)
+		}
+	}
+	c.Backups = kept
+}
+
+// resolve maps an ID or the "latest" alias to a catalogued entry.
+func (c *backupCatalog) resolve(id string) (*CatalogEntry, error) {
+	if id == LatestBackupID {
+		newest := ""
+		for _, e := range c.Backups {
+			if e.ID > newest {
+				newest = e.ID
+			}
+		}
+		if newest == "" {
+			return nil, fmt.Errorf("no backups recorded")
+		}
+		id = newest
+	}
+	if e := c.find(id); e != nil {
+		return e, nil
+	}
+	return nil, fmt.Errorf("backup not found: %s", id)
+}
+
+// reconcile brings the catalog in line with the backups directory: files
+// written before the catalog existed are added, and entries whose local file
+// is gone keep only their off-host copy or are dropped.
+func (c *backupCatalog) reconcile() error {
+	files, err := listBackupFiles(c.dir)
+	if err != nil {
+		return err
+	}
+	onDisk := map[string]backupFile{}
+	for _, bf := range files {
+		onDisk[bf.ID] = bf
+	}
+
+	kept := c.Backups[:0]
+	for _, e := range c.Backups {
+		e.Location = ""
+		if bf, ok := onDisk[e.ID]; ok {
+			// The file may have been rewritten under another name, e.g.
+			// encrypted by a rekey; what else is known about it stays
+			if name := filepath.Base(bf.Path); name != e.File {
+				size, sum, err := hashFile(bf.Path)
+				if err != nil {
+					return err
+				}
+				e.File, e.Size, e.SHA256, e.Encrypted = name, size, sum, bf.Encrypted
+			}
+			e.Location = bf.Path
+		}
+		if e.Location != "" || e.Remote != "" {
+			kept = append(kept, e)
+		}
+	}
+	c.Backups = kept
+
+	for _, bf := range files {
+		if c.find(bf.ID) != nil {
+			continue
+		}
+		size, sum, err := hashFile(bf.Path)
+		if err != nil {
+			return err
+		}
+		created, ok := backupTime(bf.ID)
+		if !ok {
+			if info, err := os.Stat(bf.Path); err == nil {
+				created = info.ModTime().UTC()
+			}
+		}
+		entry := CatalogEntry{
+			ID:        bf.ID,
+			CreatedAt: created,
+			File:      filepath.Base(bf.Path),
+			Size:      size,
+			SHA256:    sum,
+			Dialect:   bf.Dialect,
+			Full:      bf.Full,
+			Encrypted: bf.Encrypted,
+			Location:  bf.Path,
+		}
+		if bf.Full && !bf.Encrypted {
+			// The manifest still knows what a full archive was taken of
+			if manifest, _, err := readFullBackupManifest(bf.Path, nil); err == nil {
+				entry.ImageTag, entry.Dialect = manifest.ImageTag, manifest.Dialect
+			}
+		}
+		c.put(entry)
+	}
+	return nil
+}
+
+// writeBackupFile is writeFileAtomic for backups: it also returns the
+// SHA-256 of what was written, as recorded in the catalog.
+func writeBackupFile(dst string, fn func(w io.Writer) error) (int64, string, error) {
+	h := sha256.New()
+	size, err := writeFileAtomic(dst, 0640, func(w io.Writer) error {
+		return fn(io.MultiWriter(w, h))
+	})
+	if err != nil {
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashFile returns the size and SHA-256 of the file at name.
+func hashFile(name string) (int64, string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return 0, "", err
+	}
+	return n, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// backupDir is where the Docker provider keeps backups and their catalog.
+func (d *DockerProvider) backupDir() string {
+	return filepath.Join(d.dir, "backups")
+}
+
+// updateCatalog loads the catalog, applies fn and saves it, holding the
+// catalog lock throughout so that concurrent backups and prunes from the CLI
+// and the sidecar do not lose each other's entries. fn should be quick.
+func (d *DockerProvider) updateCatalog(fn func(c *backupCatalog) error) error {
+	unlock, err := lockCatalog(d.backupDir())
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	c, err := loadCatalog(d.backupDir())
+	if err != nil {
+		return err
+	}
+	if err := fn(c); err != nil {
+		return err
+	}
+	return c.save()
+}
+
+// lockCatalog takes the lock file of the catalog in dir, waiting up to
+// catalogLockWait for another holder and breaking a stale lock. It returns
+// the function that releases it.
+func lockCatalog(dir string) (func(), error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, fmt.Errorf("creating backup directory: %w", err)
+	}
+	name := filepath.Join(dir, catalogLockFile)
+	deadline := time.Now().Add(catalogLockWait)
+	for {
+		f, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			fmt.Fprintf(f, "%d\n", os.Getpid())
+			f.Close()
+			return func() { _ = os.Remove(name) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("locking backup catalog: %w", err)
+		}
+		if info, err := os.Stat(name); err == nil && time.Since(info.ModTime()) > catalogLockStale {
+			_ = os.Remove(name)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("backup catalog is locked by another kmp process (%s)", name)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// recordBackup adds a freshly written backup to the catalog.
+func (d *DockerProvider) recordBackup(result *BackupResult, reason string) error {
+	created, ok := backupTime(result.ID)
+	if !ok {
+		created = time.Now().UTC()
+	}
+	return d.updateCatalog(func(c *backupCatalog) error {
+		c.put(CatalogEntry{
+			ID:        result.ID,
+			CreatedAt: created,
+			File:      filepath.Base(result.Location),
+			Size:      result.Size,
+			SHA256:    result.SHA256,
+			Dialect:   result.Dialect,
+			ImageTag:  d.currentImageTag(),
+			Full:      result.Full,
+			Encrypted: result.Encrypted,
+			Location:  result.Location,
+			Remote:    result.Remote,
+			Reason:    reason,
+		})
+		return nil
+	})
+}
+
+// resolveBackupID maps the "latest" alias to the newest catalogued backup.
+func (d *DockerProvider) resolveBackupID(ctx context.Context, id string) (string, error) {
+	if id != LatestBackupID {
+		return id, nil
+	}
+	entry, err := d.ShowBackup(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	return entry.ID, nil
+}
+
+// ListBackups returns the catalogued backups, oldest first, after adding any
+// backup files the catalog does not know about yet.
+func (d *DockerProvider) ListBackups(ctx context.Context) ([]CatalogEntry, error) {
+	var entries []CatalogEntry
+	err := d.updateCatalog(func(c *backupCatalog) error {
+		if err := c.reconcile(); err != nil {
+			return err
+		}
+		sort.Slice(c.Backups, func(i, j int) bool { return c.Backups[i].ID < c.Backups[j].ID })
+		entries = append(entries, c.Backups...)
+		return nil
+	})
+	return entries, err
+}
+
+// ShowBackup returns the catalog entry for id, which may be "latest".
+func (d *DockerProvider) ShowBackup(ctx context.Context, id string) (*CatalogEntry, error) {
+	entries, err := d.ListBackups(ctx)
+	if err != nil {
+		return nil, err
+	}
+	entry, err := (&backupCatalog{Backups: entries}).resolve(id)
+	if err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// DeleteBackup removes a backup's local file and off-host copy, then drops
+// it from the catalog.
+func (d *DockerProvider) DeleteBackup(ctx context.Context, id string) (*CatalogEntry, error) {
+	entry, err := d.ShowBackup(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if entry.Location != "" {
+		if err := os.Remove(entry.Location); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("removing backup %s: %w", entry.ID, err)
+		}
+	}
+	if entry.Remote != "" {
+		target, err := d.backupTarget()
+		if err != nil {
+			return nil, err
+		}
+		if target != nil {
+			if err := target.Delete(ctx, path.Base(entry.Remote)); err != nil && !errors.Is(err, backuptarget.ErrNotFound) {
+				return nil, fmt.Errorf("removing backup %s from %s: %w", entry.ID, target, err)
+			}
+		}
+	}
+
+	return entry, d.updateCatalog(func(c *backupCatalog) error {
+		c.remove(entry.ID)
+		return nil
+	})
+}
@@ -0,0 +1,167 @@
+package providers
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jhandel/KMP/installer/internal/config"
+)
+
+func TestBackupCatalogRecordsListsAndDeletes(t *testing.T) {
+	installMockDocker(t, "printf 'CREATE TABLE members (id int);\\n'\n")
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, ".env"), []byte("KMP_IMAGE_TAG=v1.4.2\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	d := NewDockerProvider(&config.Deployment{ComposeDir: dir})
+	ctx := context.Background()
+
+	// A backup from before the catalog existed
+	legacy := filepath.Join(dir, "backups", "20200101-000000.sql.gz")
+	if err := os.MkdirAll(filepath.Dir(legacy), 0o750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(legacy, []byte("legacy"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := d.Backup(ctx, BackupOptions{})
+	if err != nil {
+		t.Fatalf("Backup: %v", err)
+	}
+	_, sum, err := hashFile(result.Location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.SHA256 != sum {
+		t.Fatalf("result checksum %s does not match file %s", result.SHA256, sum)
+	}
+
+	entries, err := d.ListBackups(ctx)
+	if err != nil {
+		t.Fatalf("ListBackups: %v", err)
+	}
+	if len(entries) != 2 || entries[0].ID != "20200101-000000" || entries[1].ID != result.ID {
+		t.Fatalf("unexpected catalog %+v", entries)
+	}
+	if entries[0].SHA256 == "" || entries[0].Dialect != "mysql" {
+		t.Fatalf("legacy backup not catalogued: %+v", entries[0])
+	}
+
+	latest, err := d.ShowBackup(ctx, LatestBackupID)
+	if err != nil {
+		t.Fatalf("ShowBackup(latest): %v", err)
+	}
+	if latest.ID != result.ID || latest.SHA256 != sum || latest.ImageTag != "v1.4.2" || latest.Location != result.Location {
+		t.Fatalf("unexpected latest entry %+v", latest)
+	}
+
+	// Locations are stored relative to the catalog
+	raw, err := os.ReadFile(filepath.Join(dir, "backups", backupCatalogFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(raw), dir) {
+		t.Fatalf("catalog stores absolute paths:\n%s", raw)
+	}
+
+	if _, err := d.DeleteBackup(ctx, LatestBackupID); err != nil {
+		t.Fatalf("DeleteBackup: %v", err)
+	}
+	if _, err := os.Stat(result.Location); !os.IsNotExist(err) {
+		t.Fatalf("expected backup file to be removed, got %v", err)
+	}
+	entries, err = d.ListBackups(ctx)
+	if err != nil {
+		t.Fatalf("ListBackups: %v", err)
+	}
+	if len(entries) != 1 || entries[0].ID != "20200101-000000" {
+		t.Fatalf("unexpected catalog after delete %+v", entries)
+	}
+	if _, err := d.ShowBackup(ctx, result.ID); err == nil {
+		t.Fatalf("expected deleted backup to be gone from the catalog")
+	}
+}
+
+func TestBackupCatalogUpdatesFromSeveralProcessesAreNotLost(t *testing.T) {
+	dir := t.TempDir()
+	// Each writer stands in for a kmp process: the CLI or the sidecar
+	writers := make([]*DockerProvider, 8)
+	for i := range writers {
+		writers[i] = NewDockerProvider(&config.Deployment{ComposeDir: dir})
+	}
+
+	var wg sync.WaitGroup
+	for i, d := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id := fmt.Sprintf("20240101-00000%d", i)
+			if err := d.updateCatalog(func(c *backupCatalog) error {
+				c.put(CatalogEntry{ID: id, Remote: "s3://kmp/" + id})
+				return nil
+			}); err != nil {
+				t.Errorf("updateCatalog: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	c, err := loadCatalog(filepath.Join(dir, "backups"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Backups) != len(writers) {
+		t.Fatalf("expected %d entries, got %+v", len(writers), c.Backups)
+	}
+
+	// A lock left behind by a process that died is broken
+	lock := filepath.Join(dir, "backups", catalogLockFile)
+	if err := os.WriteFile(lock, []byte("1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-catalogLockStale - time.Minute)
+	if err := os.Chtimes(lock, old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := writers[0].updateCatalog(func(*backupCatalog) error { return nil }); err != nil {
+		t.Fatalf("expected a stale lock to be broken, got %v", err)
+	}
+	if _, err := os.Stat(lock); !os.IsNotExist(err) {
+		t.Fatalf("expected the lock to be released, got %v", err)
+	}
+}
+
+func TestBackupCatalogReconcileKeepsWhatTheFileCannotTell(t *testing.T) {
+	dir := t.TempDir()
+	backups := filepath.Join(dir, "backups")
+	if err := os.MkdirAll(backups, 0o750); err != nil {
+		t.Fatal(err)
+	}
+	c := &backupCatalog{dir: backups, Backups: []CatalogEntry{{
+		ID: "20240101-000000", File: "20240101-000000.sql.gz", ImageTag: "v1.4.2",
+		Remote: "s3://kmp/20240101-000000.sql.gz.enc", Reason: "pre-update v1.4.2 -> v1.5.0",
+	}}}
+	// Rewritten under a new name, as a rekey does
+	if err := os.WriteFile(filepath.Join(backups, "20240101-000000.sql.gz.enc"), []byte("sealed"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.reconcile(); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	e := c.find("20240101-000000")
+	if e == nil || e.File != "20240101-000000.sql.gz.enc" || !e.Encrypted || e.Size != 6 || e.SHA256 == "" {
+		t.Fatalf("expected the file's facts to be refreshed, got %+v", e)
+	}
+	if e.ImageTag != "v1.4.2" || e.Remote != "s3://kmp/20240101-000000.sql.gz.enc" || e.Reason == "" {
+		t.Fatalf("expected the image tag, remote copy and reason to be kept, got %+v", e)
+	}
+}
@@ -0,0 +1,230 @@
+package providers
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/jhandel/KMP/installer/internal/backupcrypt"
+	"github.com/jhandel/KMP/installer/internal/backuptarget"
+)
+
+// rekeyProgressFile lists the backups a rekey has finished, so an
+// interrupted one can be re-run.
+const rekeyProgressFile = ".rekey-progress.json"
+
+// ErrRemoteCopiesStale means a rekey could not replace some off-host copies,
+// which are still encrypted to the previous key.
+var ErrRemoteCopiesStale = errors.New("off-host copies still use the previous key")
+
+// backupFile describes one backup on disk, decoded from its file name:
+// <id><dialect extension | .full.tar>[.enc]
+type backupFile struct {
+	ID        string
+	Path      string
+	Dialect   string // empty for full archives; the manifest records it
+	Full      bool
+	Encrypted bool
+}
+
+// parseBackupFileName decodes a backup file name; ok is false for anything
+// that is not a finished backup (partials, staging dirs, the catalog).
+func parseBackupFileName(name string) (backupFile, bool) {
+	if strings.HasPrefix(name, ".") {
+		return backupFile{}, false
+	}
+	bf := backupFile{}
+	if strings.HasSuffix(name, backupcrypt.Extension) {
+		bf.Encrypted = true
+		name = strings.TrimSuffix(name, backupcrypt.Extension)
+	}
+	if strings.HasSuffix(name, fullBackupExtension) {
+		bf.Full = true
+		bf.ID = strings.TrimSuffix(name, fullBackupExtension)
+		return bf, bf.ID != ""
+	}
+	for _, dl := range dialects {
+		if strings.HasSuffix(name, dl.Extension()) {
+			bf.Dialect = dl.Name()
+			bf.ID = strings.TrimSuffix(name, dl.Extension())
+			return bf, bf.ID != ""
+		}
+	}
+	return backupFile{}, false
+}
+
+// listBackupFiles returns the backups in dir ordered oldest first.
+func listBackupFiles(dir string) ([]backupFile, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var files []backupFile
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		bf, ok := parseBackupFileName(entry.Name())
+		if !ok {
+			continue
+		}
+		bf.Path = filepath.Join(dir, entry.Name())
+		files = append(files, bf)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].ID < files[j].ID })
+	return files, nil
+}
+
+// findBackupFile locates the backup with the given ID in dir.
+func findBackupFile(dir, id string) (backupFile, error) {
+	files, err := listBackupFiles(dir)
+	if err != nil {
+		return backupFile{}, err
+	}
+	for _, bf := range files {
+		if bf.ID == id {
+			return bf, nil
+		}
+	}
+	return backupFile{}, fmt.Errorf("backup not found: %s", id)
+}
+
+// backupFileName builds the on-disk name for a backup.
+func backupFileName(id string, dialect dbDialect, full, encrypted bool) string {
+	name := id + dialect.Extension()
+	if full {
+		name = id + fullBackupExtension
+	}
+	if encrypted {
+		name += backupcrypt.Extension
+	}
+	return name
+}
+
+// openBackupReader returns the plaintext stream of a backup file, decrypting
+// it with the first identity that fits when the file is encrypted.
+func openBackupReader(r io.Reader, identities []string) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	if !backupcrypt.IsEncrypted(br) {
+		return br, nil
+	}
+	var ids []backupcrypt.Identity
+	for _, key := range identities {
+		if strings.TrimSpace(key) == "" {
+			continue
+		}
+		id, err := backupcrypt.ParseIdentity(key)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	return backupcrypt.Decrypt(br, ids...)
+}
+
+// sealBackup wraps w in an encrypting writer when a key is configured, runs
+// fn against it and finalises the encrypted stream.
+func sealBackup(w io.Writer, key string, fn func(w io.Writer) error) error {
+	if strings.TrimSpace(key) == "" {
+		return fn(w)
+	}
+	recipient, err := backupcrypt.ParseRecipient(key)
+	if err != nil {
+		return fmt.Errorf("backup encryption key: %w", err)
+	}
+	ew, err := backupcrypt.Encrypt(w, recipient)
+	if err != nil {
+		return err
+	}
+	if err := fn(ew); err != nil {
+		return err
+	}
+	return ew.Close()
+}
+
+// rekeyProgress records which backups a rekey to one key has finished. The
+// key itself is kept only as a hash.
+type rekeyProgress struct {
+	path    string
+	KeyHash string          `json:"key_sha256"`
+	Done    map[string]bool `json:"done"`
+}
+
+// loadRekeyProgress returns the progress of an earlier rekey of dir to
+// newKey, or a fresh record when the last rekey was to another key.
+func loadRekeyProgress(dir, newKey string) (*rekeyProgress, error) {
+	sum := sha256.Sum256([]byte(strings.TrimSpace(newKey)))
+	p := &rekeyProgress{path: filepath.Join(dir, rekeyProgressFile), KeyHash: hex.EncodeToString(sum[:])}
+	var stored rekeyProgress
+	data, err := os.ReadFile(p.path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	case json.Unmarshal(data, &stored) == nil && stored.KeyHash == p.KeyHash:
+		p.Done = stored.Done
+	}
+	if p.Done == nil {
+		p.Done = map[string]bool{}
+	}
+	return p, nil
+}
+
+// add records id as re-encrypted.
+func (p *rekeyProgress) add(id string) error {
+	p.Done[id] = true
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	if _, err := writeFileAtomic(p.path, 0600, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	}); err != nil {
+		return fmt.Errorf("recording rekey progress: %w", err)
+	}
+	return nil
+}
+
+// clear forgets the progress once the rekey has finished.
+func (p *rekeyProgress) clear() {
+	_ = os.Remove(p.path)
+}
+
+// replaceRemoteCopy uploads the re-encrypted local file of entry over its
+// off-host copy, removing the old object when the file name changed.
+func replaceRemoteCopy(ctx context.Context, target backuptarget.Target, entry *CatalogEntry) error {
+	if target == nil {
+		return fmt.Errorf("no off-host target configured")
+	}
+	f, err := os.Open(entry.Location)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	name := filepath.Base(entry.Location)
+	if err := target.Upload(ctx, name, f, entry.Size); err != nil {
+		return err
+	}
+	if old := path.Base(entry.Remote); old != name {
+		if err := target.Delete(ctx, old); err != nil && !errors.Is(err, backuptarget.ErrNotFound) {
+			return err
+		}
+	}
+	entry.Remote = target.String() + name
+	return nil
+}
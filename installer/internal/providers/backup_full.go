@@ -0,0 +1,528 @@
+package providers
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jhandel/KMP/installer/internal/backupcrypt"
+	"github.com/jhandel/KMP/installer/internal/config"
+)
+
+const (
+	// fullBackupExtension marks archives produced by `kmp backup --full`.
+	fullBackupExtension = ".full.tar"
+	// fullManifestName is always the first entry of a full backup archive.
+	fullManifestName = "manifest.json"
+	// volumeHelperImage runs tar against named volumes.
+	volumeHelperImage = "alpine:3.21"
+)
+
+// fullBackupVolumes are the named volumes captured by a full backup.
+var fullBackupVolumes = []string{"kmp-uploads", "caddy-data"}
+
+// fullBackupConfigFiles are the rendered files captured by a full backup.
+var fullBackupConfigFiles = []string{".env", sidecarEnvFile, "docker-compose.yml", "Caddyfile"}
+
+// FullBackupManifest describes the contents of a full backup archive.
+type FullBackupManifest struct {
+	FormatVersion int                  `json:"format_version"`
+	ID            string               `json:"id"`
+	CreatedAt     string               `json:"created_at"`
+	Deployment    string               `json:"deployment"`
+	Domain        string               `json:"domain,omitempty"`
+	Channel       string               `json:"channel,omitempty"`
+	Image         string               `json:"image,omitempty"`
+	ImageTag      string               `json:"image_tag"`
+	LocalDBType   string               `json:"local_db_type,omitempty"`
+	Dialect       string               `json:"dialect"`
+	Files         []FullBackupFileInfo `json:"files"`
+}
+
+// FullBackupFileInfo is one archive entry listed in the manifest.
+type FullBackupFileInfo struct {
+	Name   string `json:"name"`
+	Kind   string `json:"kind"` // database, volume, config
+	Volume string `json:"volume,omitempty"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// backupFull stages the database dump, volume tarballs and config files on
+// disk, then packs them behind a manifest into a single tar archive.
+func (d *DockerProvider) backupFull(ctx context.Context, backupDir, id string, dialect dbDialect, opts BackupOptions) (*BackupResult, error) {
+	staging, err := os.MkdirTemp(backupDir, "."+id+"-staging-")
+	if err != nil {
+		return nil, fmt.Errorf("creating staging directory: %w", err)
+	}
+	defer os.RemoveAll(staging)
+
+	manifest := FullBackupManifest{
+		FormatVersion: 1,
+		ID:            id,
+		CreatedAt:     time.Now().UTC().Format(time.RFC3339),
+		Deployment:    deploymentName(d.cfg),
+		Dialect:       dialect.Name(),
+		ImageTag:      d.currentImageTag(),
+	}
+	if d.cfg != nil {
+		manifest.Domain = d.cfg.Domain
+		manifest.Channel = d.cfg.Channel
+		manifest.Image = d.cfg.Image
+		manifest.LocalDBType = d.cfg.LocalDBType
+	}
+
+	var done int64
+	progress := func(n, _ int64) {
+		if opts.Progress != nil {
+			opts.Progress(done+n, -1)
+		}
+	}
+	stage := func(name, kind, volume string, fn func(w io.Writer) error) error {
+		info, err := stageFile(filepath.Join(staging, filepath.FromSlash(name)), fn)
+		if err != nil {
+			return err
+		}
+		info.Name, info.Kind, info.Volume = name, kind, volume
+		manifest.Files = append(manifest.Files, info)
+		done += info.Size
+		return nil
+	}
+
+	if err := stage("database"+dialect.Extension(), "database", "", func(w io.Writer) error {
+		return d.dumpDatabase(ctx, dialect, w, progress)
+	}); err != nil {
+		return nil, err
+	}
+
+	project := d.composeProjectName()
+	for _, volume := range fullBackupVolumes {
+		if err := stage("volumes/"+volume+".tar.gz", "volume", volume, func(w io.Writer) error {
+			pw := &progressWriter{w: w, fn: progress, total: -1}
+			return streamDocker(ctx, nil, pw, "run", "--rm", "-v", project+"_"+volume+":/data:ro",
+				volumeHelperImage, "tar", "czf", "-", "-C", "/data", ".")
+		}); err != nil {
+			return nil, fmt.Errorf("archiving volume %s: %w", volume, err)
+		}
+	}
+
+	for _, name := range fullBackupConfigFiles {
+		src := filepath.Join(d.dir, name)
+		if !fileExists(src) {
+			continue
+		}
+		if err := stage("config/"+name, "config", "", func(w io.Writer) error {
+			f, err := os.Open(src)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = io.Copy(w, f)
+			return err
+		}); err != nil {
+			return nil, fmt.Errorf("copying %s: %w", name, err)
+		}
+	}
+
+	manifestData, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	// The whole archive is sealed, so the manifest is not readable either
+	key := d.backupKey()
+	backupPath := filepath.Join(backupDir, backupFileName(id, dialect, true, key != ""))
+	size, sum, err := writeBackupFile(backupPath, func(w io.Writer) error {
+		return sealBackup(w, key, func(w io.Writer) error {
+			tw := tar.NewWriter(w)
+			if err := writeTarBytes(tw, fullManifestName, manifestData); err != nil {
+				return err
+			}
+			for _, file := range manifest.Files {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				if err := writeTarFile(tw, file.Name, filepath.Join(staging, filepath.FromSlash(file.Name))); err != nil {
+					return err
+				}
+			}
+			return tw.Close()
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &BackupResult{
+		ID:        id,
+		Timestamp: id,
+		Size:      size,
+		SHA256:    sum,
+		Location:  backupPath,
+		Dialect:   dialect.Name(),
+		Full:      true,
+		Encrypted: key != "",
+	}, nil
+}
+
+// restoreFull unpacks a full backup archive, verifies every checksum, puts the
+// config files and volumes back and finally restores the database dump. It
+// returns the archive's manifest.
+func (d *DockerProvider) restoreFull(ctx context.Context, archivePath string, opts RestoreOptions) (*FullBackupManifest, error) {
+	staging, err := os.MkdirTemp(filepath.Dir(archivePath), ".restore-staging-")
+	if err != nil {
+		return nil, fmt.Errorf("creating staging directory: %w", err)
+	}
+	defer os.RemoveAll(staging)
+
+	manifest, err := extractFullBackup(archivePath, staging, opts.Progress, d.backupIdentities(opts))
+	if err != nil {
+		return nil, err
+	}
+
+	dialect, err := dialectByName(manifest.Dialect)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(d.dir, 0750); err != nil {
+		return nil, fmt.Errorf("creating deployment directory: %w", err)
+	}
+
+	// Config files first, keeping any existing copy next to it
+	for _, file := range manifest.Files {
+		if file.Kind != "config" {
+			continue
+		}
+		dst := filepath.Join(d.dir, path.Base(file.Name))
+		if fileExists(dst) {
+			if err := os.Rename(dst, dst+".pre-restore"); err != nil {
+				return nil, fmt.Errorf("preserving %s: %w", dst, err)
+			}
+		}
+		perm := os.FileMode(0644)
+		if name := path.Base(file.Name); name == ".env" || name == sidecarEnvFile {
+			perm = 0600
+		}
+		data, err := os.ReadFile(filepath.Join(staging, filepath.FromSlash(file.Name)))
+		if err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(dst, data, perm); err != nil {
+			return nil, fmt.Errorf("writing %s: %w", dst, err)
+		}
+	}
+
+	// Stop the stack and (re)create containers and volumes without starting them
+	if out, err := runDockerCompose(d.dir, "stop"); err != nil {
+		return nil, fmt.Errorf("docker compose stop: %s\n%w", out, err)
+	}
+	if out, err := runDockerCompose(d.dir, "up", "--no-start"); err != nil {
+		return nil, fmt.Errorf("docker compose up --no-start: %s\n%w", out, err)
+	}
+
+	project := d.composeProjectName()
+	for _, file := range manifest.Files {
+		if file.Kind != "volume" {
+			continue
+		}
+		f, err := os.Open(filepath.Join(staging, filepath.FromSlash(file.Name)))
+		if err != nil {
+			return nil, err
+		}
+		err = streamDocker(ctx, f, io.Discard, "run", "--rm", "-i", "-v", project+"_"+file.Volume+":/data",
+			volumeHelperImage, "sh", "-c", "find /data -mindepth 1 -delete && tar xzf - -C /data")
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("restoring volume %s: %w", file.Volume, err)
+		}
+	}
+
+	// Bring the database up on its own and load the dump into it. An
+	// external database has no db service and is loaded from a client
+	// container instead.
+	external, err := d.externalDB()
+	if err != nil {
+		return nil, err
+	}
+	if external == nil {
+		if out, err := runDockerCompose(d.dir, "up", "-d", "--wait", "db"); err != nil {
+			return nil, fmt.Errorf("starting database: %s\n%w", out, err)
+		}
+	}
+	for _, file := range manifest.Files {
+		if file.Kind != "database" {
+			continue
+		}
+		f, err := os.Open(filepath.Join(staging, filepath.FromSlash(file.Name)))
+		if err != nil {
+			return nil, err
+		}
+		err = d.restoreDatabase(ctx, dialect, f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if out, err := runDockerCompose(d.dir, "up", "-d"); err != nil {
+		return nil, fmt.Errorf("docker compose up: %s\n%w", out, err)
+	}
+
+	return manifest, nil
+}
+
+// ImportFullBackup rebuilds a deployment on a fresh host from a full backup
+// archive: the archive is copied into the deployment's backups directory and
+// restored from there. A deployment not in the config yet is registered only
+// once the restore has succeeded, so a failed import leaves nothing behind
+// for the next kmp command to select. identity and progress are passed on
+// in opts.
+func ImportFullBackup(ctx context.Context, archivePath, name string, opts RestoreOptions) (*config.Deployment, error) {
+	manifest, encrypted, err := readFullBackupManifest(archivePath, []string{opts.Identity})
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		name = manifest.Deployment
+	}
+	if name == "" {
+		name = config.DefaultDeploymentName
+	}
+
+	appCfg, err := config.Load()
+	if err != nil {
+		return nil, err
+	}
+	dep, exists := appCfg.Deployments[name]
+	if !exists {
+		dep = &config.Deployment{
+			Name:        name,
+			Provider:    "docker",
+			Channel:     manifest.Channel,
+			Domain:      manifest.Domain,
+			Image:       manifest.Image,
+			ImageTag:    manifest.ImageTag,
+			LocalDBType: manifest.LocalDBType,
+			StorageType: "local",
+			ComposeDir:  filepath.Join(config.DefaultConfigDir(), "deployments", name),
+		}
+	}
+	dep.Name = name
+
+	d := NewDockerProvider(dep)
+	if err := os.MkdirAll(d.backupDir(), 0750); err != nil {
+		return nil, fmt.Errorf("creating backup directory: %w", err)
+	}
+	dialect, err := dialectByName(manifest.Dialect)
+	if err != nil {
+		return nil, err
+	}
+	dst := filepath.Join(d.backupDir(), backupFileName(manifest.ID, dialect, true, encrypted))
+	if abs, _ := filepath.Abs(archivePath); abs != dst {
+		src, err := os.Open(archivePath)
+		if err != nil {
+			return nil, err
+		}
+		defer src.Close()
+		if _, err := writeFileAtomic(dst, 0640, func(w io.Writer) error {
+			_, err := io.Copy(w, src)
+			return err
+		}); err != nil {
+			return nil, fmt.Errorf("copying archive: %w", err)
+		}
+	}
+
+	if _, err := d.restoreFull(ctx, dst, opts); err != nil {
+		return nil, err
+	}
+
+	if exists {
+		if manifest.ImageTag == "" {
+			return dep, nil
+		}
+		return dep, config.UpdateDeployment(name, func(dep *config.Deployment) {
+			dep.ImageTag = manifest.ImageTag
+		})
+	}
+	// Reloaded: the restore may have taken a while
+	if appCfg, err = config.Load(); err != nil {
+		return nil, err
+	}
+	appCfg.Deployments[name] = dep
+	if appCfg.Current == "" {
+		appCfg.Current = name
+	}
+	if err := appCfg.Save(); err != nil {
+		return nil, err
+	}
+	return dep, nil
+}
+
+// readFullBackupManifest reads only the leading manifest entry of an archive
+// and reports whether the archive is encrypted.
+func readFullBackupManifest(archivePath string, identities []string) (*FullBackupManifest, bool, error) {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	encrypted := backupcrypt.IsEncrypted(br)
+	r, err := openBackupReader(br, identities)
+	if err != nil {
+		return nil, encrypted, err
+	}
+	tr := tar.NewReader(r)
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != fullManifestName {
+		return nil, encrypted, fmt.Errorf("%s is not a full backup archive", archivePath)
+	}
+	var manifest FullBackupManifest
+	if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+		return nil, encrypted, fmt.Errorf("invalid backup manifest: %w", err)
+	}
+	return &manifest, encrypted, nil
+}
+
+// extractFullBackup unpacks every manifest entry into dir, verifying sizes
+// and SHA-256 checksums along the way.
+func extractFullBackup(archivePath, dir string, progress ProgressFunc, identities []string) (*FullBackupManifest, error) {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := openBackupReader(&progressReader{r: f, fn: progress, total: info.Size()}, identities)
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(r)
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != fullManifestName {
+		return nil, fmt.Errorf("%s is not a full backup archive", archivePath)
+	}
+	var manifest FullBackupManifest
+	if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("invalid backup manifest: %w", err)
+	}
+
+	expected := make(map[string]FullBackupFileInfo, len(manifest.Files))
+	for _, file := range manifest.Files {
+		if !filepath.IsLocal(filepath.FromSlash(file.Name)) {
+			return nil, fmt.Errorf("unsafe path in backup manifest: %s", file.Name)
+		}
+		expected[file.Name] = file
+	}
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading archive: %w", err)
+		}
+		want, ok := expected[hdr.Name]
+		if !ok {
+			return nil, fmt.Errorf("unexpected archive entry %s", hdr.Name)
+		}
+		got, err := stageFile(filepath.Join(dir, filepath.FromSlash(hdr.Name)), func(w io.Writer) error {
+			_, err := io.Copy(w, tr)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		if got.SHA256 != want.SHA256 || got.Size != want.Size {
+			return nil, fmt.Errorf("checksum mismatch for %s", hdr.Name)
+		}
+		delete(expected, hdr.Name)
+	}
+	for name := range expected {
+		return nil, fmt.Errorf("archive is missing %s", name)
+	}
+
+	return &manifest, nil
+}
+
+// stageFile writes fn's output to dst and returns its size and checksum.
+func stageFile(dst string, fn func(w io.Writer) error) (FullBackupFileInfo, error) {
+	if err := os.MkdirAll(filepath.Dir(dst), 0750); err != nil {
+		return FullBackupFileInfo{}, err
+	}
+	h := sha256.New()
+	size, err := writeFileAtomic(dst, 0600, func(w io.Writer) error {
+		return fn(io.MultiWriter(w, h))
+	})
+	if err != nil {
+		return FullBackupFileInfo{}, err
+	}
+	return FullBackupFileInfo{Size: size, SHA256: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+func writeTarBytes(tw *tar.Writer, name string, data []byte) error {
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	}); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+func writeTarFile(tw *tar.Writer, name, src string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// composeProjectName returns the compose project that owns the stack's
+// containers and volumes.
+func (d *DockerProvider) composeProjectName() string {
+	if project := strings.TrimSpace(readEnvValue(filepath.Join(d.dir, ".env"), "COMPOSE_PROJECT_NAME")); project != "" {
+		return project
+	}
+	return filepath.Base(d.dir)
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,212 @@
+package providers
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/jhandel/KMP/installer/internal/backuptarget"
+	"github.com/jhandel/KMP/installer/internal/config"
+)
+
+// RetentionPolicy decides which backups `kmp backup prune` keeps. A backup
+// survives if it is younger than Days or is picked by any of the
+// grandfather-father-son counts. The newest backup is never pruned.
+type RetentionPolicy struct {
+	Days    int // 0 = no age-based retention
+	Daily   int // newest backup of each of the last N days that have one
+	Weekly  int // newest backup of each of the last N ISO weeks
+	Monthly int // newest backup of each of the last N months
+}
+
+// IsZero reports whether the policy keeps everything.
+func (p RetentionPolicy) IsZero() bool {
+	return p.Days <= 0 && p.Daily <= 0 && p.Weekly <= 0 && p.Monthly <= 0
+}
+
+// PruneOptions tunes a prune run.
+type PruneOptions struct {
+	Policy RetentionPolicy
+	DryRun bool // report what would be deleted without deleting it
+}
+
+// PrunedBackup is one backup removed (or, on a dry run, selected) by prune.
+type PrunedBackup struct {
+	ID       string
+	Location string // local path or remote URL
+}
+
+// PruneResult lists what a prune run removed.
+type PruneResult struct {
+	Kept   int
+	Pruned []PrunedBackup
+}
+
+// backupTime parses the timestamp encoded in a backup ID.
+func backupTime(id string) (time.Time, bool) {
+	t, err := time.ParseInLocation("20060102-150405", id, time.UTC)
+	return t, err == nil
+}
+
+// selectExpired returns the IDs policy does not keep, given the IDs present.
+// IDs that are not timestamps are always kept.
+func selectExpired(ids []string, policy RetentionPolicy, now time.Time) map[string]bool {
+	expired := map[string]bool{}
+	if policy.IsZero() {
+		return expired
+	}
+
+	type dated struct {
+		id string
+		t  time.Time
+	}
+	var backups []dated
+	for _, id := range ids {
+		if t, ok := backupTime(id); ok {
+			backups = append(backups, dated{id, t})
+		}
+	}
+	if len(backups) == 0 {
+		return expired
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].t.After(backups[j].t) })
+
+	keep := map[string]bool{backups[0].id: true}
+	if policy.Days > 0 {
+		cutoff := now.AddDate(0, 0, -policy.Days)
+		for _, b := range backups {
+			if b.t.After(cutoff) {
+				keep[b.id] = true
+			}
+		}
+	}
+	// Walking newest first, the first backup seen in each period is the one kept
+	keepPerPeriod := func(count int, period func(time.Time) string) {
+		seen := map[string]bool{}
+		for _, b := range backups {
+			if len(seen) >= count {
+				return
+			}
+			if p := period(b.t); !seen[p] {
+				seen[p] = true
+				keep[b.id] = true
+			}
+		}
+	}
+	keepPerPeriod(policy.Daily, func(t time.Time) string { return t.Format("2006-01-02") })
+	keepPerPeriod(policy.Weekly, func(t time.Time) string {
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	})
+	keepPerPeriod(policy.Monthly, func(t time.Time) string { return t.Format("2006-01") })
+
+	for _, b := range backups {
+		if !keep[b.id] {
+			expired[b.id] = true
+		}
+	}
+	return expired
+}
+
+// RetentionPolicyFor returns the retention configured for a deployment.
+func RetentionPolicyFor(dep *config.Deployment) RetentionPolicy {
+	if dep == nil {
+		return RetentionPolicy{}
+	}
+	return RetentionPolicy{
+		Days:    dep.BackupRetention,
+		Daily:   dep.BackupKeepDaily,
+		Weekly:  dep.BackupKeepWeekly,
+		Monthly: dep.BackupKeepMonthly,
+	}
+}
+
+// PruneBackups applies opts.Policy to the local backups directory and, when
+// one is configured, the off-host target. Each location is pruned on its own
+// so a backup that only survives remotely is judged against its peers there.
+func (d *DockerProvider) PruneBackups(ctx context.Context, opts PruneOptions) (*PruneResult, error) {
+	now := time.Now().UTC()
+	result := &PruneResult{}
+
+	files, err := listBackupFiles(d.backupDir())
+	if err != nil {
+		return nil, err
+	}
+	remoteGone := map[string]bool{}
+	ids := make([]string, 0, len(files))
+	for _, bf := range files {
+		ids = append(ids, bf.ID)
+	}
+	expired := selectExpired(ids, opts.Policy, now)
+	for _, bf := range files {
+		if !expired[bf.ID] {
+			result.Kept++
+			continue
+		}
+		if !opts.DryRun {
+			if err := os.Remove(bf.Path); err != nil {
+				return result, fmt.Errorf("removing backup %s: %w", bf.ID, err)
+			}
+		}
+		result.Pruned = append(result.Pruned, PrunedBackup{ID: bf.ID, Location: bf.Path})
+	}
+
+	target, err := d.backupTarget()
+	if err == nil && target != nil {
+		localPruned := len(result.Pruned)
+		err = pruneTarget(ctx, target, opts, now, result)
+		for _, b := range result.Pruned[localPruned:] {
+			remoteGone[b.ID] = true
+		}
+	}
+	if opts.DryRun {
+		return result, err
+	}
+	if catErr := d.updateCatalog(func(c *backupCatalog) error {
+		for id := range remoteGone {
+			if entry := c.find(id); entry != nil {
+				entry.Remote = ""
+			}
+		}
+		return c.reconcile()
+	}); catErr != nil && err == nil {
+		err = fmt.Errorf("updating backup catalog: %w", catErr)
+	}
+	return result, err
+}
+
+// pruneTarget applies the policy to the backups stored on target.
+func pruneTarget(ctx context.Context, target backuptarget.Target, opts PruneOptions, now time.Time, result *PruneResult) error {
+	objects, err := target.List(ctx)
+	if err != nil {
+		return err
+	}
+	var names []string
+	idOf := map[string]string{}
+	for _, obj := range objects {
+		if bf, ok := parseBackupFileName(obj.Name); ok {
+			names = append(names, obj.Name)
+			idOf[obj.Name] = bf.ID
+		}
+	}
+	ids := make([]string, 0, len(names))
+	for _, name := range names {
+		ids = append(ids, idOf[name])
+	}
+	expired := selectExpired(ids, opts.Policy, now)
+	for _, name := range names {
+		if !expired[idOf[name]] {
+			result.Kept++
+			continue
+		}
+		if !opts.DryRun {
+			if err := target.Delete(ctx, name); err != nil {
+				return fmt.Errorf("removing backup %s from %s: %w", idOf[name], target, err)
+			}
+		}
+		result.Pruned = append(result.Pruned, PrunedBackup{ID: idOf[name], Location: target.String() + name})
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package providers
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/jhandel/KMP/installer/internal/config"
+)
+
+func expiredIDs(ids []string, policy RetentionPolicy, now time.Time) []string {
+	var out []string
+	for id := range selectExpired(ids, policy, now) {
+		out = append(out, id)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func TestSelectExpiredByAge(t *testing.T) {
+	now := time.Date(2024, 3, 31, 12, 0, 0, 0, time.UTC)
+	ids := []string{"20240101-030000", "20240325-030000", "20240330-030000", "not-a-timestamp"}
+
+	got := expiredIDs(ids, RetentionPolicy{Days: 7}, now)
+	if len(got) != 1 || got[0] != "20240101-030000" {
+		t.Fatalf("expected only the January backup to expire, got %v", got)
+	}
+	if got := expiredIDs(ids, RetentionPolicy{}, now); len(got) != 0 {
+		t.Fatalf("expected an empty policy to keep everything, got %v", got)
+	}
+	// The newest backup survives even when every backup is past the cutoff
+	if got := expiredIDs([]string{"20230101-000000"}, RetentionPolicy{Days: 1}, now); len(got) != 0 {
+		t.Fatalf("expected the newest backup to be kept, got %v", got)
+	}
+}
+
+func TestSelectExpiredGrandfatherFatherSon(t *testing.T) {
+	now := time.Date(2024, 3, 31, 12, 0, 0, 0, time.UTC)
+	// Two backups a day for the last 70 days
+	var ids []string
+	for d := 0; d < 70; d++ {
+		day := now.AddDate(0, 0, -d)
+		ids = append(ids, day.Format("20060102")+"-030000", day.Format("20060102")+"-150000")
+	}
+
+	expired := selectExpired(ids, RetentionPolicy{Daily: 3, Weekly: 2, Monthly: 3}, now)
+	var kept []string
+	for _, id := range ids {
+		if !expired[id] {
+			kept = append(kept, id)
+		}
+	}
+	sort.Strings(kept)
+	want := []string{
+		"20240131-150000", // month: January
+		"20240229-150000", // month: February
+		"20240324-150000", // week: ISO 2024-W12
+		"20240329-150000", // day
+		"20240330-150000", // day
+		"20240331-150000", // day, week W13 and month March
+	}
+	if len(kept) != len(want) {
+		t.Fatalf("kept %v, want %v", kept, want)
+	}
+	for i := range want {
+		if kept[i] != want[i] {
+			t.Fatalf("kept %v, want %v", kept, want)
+		}
+	}
+}
+
+func TestDockerPruneBackupsDryRunKeepsFiles(t *testing.T) {
+	dir := t.TempDir()
+	backupDir := filepath.Join(dir, "backups")
+	if err := os.MkdirAll(backupDir, 0o750); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	old := time.Now().UTC().AddDate(0, 0, -40).Format("20060102-150405")
+	recent := time.Now().UTC().AddDate(0, 0, -1).Format("20060102-150405")
+	for _, name := range []string{old + ".sql.gz", recent + ".sql.gz", "notes.txt"} {
+		if err := os.WriteFile(filepath.Join(backupDir, name), []byte("x"), 0o640); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+
+	d := NewDockerProvider(&config.Deployment{ComposeDir: dir, BackupRetention: 30})
+	opts := PruneOptions{Policy: RetentionPolicyFor(d.cfg), DryRun: true}
+	result, err := d.PruneBackups(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("PruneBackups: %v", err)
+	}
+	if len(result.Pruned) != 1 || result.Pruned[0].ID != old || result.Kept != 1 {
+		t.Fatalf("unexpected dry-run result %+v", result)
+	}
+	if !fileExists(filepath.Join(backupDir, old+".sql.gz")) {
+		t.Fatalf("dry run deleted a backup")
+	}
+
+	opts.DryRun = false
+	if _, err := d.PruneBackups(context.Background(), opts); err != nil {
+		t.Fatalf("PruneBackups: %v", err)
+	}
+	if fileExists(filepath.Join(backupDir, old+".sql.gz")) || !fileExists(filepath.Join(backupDir, recent+".sql.gz")) {
+		t.Fatalf("expected only the expired backup to be removed")
+	}
+}
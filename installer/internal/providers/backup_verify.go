@@ -0,0 +1,348 @@
+package providers
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jhandel/KMP/installer/internal/dockerapi"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// verifyReadyTimeout bounds how long the scratch server may take to start.
+	verifyReadyTimeout = 3 * time.Minute
+	// verifyPollInterval is the delay between readiness probes.
+	verifyPollInterval = 2 * time.Second
+)
+
+// verifyCoreTables must exist in every restored KMP database.
+var verifyCoreTables = []string{"members", "branches", "roles", "permissions"}
+
+// VerifyOptions tunes a backup verification.
+type VerifyOptions struct {
+	Progress ProgressFunc // optional
+	Identity string       // private key or passphrase for encrypted backups
+}
+
+// BackupVerification is the outcome of restoring a backup into a scratch
+// database. It is stored on the backup's catalog entry.
+type BackupVerification struct {
+	VerifiedAt time.Time        `json:"verified_at"`
+	Passed     bool             `json:"passed"`
+	ChecksumOK bool             `json:"checksum_ok"`
+	Image      string           `json:"image,omitempty"`
+	Tables     int              `json:"tables,omitempty"`
+	RowCounts  map[string]int64 `json:"row_counts,omitempty"`
+	Error      string           `json:"error,omitempty"`
+}
+
+// VerifyBackup checks a backup against its catalog checksum, restores it into
+// a throwaway database container running the deployment's database image and
+// runs sanity queries against the result. The outcome is recorded in the
+// catalog whether or not verification passes.
+func (d *DockerProvider) VerifyBackup(ctx context.Context, id string, opts VerifyOptions) (*BackupVerification, error) {
+	entry, err := d.ShowBackup(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	archivePath := entry.Location
+	if archivePath == "" {
+		bf, err := d.fetchBackup(ctx, d.backupDir(), entry.ID, opts.Progress)
+		if err != nil {
+			return nil, err
+		}
+		archivePath = bf.Path
+	}
+
+	v := &BackupVerification{VerifiedAt: time.Now().UTC()}
+	verifyErr := d.verifyBackupFile(ctx, entry, archivePath, opts, v)
+	if ctx.Err() != nil {
+		// An interrupted run says nothing about the backup
+		return nil, ctx.Err()
+	}
+	v.Passed = verifyErr == nil
+	if verifyErr != nil {
+		v.Error = verifyErr.Error()
+	}
+
+	if err := d.updateCatalog(func(c *backupCatalog) error {
+		if err := c.reconcile(); err != nil {
+			return err
+		}
+		if e := c.find(entry.ID); e != nil {
+			e.Verification = v
+		}
+		return nil
+	}); err != nil && verifyErr == nil {
+		verifyErr = fmt.Errorf("updating backup catalog: %w", err)
+	}
+	return v, verifyErr
+}
+
+// verifyBackupFile does the work of VerifyBackup, filling in v as it goes.
+func (d *DockerProvider) verifyBackupFile(ctx context.Context, entry *CatalogEntry, archivePath string, opts VerifyOptions, v *BackupVerification) error {
+	_, sum, err := hashFile(archivePath)
+	if err != nil {
+		return err
+	}
+	if entry.SHA256 != "" && sum != entry.SHA256 {
+		return fmt.Errorf("checksum mismatch: catalog has %s, file is %s", entry.SHA256, sum)
+	}
+	v.ChecksumOK = true
+
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	r, err := openBackupReader(&progressReader{r: f, fn: opts.Progress, total: info.Size()}, d.backupIdentities(RestoreOptions{Identity: opts.Identity}))
+	if err != nil {
+		return err
+	}
+
+	dialectName := entry.Dialect
+	if entry.Full {
+		if r, dialectName, err = fullBackupDatabase(r); err != nil {
+			return err
+		}
+	}
+	dialect, err := dialectByName(dialectName)
+	if err != nil {
+		return err
+	}
+
+	// The scratch server gets fresh credentials but keeps the deployment's
+	// database and user names, which the dump refers to
+	env := readEnvFile(filepath.Join(d.dir, ".env"))
+	external, err := d.externalDB()
+	if err != nil {
+		return err
+	}
+	if external != nil {
+		env["MYSQL_DB_NAME"], env["POSTGRES_DB"], env["POSTGRES_USER"] = external.Database, external.Database, external.User
+	}
+	password := generateRandomString(24)
+	env["MYSQL_ROOT_PASSWORD"], env["POSTGRES_PASSWORD"] = password, password
+	if env["MYSQL_DB_NAME"] == "" {
+		env["MYSQL_DB_NAME"] = "kmp"
+	}
+	if env["POSTGRES_DB"] == "" {
+		env["POSTGRES_DB"] = "kmp"
+	}
+	if env["POSTGRES_USER"] == "" {
+		env["POSTGRES_USER"] = "kmpuser"
+	}
+
+	v.Image = d.dbImage(dialect)
+	if external != nil {
+		// No db service to copy; match the client that wrote the dump
+		v.Image = external.clientImage()
+	}
+
+	container := "kmp-verify-" + entry.ID
+	labels := map[string]string{"kmp.verify": entry.ID}
+	if err := d.startScratchContainer(ctx, container, v.Image, labels, dialect.ServerEnv(env)); err != nil {
+		return fmt.Errorf("starting scratch %s container: %w", dialect.Name(), err)
+	}
+	defer func() {
+		// Tear down even when ctx was cancelled
+		rmCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		_ = d.removeScratchContainer(rmCtx, container)
+	}()
+
+	if err := waitForScratchDB(ctx, container, dialect, env); err != nil {
+		return err
+	}
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("decompressing backup: %w", err)
+	}
+	defer gz.Close()
+	vars, restoreCmd := dialect.RestoreCommand(env)
+	if err := streamScratchExec(ctx, container, vars, restoreCmd, gz, io.Discard); err != nil {
+		return fmt.Errorf("restoring into scratch database: %w", err)
+	}
+
+	tables, err := scratchCount(ctx, container, dialect, env, dialect.TableCountQuery(env))
+	if err != nil {
+		return fmt.Errorf("counting tables: %w", err)
+	}
+	v.Tables = int(tables)
+	if tables == 0 {
+		return fmt.Errorf("restored database has no tables")
+	}
+	v.RowCounts = map[string]int64{}
+	for _, table := range verifyCoreTables {
+		n, err := scratchCount(ctx, container, dialect, env, dialect.RowCountQuery(env, table))
+		if err != nil {
+			return fmt.Errorf("core table %s: %w", table, err)
+		}
+		v.RowCounts[table] = n
+	}
+	return nil
+}
+
+// fullBackupDatabase advances a full backup archive stream to its database
+// dump and returns it together with the dialect named in the manifest.
+func fullBackupDatabase(r io.Reader) (io.Reader, string, error) {
+	tr := tar.NewReader(r)
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != fullManifestName {
+		return nil, "", fmt.Errorf("not a full backup archive")
+	}
+	var manifest FullBackupManifest
+	if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+		return nil, "", fmt.Errorf("invalid backup manifest: %w", err)
+	}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, "", fmt.Errorf("full backup has no database dump")
+		}
+		if err != nil {
+			return nil, "", fmt.Errorf("reading archive: %w", err)
+		}
+		if strings.HasPrefix(hdr.Name, "database") {
+			return tr, manifest.Dialect, nil
+		}
+	}
+}
+
+// dbImage returns the image of the deployment's db service, falling back to
+// the image the installer would have rendered for dialect.
+func (d *DockerProvider) dbImage(dialect dbDialect) string {
+	data, err := os.ReadFile(filepath.Join(d.dir, "docker-compose.yml"))
+	if err == nil {
+		var compose struct {
+			Services map[string]struct {
+				Image string `yaml:"image"`
+			} `yaml:"services"`
+		}
+		if yaml.Unmarshal(data, &compose) == nil {
+			if image := compose.Services["db"].Image; image != "" {
+				return image
+			}
+		}
+	}
+	return dialect.DefaultImage()
+}
+
+// startScratchContainer starts image as a detached, self-removing container
+// called name, pulling the image first when the host does not have it. Where
+// the engine is not on a unix socket it runs `docker run` instead.
+func (d *DockerProvider) startScratchContainer(ctx context.Context, name, image string, labels map[string]string, env []string) error {
+	config := dockerapi.ContainerConfig{Image: image, Env: env, Labels: labels}
+	host := dockerapi.HostConfig{AutoRemove: true}
+	_, err := d.engine.CreateContainer(ctx, name, config, host)
+	if errors.Is(err, dockerapi.ErrNotFound) {
+		if err = d.engine.PullImage(ctx, image, nil); err == nil {
+			_, err = d.engine.CreateContainer(ctx, name, config, host)
+		}
+	}
+	if err == nil {
+		if err = d.engine.StartContainer(ctx, name); err != nil {
+			_ = d.removeScratchContainer(ctx, name)
+		}
+		return err
+	}
+	if !errors.Is(err, dockerapi.ErrUnavailable) {
+		return err
+	}
+
+	args := []string{"run", "-d", "--rm", "--name", name}
+	for k, v := range labels {
+		args = append(args, "--label", k+"="+v)
+	}
+	args = append(args, envFlags(env)...)
+	return streamDockerIn(ctx, "", env, nil, io.Discard, append(args, image)...)
+}
+
+// removeScratchContainer removes a scratch container and its volumes.
+func (d *DockerProvider) removeScratchContainer(ctx context.Context, name string) error {
+	err := d.engine.RemoveContainer(ctx, name, dockerapi.RemoveOptions{Force: true, Volumes: true})
+	if errors.Is(err, dockerapi.ErrUnavailable) {
+		return streamDocker(ctx, nil, io.Discard, "rm", "-f", "-v", name)
+	}
+	return err
+}
+
+// streamScratchExec runs cmd in the scratch container with vars set in its
+// environment, passed on by name like streamDBExec does.
+func streamScratchExec(ctx context.Context, container string, vars, cmd []string, stdin io.Reader, stdout io.Writer) error {
+	args := append([]string{"exec", "-i"}, envFlags(vars)...)
+	args = append(args, container)
+	return streamDockerIn(ctx, "", vars, stdin, stdout, append(args, cmd...)...)
+}
+
+// waitForScratchDB polls the scratch server over TCP until it accepts
+// queries. Both images only open TCP once their init scripts have finished.
+func waitForScratchDB(ctx context.Context, container string, dialect dbDialect, env map[string]string) error {
+	deadline := time.Now().Add(verifyReadyTimeout)
+	for {
+		_, err := scratchCount(ctx, container, dialect, env, "SELECT 1")
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("scratch %s server did not become ready: %w", dialect.Name(), err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(verifyPollInterval):
+		}
+	}
+}
+
+// scratchCount runs a query that returns a single number.
+func scratchCount(ctx context.Context, container string, dialect dbDialect, env map[string]string, query string) (int64, error) {
+	vars, cmd := dialect.QueryCommand(env, query)
+	var out bytes.Buffer
+	if err := streamScratchExec(ctx, container, vars, cmd, nil, &out); err != nil {
+		return 0, err
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(out.String()), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected query result %q", strings.TrimSpace(out.String()))
+	}
+	return n, nil
+}
+
+// fillVerifyStatus reports the most recent backup verification.
+func (d *DockerProvider) fillVerifyStatus(st *Status) {
+	c, err := loadCatalog(d.backupDir())
+	if err != nil {
+		return
+	}
+	var latest *CatalogEntry
+	for i, e := range c.Backups {
+		if e.Verification != nil && (latest == nil || e.Verification.VerifiedAt.After(latest.Verification.VerifiedAt)) {
+			latest = &c.Backups[i]
+		}
+	}
+	if latest == nil {
+		return
+	}
+	result := "passed"
+	if !latest.Verification.Passed {
+		result = "FAILED"
+	}
+	st.LastVerify = fmt.Sprintf("%s %s (%s)", latest.ID, result, latest.Verification.VerifiedAt.Local().Format("2006-01-02 15:04"))
+}
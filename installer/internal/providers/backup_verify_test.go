@@ -0,0 +1,207 @@
+package providers
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jhandel/KMP/installer/internal/config"
+)
+
+// verifyMockDocker dumps a tiny database through `docker compose exec` and
+// plays a scratch server for `docker run/exec/rm`, logging those calls.
+const verifyMockDocker = `case "$1" in
+compose) printf 'CREATE TABLE members (id int);\n' ;;
+run|rm) echo "$@" >> "$LOG" ;;
+exec)
+	echo "$@" >> "$LOG"
+	case "$*" in
+	*information_schema*) echo 42 ;;
+	*members*) echo 7 ;;
+	*"SELECT 1"*) echo 1 ;;
+	*-e\ SELECT*) echo 3 ;;
+	*) cat > "$RESTORED" ;;
+	esac ;;
+esac
+`
+
+func TestVerifyBackupRestoresIntoScratchContainer(t *testing.T) {
+	installMockDocker(t, verifyMockDocker)
+	dir := t.TempDir()
+	t.Setenv("LOG", filepath.Join(dir, "docker.log"))
+	t.Setenv("RESTORED", filepath.Join(dir, "restored.sql"))
+
+	d := NewDockerProvider(&config.Deployment{ComposeDir: dir})
+	ctx := context.Background()
+	result, err := d.Backup(ctx, BackupOptions{})
+	if err != nil {
+		t.Fatalf("Backup: %v", err)
+	}
+
+	v, err := d.VerifyBackup(ctx, LatestBackupID, VerifyOptions{})
+	if err != nil {
+		t.Fatalf("VerifyBackup: %v", err)
+	}
+	if !v.Passed || !v.ChecksumOK || v.Tables != 42 || v.RowCounts["members"] != 7 || v.RowCounts["roles"] != 3 {
+		t.Fatalf("unexpected verification %+v", v)
+	}
+	if v.Image != "mariadb:11" {
+		t.Fatalf("expected default MariaDB image, got %q", v.Image)
+	}
+
+	restored, _ := os.ReadFile(filepath.Join(dir, "restored.sql"))
+	if !strings.Contains(string(restored), "CREATE TABLE members") {
+		t.Fatalf("dump was not streamed into the scratch container: %q", restored)
+	}
+	log, _ := os.ReadFile(filepath.Join(dir, "docker.log"))
+	container := "kmp-verify-" + result.ID
+	if !strings.Contains(string(log), "run -d --rm --name "+container) || !strings.Contains(string(log), "rm -f -v "+container) {
+		t.Fatalf("scratch container not started and removed:\n%s", log)
+	}
+
+	entry, err := d.ShowBackup(ctx, result.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Verification == nil || !entry.Verification.Passed {
+		t.Fatalf("verification not recorded in catalog: %+v", entry)
+	}
+	st := &Status{}
+	d.fillVerifyStatus(st)
+	if !strings.HasPrefix(st.LastVerify, result.ID+" passed") {
+		t.Fatalf("unexpected status line %q", st.LastVerify)
+	}
+}
+
+func TestVerifyBackupRunsScratchContainerThroughTheEngine(t *testing.T) {
+	installMockDocker(t, verifyMockDocker)
+	requests := fakeEngine(t)
+	dir := t.TempDir()
+	t.Setenv("LOG", filepath.Join(dir, "docker.log"))
+	t.Setenv("RESTORED", filepath.Join(dir, "restored.sql"))
+
+	d := NewDockerProvider(&config.Deployment{ComposeDir: dir})
+	ctx := context.Background()
+	result, err := d.Backup(ctx, BackupOptions{})
+	if err != nil {
+		t.Fatalf("Backup: %v", err)
+	}
+	if v, err := d.VerifyBackup(ctx, result.ID, VerifyOptions{}); err != nil || !v.Passed {
+		t.Fatalf("VerifyBackup = %+v, %v", v, err)
+	}
+
+	// The image is pulled only once creating the container finds it missing
+	container := "/containers/kmp-verify-" + result.ID
+	want := []string{
+		"POST /containers/create?name=kmp-verify-" + result.ID,
+		"POST /images/create?fromImage=mariadb&tag=11",
+		"POST /containers/create?name=kmp-verify-" + result.ID,
+		"POST " + container + "/start",
+		"DELETE " + container + "?force=1&v=1",
+	}
+	if got := requests(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("engine requests = %q, want %q", got, want)
+	}
+	log, _ := os.ReadFile(filepath.Join(dir, "docker.log"))
+	if strings.Contains(string(log), "run ") || strings.Contains(string(log), "rm ") {
+		t.Fatalf("expected only exec through the CLI:\n%s", log)
+	}
+}
+
+func TestBackupAndVerifyKeepTheDatabasePasswordOffTheCommandLine(t *testing.T) {
+	installMockDocker(t, `echo "$@" >> "$ARGS"
+echo "$1 $MYSQL_PWD $MARIADB_ROOT_PASSWORD" >> "$PASSWORDS"
+`+verifyMockDocker)
+	dir := t.TempDir()
+	t.Setenv("LOG", filepath.Join(dir, "docker.log"))
+	t.Setenv("RESTORED", filepath.Join(dir, "restored.sql"))
+	t.Setenv("ARGS", filepath.Join(dir, "args.log"))
+	t.Setenv("PASSWORDS", filepath.Join(dir, "passwords.log"))
+	if err := os.WriteFile(filepath.Join(dir, ".env"), []byte("MYSQL_ROOT_PASSWORD=s3cret\nMYSQL_DB_NAME=kmp\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDockerProvider(&config.Deployment{ComposeDir: dir})
+	ctx := context.Background()
+	result, err := d.Backup(ctx, BackupOptions{})
+	if err != nil {
+		t.Fatalf("Backup: %v", err)
+	}
+	if v, err := d.VerifyBackup(ctx, result.ID, VerifyOptions{}); err != nil || !v.Passed {
+		t.Fatalf("VerifyBackup = %+v, %v", v, err)
+	}
+
+	// The scratch server gets a password of its own
+	passwords, _ := os.ReadFile(filepath.Join(dir, "passwords.log"))
+	var scratch string
+	for _, line := range strings.Split(string(passwords), "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 && fields[0] == "run" {
+			scratch = fields[1]
+		}
+	}
+	for _, want := range []string{"compose s3cret", "exec " + scratch} {
+		if scratch == "" || !strings.Contains(string(passwords), want) {
+			t.Fatalf("expected %q among the values docker received:\n%s", want, passwords)
+		}
+	}
+
+	args, _ := os.ReadFile(filepath.Join(dir, "args.log"))
+	if strings.Contains(string(args), "s3cret") || strings.Contains(string(args), scratch) {
+		t.Fatalf("expected the passwords to stay out of the docker command line:\n%s", args)
+	}
+	for _, want := range []string{"compose exec -T -e MYSQL_PWD db", "-e MARIADB_ROOT_PASSWORD -e MYSQL_ROOT_PASSWORD", "exec -i -e MYSQL_PWD kmp-verify-"} {
+		if !strings.Contains(string(args), want) {
+			t.Fatalf("expected %q in the docker invocations:\n%s", want, args)
+		}
+	}
+}
+
+func TestVerifyBackupFailsOnChecksumMismatch(t *testing.T) {
+	installMockDocker(t, verifyMockDocker)
+	dir := t.TempDir()
+	t.Setenv("LOG", filepath.Join(dir, "docker.log"))
+	t.Setenv("RESTORED", filepath.Join(dir, "restored.sql"))
+
+	d := NewDockerProvider(&config.Deployment{ComposeDir: dir})
+	ctx := context.Background()
+	result, err := d.Backup(ctx, BackupOptions{})
+	if err != nil {
+		t.Fatalf("Backup: %v", err)
+	}
+	if err := os.WriteFile(result.Location, []byte("tampered"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := d.VerifyBackup(ctx, result.ID, VerifyOptions{})
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("expected checksum mismatch, got %v", err)
+	}
+	if v.Passed || v.ChecksumOK {
+		t.Fatalf("unexpected verification %+v", v)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "docker.log")); !os.IsNotExist(err) {
+		t.Fatalf("no container should start for a corrupt backup")
+	}
+	entry, _ := d.ShowBackup(ctx, result.ID)
+	if entry.Verification == nil || entry.Verification.Passed {
+		t.Fatalf("failed verification not recorded: %+v", entry.Verification)
+	}
+}
+
+func TestDialectQueriesQuoteNamesAndValues(t *testing.T) {
+	env := map[string]string{"MYSQL_DB_NAME": `k'mp\`}
+	mysql, postgres := mysqlDialect{}, postgresDialect{}
+	cases := []struct{ got, want string }{
+		{mysql.TableCountQuery(env), `SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = 'k''mp\\'`},
+		{mysql.RowCountQuery(env, "mem`bers"), "SELECT COUNT(*) FROM `k'mp\\`.`mem``bers`"},
+		{postgres.RowCountQuery(env, `mem"bers`), `SELECT count(*) FROM "mem""bers"`},
+	}
+	for _, tc := range cases {
+		if tc.got != tc.want {
+			t.Fatalf("got %s, want %s", tc.got, tc.want)
+		}
+	}
+}
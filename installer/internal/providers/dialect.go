@@ -0,0 +1,192 @@
+package providers
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/jhandel/KMP/installer/internal/config"
+)
+
+// dbDialect knows how to dump and restore one database engine using the
+// client tools shipped inside its container image.
+type dbDialect interface {
+	// Name is recorded with every backup, e.g. "mysql" or "postgres".
+	Name() string
+	// Extension is the backup file suffix, including the compression suffix.
+	Extension() string
+	// DumpCommand returns the env and command that write a dump to stdout.
+	DumpCommand(env map[string]string) (vars []string, cmd []string)
+	// RestoreCommand returns the env and command that read a dump from stdin.
+	RestoreCommand(env map[string]string) (vars []string, cmd []string)
+	// QueryCommand returns the env and command that run one SQL query over
+	// TCP and print each result value bare, one per line.
+	QueryCommand(env map[string]string, query string) (vars []string, cmd []string)
+	// TableCountQuery counts the tables in the application database.
+	TableCountQuery(env map[string]string) string
+	// RowCountQuery counts the rows of an application table.
+	RowCountQuery(env map[string]string, table string) string
+	// ServerEnv configures a scratch server container from env.
+	ServerEnv(env map[string]string) []string
+	// DefaultImage is the server image used when the deployment's is unknown.
+	DefaultImage() string
+}
+
+var dialects = []dbDialect{mysqlDialect{}, postgresDialect{}}
+
+// mysqlDialect covers MariaDB and MySQL.
+type mysqlDialect struct{}
+
+func (mysqlDialect) Name() string      { return "mysql" }
+func (mysqlDialect) Extension() string { return ".sql.gz" }
+
+func (mysqlDialect) DumpCommand(env map[string]string) ([]string, []string) {
+	// MariaDB 11+ ships mariadb-dump; older images only have mysqldump
+	script := "if command -v mariadb-dump >/dev/null 2>&1; then " +
+		"exec mariadb-dump -uroot --all-databases --single-transaction --routines --triggers; " +
+		"else exec mysqldump -uroot --all-databases --single-transaction --routines --triggers; fi"
+	return []string{"MYSQL_PWD=" + env["MYSQL_ROOT_PASSWORD"]}, []string{"sh", "-c", script}
+}
+
+func (mysqlDialect) RestoreCommand(env map[string]string) ([]string, []string) {
+	// The application database is the default so single-database dumps
+	// (external databases) land there; --all-databases dumps USE their own
+	script := "if command -v mariadb >/dev/null 2>&1; then exec mariadb -uroot \"$@\"; else exec mysql -uroot \"$@\"; fi"
+	cmd := []string{"sh", "-c", script, "sh"}
+	if db := env["MYSQL_DB_NAME"]; db != "" {
+		cmd = append(cmd, db)
+	}
+	return []string{"MYSQL_PWD=" + env["MYSQL_ROOT_PASSWORD"]}, cmd
+}
+
+func (mysqlDialect) QueryCommand(env map[string]string, query string) ([]string, []string) {
+	script := "if command -v mariadb >/dev/null 2>&1; then exec mariadb \"$@\"; else exec mysql \"$@\"; fi"
+	return []string{"MYSQL_PWD=" + env["MYSQL_ROOT_PASSWORD"]},
+		[]string{"sh", "-c", script, "sh", "-h127.0.0.1", "-uroot", "-N", "-B", "-e", query}
+}
+
+func (mysqlDialect) TableCountQuery(env map[string]string) string {
+	return "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = " + mysqlLiteral(env["MYSQL_DB_NAME"])
+}
+
+func (mysqlDialect) RowCountQuery(env map[string]string, table string) string {
+	return "SELECT COUNT(*) FROM " + mysqlIdent(env["MYSQL_DB_NAME"]) + "." + mysqlIdent(table)
+}
+
+// mysqlLiteral quotes s as a string literal. Backslashes are escapes in
+// MySQL strings unless NO_BACKSLASH_ESCAPES is set, so they are doubled too.
+func mysqlLiteral(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", "''").Replace(s) + "'"
+}
+
+// mysqlIdent quotes s as an identifier.
+func mysqlIdent(s string) string {
+	return "`" + strings.ReplaceAll(s, "`", "``") + "`"
+}
+
+func (mysqlDialect) ServerEnv(env map[string]string) []string {
+	// MariaDB images read MARIADB_*, MySQL images MYSQL_*
+	return []string{
+		"MARIADB_ROOT_PASSWORD=" + env["MYSQL_ROOT_PASSWORD"], "MYSQL_ROOT_PASSWORD=" + env["MYSQL_ROOT_PASSWORD"],
+		"MARIADB_DATABASE=" + env["MYSQL_DB_NAME"], "MYSQL_DATABASE=" + env["MYSQL_DB_NAME"],
+	}
+}
+
+func (mysqlDialect) DefaultImage() string { return "mariadb:11" }
+
+// postgresDialect uses pg_dump's custom format so pg_restore can rebuild the
+// schema with --clean. Compression is left to the gzip layer (-Z0).
+type postgresDialect struct{}
+
+func (postgresDialect) Name() string      { return "postgres" }
+func (postgresDialect) Extension() string { return ".pgdump.gz" }
+
+func (postgresDialect) DumpCommand(env map[string]string) ([]string, []string) {
+	return []string{"PGPASSWORD=" + env["POSTGRES_PASSWORD"]},
+		[]string{"pg_dump", "-U", env["POSTGRES_USER"], "-d", env["POSTGRES_DB"], "-Fc", "-Z0"}
+}
+
+func (postgresDialect) RestoreCommand(env map[string]string) ([]string, []string) {
+	return []string{"PGPASSWORD=" + env["POSTGRES_PASSWORD"]},
+		[]string{"pg_restore", "-U", env["POSTGRES_USER"], "-d", env["POSTGRES_DB"],
+			"--clean", "--if-exists", "--no-owner", "--exit-on-error"}
+}
+
+func (postgresDialect) QueryCommand(env map[string]string, query string) ([]string, []string) {
+	return []string{"PGPASSWORD=" + env["POSTGRES_PASSWORD"]},
+		[]string{"psql", "-h", "127.0.0.1", "-U", env["POSTGRES_USER"], "-d", env["POSTGRES_DB"], "-At", "-c", query}
+}
+
+func (postgresDialect) TableCountQuery(map[string]string) string {
+	return "SELECT count(*) FROM information_schema.tables WHERE table_schema = 'public'"
+}
+
+func (postgresDialect) RowCountQuery(_ map[string]string, table string) string {
+	return "SELECT count(*) FROM " + postgresIdent(table)
+}
+
+// postgresIdent quotes s as an identifier.
+func postgresIdent(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
+
+func (postgresDialect) ServerEnv(env map[string]string) []string {
+	return []string{"POSTGRES_USER=" + env["POSTGRES_USER"], "POSTGRES_PASSWORD=" + env["POSTGRES_PASSWORD"], "POSTGRES_DB=" + env["POSTGRES_DB"]}
+}
+
+func (postgresDialect) DefaultImage() string { return "postgres:16-alpine" }
+
+// dialectByName returns the dialect recorded under name.
+func dialectByName(name string) (dbDialect, error) {
+	for _, dl := range dialects {
+		if dl.Name() == name {
+			return dl, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown database dialect %q", name)
+}
+
+// dialectForDeployment picks the dialect from the deployment's database type,
+// falling back to the driver recorded in the rendered .env.
+func dialectForDeployment(cfg *config.Deployment, envPath string) dbDialect {
+	if cfg != nil {
+		if cfg.LocalDBType == "postgres" {
+			return postgresDialect{}
+		}
+		if isPostgresURL(cfg.DatabaseDSN) {
+			return postgresDialect{}
+		}
+	}
+	// The sidecar only knows the database from the rendered .env
+	env := readEnvFile(envPath)
+	if env["KMP_DB_DRIVER"] == "postgres" || isPostgresURL(env["DATABASE_URL"]) {
+		return postgresDialect{}
+	}
+	return mysqlDialect{}
+}
+
+func isPostgresURL(dsn string) bool {
+	dsn = strings.ToLower(strings.TrimSpace(dsn))
+	return strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://")
+}
+
+// readEnvFile parses a .env file into a map, ignoring comments and blanks.
+func readEnvFile(envPath string) map[string]string {
+	values := map[string]string{}
+	data, err := os.ReadFile(envPath)
+	if err != nil {
+		return values
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		values[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	return values
+}
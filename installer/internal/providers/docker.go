@@ -3,9 +3,11 @@ package providers
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"crypto/rand"
 	_ "embed"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -16,8 +18,13 @@ import (
 	"text/template"
 	"time"
 
+	"github.com/jhandel/KMP/installer/internal/backupcrypt"
+	"github.com/jhandel/KMP/installer/internal/backuptarget"
 	"github.com/jhandel/KMP/installer/internal/config"
+	"github.com/jhandel/KMP/installer/internal/dockerapi"
 	"github.com/jhandel/KMP/installer/internal/health"
+	"github.com/jhandel/KMP/installer/internal/notify"
+	"github.com/jhandel/KMP/installer/internal/updater"
 	"gopkg.in/yaml.v3"
 )
 
@@ -32,10 +39,30 @@ var envTemplate string
 
 // DockerProvider implements Provider for Docker Compose deployments.
 type DockerProvider struct {
-	cfg *config.Deployment
-	dir string // deployment directory (compose files live here)
+	cfg    *config.Deployment
+	dir    string            // deployment directory (compose files live here)
+	engine *dockerapi.Client // Docker Engine API, for queries compose cannot answer
+
+	// confirmRestore asks whether to restore the pre-update backup after a
+	// failed update under the "offer" policy; nil means nobody can answer.
+	confirmRestore func(backupID string) bool
+
+	// notifications delivers webhook events in the background; it is
+	// started by the first event.
+	notifications *notify.Queue
 }
 
+// notifyFlushTimeout bounds how long an update or rollback waits, once it
+// has finished, for its webhooks to be delivered.
+var notifyFlushTimeout = 10 * time.Second
+
+// rolledBackError is an update failure after which the previous tag was
+// started again.
+type rolledBackError struct{ err error }
+
+func (e *rolledBackError) Error() string { return e.err.Error() }
+func (e *rolledBackError) Unwrap() error { return e.err }
+
 // NewDockerProvider creates a provider for local Docker Compose deployments.
 func NewDockerProvider(cfg *config.Deployment) *DockerProvider {
 	dir := ""
@@ -46,10 +73,10 @@ func NewDockerProvider(cfg *config.Deployment) *DockerProvider {
 		if cfg == nil {
 			dir = generateRandomComposeDir()
 		} else {
-			dir = filepath.Join(config.DefaultConfigDir(), "deployments", "default")
+			dir = filepath.Join(config.DefaultConfigDir(), "deployments", deploymentName(cfg))
 		}
 	}
-	return &DockerProvider{cfg: cfg, dir: dir}
+	return &DockerProvider{cfg: cfg, dir: dir, engine: dockerapi.FromEnv()}
 }
 
 func (d *DockerProvider) Name() string {
@@ -66,7 +93,7 @@ func (d *DockerProvider) Prerequisites() []Prerequisite {
 		{
 			Name:        "Docker",
 			Description: "Docker Engine must be installed",
-			Met:         exec.Command("docker", "info").Run() == nil,
+			Met:         d.dockerRunning(),
 			InstallHint: "Install Docker: https://docs.docker.com/engine/install/",
 		},
 		{
@@ -140,6 +167,7 @@ func (d *DockerProvider) Install(cfg *DeployConfig) error {
 		SecuritySalt:          generateRandomString(32),
 		DBRootPassword:        generateRandomString(16),
 		DBPassword:            generateRandomString(16),
+		UpdaterToken:          newUpdaterToken(),
 		SMTPHost:              valueOrDefault(cfg.StorageConfig["smtp_host"], ""),
 		SMTPPort:              valueOrDefault(cfg.StorageConfig["smtp_port"], "587"),
 		SMTPUser:              valueOrDefault(cfg.StorageConfig["smtp_user"], ""),
@@ -196,7 +224,88 @@ func (d *DockerProvider) Install(cfg *DeployConfig) error {
 	return d.saveDeployment(cfg)
 }
 
+// SetRestorePrompt installs the question asked before restoring the
+// pre-update backup when an update fails under the "offer" policy.
+func (d *DockerProvider) SetRestorePrompt(fn func(backupID string) bool) {
+	d.confirmRestore = fn
+}
+
+// Update moves the deployment to version and records the attempt in the
+// updater's history alongside the updates the sidecar runs.
 func (d *DockerProvider) Update(version string) error {
+	entry := updater.HistoryEntry{
+		Operation:   "update",
+		StartedAt:   time.Now().UTC(),
+		PreviousTag: d.cfg.ImageTag,
+		TargetTag:   version,
+		RequestedBy: cliRequester(),
+	}
+	ev := notify.Event{Deployment: deploymentName(d.cfg), Operation: entry.Operation,
+		PreviousTag: entry.PreviousTag, TargetTag: version, RequestedBy: entry.RequestedBy}
+	d.notify(ev, notify.EventUpdateStarted)
+
+	err := d.update(context.Background(), version, &entry)
+	entry.FinishedAt = time.Now().UTC()
+	entry.Status, entry.Message = "completed", "Updated to "+version
+	var rolledBack *rolledBackError
+	switch {
+	case errors.As(err, &rolledBack):
+		entry.Status, entry.Message, entry.Error = "rolled_back", "", err.Error()
+	case err != nil:
+		entry.Status, entry.Message, entry.Error = "failed", "", err.Error()
+	}
+	// Best effort: a history write must not mask the update's own result
+	_ = updater.AppendHistory(d.stateDir(), entry)
+
+	ev.BackupID, ev.Message, ev.Error = entry.BackupID, entry.Message, entry.Error
+	switch entry.Status {
+	case "rolled_back":
+		d.notify(ev, notify.EventUpdateRolledBack)
+	case "failed":
+		d.notify(ev, notify.EventUpdateFailed)
+	default:
+		d.notify(ev, notify.EventUpdateCompleted)
+	}
+	d.flushNotifications()
+	return err
+}
+
+// notify queues ev for the deployment's webhooks as eventType. Like the
+// history, notifications are best effort, and a slow webhook does not hold
+// up the update.
+func (d *DockerProvider) notify(ev notify.Event, eventType string) {
+	if len(d.cfg.Webhooks) == 0 {
+		return
+	}
+	if d.notifications == nil {
+		d.notifications = notify.NewQueue(notify.NewSender(), func() []config.Webhook { return d.cfg.Webhooks })
+		go d.notifications.Run(context.Background())
+	}
+	ev.Type = eventType
+	d.notifications.Post(ev)
+}
+
+// flushNotifications gives queued webhook events up to notifyFlushTimeout to
+// be delivered before the command exits; the queue logs the ones that fail.
+func (d *DockerProvider) flushNotifications() {
+	if d.notifications == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), notifyFlushTimeout)
+	defer cancel()
+	_ = d.notifications.Wait(ctx)
+}
+
+func (d *DockerProvider) update(ctx context.Context, version string, entry *updater.HistoryEntry) error {
+
+	// Snapshot the database first so a migration that half-applies can be
+	// undone. A failed off-host copy still leaves a usable local file.
+	snapshot, err := d.Backup(ctx, BackupOptions{Reason: fmt.Sprintf("pre-update %s -> %s", d.cfg.ImageTag, version)})
+	if err != nil && snapshot == nil {
+		return fmt.Errorf("pre-update backup failed, not updating: %w", err)
+	}
+	entry.BackupID = snapshot.ID
+
 	// Update .env image tag
 	envPath := filepath.Join(d.dir, ".env")
 	if err := replaceEnvValue(envPath, d.cfg.ImageTag, version); err != nil {
@@ -217,6 +326,20 @@ func (d *DockerProvider) Update(version string) error {
 		return fmt.Errorf("docker compose pull: %s\n%w", out, err)
 	}
 
+	// Migrate in a one-off container of the new image while the previous
+	// tag keeps serving. A failure leaves the running app alone unless the
+	// restore policy asks for the half-migrated schema to be undone.
+	out, err := runDockerCompose(d.dir, updater.MigrateArgs("app", updater.DefaultMigrateCommand)...)
+	entry.MigrationOutput = updater.TrimMigrationOutput(out)
+	if err != nil {
+		if d.shouldRestoreAfterFailedUpdate(snapshot.ID) {
+			return d.rollBack(ctx, version, previousTag, snapshot.ID, true, fmt.Errorf("migrations failed: %w", err))
+		}
+		_ = replaceEnvValue(envPath, version, previousTag)
+		d.cfg.ImageTag = previousTag
+		return fmt.Errorf("migrations failed, still on %s (pre-update backup %s): %w", previousTag, snapshot.ID, err)
+	}
+
 	if out, err := runDockerCompose(d.dir, "up", "-d"); err != nil {
 		// Attempt rollback on failure
 		_ = replaceEnvValue(envPath, version, previousTag)
@@ -231,7 +354,7 @@ func (d *DockerProvider) Update(version string) error {
 			if rollbackErr != nil {
 				return fmt.Errorf("docker compose restart caddy: %s\n%w; rollback failed: %s\n%w", out, err, rollbackOut, rollbackErr)
 			}
-			return fmt.Errorf("docker compose restart caddy: %s\n%w; rolled back to %s", out, err, previousTag)
+			return &rolledBackError{fmt.Errorf("docker compose restart caddy: %s\n%w; rolled back to %s", out, err, previousTag)}
 		}
 	}
 
@@ -240,19 +363,64 @@ func (d *DockerProvider) Update(version string) error {
 		domain = "localhost"
 	}
 	if err := d.waitForHealthy(domain, 120*time.Second); err != nil {
-		return fmt.Errorf("health check after update: %w", err)
+		return d.rollbackFailedUpdate(ctx, version, previousTag, snapshot.ID, fmt.Errorf("health check after update: %w", err))
+	}
+
+	// Update saved config and remember the replaced tag for kmp rollback. A
+	// stack that cannot be read starts over rather than failing the update.
+	stack, _ := d.versionStack()
+	stack = updater.PushVersion(stack, config.DeployedVersion{
+		Tag:        previousTag,
+		Digest:     d.imageDigest(previousTag),
+		ReplacedAt: time.Now().UTC(),
+	})
+	return d.saveVersionStack(stack, func(dep *config.Deployment) {
+		dep.ImageTag = version
+	})
+}
+
+// rollbackFailedUpdate stops the unhealthy app, restores the pre-update
+// backup when the restore policy says so, and starts the previous tag. The
+// database is restored first so the old code never sees the new schema.
+func (d *DockerProvider) rollbackFailedUpdate(ctx context.Context, version, previousTag, backupID string, cause error) error {
+	return d.rollBack(ctx, version, previousTag, backupID, d.shouldRestoreAfterFailedUpdate(backupID), cause)
+}
+
+// rollBack stops the app, restores backupID when restore is set and starts
+// previousTag again.
+func (d *DockerProvider) rollBack(ctx context.Context, version, previousTag, backupID string, restore bool, cause error) error {
+	if out, err := runDockerCompose(d.dir, "stop", "app"); err != nil {
+		return fmt.Errorf("%w; stopping app for rollback: %s\n%v", cause, out, err)
 	}
 
-	// Update saved config
-	appCfg, err := config.Load()
-	if err != nil {
-		return err
+	if restore {
+		if err := d.Restore(ctx, backupID, RestoreOptions{}); err != nil {
+			// Starting the old code on a half-restored database helps nobody
+			return fmt.Errorf("%w; restoring pre-update backup %s failed, app left stopped: %v", cause, backupID, err)
+		}
 	}
-	if dep, ok := appCfg.Deployments["default"]; ok {
-		dep.ImageTag = version
-		return appCfg.Save()
+
+	_ = replaceEnvValue(filepath.Join(d.dir, ".env"), version, previousTag)
+	d.cfg.ImageTag = previousTag
+	if out, err := runDockerCompose(d.dir, "up", "-d"); err != nil {
+		return fmt.Errorf("%w; rollback to %s failed: %s\n%v", cause, previousTag, out, err)
+	}
+	if restore {
+		return &rolledBackError{fmt.Errorf("%w; restored the database from %s and rolled back to %s", cause, backupID, previousTag)}
+	}
+	return &rolledBackError{fmt.Errorf("%w; rolled back to %s without restoring the database (run `kmp restore %s` if the update changed the schema)", cause, previousTag, backupID)}
+}
+
+// shouldRestoreAfterFailedUpdate applies the deployment's restore policy.
+func (d *DockerProvider) shouldRestoreAfterFailedUpdate(backupID string) bool {
+	switch d.cfg.UpdateRestorePolicy {
+	case config.RestorePolicyAuto:
+		return true
+	case config.RestorePolicyNever:
+		return false
+	default:
+		return d.confirmRestore != nil && d.confirmRestore(backupID)
 	}
-	return nil
 }
 
 func (d *DockerProvider) Status() (*Status, error) {
@@ -291,19 +459,73 @@ func (d *DockerProvider) Status() (*Status, error) {
 	}
 
 	// Check if kmp-updater sidecar is running
-	if out, err := runDockerCompose(d.dir, "ps", "--status", "running", "--format", "{{.Name}}"); err == nil {
-		st.UpdaterRunning = strings.Contains(out, "kmp-updater")
+	st.UpdaterRunning = d.updaterRunning()
+	if st.UpdaterRunning {
+		d.fillBackupStatus(st)
 	}
+	d.fillVerifyStatus(st)
+
+	st.Uptime = d.appUptime()
+
+	return st, nil
+}
 
-	// Try to get uptime from docker compose ps
-	if out, err := runDockerCompose(d.dir, "ps", "--format", "{{.Status}}"); err == nil {
-		lines := strings.TrimSpace(out)
-		if lines != "" {
-			st.Uptime = strings.Split(lines, "\n")[0]
+// dockerRunning reports whether the daemon answers, asking the docker CLI
+// where it is not on a unix socket.
+func (d *DockerProvider) dockerRunning() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := d.engine.Ping(ctx)
+	if errors.Is(err, dockerapi.ErrUnavailable) {
+		return exec.Command("docker", "info").Run() == nil
+	}
+	return err == nil
+}
+
+// appUptime returns the docker status of the running app container, such as
+// "Up 2 hours", or "" when it is not running. Where the daemon is not on a
+// unix socket it asks docker compose instead.
+func (d *DockerProvider) appUptime() string {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	containers, err := d.engine.ListContainers(ctx, dockerapi.ListOptions{Labels: map[string]string{
+		dockerapi.LabelComposeProject: d.composeProjectName(),
+		dockerapi.LabelComposeService: "app",
+	}})
+	if err == nil {
+		if len(containers) == 0 {
+			return ""
 		}
+		return containers[0].Status
+	}
+	if !errors.Is(err, dockerapi.ErrUnavailable) {
+		return ""
 	}
+	out, err := runDockerCompose(d.dir, "ps", "--format", "{{.Status}}", "app")
+	if err != nil {
+		return ""
+	}
+	return strings.Split(strings.TrimSpace(out), "\n")[0]
+}
 
-	return st, nil
+// updaterRunning reports whether the stack's updater sidecar is running,
+// found by its compose labels. Where the daemon is not on a unix socket, as
+// with Docker Desktop on Windows, it asks docker compose instead.
+func (d *DockerProvider) updaterRunning() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	containers, err := d.engine.ListContainers(ctx, dockerapi.ListOptions{Labels: map[string]string{
+		dockerapi.LabelComposeProject: d.composeProjectName(),
+		dockerapi.LabelComposeService: "kmp-updater",
+	}})
+	if err == nil {
+		return len(containers) > 0
+	}
+	if !errors.Is(err, dockerapi.ErrUnavailable) {
+		return false
+	}
+	out, err := runDockerCompose(d.dir, "ps", "--status", "running", "--format", "{{.Name}}")
+	return err == nil && strings.Contains(out, "kmp-updater")
 }
 
 func (d *DockerProvider) Logs(follow bool) (io.ReadCloser, error) {
@@ -328,133 +550,551 @@ func (d *DockerProvider) Logs(follow bool) (io.ReadCloser, error) {
 	return stdout, nil
 }
 
-func (d *DockerProvider) Backup() (*BackupResult, error) {
-	backupDir := filepath.Join(d.dir, "backups")
+func (d *DockerProvider) Backup(ctx context.Context, opts BackupOptions) (*BackupResult, error) {
+	backupDir := d.backupDir()
 	if err := os.MkdirAll(backupDir, 0750); err != nil {
 		return nil, fmt.Errorf("creating backup directory: %w", err)
 	}
 
+	envPath := filepath.Join(d.dir, ".env")
+	dialect := dialectForDeployment(d.cfg, envPath)
+
 	ts := time.Now().UTC().Format("20060102-150405")
-	filename := fmt.Sprintf("%s.sql.gz", ts)
-	backupPath := filepath.Join(backupDir, filename)
+	if opts.Full {
+		result, err := d.backupFull(ctx, backupDir, ts, dialect, opts)
+		if err != nil {
+			return nil, err
+		}
+		return result, d.finishBackup(ctx, result, opts.Reason)
+	}
+	key := d.backupKey()
+	backupPath := filepath.Join(backupDir, backupFileName(ts, dialect, false, key != ""))
+
+	// Stream the dump straight through gzip (and encryption, if configured)
+	// into the backup file
+	size, sum, err := writeBackupFile(backupPath, func(w io.Writer) error {
+		return sealBackup(w, key, func(w io.Writer) error {
+			return d.dumpDatabase(ctx, dialect, w, opts.Progress)
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
 
-	// Read root password from .env
-	rootPass := readEnvValue(filepath.Join(d.dir, ".env"), "MYSQL_ROOT_PASSWORD")
-	dumpCmd := fmt.Sprintf(
-		"mariadb-dump -uroot -p%s --all-databases --single-transaction 2>/dev/null || "+
-			"mysqldump -uroot -p%s --all-databases --single-transaction",
-		rootPass, rootPass,
-	)
+	result := &BackupResult{
+		ID:        ts,
+		Timestamp: ts,
+		Size:      size,
+		SHA256:    sum,
+		Location:  backupPath,
+		Dialect:   dialect.Name(),
+		Encrypted: key != "",
+	}
+	return result, d.finishBackup(ctx, result, opts.Reason)
+}
 
-	// Dump database (MariaDB 11+ uses mariadb-dump; fall back to mysqldump for older images)
-	dumpOut, err := runDockerCompose(d.dir, "exec", "-T", "db", "sh", "-c", dumpCmd)
-	if err != nil {
-		return nil, fmt.Errorf("database dump failed: %w", err)
+// finishBackup copies a new backup off-host and records it in the catalog.
+// The catalog entry is written even when the upload fails, since the local
+// file is still good.
+func (d *DockerProvider) finishBackup(ctx context.Context, result *BackupResult, reason string) error {
+	uploadErr := d.uploadBackup(ctx, result)
+	if err := d.recordBackup(result, reason); err != nil {
+		return fmt.Errorf("updating backup catalog: %w", err)
+	}
+	return uploadErr
+}
+
+// currentImageTag is the app image tag the deployment is running.
+func (d *DockerProvider) currentImageTag() string {
+	if tag := readEnvValue(filepath.Join(d.dir, ".env"), "KMP_IMAGE_TAG"); tag != "" {
+		return tag
 	}
+	if d.cfg != nil {
+		return d.cfg.ImageTag
+	}
+	return ""
+}
 
-	// Compress and write
-	f, err := os.Create(backupPath)
+// backupTarget returns the configured off-host target, or nil when backups
+// are kept on this host only.
+func (d *DockerProvider) backupTarget() (backuptarget.Target, error) {
+	if d.cfg == nil {
+		return nil, nil
+	}
+	return backuptarget.New(d.cfg.BackupStorageType, d.cfg.BackupStorageConfig, "kmp-backups/"+deploymentName(d.cfg)+"/")
+}
+
+// uploadBackup copies a finished backup to the off-host target, if any. The
+// local file is kept either way, so a failed upload still returns result.
+func (d *DockerProvider) uploadBackup(ctx context.Context, result *BackupResult) error {
+	target, err := d.backupTarget()
+	if err != nil || target == nil {
+		return err
+	}
+
+	f, err := os.Open(result.Location)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer f.Close()
 
-	gz := gzip.NewWriter(f)
-	if _, err := gz.Write([]byte(dumpOut)); err != nil {
-		return nil, err
-	}
-	if err := gz.Close(); err != nil {
-		return nil, err
+	name := filepath.Base(result.Location)
+	if err := target.Upload(ctx, name, f, result.Size); err != nil {
+		return fmt.Errorf("backup saved to %s but copying it to %s failed: %w", result.Location, target, err)
 	}
+	result.Remote = target.String() + name
+	return nil
+}
 
-	info, _ := f.Stat()
-	size := int64(0)
-	if info != nil {
-		size = info.Size()
+// fetchBackup downloads a backup that is not on local disk from the
+// off-host target into backupDir.
+func (d *DockerProvider) fetchBackup(ctx context.Context, backupDir, id string, progress ProgressFunc) (backupFile, error) {
+	target, err := d.backupTarget()
+	if err != nil {
+		return backupFile{}, err
+	}
+	if target == nil {
+		return backupFile{}, fmt.Errorf("backup not found: %s", id)
 	}
 
-	return &BackupResult{
-		ID:        ts,
-		Timestamp: ts,
-		Size:      size,
-		Location:  backupPath,
-	}, nil
+	objects, err := target.List(ctx)
+	if err != nil {
+		return backupFile{}, err
+	}
+	for _, obj := range objects {
+		bf, ok := parseBackupFileName(obj.Name)
+		if !ok || bf.ID != id || filepath.Base(obj.Name) != obj.Name {
+			continue
+		}
+		if err := os.MkdirAll(backupDir, 0750); err != nil {
+			return backupFile{}, fmt.Errorf("creating backup directory: %w", err)
+		}
+		bf.Path = filepath.Join(backupDir, obj.Name)
+		if _, err := writeFileAtomic(bf.Path, 0640, func(w io.Writer) error {
+			return target.Download(ctx, obj.Name, &progressWriter{w: w, fn: progress, total: obj.Size})
+		}); err != nil {
+			return backupFile{}, fmt.Errorf("fetching backup %s from %s: %w", id, target, err)
+		}
+		return bf, nil
+	}
+	return backupFile{}, fmt.Errorf("backup not found locally or on %s: %s", target, id)
 }
 
-func (d *DockerProvider) Restore(backupID string) error {
-	backupPath := filepath.Join(d.dir, "backups", backupID+".sql.gz")
-	if _, err := os.Stat(backupPath); err != nil {
-		return fmt.Errorf("backup not found: %s", backupID)
+func (d *DockerProvider) Restore(ctx context.Context, backupID string, opts RestoreOptions) error {
+	backupID, err := d.resolveBackupID(ctx, backupID)
+	if err != nil {
+		return err
+	}
+	backupDir := d.backupDir()
+	bf, err := findBackupFile(backupDir, backupID)
+	if err != nil {
+		if bf, err = d.fetchBackup(ctx, backupDir, backupID, opts.Progress); err != nil {
+			return err
+		}
+	}
+	if bf.Full {
+		manifest, err := d.restoreFull(ctx, bf.Path, opts)
+		if err != nil || manifest.ImageTag == "" {
+			return err
+		}
+		err = config.UpdateDeployment(deploymentName(d.cfg), func(dep *config.Deployment) {
+			dep.ImageTag = manifest.ImageTag
+		})
+		if errors.Is(err, config.ErrDeploymentNotFound) {
+			// The sidecar restores without a CLI config to record the tag in
+			return nil
+		}
+		return err
+	}
+
+	dialect := dialectForDeployment(d.cfg, filepath.Join(d.dir, ".env"))
+	if bf.Dialect != dialect.Name() {
+		return fmt.Errorf("backup %s is a %s dump but this deployment uses %s; refusing to restore", backupID, bf.Dialect, dialect.Name())
 	}
 
-	// Read and decompress
-	f, err := os.Open(backupPath)
+	f, err := os.Open(bf.Path)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 
-	gz, err := gzip.NewReader(f)
+	info, err := f.Stat()
 	if err != nil {
-		return fmt.Errorf("decompressing backup: %w", err)
+		return err
 	}
-	defer gz.Close()
 
-	sqlData, err := io.ReadAll(gz)
+	// Stream file → decrypt → gunzip → database client without holding the
+	// dump in memory
+	r, err := openBackupReader(&progressReader{r: f, fn: opts.Progress, total: info.Size()}, d.backupIdentities(opts))
 	if err != nil {
-		return fmt.Errorf("reading backup: %w", err)
+		return err
 	}
+	return d.restoreDatabase(ctx, dialect, r)
+}
 
-	// Pipe SQL into mysql
-	cmd := exec.Command("docker", "compose", "exec", "-T", "db", "mysql")
-	cmd.Dir = d.dir
-	cmd.Stdin = bytes.NewReader(sqlData)
+// backupKey returns the configured encryption key; empty means plaintext.
+func (d *DockerProvider) backupKey() string {
+	if d.cfg == nil {
+		return ""
+	}
+	return d.cfg.BackupEncryptionKey
+}
 
-	var out bytes.Buffer
-	cmd.Stdout = &out
-	cmd.Stderr = &out
+// backupIdentities lists the keys tried when decrypting a backup: the one
+// given for this restore, then the configured key if it is a passphrase.
+func (d *DockerProvider) backupIdentities(opts RestoreOptions) []string {
+	return []string{opts.Identity, d.backupKey()}
+}
 
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("restore failed: %s\n%w", out.String(), err)
+// RekeyBackups re-encrypts every local backup to newKey and records it as the
+// deployment's backup key. Plaintext backups are encrypted along the way, and
+// off-host copies are replaced by the re-encrypted files; copies that cannot
+// be replaced are marked stale in the catalog and reported with
+// ErrRemoteCopiesStale. The backups an interrupted rekey finished are listed
+// in the backup directory, so re-running it with the same key skips them:
+// a kmp-pub- key could not open them again.
+func (d *DockerProvider) RekeyBackups(ctx context.Context, newKey, identity string) (int, error) {
+	if strings.TrimSpace(newKey) == "" {
+		return 0, fmt.Errorf("a new encryption key is required")
+	}
+	if _, err := backupcrypt.ParseRecipient(newKey); err != nil {
+		return 0, fmt.Errorf("new encryption key: %w", err)
+	}
+
+	var catalog []CatalogEntry
+	if err := d.updateCatalog(func(c *backupCatalog) error {
+		if err := c.reconcile(); err != nil {
+			return err
+		}
+		catalog = append(catalog, c.Backups...)
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	files, err := listBackupFiles(d.backupDir())
+	if err != nil {
+		return 0, err
+	}
+	target, err := d.backupTarget()
+	if err != nil {
+		return 0, err
+	}
+	progress, err := loadRekeyProgress(d.backupDir(), newKey)
+	if err != nil {
+		return 0, err
+	}
+	identities := []string{identity, d.backupKey()}
+	if !strings.HasPrefix(strings.TrimSpace(newKey), backupcrypt.RecipientPrefix) {
+		// A new passphrase also opens a file rekeyed just before an
+		// interruption could record it
+		identities = append(identities, newKey)
+	}
+
+	rekeyed := 0
+	local := map[string]bool{}
+	var stale []string
+	for _, bf := range files {
+		local[bf.ID] = true
+		if progress.Done[bf.ID] {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return rekeyed, err
+		}
+		dst, size, sum, err := rekeyBackupFile(bf, newKey, identities)
+		if err != nil {
+			return rekeyed, fmt.Errorf("re-encrypting backup %s: %w", bf.ID, err)
+		}
+		// The off-host copy is replaced outside the catalog lock; only the
+		// result is recorded under it
+		var entry *CatalogEntry
+		for i := range catalog {
+			if catalog[i].ID == bf.ID {
+				entry = &catalog[i]
+			}
+		}
+		if entry != nil {
+			entry.File, entry.Location = filepath.Base(dst), dst
+			entry.Size, entry.SHA256, entry.Encrypted = size, sum, true
+			if entry.Remote != "" {
+				entry.RemoteStale = replaceRemoteCopy(ctx, target, entry) != nil
+			}
+			if err := d.updateCatalog(func(c *backupCatalog) error {
+				if e := c.find(bf.ID); e != nil {
+					e.File, e.Location, e.Size, e.SHA256, e.Encrypted = entry.File, entry.Location, entry.Size, entry.SHA256, entry.Encrypted
+					e.Remote, e.RemoteStale = entry.Remote, entry.RemoteStale
+				}
+				return nil
+			}); err != nil {
+				return rekeyed, fmt.Errorf("updating backup catalog: %w", err)
+			}
+		}
+		rekeyed++
+		if err := progress.add(bf.ID); err != nil {
+			return rekeyed, err
+		}
 	}
 
-	return nil
+	if err := config.UpdateDeployment(deploymentName(d.cfg), func(dep *config.Deployment) {
+		dep.BackupEncryptionKey = newKey
+	}); err != nil {
+		return rekeyed, err
+	}
+	if d.cfg != nil {
+		d.cfg.BackupEncryptionKey = newKey
+	}
+	progress.clear()
+	if err := SyncSidecarEnv(deploymentName(d.cfg)); err != nil {
+		return rekeyed, err
+	}
+
+	// Backups kept only off-host were not re-encrypted at all
+	if err := d.updateCatalog(func(c *backupCatalog) error {
+		for i := range c.Backups {
+			e := &c.Backups[i]
+			if e.Remote != "" && !local[e.ID] {
+				e.RemoteStale = true
+			}
+			if e.RemoteStale {
+				stale = append(stale, e.ID)
+			}
+		}
+		return nil
+	}); err != nil {
+		return rekeyed, fmt.Errorf("updating backup catalog: %w", err)
+	}
+	if len(stale) > 0 {
+		return rekeyed, fmt.Errorf("backups %s: %w", strings.Join(stale, ", "), ErrRemoteCopiesStale)
+	}
+	return rekeyed, nil
 }
 
-func (d *DockerProvider) Rollback() error {
-	appCfg, err := config.Load()
+// rekeyBackupFile decrypts one backup and writes it back sealed to newKey,
+// replacing the original only once the new file is complete. It returns the
+// new file's path, size and checksum.
+func rekeyBackupFile(bf backupFile, newKey string, identities []string) (string, int64, string, error) {
+	f, err := os.Open(bf.Path)
+	if err != nil {
+		return "", 0, "", err
+	}
+	defer f.Close()
+
+	r, err := openBackupReader(f, identities)
+	if err != nil {
+		return "", 0, "", err
+	}
+	dst := bf.Path
+	if !bf.Encrypted {
+		dst += backupcrypt.Extension
+	}
+	size, sum, err := writeBackupFile(dst, func(w io.Writer) error {
+		return sealBackup(w, newKey, func(w io.Writer) error {
+			_, err := io.Copy(w, r)
+			return err
+		})
+	})
+	if err != nil {
+		return "", 0, "", err
+	}
+	if dst != bf.Path {
+		if err := os.Remove(bf.Path); err != nil {
+			return "", 0, "", err
+		}
+	}
+	return dst, size, sum, nil
+}
+
+// dumpDatabase streams a gzip-compressed dump of the db service into w.
+// External databases are dumped by a client container instead.
+func (d *DockerProvider) dumpDatabase(ctx context.Context, dialect dbDialect, w io.Writer, progress ProgressFunc) error {
+	external, err := d.externalDB()
 	if err != nil {
 		return err
 	}
+	gz := gzip.NewWriter(w)
+	dump := &progressWriter{w: gz, fn: progress, total: -1}
+	if external != nil {
+		err = d.runExternalClient(ctx, external, nil, dump, external.dumpCommand())
+	} else {
+		vars, dumpCmd := dialect.DumpCommand(readEnvFile(filepath.Join(d.dir, ".env")))
+		err = d.streamDBExec(ctx, vars, dumpCmd, nil, dump)
+	}
+	if err != nil {
+		return fmt.Errorf("%s dump failed: %w", dialect.Name(), err)
+	}
+	return gz.Close()
+}
 
-	dep, ok := appCfg.Deployments["default"]
-	if !ok {
-		return fmt.Errorf("no deployment found to rollback")
+// restoreDatabase streams a gzip-compressed dump from r into the db service.
+func (d *DockerProvider) restoreDatabase(ctx context.Context, dialect dbDialect, r io.Reader) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("decompressing backup: %w", err)
 	}
+	defer gz.Close()
 
-	// The current tag is the one we want to revert from;
-	// we need the previous tag stored in config.
-	previousTag := dep.ImageTag
-	if previousTag == "" || previousTag == d.cfg.ImageTag {
-		return fmt.Errorf("no previous version available for rollback")
+	external, err := d.externalDB()
+	if err != nil {
+		return err
+	}
+	if external != nil {
+		err = d.runExternalClient(ctx, external, gz, io.Discard, external.restoreCommand())
+	} else {
+		vars, restoreCmd := dialect.RestoreCommand(readEnvFile(filepath.Join(d.dir, ".env")))
+		err = d.streamDBExec(ctx, vars, restoreCmd, gz, io.Discard)
+	}
+	if err != nil {
+		return fmt.Errorf("restore failed: %w", err)
+	}
+	return nil
+}
+
+// Rollback moves the deployment back to a tag an earlier update replaced:
+// the one the last update replaced, or opts.To. Like an update it is
+// recorded in the updater's history.
+func (d *DockerProvider) Rollback(opts RollbackOptions) error {
+	stack, err := d.versionStack()
+	if err != nil {
+		return err
+	}
+	target, rest, err := updater.PopVersion(stack, opts.To)
+	if err != nil {
+		return err
 	}
 
 	envPath := filepath.Join(d.dir, ".env")
-	if err := replaceEnvValue(envPath, d.cfg.ImageTag, previousTag); err != nil {
-		return fmt.Errorf("updating .env for rollback: %w", err)
+	current := readEnvValue(envPath, "KMP_IMAGE_TAG")
+	if current == "" {
+		current = d.cfg.ImageTag
+	}
+	entry := updater.HistoryEntry{
+		Operation:   "rollback",
+		StartedAt:   time.Now().UTC(),
+		PreviousTag: current,
+		TargetTag:   target.Tag,
+		RequestedBy: cliRequester(),
+	}
+	ev := notify.Event{Deployment: deploymentName(d.cfg), Operation: entry.Operation,
+		PreviousTag: current, TargetTag: target.Tag, RequestedBy: entry.RequestedBy}
+	d.notify(ev, notify.EventUpdateStarted)
+
+	err = d.rollback(envPath, current, target)
+	if err == nil {
+		d.cfg.ImageTag = target.Tag
+		err = d.saveVersionStack(rest, func(dep *config.Deployment) {
+			dep.ImageTag = target.Tag
+		})
+	}
+	entry.FinishedAt = time.Now().UTC()
+	entry.Status, entry.Message = "completed", "Rolled back to "+target.Tag
+	if err != nil {
+		entry.Status, entry.Message, entry.Error = "failed", "", err.Error()
 	}
+	_ = updater.AppendHistory(d.stateDir(), entry)
 
-	if out, err := runDockerCompose(d.dir, "pull"); err != nil {
-		return fmt.Errorf("docker compose pull: %s\n%w", out, err)
+	ev.Message, ev.Error = entry.Message, entry.Error
+	if err != nil {
+		d.notify(ev, notify.EventUpdateFailed)
+	} else {
+		d.notify(ev, notify.EventUpdateCompleted)
 	}
+	d.flushNotifications()
+	return err
+}
 
+// rollback points .env at target and recreates the stack on it. A recorded
+// digest is pulled and tagged locally, so a tag pushed again since the update
+// cannot bring back a different image. If the stack fails to come up it is
+// recreated on the current tag again.
+func (d *DockerProvider) rollback(envPath, current string, target config.DeployedVersion) error {
+	if target.Digest != "" {
+		if err := d.pinImage(context.Background(), target); err != nil {
+			return err
+		}
+	}
+	if err := setEnvValue(envPath, "KMP_IMAGE_TAG", target.Tag); err != nil {
+		return fmt.Errorf("updating .env for rollback: %w", err)
+	}
+	if target.Digest == "" {
+		if out, err := runDockerCompose(d.dir, "pull"); err != nil {
+			_ = setEnvValue(envPath, "KMP_IMAGE_TAG", current)
+			return fmt.Errorf("docker compose pull: %s\n%w", out, err)
+		}
+	}
 	if out, err := runDockerCompose(d.dir, "up", "-d"); err != nil {
-		return fmt.Errorf("docker compose up: %s\n%w", out, err)
+		err = fmt.Errorf("docker compose up: %s\n%w", out, err)
+		if envErr := setEnvValue(envPath, "KMP_IMAGE_TAG", current); envErr != nil {
+			return fmt.Errorf("%w; restoring %s in .env: %v", err, current, envErr)
+		}
+		if out, upErr := runDockerCompose(d.dir, "up", "-d"); upErr != nil {
+			return fmt.Errorf("%w; restarting %s: %s\n%v", err, current, out, upErr)
+		}
+		return fmt.Errorf("%w; still on %s", err, current)
 	}
+	return nil
+}
 
-	d.cfg.ImageTag = previousTag
-	dep.ImageTag = previousTag
-	return appCfg.Save()
+// pinImage pulls the image v.Digest names and tags it v.Tag locally, through
+// the docker CLI where the daemon is not on a unix socket.
+func (d *DockerProvider) pinImage(ctx context.Context, v config.DeployedVersion) error {
+	repo := valueOrDefault(d.cfg.Image, "ghcr.io/jhandel/kmp")
+	pinned := repo + "@" + v.Digest
+	err := d.engine.PullImage(ctx, pinned, nil)
+	if errors.Is(err, dockerapi.ErrUnavailable) {
+		err = streamDocker(ctx, nil, io.Discard, "pull", pinned)
+	}
+	if err != nil {
+		return fmt.Errorf("pulling %s: %w", pinned, err)
+	}
+	err = d.engine.TagImage(ctx, pinned, repo, v.Tag)
+	if errors.Is(err, dockerapi.ErrUnavailable) {
+		err = streamDocker(ctx, nil, io.Discard, "tag", pinned, repo+":"+v.Tag)
+	}
+	if err != nil {
+		return fmt.Errorf("tagging %s as %s: %w", pinned, v.Tag, err)
+	}
+	return nil
+}
+
+// stateDir is the updater sidecar's state directory, shared with the CLI.
+func (d *DockerProvider) stateDir() string {
+	return filepath.Join(d.dir, updater.DefaultStateDir)
+}
+
+// versionStack returns the tags earlier updates replaced, newest last. The
+// copy in the updater's state dir also follows the sidecar's updates, so it
+// wins over the one saved with the deployment.
+func (d *DockerProvider) versionStack() ([]config.DeployedVersion, error) {
+	if _, err := os.Stat(filepath.Join(d.stateDir(), updater.VersionsFile)); err == nil {
+		return updater.ReadVersions(d.stateDir())
+	}
+	return d.cfg.VersionHistory, nil
+}
+
+// saveVersionStack stores stack with the deployment, applying fn to it as
+// well, and in the updater's state dir.
+func (d *DockerProvider) saveVersionStack(stack []config.DeployedVersion, fn func(*config.Deployment)) error {
+	d.cfg.VersionHistory = stack
+	if err := config.UpdateDeployment(deploymentName(d.cfg), func(dep *config.Deployment) {
+		dep.VersionHistory = stack
+		fn(dep)
+	}); err != nil {
+		return err
+	}
+	return updater.WriteVersions(d.stateDir(), stack)
+}
+
+// imageDigest returns the registry digest of the local image for tag, or ""
+// when the engine cannot tell.
+func (d *DockerProvider) imageDigest(tag string) string {
+	repo := valueOrDefault(d.cfg.Image, "ghcr.io/jhandel/kmp")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	img, err := d.engine.InspectImage(ctx, repo+":"+tag)
+	if err != nil {
+		return ""
+	}
+	return img.RepoDigest(repo)
 }
 
 func (d *DockerProvider) Destroy() error {
@@ -480,6 +1120,7 @@ type templateData struct {
 	SecuritySalt       string
 	DBRootPassword     string
 	DBPassword         string
+	UpdaterToken       string // bearer token for the kmp-updater API
 	// Email
 	EmailDriver                       string // "smtp", "azure", "sendgrid", "resend"
 	SMTPHost                          string
@@ -535,6 +1176,58 @@ func runDockerCompose(dir string, args ...string) (string, error) {
 	return out.String(), err
 }
 
+// streamDBExec runs cmd inside the db service with vars set in its
+// environment. The values reach docker through its own environment and are
+// passed on by name, so the database password is not on the command line.
+func (d *DockerProvider) streamDBExec(ctx context.Context, vars, cmd []string, stdin io.Reader, stdout io.Writer) error {
+	args := append([]string{"compose", "exec", "-T"}, envFlags(vars)...)
+	args = append(args, "db")
+	return streamDockerIn(ctx, d.dir, vars, stdin, stdout, append(args, cmd...)...)
+}
+
+// envFlags returns a "-e NAME" pair for every NAME=value in vars.
+func envFlags(vars []string) []string {
+	var args []string
+	for _, v := range vars {
+		name, _, _ := strings.Cut(v, "=")
+		args = append(args, "-e", name)
+	}
+	return args
+}
+
+// streamDockerCompose runs docker compose with stdin/stdout wired to the given
+// streams so large payloads never sit in memory. Stderr is captured for the
+// error message. Cancelling ctx kills the docker client process.
+func streamDockerCompose(ctx context.Context, dir string, stdin io.Reader, stdout io.Writer, args ...string) error {
+	return streamDockerIn(ctx, dir, nil, stdin, stdout, append([]string{"compose"}, args...)...)
+}
+
+// streamDocker is streamDockerCompose for plain docker commands.
+func streamDocker(ctx context.Context, stdin io.Reader, stdout io.Writer, args ...string) error {
+	return streamDockerIn(ctx, "", nil, stdin, stdout, args...)
+}
+
+// streamDockerIn runs docker in dir with env added to its environment, so
+// values passed on with "-e NAME" stay out of the command line.
+func streamDockerIn(ctx context.Context, dir string, env []string, stdin io.Reader, stdout io.Writer, args ...string) error {
+	cmd := exec.CommandContext(ctx, "docker", args...)
+	cmd.Dir = dir
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		return fmt.Errorf("%s\n%w", strings.TrimSpace(stderr.String()), err)
+	}
+	return nil
+}
+
 func renderToFile(tmplStr string, data templateData, path string, perm os.FileMode) error {
 	t, err := template.New("").Parse(tmplStr)
 	if err != nil {
@@ -745,6 +1438,30 @@ func readEnvValue(envPath, key string) string {
 	return ""
 }
 
+// setEnvValue sets key in a .env file, appending it when missing.
+func setEnvValue(envPath, key, value string) error {
+	data, err := os.ReadFile(envPath)
+	if err != nil {
+		return err
+	}
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	found := false
+	for i, line := range lines {
+		if strings.HasPrefix(line, key+"=") {
+			lines[i] = key + "=" + value
+			found = true
+		}
+	}
+	if !found {
+		lines = append(lines, key+"="+value)
+	}
+	_, err = writeFileAtomic(envPath, 0600, func(w io.Writer) error {
+		_, err := io.WriteString(w, strings.Join(lines, "\n")+"\n")
+		return err
+	})
+	return err
+}
+
 func (d *DockerProvider) waitForHealthy(domain string, timeout time.Duration) error {
 	scheme := "https"
 	if domain == "localhost" {
@@ -771,27 +1488,37 @@ func (d *DockerProvider) saveDeployment(cfg *DeployConfig) error {
 
 	name := cfg.Name
 	if name == "" {
-		name = "default"
+		name = config.DefaultDeploymentName
+	}
+	if appCfg.Current == "" {
+		appCfg.Current = name
 	}
 
 	appCfg.Deployments[name] = &config.Deployment{
-		Provider:        "docker",
-		Channel:         cfg.Channel,
-		Domain:          cfg.Domain,
-		Image:           cfg.Image,
-		ImageTag:        cfg.ImageTag,
-		ComposeDir:      d.dir,
-		DatabaseDSN:     cfg.DatabaseDSN,
-		MySQLSSL:        cfg.MySQLSSL,
-		LocalDBType:     cfg.LocalDBType,
-		StorageType:     cfg.StorageType,
-		StorageConfig:   cfg.StorageConfig,
-		CacheEngine:     cfg.CacheEngine,
-		RedisURL:        cfg.RedisURL,
-		BackupEnabled:   cfg.BackupConfig.Enabled,
-		BackupSchedule:  cfg.BackupConfig.Schedule,
-		BackupRetention: cfg.BackupConfig.RetentionDays,
-	}
-
-	return appCfg.Save()
+		Provider:            "docker",
+		Channel:             cfg.Channel,
+		Domain:              cfg.Domain,
+		Image:               cfg.Image,
+		ImageTag:            cfg.ImageTag,
+		ComposeDir:          d.dir,
+		DatabaseDSN:         cfg.DatabaseDSN,
+		MySQLSSL:            cfg.MySQLSSL,
+		LocalDBType:         cfg.LocalDBType,
+		StorageType:         cfg.StorageType,
+		StorageConfig:       cfg.StorageConfig,
+		CacheEngine:         cfg.CacheEngine,
+		RedisURL:            cfg.RedisURL,
+		BackupEnabled:       cfg.BackupConfig.Enabled,
+		BackupSchedule:      cfg.BackupConfig.Schedule,
+		BackupRetention:     cfg.BackupConfig.RetentionDays,
+		BackupEncryptionKey: cfg.BackupConfig.EncryptionKey,
+		BackupStorageType:   cfg.BackupConfig.StorageType,
+		BackupStorageConfig: cfg.BackupConfig.StorageConfig,
+	}
+	appCfg.Deployments[name].Name = name
+
+	if err := appCfg.Save(); err != nil {
+		return err
+	}
+	return WriteSidecarEnv(d.dir, appCfg.Deployments[name])
 }
@@ -0,0 +1,903 @@
+package providers
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jhandel/KMP/installer/internal/backupcrypt"
+	"github.com/jhandel/KMP/installer/internal/config"
+	"github.com/jhandel/KMP/installer/internal/updater"
+)
+
+// installMockDocker puts a fake docker executable running script first on PATH.
+func installMockDocker(t *testing.T, script string) {
+	t.Helper()
+	binDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(binDir, "docker"), []byte("#!/bin/sh\n"+script), 0o755); err != nil {
+		t.Fatalf("write mock docker script: %v", err)
+	}
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	// Keep a real daemon out of it: with no engine socket the provider uses
+	// the mock CLI
+	t.Setenv("DOCKER_HOST", "unix://"+filepath.Join(binDir, "missing.sock"))
+}
+
+// fakeEngine serves the Engine API calls the provider makes on a unix socket
+// it points DOCKER_HOST at, and returns the requests it received. Images
+// are missing until pulled.
+func fakeEngine(t *testing.T) func() []string {
+	t.Helper()
+	socket := filepath.Join(t.TempDir(), "docker.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		mu       sync.Mutex
+		requests []string
+		pulled   = map[string]bool{}
+	)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		path := strings.TrimPrefix(r.URL.Path, "/v1.41")
+		requests = append(requests, strings.TrimSuffix(r.Method+" "+path+"?"+r.URL.RawQuery, "?"))
+		switch {
+		case path == "/images/create":
+			pulled[r.URL.Query().Get("fromImage")+":"+r.URL.Query().Get("tag")] = true
+			fmt.Fprint(w, `{"status":"Pull complete"}`)
+		case path == "/containers/create":
+			var body struct{ Image string }
+			_ = json.NewDecoder(r.Body).Decode(&body)
+			if !pulled[body.Image] {
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprintf(w, `{"message":"No such image: %s"}`, body.Image)
+				return
+			}
+			fmt.Fprint(w, `{"Id":"abc123"}`)
+		case strings.HasSuffix(path, "/tag"):
+			w.WriteHeader(http.StatusCreated)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	server.Listener = ln
+	server.Start()
+	t.Cleanup(server.Close)
+	t.Setenv("DOCKER_HOST", "unix://"+socket)
+	return func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), requests...)
+	}
+}
+
+func TestDockerBackupStreamsDumpToGzipFile(t *testing.T) {
+	installMockDocker(t, "printf 'CREATE TABLE members (id int);\\n'\n")
+
+	dir := t.TempDir()
+	d := NewDockerProvider(&config.Deployment{ComposeDir: dir})
+
+	var reported int64
+	result, err := d.Backup(context.Background(), BackupOptions{
+		Progress: func(done, total int64) { reported = done },
+	})
+	if err != nil {
+		t.Fatalf("Backup returned error: %v", err)
+	}
+	if reported == 0 {
+		t.Fatalf("expected progress to be reported")
+	}
+
+	f, err := os.Open(result.Location)
+	if err != nil {
+		t.Fatalf("open backup: %v", err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("gzip reader: %v", err)
+	}
+	data, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatalf("read backup: %v", err)
+	}
+	if !strings.Contains(string(data), "CREATE TABLE members") {
+		t.Fatalf("unexpected backup contents %q", string(data))
+	}
+}
+
+func TestDockerBackupCancelLeavesNoPartialFile(t *testing.T) {
+	installMockDocker(t, "printf 'partial'\nexec sleep 5\n")
+
+	dir := t.TempDir()
+	d := NewDockerProvider(&config.Deployment{ComposeDir: dir})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	if _, err := d.Backup(ctx, BackupOptions{}); err == nil {
+		t.Fatalf("expected cancelled backup to fail")
+	}
+
+	entries, err := os.ReadDir(filepath.Join(dir, "backups"))
+	if err != nil {
+		t.Fatalf("read backups dir: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("expected no files after abort, found %d (%s)", len(entries), entries[0].Name())
+	}
+}
+
+func TestDockerBackupUsesPgDumpForPostgres(t *testing.T) {
+	installMockDocker(t, "echo \"$@\"\n")
+
+	dir := t.TempDir()
+	d := NewDockerProvider(&config.Deployment{ComposeDir: dir, LocalDBType: "postgres"})
+
+	result, err := d.Backup(context.Background(), BackupOptions{})
+	if err != nil {
+		t.Fatalf("Backup returned error: %v", err)
+	}
+	if result.Dialect != "postgres" || !strings.HasSuffix(result.Location, ".pgdump.gz") {
+		t.Fatalf("expected postgres dump, got dialect %q at %s", result.Dialect, result.Location)
+	}
+
+	f, err := os.Open(result.Location)
+	if err != nil {
+		t.Fatalf("open backup: %v", err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("gzip reader: %v", err)
+	}
+	args, _ := io.ReadAll(gz)
+	if !strings.Contains(string(args), "pg_dump") {
+		t.Fatalf("expected pg_dump invocation, got %q", string(args))
+	}
+}
+
+func TestDockerRestoreRefusesDialectMismatch(t *testing.T) {
+	installMockDocker(t, "exit 0\n")
+
+	dir := t.TempDir()
+	backupDir := filepath.Join(dir, "backups")
+	if err := os.MkdirAll(backupDir, 0o750); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(backupDir, "20240101-000000.sql.gz"), []byte{}, 0o640); err != nil {
+		t.Fatalf("write backup: %v", err)
+	}
+
+	d := NewDockerProvider(&config.Deployment{ComposeDir: dir, LocalDBType: "postgres"})
+	err := d.Restore(context.Background(), "20240101-000000", RestoreOptions{})
+	if err == nil || !strings.Contains(err.Error(), "refusing to restore") {
+		t.Fatalf("expected dialect mismatch error, got %v", err)
+	}
+}
+
+func TestDockerFullBackupRoundTripsThroughManifest(t *testing.T) {
+	installMockDocker(t, "echo \"$@\"\n")
+
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		".env":               "KMP_IMAGE_TAG=v1.4.0\nCOMPOSE_PROJECT_NAME=kmp-test\n",
+		"docker-compose.yml": "services: {}\n",
+		"Caddyfile":          "localhost {}\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+
+	d := NewDockerProvider(&config.Deployment{ComposeDir: dir})
+	result, err := d.Backup(context.Background(), BackupOptions{Full: true})
+	if err != nil {
+		t.Fatalf("full Backup returned error: %v", err)
+	}
+	if !result.Full || !strings.HasSuffix(result.Location, fullBackupExtension) {
+		t.Fatalf("expected full archive, got %+v", result)
+	}
+
+	manifest, err := extractFullBackup(result.Location, t.TempDir(), nil, nil)
+	if err != nil {
+		t.Fatalf("extractFullBackup: %v", err)
+	}
+	if manifest.ImageTag != "v1.4.0" || manifest.Dialect != "mysql" {
+		t.Fatalf("unexpected manifest %+v", manifest)
+	}
+	kinds := map[string]int{}
+	for _, f := range manifest.Files {
+		kinds[f.Kind]++
+		if f.SHA256 == "" {
+			t.Fatalf("missing checksum for %s", f.Name)
+		}
+	}
+	if kinds["database"] != 1 || kinds["volume"] != len(fullBackupVolumes) || kinds["config"] != 3 {
+		t.Fatalf("unexpected manifest file kinds %v", kinds)
+	}
+}
+
+func TestImportFullBackupRegistersTheDeploymentOnlyOnceRestored(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	installMockDocker(t, `echo "$@" >> "$LOG"
+case "$*" in
+"compose up -d") if [ -n "$FAIL_UP" ]; then exit 1; fi ;;
+*dump*) printf 'CREATE TABLE members (id int);\n' ;;
+*"tar czf"*) printf 'volume' ;;
+*"exec -T"*|run*) cat > /dev/null ;;
+esac
+`)
+	src := t.TempDir()
+	t.Setenv("LOG", filepath.Join(src, "docker.log"))
+	for name, content := range map[string]string{
+		".env":               "KMP_IMAGE_TAG=v1.4.0\nCOMPOSE_PROJECT_NAME=kmp-old\n",
+		"docker-compose.yml": "services: {}\n",
+		"Caddyfile":          "localhost {}\n",
+	} {
+		if err := os.WriteFile(filepath.Join(src, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	result, err := NewDockerProvider(&config.Deployment{Name: "old", ComposeDir: src}).Backup(context.Background(), BackupOptions{Full: true})
+	if err != nil {
+		t.Fatalf("full Backup: %v", err)
+	}
+
+	t.Setenv("FAIL_UP", "1")
+	if _, err := ImportFullBackup(context.Background(), result.Location, "rebuilt", RestoreOptions{}); err == nil {
+		t.Fatal("expected the failed restore to be reported")
+	}
+	if appCfg, _ := config.Load(); len(appCfg.Deployments) != 0 || appCfg.Current != "" {
+		t.Fatalf("expected a failed import to leave no deployment behind, got %+v", appCfg)
+	}
+
+	t.Setenv("FAIL_UP", "")
+	dep, err := ImportFullBackup(context.Background(), result.Location, "rebuilt", RestoreOptions{})
+	if err != nil {
+		t.Fatalf("ImportFullBackup: %v", err)
+	}
+	appCfg, _ := config.Load()
+	saved := appCfg.Deployments["rebuilt"]
+	if saved == nil || appCfg.Current != "rebuilt" || saved.ImageTag != "v1.4.0" || saved.ComposeDir != dep.ComposeDir {
+		t.Fatalf("expected the rebuilt deployment to be registered, got %+v", appCfg)
+	}
+	if env := readEnvValue(filepath.Join(dep.ComposeDir, ".env"), "COMPOSE_PROJECT_NAME"); env != "kmp-old" {
+		t.Fatalf("expected the archived .env to be restored, got project %q", env)
+	}
+	log, _ := os.ReadFile(filepath.Join(src, "docker.log"))
+	if !strings.Contains(string(log), "compose up -d --wait db") || !strings.Contains(string(log), "exec -T") {
+		t.Fatalf("expected the database to be started and loaded:\n%s", log)
+	}
+}
+
+func TestDockerEncryptedBackupRestoresWithIdentityAndRekeys(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	installMockDocker(t, "if [ -n \"$CAPTURE\" ]; then cat > \"$CAPTURE\"; else printf 'INSERT INTO members VALUES (1);\\n'; fi\n")
+
+	identity, recipient, err := backupcrypt.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("GenerateKeyPair: %v", err)
+	}
+	dep := &config.Deployment{Name: config.DefaultDeploymentName, ComposeDir: t.TempDir(), BackupEncryptionKey: recipient}
+	appCfg := &config.Config{Version: 1, Deployments: map[string]*config.Deployment{dep.Name: dep}}
+	if err := appCfg.Save(); err != nil {
+		t.Fatal(err)
+	}
+	d := NewDockerProvider(dep)
+
+	result, err := d.Backup(context.Background(), BackupOptions{})
+	if err != nil {
+		t.Fatalf("Backup returned error: %v", err)
+	}
+	if !result.Encrypted || !strings.HasSuffix(result.Location, ".sql.gz"+backupcrypt.Extension) {
+		t.Fatalf("expected encrypted backup, got %+v", result)
+	}
+	raw, _ := os.ReadFile(result.Location)
+	if strings.Contains(string(raw), "members") {
+		t.Fatalf("backup file contains plaintext")
+	}
+
+	captured := filepath.Join(t.TempDir(), "restored.sql")
+	t.Setenv("CAPTURE", captured)
+	if err := d.Restore(context.Background(), result.ID, RestoreOptions{}); !errors.Is(err, backupcrypt.ErrNoIdentity) {
+		t.Fatalf("expected ErrNoIdentity without a private key, got %v", err)
+	}
+	if err := d.Restore(context.Background(), result.ID, RestoreOptions{Identity: identity}); err != nil {
+		t.Fatalf("Restore returned error: %v", err)
+	}
+	if got, _ := os.ReadFile(captured); !strings.Contains(string(got), "INSERT INTO members") {
+		t.Fatalf("unexpected restored dump %q", got)
+	}
+
+	n, err := d.RekeyBackups(context.Background(), "new passphrase", identity)
+	if err != nil || n != 1 {
+		t.Fatalf("RekeyBackups = %d, %v", n, err)
+	}
+	if err := d.Restore(context.Background(), result.ID, RestoreOptions{}); err != nil {
+		t.Fatalf("Restore with configured passphrase returned error: %v", err)
+	}
+}
+
+func TestDockerRestoreFetchesBackupFromRemoteTarget(t *testing.T) {
+	installMockDocker(t, "if [ -n \"$CAPTURE\" ]; then cat > \"$CAPTURE\"; else printf 'INSERT INTO members VALUES (1);\\n'; fi\n")
+
+	// In-memory path-style bucket standing in for MinIO
+	var mu sync.Mutex
+	objects := map[string][]byte{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		key := strings.TrimPrefix(r.URL.Path, "/kmp/")
+		switch {
+		case r.Method == http.MethodPut:
+			objects[key], _ = io.ReadAll(r.Body)
+		case r.URL.Query().Get("list-type") == "2":
+			fmt.Fprint(w, "<ListBucketResult>")
+			for k, v := range objects {
+				fmt.Fprintf(w, "<Contents><Key>%s</Key><Size>%d</Size></Contents>", k, len(v))
+			}
+			fmt.Fprint(w, "</ListBucketResult>")
+		case r.Method == http.MethodGet:
+			_, _ = w.Write(objects[key])
+		}
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	d := NewDockerProvider(&config.Deployment{
+		ComposeDir:        dir,
+		BackupStorageType: "s3",
+		BackupStorageConfig: map[string]string{
+			"s3_bucket":   "kmp",
+			"s3_endpoint": server.URL,
+		},
+	})
+
+	result, err := d.Backup(context.Background(), BackupOptions{})
+	if err != nil {
+		t.Fatalf("Backup returned error: %v", err)
+	}
+	if want := "s3://kmp/kmp-backups/default/" + filepath.Base(result.Location); result.Remote != want {
+		t.Fatalf("Remote = %q, want %q", result.Remote, want)
+	}
+
+	// Simulate a lost disk
+	if err := os.Remove(result.Location); err != nil {
+		t.Fatalf("remove local backup: %v", err)
+	}
+
+	captured := filepath.Join(t.TempDir(), "restored.sql")
+	t.Setenv("CAPTURE", captured)
+	if err := d.Restore(context.Background(), result.ID, RestoreOptions{}); err != nil {
+		t.Fatalf("Restore returned error: %v", err)
+	}
+	if got, _ := os.ReadFile(captured); !strings.Contains(string(got), "INSERT INTO members") {
+		t.Fatalf("unexpected restored dump %q", got)
+	}
+	if !fileExists(result.Location) {
+		t.Fatalf("expected fetched backup to be kept at %s", result.Location)
+	}
+}
+
+func TestDockerRekeyResumesAndReplacesRemoteCopies(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	installMockDocker(t, "printf 'INSERT INTO members VALUES (1);\\n'\n")
+
+	var mu sync.Mutex
+	objects := map[string][]byte{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		key := strings.TrimPrefix(r.URL.Path, "/kmp/")
+		switch r.Method {
+		case http.MethodPut:
+			objects[key], _ = io.ReadAll(r.Body)
+		case http.MethodDelete:
+			delete(objects, key)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	dep := &config.Deployment{
+		Name:              config.DefaultDeploymentName,
+		ComposeDir:        dir,
+		BackupStorageType: "s3",
+		BackupStorageConfig: map[string]string{
+			"s3_bucket":   "kmp",
+			"s3_endpoint": server.URL,
+		},
+	}
+	appCfg := &config.Config{Version: 1, Deployments: map[string]*config.Deployment{dep.Name: dep}}
+	if err := appCfg.Save(); err != nil {
+		t.Fatal(err)
+	}
+	d := NewDockerProvider(dep)
+
+	result, err := d.Backup(context.Background(), BackupOptions{})
+	if err != nil {
+		t.Fatalf("Backup returned error: %v", err)
+	}
+
+	// An earlier rekey to a public key finished an older backup before it
+	// was interrupted; the host cannot open that file any more
+	_, recipient, err := backupcrypt.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("GenerateKeyPair: %v", err)
+	}
+	raw, err := os.ReadFile(result.Location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	older := strings.Replace(result.Location, result.ID, "20200101-000000", 1)
+	if err := os.WriteFile(older, raw, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	bf, err := findBackupFile(d.backupDir(), "20200101-000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := rekeyBackupFile(bf, recipient, nil); err != nil {
+		t.Fatalf("rekeyBackupFile: %v", err)
+	}
+	progress, err := loadRekeyProgress(d.backupDir(), recipient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := progress.add(bf.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := d.RekeyBackups(context.Background(), recipient, "")
+	if err != nil || n != 1 {
+		t.Fatalf("RekeyBackups = %d, %v", n, err)
+	}
+	if fileExists(filepath.Join(d.backupDir(), rekeyProgressFile)) {
+		t.Fatalf("expected rekey progress to be cleared")
+	}
+
+	catalog, err := loadCatalog(d.backupDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := catalog.find(result.ID)
+	if entry == nil || entry.RemoteStale || !strings.HasSuffix(entry.Remote, backupcrypt.Extension) {
+		t.Fatalf("expected the catalog to point at the re-encrypted copy, got %+v", entry)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(objects) != 1 {
+		t.Fatalf("expected the old off-host copy to be replaced, have %d objects", len(objects))
+	}
+	for key, data := range objects {
+		if strings.Contains(string(data), "members") {
+			t.Fatalf("off-host copy %s still holds plaintext", key)
+		}
+	}
+}
+
+func TestSidecarEnvRoundTripsScheduleAndTarget(t *testing.T) {
+	dir := t.TempDir()
+	dep := &config.Deployment{
+		Name:              "prod",
+		BackupEnabled:     true,
+		BackupSchedule:    "0 3 * * *",
+		BackupRetention:   14,
+		BackupKeepWeekly:  4,
+		BackupStorageType: "s3",
+		BackupStorageConfig: map[string]string{
+			"s3_bucket":     "kmp",
+			"s3_secret":     "secret",
+			"smtp_password": "not for the sidecar",
+		},
+	}
+	if err := WriteSidecarEnv(dir, dep); err != nil {
+		t.Fatalf("WriteSidecarEnv: %v", err)
+	}
+
+	got := SidecarDeploymentFromEnv(dir)
+	if got.Name != "prod" || !got.BackupEnabled || got.BackupSchedule != "0 3 * * *" ||
+		got.BackupRetention != 14 || got.BackupKeepWeekly != 4 || got.BackupStorageType != "s3" {
+		t.Fatalf("unexpected deployment from sidecar.env: %+v", got)
+	}
+	if got.BackupStorageConfig["s3_bucket"] != "kmp" || got.BackupStorageConfig["s3_secret"] != "secret" {
+		t.Fatalf("expected storage credentials to round-trip, got %v", got.BackupStorageConfig)
+	}
+	if _, ok := got.BackupStorageConfig["smtp_password"]; ok {
+		t.Fatalf("unrelated storage config leaked into sidecar.env")
+	}
+
+	// The sidecar's settings follow the file without re-parsing it per call
+	settings := NewSidecarSettings(dir)
+	if first := settings.Deployment(); first.BackupSchedule != "0 3 * * *" {
+		t.Fatalf("unexpected settings %+v", first)
+	}
+	settings.Deployment().BackupSchedule = "changed by a caller"
+	if again := settings.Deployment(); again.BackupSchedule != "0 3 * * *" {
+		t.Fatalf("expected callers to get copies, got %q", again.BackupSchedule)
+	}
+	dep.BackupSchedule, dep.UpdateStrategy = "30 2 * * *", config.UpdateStrategyBlueGreen
+	if err := WriteSidecarEnv(dir, dep); err != nil {
+		t.Fatal(err)
+	}
+	if got := settings.Deployment(); got.BackupSchedule != "30 2 * * *" || got.UpdateStrategy != config.UpdateStrategyBlueGreen {
+		t.Fatalf("expected the rewritten file to be picked up, got %+v", got)
+	}
+}
+
+func TestDockerFailedUpdateRestoresPreUpdateBackup(t *testing.T) {
+	installMockDocker(t, `echo "$@" >> "$LOG"
+case "$*" in
+*dump*) printf 'CREATE TABLE members (id int);\n' ;;
+*"exec -T"*) cat > /dev/null ;;
+esac
+`)
+	dir := t.TempDir()
+	t.Setenv("LOG", filepath.Join(dir, "docker.log"))
+	if err := os.WriteFile(filepath.Join(dir, ".env"), []byte("KMP_IMAGE_TAG=v1.1.0\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDockerProvider(&config.Deployment{ComposeDir: dir, ImageTag: "v1.1.0", UpdateRestorePolicy: config.RestorePolicyAuto})
+	snapshot, err := d.Backup(context.Background(), BackupOptions{Reason: "pre-update v1.0.0 -> v1.1.0"})
+	if err != nil {
+		t.Fatalf("Backup: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "docker.log"), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	err = d.rollbackFailedUpdate(context.Background(), "v1.1.0", "v1.0.0", snapshot.ID, errors.New("health check after update: timed out"))
+	if err == nil || !strings.Contains(err.Error(), "restored the database from "+snapshot.ID) {
+		t.Fatalf("expected restore to be reported, got %v", err)
+	}
+
+	log, _ := os.ReadFile(filepath.Join(dir, "docker.log"))
+	lines := strings.Split(strings.TrimSpace(string(log)), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "compose stop app") || !strings.Contains(lines[1], "exec -T") || !strings.HasPrefix(lines[2], "compose up -d") {
+		t.Fatalf("expected stop, restore, up in that order:\n%s", log)
+	}
+	if tag := readEnvValue(filepath.Join(dir, ".env"), "KMP_IMAGE_TAG"); tag != "v1.0.0" {
+		t.Fatalf("expected .env to be rolled back, got %q", tag)
+	}
+	entry, err := d.ShowBackup(context.Background(), snapshot.ID)
+	if err != nil || entry.Reason != "pre-update v1.0.0 -> v1.1.0" {
+		t.Fatalf("expected pre-update backup in catalog, got %+v (%v)", entry, err)
+	}
+}
+
+func TestDockerFailedMigrationRestoresPreUpdateBackupUnderAutoPolicy(t *testing.T) {
+	installMockDocker(t, `echo "$@" >> "$LOG"
+case "$*" in
+*dump*) printf 'CREATE TABLE members (id int);\n' ;;
+*"exec -T"*) cat > /dev/null ;;
+"compose run"*) echo 'SQLSTATE[42S01]: table exists' >&2; exit 1 ;;
+esac
+`)
+	dir := t.TempDir()
+	t.Setenv("LOG", filepath.Join(dir, "docker.log"))
+	if err := os.WriteFile(filepath.Join(dir, ".env"), []byte("KMP_IMAGE_TAG=v1.0.0\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDockerProvider(&config.Deployment{ComposeDir: dir, ImageTag: "v1.0.0", UpdateRestorePolicy: config.RestorePolicyAuto})
+	err := d.Update("v1.1.0")
+	if err == nil || !strings.Contains(err.Error(), "migrations failed") || !strings.Contains(err.Error(), "restored the database from") {
+		t.Fatalf("expected the failed migration to restore the snapshot, got %v", err)
+	}
+
+	log, _ := os.ReadFile(filepath.Join(dir, "docker.log"))
+	var steps []string
+	for _, line := range strings.Split(strings.TrimSpace(string(log)), "\n") {
+		switch {
+		case strings.HasPrefix(line, "compose run"):
+			steps = append(steps, "migrate")
+		case strings.HasPrefix(line, "compose stop app"):
+			steps = append(steps, "stop")
+		case strings.Contains(line, "dump"):
+			steps = append(steps, "backup")
+		case strings.Contains(line, "exec -T"):
+			steps = append(steps, "restore")
+		case line == "compose up -d":
+			steps = append(steps, "up")
+		}
+	}
+	if strings.Join(steps, ",") != "backup,migrate,stop,restore,up" {
+		t.Fatalf("expected backup, migrate, stop, restore, up in that order, got %v:\n%s", steps, log)
+	}
+	if tag := readEnvValue(filepath.Join(dir, ".env"), "KMP_IMAGE_TAG"); tag != "v1.0.0" {
+		t.Fatalf("expected .env to be back on v1.0.0, got %q", tag)
+	}
+	entries, _ := updater.ReadHistory(filepath.Join(dir, updater.DefaultStateDir))
+	if len(entries) != 1 || entries[0].Status != "rolled_back" || entries[0].BackupID == "" {
+		t.Fatalf("expected a rolled back update with its backup, got %+v", entries)
+	}
+}
+
+func TestDockerRotateUpdaterTokenRewritesEnvAndAuthenticatesRequests(t *testing.T) {
+	installMockDocker(t, `echo "$@" >> "$LOG"
+case "$*" in *" -K - "*) cat > "$CURL_CONFIG" ;; esac
+case "$*" in *updater/backups*) printf '{}' ;; esac
+`)
+	dir := t.TempDir()
+	t.Setenv("LOG", filepath.Join(dir, "docker.log"))
+	t.Setenv("CURL_CONFIG", filepath.Join(dir, "curl.conf"))
+	envPath := filepath.Join(dir, ".env")
+	if err := os.WriteFile(envPath, []byte("KMP_IMAGE_TAG=v1.0.0\nUPDATER_TOKEN=old\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDockerProvider(&config.Deployment{ComposeDir: dir})
+	token, err := d.RotateUpdaterToken(context.Background())
+	if err != nil {
+		t.Fatalf("RotateUpdaterToken: %v", err)
+	}
+	if token == "" || token == "old" || UpdaterToken(dir) != token {
+		t.Fatalf("expected .env to hold the new token %q, got %q", token, UpdaterToken(dir))
+	}
+	if got := readEnvValue(envPath, "KMP_IMAGE_TAG"); got != "v1.0.0" {
+		t.Fatalf("other settings should be kept, KMP_IMAGE_TAG=%q", got)
+	}
+
+	if _, err := d.BackupSchedule(context.Background()); err != nil {
+		t.Fatalf("BackupSchedule: %v", err)
+	}
+	log, _ := os.ReadFile(filepath.Join(dir, "docker.log"))
+	if !strings.Contains(string(log), "up -d --no-deps app") {
+		t.Fatalf("expected the app to be recreated:\n%s", log)
+	}
+	// The token goes to curl on stdin, never on a command line
+	if strings.Contains(string(log), token) {
+		t.Fatalf("expected the token to stay out of argv:\n%s", log)
+	}
+	if conf, _ := os.ReadFile(filepath.Join(dir, "curl.conf")); !strings.Contains(string(conf), `header = "Authorization: Bearer `+token+`"`) {
+		t.Fatalf("expected sidecar requests to carry the new token, got config:\n%s", conf)
+	}
+
+	if _, err := d.updaterRequest(context.Background(), "POST", "/updater/update", []byte(`{"targetTag":"v1.1.0","requestedBy":"a \\ \"b\""}`)); err != nil {
+		t.Fatalf("updaterRequest: %v", err)
+	}
+	conf, _ := os.ReadFile(filepath.Join(dir, "curl.conf"))
+	if want := `data-binary = "{\"targetTag\":\"v1.1.0\",\"requestedBy\":\"a \\\\ \\\"b\\\"\"}"`; !strings.Contains(string(conf), want) {
+		t.Fatalf("expected the body quoted for curl, want %s in:\n%s", want, conf)
+	}
+}
+
+func TestDockerWatchUpdaterResumesWithLastEventID(t *testing.T) {
+	installMockDocker(t, `echo "$@" >> "$LOG"
+case "$*" in
+*"Last-Event-ID: 1"*) printf 'id: 2\nevent: state\ndata: {"id":2,"type":"state","state":{"status":"completed","message":"Updated"}}\n\n' ;;
+*) printf 'id: 1\nevent: log\ndata: {"id":1,"type":"log","line":"Pulling app"}\n\n' ;;
+esac
+`)
+	retry := updaterWatchRetry
+	updaterWatchRetry = 0
+	t.Cleanup(func() { updaterWatchRetry = retry })
+	dir := t.TempDir()
+	t.Setenv("LOG", filepath.Join(dir, "docker.log"))
+
+	d := NewDockerProvider(&config.Deployment{ComposeDir: dir})
+	var got []string
+	err := d.WatchUpdater(context.Background(), func(ev updater.Event) bool {
+		if ev.Type == updater.EventLog {
+			got = append(got, ev.Line)
+			return true
+		}
+		got = append(got, ev.State.Status)
+		return ev.State.Busy()
+	})
+	if err != nil {
+		t.Fatalf("WatchUpdater: %v", err)
+	}
+	if strings.Join(got, ",") != "Pulling app,completed" {
+		t.Fatalf("unexpected events %q", got)
+	}
+	log, _ := os.ReadFile(filepath.Join(dir, "docker.log"))
+	if lines := strings.Split(strings.TrimSpace(string(log)), "\n"); len(lines) != 2 || strings.Contains(lines[0], "Last-Event-ID") {
+		t.Fatalf("expected a fresh connection then a resumed one:\n%s", log)
+	}
+}
+
+func TestDockerUpdateRecordsAttemptInUpdaterHistory(t *testing.T) {
+	installMockDocker(t, "echo 'db is down' >&2\nexit 1\n")
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, ".env"), []byte("KMP_IMAGE_TAG=v1.0.0\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDockerProvider(&config.Deployment{ComposeDir: dir, ImageTag: "v1.0.0"})
+	if err := d.Update("v1.1.0"); err == nil {
+		t.Fatal("expected the update to abort without a pre-update backup")
+	}
+
+	entries, err := updater.ReadHistory(filepath.Join(dir, updater.DefaultStateDir))
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("expected one history entry, got %+v (%v)", entries, err)
+	}
+	e := entries[0]
+	if e.Status != "failed" || e.PreviousTag != "v1.0.0" || e.TargetTag != "v1.1.0" || !strings.HasPrefix(e.RequestedBy, "kmp CLI") || !strings.Contains(e.Error, "pre-update backup failed") {
+		t.Fatalf("unexpected history entry %+v", e)
+	}
+}
+
+func TestDockerUpdateRolledBackNotifiesWithoutWaitingOnWebhooks(t *testing.T) {
+	installMockDocker(t, `echo "$@" >> "$LOG"
+case "$*" in
+*dump*) printf 'CREATE TABLE members (id int);\n' ;;
+"compose restart caddy") exit 1 ;;
+esac
+`)
+	dir := t.TempDir()
+	t.Setenv("LOG", filepath.Join(dir, "docker.log"))
+	for name, content := range map[string]string{
+		".env":      "KMP_IMAGE_TAG=v1.0.0\n",
+		"Caddyfile": "localhost {\n\treverse_proxy app:80\n}\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func(timeout time.Duration) { notifyFlushTimeout = timeout }(notifyFlushTimeout)
+	notifyFlushTimeout = 100 * time.Millisecond
+
+	// The webhook does not answer the first event until the update is over
+	var (
+		mu     sync.Mutex
+		events []string
+	)
+	release := make(chan struct{})
+	var once sync.Once
+	releaseWebhook := func() { once.Do(func() { close(release) }) }
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev struct{ Type string }
+		_ = json.NewDecoder(r.Body).Decode(&ev)
+		if ev.Type == "update.started" {
+			<-release
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, ev.Type)
+	}))
+	defer server.Close()
+	defer releaseWebhook()
+
+	d := NewDockerProvider(&config.Deployment{ComposeDir: dir, ImageTag: "v1.0.0", Webhooks: []config.Webhook{{URL: server.URL}}})
+	start := time.Now()
+	err := d.Update("v1.1.0")
+	if err == nil || !strings.Contains(err.Error(), "rolled back to v1.0.0") {
+		t.Fatalf("expected the update to be rolled back, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("expected the update not to wait on the webhook, took %s", elapsed)
+	}
+	entries, _ := updater.ReadHistory(filepath.Join(dir, updater.DefaultStateDir))
+	if len(entries) != 1 || entries[0].Status != "rolled_back" {
+		t.Fatalf("expected the update to be recorded as rolled back, got %+v", entries)
+	}
+
+	releaseWebhook()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		got := strings.Join(events, ",")
+		mu.Unlock()
+		if got == "update.started,update.rolled_back" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected started and rolled_back events, got %q", got)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDockerRollbackPinsTheRecordedDigestThroughTheEngine(t *testing.T) {
+	installMockDocker(t, "exit 1\n")
+	requests := fakeEngine(t)
+	d := NewDockerProvider(&config.Deployment{ComposeDir: t.TempDir()})
+
+	if err := d.pinImage(context.Background(), config.DeployedVersion{Tag: "v1.1.0", Digest: "sha256:abcd"}); err != nil {
+		t.Fatalf("pinImage: %v", err)
+	}
+	want := []string{
+		"POST /images/create?fromImage=ghcr.io%2Fjhandel%2Fkmp&tag=sha256%3Aabcd",
+		"POST /images/ghcr.io/jhandel/kmp@sha256:abcd/tag?repo=ghcr.io%2Fjhandel%2Fkmp&tag=v1.1.0",
+	}
+	if got := requests(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("engine requests = %q, want %q", got, want)
+	}
+}
+
+func TestDockerRollbackWalksBackTheVersionStack(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	installMockDocker(t, `echo "$@" >> "$LOG"
+if [ "$*" = "compose up -d" ] && [ -n "$FAIL_TAG" ] && grep -q "=$FAIL_TAG" .env; then exit 1; fi
+`)
+	dir := t.TempDir()
+	t.Setenv("LOG", filepath.Join(dir, "docker.log"))
+	envPath := filepath.Join(dir, ".env")
+	if err := os.WriteFile(envPath, []byte("KMP_IMAGE_TAG=v1.2.0\nUPDATER_TOKEN=t\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	dep := &config.Deployment{Name: "prod", Provider: "docker", ComposeDir: dir, ImageTag: "v1.2.0",
+		VersionHistory: []config.DeployedVersion{{Tag: "v1.0.0"}, {Tag: "v1.1.0", Digest: "sha256:abcd"}}}
+	appCfg := &config.Config{Version: 1, Deployments: map[string]*config.Deployment{"prod": dep}}
+	if err := appCfg.Save(); err != nil {
+		t.Fatal(err)
+	}
+	stateDir := filepath.Join(dir, updater.DefaultStateDir)
+	d := NewDockerProvider(dep)
+
+	// Nothing in the state dir yet: the stack saved with the deployment is used
+	if err := d.Rollback(RollbackOptions{}); err != nil {
+		t.Fatalf("Rollback: %v", err)
+	}
+	saved, _ := config.Load()
+	stack, _ := updater.ReadVersions(stateDir)
+	if tag := readEnvValue(envPath, "KMP_IMAGE_TAG"); tag != "v1.1.0" || saved.Deployments["prod"].ImageTag != "v1.1.0" {
+		t.Fatalf("expected v1.1.0 in .env and config, got %q and %q", tag, saved.Deployments["prod"].ImageTag)
+	}
+	if len(stack) != 1 || stack[0].Tag != "v1.0.0" || len(saved.Deployments["prod"].VersionHistory) != 1 {
+		t.Fatalf("expected v1.0.0 left on both stacks, got %+v and %+v", stack, saved.Deployments["prod"].VersionHistory)
+	}
+	if readEnvValue(envPath, "UPDATER_TOKEN") != "t" {
+		t.Fatal("expected the rest of .env to be kept")
+	}
+
+	// The sidecar has since updated: its stack in the state dir wins
+	if err := updater.WriteVersions(stateDir, []config.DeployedVersion{{Tag: "v1.0.0"}, {Tag: "v1.0.5"}, {Tag: "v1.1.0"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Rollback(RollbackOptions{To: "v0.9.0"}); err == nil || !strings.Contains(err.Error(), "not a previous version") {
+		t.Fatalf("expected an unknown tag to be refused, got %v", err)
+	}
+	if err := d.Rollback(RollbackOptions{To: "v1.0.5"}); err != nil {
+		t.Fatalf("Rollback --to: %v", err)
+	}
+	stack, _ = updater.ReadVersions(stateDir)
+	if tag := readEnvValue(envPath, "KMP_IMAGE_TAG"); tag != "v1.0.5" || len(stack) != 1 || stack[0].Tag != "v1.0.0" {
+		t.Fatalf("expected v1.0.5 with v1.0.0 left, got %q and %+v", tag, stack)
+	}
+
+	// v1.1.0 had a recorded digest: exactly that image comes back, without
+	// pulling the tag again
+	log, _ := os.ReadFile(filepath.Join(dir, "docker.log"))
+	if !strings.Contains(string(log), "pull ghcr.io/jhandel/kmp@sha256:abcd\ntag ghcr.io/jhandel/kmp@sha256:abcd ghcr.io/jhandel/kmp:v1.1.0\n") {
+		t.Fatalf("expected the recorded digest to be pulled and tagged:\n%s", log)
+	}
+	if got := strings.Count(string(log), "compose pull"); got != 1 || strings.Count(string(log), "compose up -d") != 2 {
+		t.Fatalf("expected a pull only for the tag without a digest and an up per rollback:\n%s", log)
+	}
+	entries, _ := updater.ReadHistory(stateDir)
+	if len(entries) != 2 || entries[1].Operation != "rollback" || entries[1].Status != "completed" || entries[1].PreviousTag != "v1.1.0" || entries[1].TargetTag != "v1.0.5" {
+		t.Fatalf("unexpected history %+v", entries)
+	}
+
+	// A stack that will not start on the old tag is brought back up on the
+	// current one
+	t.Setenv("FAIL_TAG", "v1.0.0")
+	if err := d.Rollback(RollbackOptions{}); err == nil || !strings.Contains(err.Error(), "still on v1.0.5") {
+		t.Fatalf("expected the failed rollback to be reported, got %v", err)
+	}
+	log, _ = os.ReadFile(filepath.Join(dir, "docker.log"))
+	if tag := readEnvValue(envPath, "KMP_IMAGE_TAG"); tag != "v1.0.5" || strings.Count(string(log), "compose up -d") != 4 {
+		t.Fatalf("expected the stack to be recreated on v1.0.5, got %q:\n%s", tag, log)
+	}
+}
@@ -1,6 +1,7 @@
 package providers
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"strings"
@@ -151,17 +152,17 @@ func (f *FlyProvider) Logs(follow bool) (io.ReadCloser, error) {
 	return nil, fmt.Errorf("%s: not yet implemented — coming in a future release", f.Name())
 }
 
-func (f *FlyProvider) Backup() (*BackupResult, error) {
+func (f *FlyProvider) Backup(ctx context.Context, opts BackupOptions) (*BackupResult, error) {
 	// TODO: Run fly postgres backup create and capture result
 	return nil, fmt.Errorf("%s: not yet implemented — coming in a future release", f.Name())
 }
 
-func (f *FlyProvider) Restore(backupID string) error {
+func (f *FlyProvider) Restore(ctx context.Context, backupID string, opts RestoreOptions) error {
 	// TODO: Run fly postgres backup restore
 	return fmt.Errorf("%s: not yet implemented — coming in a future release", f.Name())
 }
 
-func (f *FlyProvider) Rollback() error {
+func (f *FlyProvider) Rollback(opts RollbackOptions) error {
 	// TODO: Look up previous release and run fly deploy --image with previous tag
 	return fmt.Errorf("%s: not yet implemented — coming in a future release", f.Name())
 }
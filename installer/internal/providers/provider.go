@@ -1,6 +1,11 @@
 package providers
 
-import "io"
+import (
+	"context"
+	"io"
+
+	"github.com/jhandel/KMP/installer/internal/updater"
+)
 
 // Provider defines the interface all deployment targets must implement.
 type Provider interface {
@@ -25,14 +30,14 @@ type Provider interface {
 	// Logs returns application log output
 	Logs(follow bool) (io.ReadCloser, error)
 
-	// Backup creates a backup
-	Backup() (*BackupResult, error)
+	// Backup creates a backup; cancelling ctx aborts it without leaving a partial file
+	Backup(ctx context.Context, opts BackupOptions) (*BackupResult, error)
 
 	// Restore restores from a backup
-	Restore(backupID string) error
+	Restore(ctx context.Context, backupID string, opts RestoreOptions) error
 
-	// Rollback reverts to the previous version
-	Rollback() error
+	// Rollback reverts to a version an earlier update replaced
+	Rollback(opts RollbackOptions) error
 
 	// Destroy tears down the entire deployment
 	Destroy() error
@@ -87,15 +92,93 @@ type Status struct {
 	DBConnected    bool
 	CacheOK        bool
 	Uptime         string
-	LastBackup     string
+	LastBackup     string // from the updater sidecar's backup schedule
+	NextBackup     string
+	LastVerify     string // newest backup verification from the catalog
 	LastUpdate     string
 	UpdaterRunning bool // true if kmp-updater sidecar is reachable
 }
 
+// ProgressFunc receives the number of bytes processed so far and the total,
+// or -1 when the total is not known in advance.
+type ProgressFunc func(done, total int64)
+
+// BackupOptions tunes a single backup run.
+type BackupOptions struct {
+	Progress ProgressFunc // optional
+	Full     bool         // also capture uploads, certificates and rendered config
+	Reason   string       // recorded in the catalog, e.g. "pre-update v1.2.0 -> v1.3.0"
+}
+
+// RestoreOptions tunes a single restore run.
+type RestoreOptions struct {
+	Progress ProgressFunc // optional
+	Identity string       // private key or passphrase for encrypted backups; the configured passphrase is tried too
+}
+
+// RollbackOptions chooses the version a rollback returns to.
+type RollbackOptions struct {
+	To string // a previous tag; empty = the one the last update replaced
+}
+
 // BackupResult holds the result of a backup operation
 type BackupResult struct {
 	ID        string
 	Timestamp string
 	Size      int64
+	SHA256    string // checksum of the backup file as written
 	Location  string
+	Dialect   string // database engine the dump came from: mysql, postgres
+	Full      bool   // archive also holds volumes and config files
+	Encrypted bool   // sealed with the deployment's backup encryption key
+	Remote    string // off-host copy, e.g. s3://bucket/kmp-backups/default/<file>; empty if local only
+}
+
+// RestorePrompter is implemented by providers that snapshot the database
+// before an update and can ask whether to restore it if the update fails.
+type RestorePrompter interface {
+	SetRestorePrompt(fn func(backupID string) bool)
+}
+
+// UpdaterManager is implemented by providers that run the kmp-updater
+// sidecar next to the app.
+type UpdaterManager interface {
+	// RotateUpdaterToken replaces the sidecar's bearer token and returns it.
+	RotateUpdaterToken(ctx context.Context) (string, error)
+	// WatchUpdater follows the sidecar's progress events until fn returns
+	// false or ctx ends.
+	WatchUpdater(ctx context.Context, fn func(updater.Event) bool) error
+	// UpdateHistory returns a page of past updates and rollbacks, newest
+	// first.
+	UpdateHistory(ctx context.Context, limit, offset int) (*updater.HistoryPage, error)
+	// CancelUpdate stops the update the sidecar is running.
+	CancelUpdate(ctx context.Context) error
+}
+
+// BackupManager is implemented by providers that keep backups as files they
+// can enumerate and rewrite, such as the Docker provider.
+type BackupManager interface {
+	// RekeyBackups re-encrypts every stored backup to newKey and saves it as
+	// the deployment's key. identity decrypts existing backups when the
+	// configured key cannot, e.g. because it is a public-key recipient.
+	RekeyBackups(ctx context.Context, newKey, identity string) (int, error)
+
+	// PruneBackups deletes local and off-host backups the policy does not keep.
+	PruneBackups(ctx context.Context, opts PruneOptions) (*PruneResult, error)
+
+	// BackupSchedule reports the updater sidecar's scheduled backup runs.
+	BackupSchedule(ctx context.Context) (*updater.BackupStatus, error)
+
+	// ListBackups returns the backup catalog, oldest first.
+	ListBackups(ctx context.Context) ([]CatalogEntry, error)
+
+	// ShowBackup returns one catalog entry; id may be "latest".
+	ShowBackup(ctx context.Context, id string) (*CatalogEntry, error)
+
+	// DeleteBackup removes a backup everywhere it is stored.
+	DeleteBackup(ctx context.Context, id string) (*CatalogEntry, error)
+
+	// VerifyBackup restores a backup into a scratch database and records
+	// the outcome in the catalog.
+	VerifyBackup(ctx context.Context, id string, opts VerifyOptions) (*BackupVerification, error)
 }
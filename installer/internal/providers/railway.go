@@ -1,6 +1,7 @@
 package providers
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -242,18 +243,11 @@ func (r *RailwayProvider) Update(version string) error {
 		return err
 	}
 
-	appCfg, err := config.Load()
-	if err != nil {
-		return err
-	}
-	if dep, ok := appCfg.Deployments["default"]; ok {
+	return config.UpdateDeployment(deploymentName(r.cfg), func(dep *config.Deployment) {
 		if strings.TrimSpace(version) != "" {
 			dep.ImageTag = version
 		}
-		return appCfg.Save()
-	}
-
-	return nil
+	})
 }
 
 func (r *RailwayProvider) Status() (*Status, error) {
@@ -326,17 +320,17 @@ func (r *RailwayProvider) Logs(follow bool) (io.ReadCloser, error) {
 	return stdout, nil
 }
 
-func (r *RailwayProvider) Backup() (*BackupResult, error) {
+func (r *RailwayProvider) Backup(ctx context.Context, opts BackupOptions) (*BackupResult, error) {
 	// TODO: Implement Railway MySQL backup via plugin or dump
 	return nil, fmt.Errorf("%s: not yet implemented — coming in a future release", r.Name())
 }
 
-func (r *RailwayProvider) Restore(backupID string) error {
+func (r *RailwayProvider) Restore(ctx context.Context, backupID string, opts RestoreOptions) error {
 	// TODO: Restore Railway MySQL from backup
 	return fmt.Errorf("%s: not yet implemented — coming in a future release", r.Name())
 }
 
-func (r *RailwayProvider) Rollback() error {
+func (r *RailwayProvider) Rollback(opts RollbackOptions) error {
 	// TODO: Redeploy previous version via railway up
 	return fmt.Errorf("%s: not yet implemented — coming in a future release", r.Name())
 }
@@ -588,7 +582,10 @@ func (r *RailwayProvider) saveDeployment(cfg *DeployConfig) error {
 
 	name := cfg.Name
 	if name == "" {
-		name = "default"
+		name = config.DefaultDeploymentName
+	}
+	if appCfg.Current == "" {
+		appCfg.Current = name
 	}
 
 	storageConfig := make(map[string]string, len(cfg.StorageConfig))
@@ -599,21 +596,24 @@ func (r *RailwayProvider) saveDeployment(cfg *DeployConfig) error {
 	storageConfig["railway_app_service"] = railwayDefaultAppServiceName
 
 	appCfg.Deployments[name] = &config.Deployment{
-		Provider:        "railway",
-		Channel:         cfg.Channel,
-		Domain:          cfg.Domain,
-		Image:           cfg.Image,
-		ImageTag:        cfg.ImageTag,
-		DatabaseDSN:     cfg.DatabaseDSN,
-		MySQLSSL:        cfg.MySQLSSL,
-		LocalDBType:     cfg.LocalDBType,
-		StorageType:     cfg.StorageType,
-		StorageConfig:   storageConfig,
-		CacheEngine:     cfg.CacheEngine,
-		RedisURL:        cfg.RedisURL,
-		BackupEnabled:   cfg.BackupConfig.Enabled,
-		BackupSchedule:  cfg.BackupConfig.Schedule,
-		BackupRetention: cfg.BackupConfig.RetentionDays,
+		Provider:            "railway",
+		Channel:             cfg.Channel,
+		Domain:              cfg.Domain,
+		Image:               cfg.Image,
+		ImageTag:            cfg.ImageTag,
+		DatabaseDSN:         cfg.DatabaseDSN,
+		MySQLSSL:            cfg.MySQLSSL,
+		LocalDBType:         cfg.LocalDBType,
+		StorageType:         cfg.StorageType,
+		StorageConfig:       storageConfig,
+		CacheEngine:         cfg.CacheEngine,
+		RedisURL:            cfg.RedisURL,
+		BackupEnabled:       cfg.BackupConfig.Enabled,
+		BackupSchedule:      cfg.BackupConfig.Schedule,
+		BackupRetention:     cfg.BackupConfig.RetentionDays,
+		BackupEncryptionKey: cfg.BackupConfig.EncryptionKey,
+		BackupStorageType:   cfg.BackupConfig.StorageType,
+		BackupStorageConfig: cfg.BackupConfig.StorageConfig,
 	}
 
 	return appCfg.Save()
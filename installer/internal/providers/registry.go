@@ -42,3 +42,11 @@ func GetProvider(id string, deployment *config.Deployment) (Provider, error) {
 	}
 	return nil, fmt.Errorf("unknown provider: %s", id)
 }
+
+// deploymentName returns the config key a provider persists changes under.
+func deploymentName(dep *config.Deployment) string {
+	if dep != nil && dep.Name != "" {
+		return dep.Name
+	}
+	return config.DefaultDeploymentName
+}
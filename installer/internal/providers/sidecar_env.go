@@ -0,0 +1,185 @@
+package providers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jhandel/KMP/installer/internal/config"
+)
+
+// sidecarEnvFile holds the deployment settings the kmp-updater sidecar needs
+// and cannot read from ~/.kmp: backups, the update strategy, restore and
+// auto-update policies, the channel and webhooks. It lives next to the
+// compose file and is kept out of .env so the app container does not receive
+// backup credentials or webhook secrets.
+const sidecarEnvFile = "sidecar.env"
+
+// backupStorageKeys are the StorageConfig keys a backup target reads; only
+// these are exported to sidecar.env.
+var backupStorageKeys = []string{
+	"s3_bucket", "s3_region", "s3_key", "s3_secret", "s3_endpoint",
+	"azure_connection_string", "azure_container", "backup_prefix",
+}
+
+// WriteSidecarEnv renders dep's sidecar settings into <dir>/sidecar.env.
+func WriteSidecarEnv(dir string, dep *config.Deployment) error {
+	values := map[string]string{
+		"BACKUP_DEPLOYMENT":     deploymentName(dep),
+		"BACKUP_ENABLED":        strconv.FormatBool(dep.BackupEnabled),
+		"BACKUP_SCHEDULE":       dep.BackupSchedule,
+		"BACKUP_RETENTION_DAYS": strconv.Itoa(dep.BackupRetention),
+		"BACKUP_KEEP_DAILY":     strconv.Itoa(dep.BackupKeepDaily),
+		"BACKUP_KEEP_WEEKLY":    strconv.Itoa(dep.BackupKeepWeekly),
+		"BACKUP_KEEP_MONTHLY":   strconv.Itoa(dep.BackupKeepMonthly),
+		"BACKUP_ENCRYPTION_KEY": dep.BackupEncryptionKey,
+		"BACKUP_STORAGE_TYPE":   dep.BackupStorageType,
+		"BACKUP_LOCAL_DB_TYPE":  dep.LocalDBType,
+		"DEPLOYMENT_CHANNEL":    dep.Channel,
+		"UPDATE_RESTORE_POLICY": dep.UpdateRestorePolicy,
+		"UPDATE_STRATEGY":       dep.UpdateStrategy,
+	}
+	if auto := dep.AutoUpdate; auto.Enabled {
+		values["AUTO_UPDATE_ENABLED"] = "true"
+		values["AUTO_UPDATE_CHANNEL"] = valueOrDefault(auto.Channel, dep.Channel)
+		values["AUTO_UPDATE_MAX_BUMP"] = auto.MaxBump
+		values["AUTO_UPDATE_WINDOW"] = auto.Window
+		values["AUTO_UPDATE_TIMEZONE"] = auto.Timezone
+		values["AUTO_UPDATE_REQUIRE_BACKUP"] = strconv.FormatBool(auto.RequireBackup)
+	}
+	for _, key := range backupStorageKeys {
+		if value := dep.BackupStorageConfig[key]; value != "" {
+			values["BACKUP_"+strings.ToUpper(key)] = value
+		}
+	}
+	if len(dep.Webhooks) > 0 {
+		hooks, err := json.Marshal(dep.Webhooks)
+		if err != nil {
+			return fmt.Errorf("encoding webhooks: %w", err)
+		}
+		values["NOTIFY_WEBHOOKS"] = string(hooks)
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString("# KMP sidecar settings — generated by kmp, read by the kmp-updater sidecar\n")
+	for _, key := range keys {
+		b.WriteString(key + "=" + values[key] + "\n")
+	}
+	if _, err := writeFileAtomic(filepath.Join(dir, sidecarEnvFile), 0600, func(w io.Writer) error {
+		_, err := io.WriteString(w, b.String())
+		return err
+	}); err != nil {
+		return fmt.Errorf("writing %s: %w", sidecarEnvFile, err)
+	}
+	return nil
+}
+
+// SidecarDeploymentFromEnv rebuilds the parts of a deployment the sidecar
+// uses from <dir>/sidecar.env. It is how the sidecar configures itself and
+// its DockerProvider.
+func SidecarDeploymentFromEnv(dir string) *config.Deployment {
+	env := readEnvFile(filepath.Join(dir, sidecarEnvFile))
+	atoi := func(key string) int {
+		n, _ := strconv.Atoi(env[key])
+		return n
+	}
+
+	dep := &config.Deployment{
+		Name:                env["BACKUP_DEPLOYMENT"],
+		Provider:            "docker",
+		ComposeDir:          dir,
+		Channel:             env["DEPLOYMENT_CHANNEL"],
+		LocalDBType:         env["BACKUP_LOCAL_DB_TYPE"],
+		BackupEnabled:       env["BACKUP_ENABLED"] == "true",
+		BackupSchedule:      env["BACKUP_SCHEDULE"],
+		BackupRetention:     atoi("BACKUP_RETENTION_DAYS"),
+		BackupKeepDaily:     atoi("BACKUP_KEEP_DAILY"),
+		BackupKeepWeekly:    atoi("BACKUP_KEEP_WEEKLY"),
+		BackupKeepMonthly:   atoi("BACKUP_KEEP_MONTHLY"),
+		BackupEncryptionKey: env["BACKUP_ENCRYPTION_KEY"],
+		BackupStorageType:   env["BACKUP_STORAGE_TYPE"],
+		BackupStorageConfig: map[string]string{},
+		UpdateRestorePolicy: env["UPDATE_RESTORE_POLICY"],
+		UpdateStrategy:      env["UPDATE_STRATEGY"],
+		AutoUpdate: config.AutoUpdatePolicy{
+			Enabled:       env["AUTO_UPDATE_ENABLED"] == "true",
+			Channel:       env["AUTO_UPDATE_CHANNEL"],
+			MaxBump:       env["AUTO_UPDATE_MAX_BUMP"],
+			Window:        env["AUTO_UPDATE_WINDOW"],
+			Timezone:      env["AUTO_UPDATE_TIMEZONE"],
+			RequireBackup: env["AUTO_UPDATE_REQUIRE_BACKUP"] == "true",
+		},
+	}
+	for _, key := range backupStorageKeys {
+		if value := env["BACKUP_"+strings.ToUpper(key)]; value != "" {
+			dep.BackupStorageConfig[key] = value
+		}
+	}
+	if hooks := env["NOTIFY_WEBHOOKS"]; hooks != "" {
+		_ = json.Unmarshal([]byte(hooks), &dep.Webhooks)
+	}
+	return dep
+}
+
+// SyncSidecarEnv refreshes sidecar.env after the saved settings change.
+// Deployments without a compose directory on this host are left alone.
+func SyncSidecarEnv(name string) error {
+	appCfg, err := config.Load()
+	if err != nil {
+		return err
+	}
+	dep, ok := appCfg.Deployments[name]
+	if !ok || dep.Provider != "docker" || dep.ComposeDir == "" {
+		return nil
+	}
+	if _, err := os.Stat(dep.ComposeDir); err != nil {
+		return nil
+	}
+	return WriteSidecarEnv(dep.ComposeDir, dep)
+}
+
+// SidecarSettings hands out the deployment in sidecar.env, parsing the file
+// again only when it has changed. It is safe for concurrent use.
+type SidecarSettings struct {
+	dir string
+
+	mu      sync.Mutex
+	dep     *config.Deployment
+	modTime time.Time // of the file dep was parsed from; zero when missing
+	size    int64
+}
+
+// NewSidecarSettings reads the sidecar settings in dir.
+func NewSidecarSettings(dir string) *SidecarSettings {
+	return &SidecarSettings{dir: dir}
+}
+
+// Deployment returns a copy of the current settings.
+func (s *SidecarSettings) Deployment() *config.Deployment {
+	var modTime time.Time
+	var size int64
+	if info, err := os.Stat(filepath.Join(s.dir, sidecarEnvFile)); err == nil {
+		modTime, size = info.ModTime(), info.Size()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dep == nil || !modTime.Equal(s.modTime) || size != s.size {
+		s.dep, s.modTime, s.size = SidecarDeploymentFromEnv(s.dir), modTime, size
+	}
+	dep := *s.dep
+	return &dep
+}
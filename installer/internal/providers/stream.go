@@ -0,0 +1,80 @@
+package providers
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// progressWriter counts bytes written through it and reports them to fn.
+type progressWriter struct {
+	w     io.Writer
+	fn    ProgressFunc
+	total int64
+	done  int64
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.done += int64(n)
+	if p.fn != nil {
+		p.fn(p.done, p.total)
+	}
+	return n, err
+}
+
+// progressReader counts bytes read through it and reports them to fn.
+type progressReader struct {
+	r     io.Reader
+	fn    ProgressFunc
+	total int64
+	done  int64
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.done += int64(n)
+	if p.fn != nil && n > 0 {
+		p.fn(p.done, p.total)
+	}
+	return n, err
+}
+
+// writeFileAtomic streams fn's output into path via a ".partial" sibling that
+// is renamed into place only on success, so an aborted write never leaves a
+// truncated file behind. It returns the size of the finished file.
+func writeFileAtomic(path string, perm os.FileMode, fn func(w io.Writer) error) (int64, error) {
+	partial := path + ".partial"
+	f, err := os.OpenFile(partial, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return 0, err
+	}
+
+	cleanup := func() {
+		_ = f.Close()
+		_ = os.Remove(partial)
+	}
+
+	if err := fn(f); err != nil {
+		cleanup()
+		return 0, err
+	}
+	if err := f.Sync(); err != nil {
+		cleanup()
+		return 0, fmt.Errorf("syncing %s: %w", partial, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		cleanup()
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		_ = os.Remove(partial)
+		return 0, err
+	}
+	if err := os.Rename(partial, path); err != nil {
+		_ = os.Remove(partial)
+		return 0, err
+	}
+	return info.Size(), nil
+}
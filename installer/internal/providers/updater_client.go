@@ -0,0 +1,212 @@
+package providers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jhandel/KMP/installer/internal/updater"
+)
+
+// updaterService and updaterURL locate the kmp-updater API. Its port is only
+// exposed on the compose network, so requests are made with curl from
+// inside the sidecar container.
+const (
+	updaterService = "kmp-updater"
+	updaterURL     = "http://localhost:8484"
+)
+
+// UpdaterTokenKey is the .env entry holding the bearer token the sidecar
+// requires on mutating requests. The app reads it from the same file.
+const UpdaterTokenKey = "UPDATER_TOKEN"
+
+// UpdaterToken returns the sidecar token recorded in dir's .env.
+func UpdaterToken(dir string) string {
+	return readEnvValue(filepath.Join(dir, ".env"), UpdaterTokenKey)
+}
+
+// newUpdaterToken returns a fresh random bearer token.
+func newUpdaterToken() string {
+	return generateRandomString(32)
+}
+
+// updaterRequest calls the sidecar API and returns the response body. The
+// token and body reach curl as a config file on stdin, so neither shows up
+// in a process list on the host or in the container.
+func (d *DockerProvider) updaterRequest(ctx context.Context, method, path string, body []byte) ([]byte, error) {
+	var config bytes.Buffer
+	if token := UpdaterToken(d.dir); token != "" {
+		fmt.Fprintf(&config, "header = %s\n", curlConfigQuote("Authorization: Bearer "+token))
+	}
+	if body != nil {
+		fmt.Fprintf(&config, "header = %s\n", curlConfigQuote("Content-Type: application/json"))
+		fmt.Fprintf(&config, "data-binary = %s\n", curlConfigQuote(string(body)))
+	}
+	args := []string{"exec", "-T", updaterService, "curl", "-fsS", "-X", method, "-K", "-", updaterURL + path}
+
+	var out bytes.Buffer
+	if err := streamDockerCompose(ctx, d.dir, &config, &out, args...); err != nil {
+		return nil, fmt.Errorf("updater %s %s: %w", method, path, err)
+	}
+	return out.Bytes(), nil
+}
+
+// curlConfigQuote quotes s as a curl config file value.
+func curlConfigQuote(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+	return `"` + r.Replace(s) + `"`
+}
+
+// updaterWatchRetry is the delay before reconnecting a dropped event stream.
+var updaterWatchRetry = 2 * time.Second
+
+// WatchUpdater follows the sidecar's event stream, calling fn for each event
+// until fn returns false or ctx ends. Dropped connections are resumed with
+// Last-Event-ID so no event is missed or repeated.
+func (d *DockerProvider) WatchUpdater(ctx context.Context, fn func(updater.Event) bool) error {
+	var (
+		lastID   uint64
+		resume   bool
+		failures int
+	)
+	for {
+		args := []string{"exec", "-T", updaterService, "curl", "-fsSN"}
+		if resume {
+			args = append(args, "-H", fmt.Sprintf("Last-Event-ID: %d", lastID))
+		}
+		args = append(args, updaterURL+"/updater/events")
+
+		streamCtx, cancel := context.WithCancel(ctx)
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(streamDockerCompose(streamCtx, d.dir, nil, pw, args...))
+		}()
+		stopped := false
+		_, err := updater.ReadEvents(pr, func(ev updater.Event) bool {
+			lastID, resume, failures = ev.ID, true, 0
+			stopped = !fn(ev)
+			return !stopped
+		})
+		cancel()
+		pr.Close()
+		if stopped {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		// The stream only ends when the connection drops
+		failures++
+		if failures > 5 {
+			if err == nil {
+				err = io.ErrUnexpectedEOF
+			}
+			return fmt.Errorf("following updater events: %w", err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(updaterWatchRetry):
+		}
+	}
+}
+
+// CancelUpdate asks the sidecar to stop the update it is running. An update
+// that already changed the running version is rolled back.
+func (d *DockerProvider) CancelUpdate(ctx context.Context) error {
+	_, err := d.updaterRequest(ctx, "POST", "/updater/cancel", nil)
+	return err
+}
+
+// cliRequester identifies the local user in the updater history.
+func cliRequester() string {
+	user := os.Getenv("USER")
+	if user == "" {
+		user = os.Getenv("USERNAME")
+	}
+	if host, err := os.Hostname(); err == nil && host != "" {
+		user += "@" + host
+	}
+	return "kmp CLI (" + strings.TrimPrefix(user, "@") + ")"
+}
+
+// UpdateHistory returns a page of the updater's history, newest first. It
+// reads the history file directly when the sidecar is not reachable.
+func (d *DockerProvider) UpdateHistory(ctx context.Context, limit, offset int) (*updater.HistoryPage, error) {
+	data, err := d.updaterRequest(ctx, "GET", fmt.Sprintf("/updater/history?limit=%d&offset=%d", limit, offset), nil)
+	if err != nil {
+		entries, ferr := updater.ReadHistory(filepath.Join(d.dir, updater.DefaultStateDir))
+		if ferr != nil {
+			return nil, fmt.Errorf("%w; reading history file: %v", err, ferr)
+		}
+		page := updater.PageHistory(entries, limit, offset)
+		return &page, nil
+	}
+	var page updater.HistoryPage
+	if err := json.Unmarshal(data, &page); err != nil {
+		return nil, fmt.Errorf("parsing updater history: %w", err)
+	}
+	return &page, nil
+}
+
+// BackupSchedule returns the sidecar's scheduled backup status.
+func (d *DockerProvider) BackupSchedule(ctx context.Context) (*updater.BackupStatus, error) {
+	data, err := d.updaterRequest(ctx, "GET", "/updater/backups", nil)
+	if err != nil {
+		return nil, err
+	}
+	var status updater.BackupStatus
+	if err := json.Unmarshal(data, &status); err != nil {
+		return nil, fmt.Errorf("parsing updater backup status: %w", err)
+	}
+	return &status, nil
+}
+
+// describeBackupRun renders a run for Status.LastBackup.
+func describeBackupRun(run *updater.BackupRun) string {
+	when := run.FinishedAt.Local().Format("2006-01-02 15:04 MST")
+	if run.Status == "succeeded" {
+		return fmt.Sprintf("%s (%s, %s)", when, run.BackupID, run.Status)
+	}
+	if run.Error != "" {
+		return fmt.Sprintf("%s (%s: %s)", when, run.Status, run.Error)
+	}
+	return fmt.Sprintf("%s (%s)", when, run.Status)
+}
+
+// fillBackupStatus copies the sidecar's last and next backup runs into st.
+func (d *DockerProvider) fillBackupStatus(st *Status) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	schedule, err := d.BackupSchedule(ctx)
+	if err != nil {
+		return
+	}
+	if schedule.LastRun != nil {
+		st.LastBackup = describeBackupRun(schedule.LastRun)
+	}
+	if schedule.NextRun != nil {
+		st.NextBackup = schedule.NextRun.Local().Format("2006-01-02 15:04 MST")
+	}
+}
+
+// RotateUpdaterToken writes a new sidecar token to .env and recreates the app
+// so its environment matches. The sidecar re-reads the token per request.
+func (d *DockerProvider) RotateUpdaterToken(ctx context.Context) (string, error) {
+	token := newUpdaterToken()
+	if err := setEnvValue(filepath.Join(d.dir, ".env"), UpdaterTokenKey, token); err != nil {
+		return "", fmt.Errorf("writing %s: %w", UpdaterTokenKey, err)
+	}
+	if err := streamDockerCompose(ctx, d.dir, nil, io.Discard, "up", "-d", "--no-deps", "app"); err != nil {
+		return token, fmt.Errorf("token rotated, but recreating the app failed: %w", err)
+	}
+	return token, nil
+}
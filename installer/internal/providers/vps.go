@@ -1,6 +1,7 @@
 package providers
 
 import (
+	"context"
 	"fmt"
 	"io"
 
@@ -65,17 +66,17 @@ func (v *VPSProvider) Logs(follow bool) (io.ReadCloser, error) {
 	return nil, fmt.Errorf("%s: not yet implemented — coming in a future release", v.Name())
 }
 
-func (v *VPSProvider) Backup() (*BackupResult, error) {
+func (v *VPSProvider) Backup(ctx context.Context, opts BackupOptions) (*BackupResult, error) {
 	// TODO: SSH exec: run backup script (mysqldump + upload)
 	return nil, fmt.Errorf("%s: not yet implemented — coming in a future release", v.Name())
 }
 
-func (v *VPSProvider) Restore(backupID string) error {
+func (v *VPSProvider) Restore(ctx context.Context, backupID string, opts RestoreOptions) error {
 	// TODO: SSH exec: download backup and restore via mysql
 	return fmt.Errorf("%s: not yet implemented — coming in a future release", v.Name())
 }
 
-func (v *VPSProvider) Rollback() error {
+func (v *VPSProvider) Rollback(opts RollbackOptions) error {
 	// TODO: SSH exec: pull previous image tag and redeploy
 	return fmt.Errorf("%s: not yet implemented — coming in a future release", v.Name())
 }
@@ -2,15 +2,30 @@ package registry
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
+	"regexp"
 	"strings"
 	"time"
 
 	"golang.org/x/mod/semver"
 )
 
+var (
+	// ErrInvalidTag means a string cannot be an image tag at all.
+	ErrInvalidTag = errors.New("not a valid image tag")
+	// ErrNotAppTag means a tag belongs to a base image, a digest or an
+	// installer/updater release rather than to the app.
+	ErrNotAppTag = errors.New("not an app image tag")
+	// ErrTagNotFound means the registry does not have the tag.
+	ErrTagNotFound = errors.New("tag not found in the registry")
+)
+
+// tagPattern is the OCI distribution spec's grammar for tags.
+var tagPattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+
 // Tag represents a container image tag from the registry.
 type Tag struct {
 	Name    string
@@ -79,10 +94,7 @@ func (g *GHCRClient) GetTags() ([]Tag, error) {
 
 	var tags []Tag
 	for _, t := range result.Tags {
-		// Filter out non-app tags: base images, digests, installer/updater releases
-		if strings.HasPrefix(t, "php") || strings.HasPrefix(t, "sha256-") ||
-			strings.HasPrefix(t, "sha-") || strings.HasPrefix(t, "installer-") ||
-			strings.HasPrefix(t, "updater-") {
+		if !IsAppTag(t) {
 			continue
 		}
 		tags = append(tags, Tag{
@@ -94,6 +106,23 @@ func (g *GHCRClient) GetTags() ([]Tag, error) {
 	return tags, nil
 }
 
+// ResolveTag looks name up among the app tags in the registry.
+func (g *GHCRClient) ResolveTag(name string) (Tag, error) {
+	if err := CheckTag(name); err != nil {
+		return Tag{}, err
+	}
+	tags, err := g.GetTags()
+	if err != nil {
+		return Tag{}, err
+	}
+	for _, t := range tags {
+		if t.Name == name {
+			return t, nil
+		}
+	}
+	return Tag{}, fmt.Errorf("%s:%s: %w", g.Image, name, ErrTagNotFound)
+}
+
 // GetLatestTagByChannel returns the most recent tag for a channel from GHCR.
 func (g *GHCRClient) GetLatestTagByChannel(channel string) (string, error) {
 	tags, err := g.GetTags()
@@ -210,6 +239,43 @@ func parseBearerChallenge(header string) (realm string, service string, scope st
 	return realm, values["service"], values["scope"], true
 }
 
+// IsAppTag reports whether tag names an app image rather than a base image,
+// a digest or an installer/updater release.
+func IsAppTag(tag string) bool {
+	for _, prefix := range []string{"php", "sha256-", "sha-", "installer-", "updater-"} {
+		if strings.HasPrefix(tag, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// CheckTag reports why tag cannot name an app image, without asking the
+// registry.
+func CheckTag(tag string) error {
+	if !tagPattern.MatchString(tag) {
+		return fmt.Errorf("%q: %w", tag, ErrInvalidTag)
+	}
+	if !IsAppTag(tag) {
+		return fmt.Errorf("%q: %w", tag, ErrNotAppTag)
+	}
+	return nil
+}
+
+// channelOrder lists the channels from most to least stable.
+var channelOrder = []string{"release", "beta", "dev", "nightly"}
+
+// ChannelRank orders channels by stability: release is 0 and each less
+// stable channel ranks higher. Unknown channels rank as release.
+func ChannelRank(channel string) int {
+	for i, c := range channelOrder {
+		if c == channel {
+			return i
+		}
+	}
+	return 0
+}
+
 func classifyTag(tag string) string {
 	lower := strings.ToLower(tag)
 	if strings.Contains(lower, "nightly") {
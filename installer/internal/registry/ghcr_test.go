@@ -2,6 +2,7 @@ package registry
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -103,3 +104,36 @@ func TestGHCRClientGetLatestTagByChannelUsesHighestSemver(t *testing.T) {
 		t.Fatalf("expected v1.10.0, got %s", tag)
 	}
 }
+
+func TestGHCRClientResolveTagRejectsUnknownAndNonAppTags(t *testing.T) {
+	requests := 0
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		_ = json.NewEncoder(w).Encode(map[string][]string{
+			"tags": {"v1.2.0", "v1.3.0-beta.1", "installer-v1.0.0", "php8.3"},
+		})
+	}))
+	defer server.Close()
+
+	client := &GHCRClient{
+		Image:      strings.TrimPrefix(server.URL, "https://") + "/jhandel/kmp",
+		HTTPClient: server.Client(),
+	}
+
+	tag, err := client.ResolveTag("v1.3.0-beta.1")
+	if err != nil || tag.Channel != "beta" {
+		t.Fatalf("expected the beta tag to resolve, got %+v, %v", tag, err)
+	}
+	if _, err := client.ResolveTag("v1.2.1"); !errors.Is(err, ErrTagNotFound) {
+		t.Fatalf("expected ErrTagNotFound for a missing tag, got %v", err)
+	}
+	if _, err := client.ResolveTag("installer-v1.0.0"); !errors.Is(err, ErrNotAppTag) {
+		t.Fatalf("expected ErrNotAppTag for an installer tag, got %v", err)
+	}
+	if _, err := client.ResolveTag("v1.2.0; rm -rf /"); !errors.Is(err, ErrInvalidTag) {
+		t.Fatalf("expected ErrInvalidTag for a malformed tag, got %v", err)
+	}
+	if requests != 2 {
+		t.Fatalf("expected only well-formed app tags to reach the registry, got %d requests", requests)
+	}
+}
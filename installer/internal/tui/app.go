@@ -4,3 +4,4 @@ package tui
 //   - NewInstallModel() — multi-step install wizard (install.go)
 //   - NewUpdateModel()  — update check and apply (update.go)
 //   - NewStatusModel()  — deployment health display (status.go)
+//   - NewWatchModel()   — live progress of a sidecar update (watch.go)
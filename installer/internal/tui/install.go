@@ -259,8 +259,8 @@ func (m *InstallModel) loadDefaults() {
 	if err != nil || len(cfg.Deployments) == 0 {
 		return
 	}
-	dep, ok := cfg.Deployments["default"]
-	if !ok {
+	dep, err := cfg.Resolve("")
+	if err != nil {
 		return
 	}
 
@@ -1338,6 +1338,9 @@ func (m *InstallModel) runInstall() tea.Cmd {
 				Enabled:       true,
 				Schedule:      "0 3 * * *",
 				RetentionDays: 30,
+				// Off-host backups reuse the document storage credentials
+				StorageType:   storageType,
+				StorageConfig: storageConfig,
 			},
 		}
 
@@ -1891,7 +1894,7 @@ func (m *InstallModel) viewProgress() string {
 func (m *InstallModel) viewComplete() string {
 	deployDir := filepath.Join(os.Getenv("HOME"), ".kmp", "deployments", "default")
 	if cfg, err := config.Load(); err == nil {
-		if dep, ok := cfg.Deployments["default"]; ok && strings.TrimSpace(dep.ComposeDir) != "" {
+		if dep, err := cfg.Resolve(""); err == nil && strings.TrimSpace(dep.ComposeDir) != "" {
 			deployDir = dep.ComposeDir
 		}
 	}
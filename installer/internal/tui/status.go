@@ -20,6 +20,7 @@ type statusFetchedMsg struct {
 
 // StatusModel is the Bubble Tea model for the status screen.
 type StatusModel struct {
+	name     string // deployment name; empty = current
 	health   *health.Response
 	deploy   *config.Deployment
 	loading  bool
@@ -28,9 +29,11 @@ type StatusModel struct {
 	height   int
 }
 
-// NewStatusModel creates a new status display model.
-func NewStatusModel() *StatusModel {
+// NewStatusModel creates a new status display model for the named
+// deployment; an empty name selects the current deployment.
+func NewStatusModel(name string) *StatusModel {
 	return &StatusModel{
+		name:    name,
 		loading: true,
 	}
 }
@@ -45,13 +48,8 @@ func (m *StatusModel) fetchStatus() tea.Msg {
 		return statusFetchedMsg{err: fmt.Errorf("failed to load config: %w", err)}
 	}
 
-	// Use the first deployment found, or return placeholder data
-	var deploy *config.Deployment
-	for _, d := range cfg.Deployments {
-		deploy = d
-		break
-	}
-
+	// Use the selected deployment, or return placeholder data
+	deploy, _ := cfg.Resolve(m.name)
 	if deploy == nil {
 		// No deployment found — return placeholder
 		return statusFetchedMsg{
@@ -45,6 +45,7 @@ var updateSteps = []string{
 
 // UpdateModel is the Bubble Tea model for the update screen.
 type UpdateModel struct {
+	name       string // deployment name; empty = current
 	phase      updatePhase
 	spinner    spinner.Model
 	current    *config.Deployment
@@ -55,13 +56,15 @@ type UpdateModel struct {
 	height     int
 }
 
-// NewUpdateModel creates a new update screen model.
-func NewUpdateModel() *UpdateModel {
+// NewUpdateModel creates a new update screen model for the named deployment;
+// an empty name selects the current deployment.
+func NewUpdateModel(name string) *UpdateModel {
 	s := spinner.New()
 	s.Spinner = spinner.Dot
 	s.Style = lipgloss.NewStyle().Foreground(lipgloss.Color("#7D56F4"))
 
 	return &UpdateModel{
+		name:    name,
 		phase:   phaseCheckingUpdate,
 		spinner: s,
 	}
@@ -77,12 +80,7 @@ func (m *UpdateModel) checkForUpdate() tea.Msg {
 		return updateCheckMsg{err: fmt.Errorf("failed to load config: %w", err)}
 	}
 
-	var deploy *config.Deployment
-	for _, d := range cfg.Deployments {
-		deploy = d
-		break
-	}
-
+	deploy, _ := cfg.Resolve(m.name)
 	if deploy == nil {
 		deploy = &config.Deployment{
 			Channel:  "release",
@@ -0,0 +1,186 @@
+package tui
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/charmbracelet/bubbles/spinner"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/jhandel/KMP/installer/internal/config"
+	"github.com/jhandel/KMP/installer/internal/providers"
+	"github.com/jhandel/KMP/installer/internal/tui/components"
+	"github.com/jhandel/KMP/installer/internal/updater"
+)
+
+// watchLogLines is how many lines of compose output the watch screen keeps.
+const watchLogLines = 12
+
+// watchEventMsg carries one event from the updater sidecar.
+type watchEventMsg struct {
+	event updater.Event
+}
+
+// watchEndedMsg signals the event stream has closed.
+type watchEndedMsg struct {
+	err error
+}
+
+// WatchModel is the Bubble Tea model that follows an update run by the
+// updater sidecar.
+type WatchModel struct {
+	name    string // deployment name; empty = current
+	spinner spinner.Model
+	events  chan tea.Msg
+	ctx     context.Context
+	cancel  context.CancelFunc
+	state   *updater.State
+	logs    []string
+	err     error
+}
+
+// NewWatchModel creates a model that follows the named deployment's
+// updater; an empty name selects the current deployment.
+func NewWatchModel(name string) *WatchModel {
+	s := spinner.New()
+	s.Spinner = spinner.Dot
+	s.Style = lipgloss.NewStyle().Foreground(lipgloss.Color("#7D56F4"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &WatchModel{
+		name:    name,
+		spinner: s,
+		events:  make(chan tea.Msg, 64),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+}
+
+func (m *WatchModel) Init() tea.Cmd {
+	return tea.Batch(m.spinner.Tick, m.startWatching, m.nextEvent)
+}
+
+// startWatching feeds sidecar events into m.events until the model quits.
+func (m *WatchModel) startWatching() tea.Msg {
+	cfg, err := config.Load()
+	if err != nil {
+		return watchEndedMsg{err: fmt.Errorf("failed to load config: %w", err)}
+	}
+	deploy, err := cfg.Resolve(m.name)
+	if err != nil {
+		return watchEndedMsg{err: err}
+	}
+	provider, err := providers.GetProvider(deploy.Provider, deploy)
+	if err != nil {
+		return watchEndedMsg{err: err}
+	}
+	manager, ok := provider.(providers.UpdaterManager)
+	if !ok {
+		return watchEndedMsg{err: fmt.Errorf("the %s provider does not run the updater sidecar", provider.Name())}
+	}
+
+	go func() {
+		err := manager.WatchUpdater(m.ctx, func(ev updater.Event) bool {
+			select {
+			case m.events <- watchEventMsg{event: ev}:
+				return true
+			case <-m.ctx.Done():
+				return false
+			}
+		})
+		m.events <- watchEndedMsg{err: err}
+	}()
+	return nil
+}
+
+// nextEvent waits for the next message from the watcher goroutine.
+func (m *WatchModel) nextEvent() tea.Msg {
+	return <-m.events
+}
+
+func (m *WatchModel) quit() (tea.Model, tea.Cmd) {
+	m.cancel()
+	return m, tea.Quit
+}
+
+func (m *WatchModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.KeyMsg:
+		switch msg.String() {
+		case "q", "ctrl+c", "esc":
+			return m.quit()
+		}
+
+	case spinner.TickMsg:
+		var cmd tea.Cmd
+		m.spinner, cmd = m.spinner.Update(msg)
+		return m, cmd
+
+	case watchEventMsg:
+		switch msg.event.Type {
+		case updater.EventState:
+			m.state = msg.event.State
+		case updater.EventLog:
+			m.logs = append(m.logs, msg.event.Line)
+			if len(m.logs) > watchLogLines {
+				m.logs = m.logs[len(m.logs)-watchLogLines:]
+			}
+		}
+		return m, m.nextEvent
+
+	case watchEndedMsg:
+		if msg.err != nil && msg.err != context.Canceled {
+			m.err = msg.err
+		}
+		return m, nil
+	}
+
+	return m, nil
+}
+
+func (m *WatchModel) View() string {
+	var s strings.Builder
+
+	s.WriteString(components.TitleStyle.Render("🏰 KMP Updater"))
+	s.WriteString("\n\n")
+
+	var body strings.Builder
+	switch {
+	case m.err != nil:
+		body.WriteString(components.ErrorStyle.Render("  ✗ " + m.err.Error()))
+	case m.state == nil:
+		body.WriteString("  " + m.spinner.View() + " Connecting to the updater...")
+	case m.state.Status == "completed":
+		body.WriteString(components.SuccessStyle.Render("  ✅ " + m.state.Message))
+	case m.state.Status == "failed":
+		body.WriteString(components.ErrorStyle.Render("  ✗ " + m.state.Message))
+	case m.state.Status == "cancelled":
+		body.WriteString(components.WarningStyle.Render("  ⚠ " + m.state.Message))
+	case !m.state.Busy():
+		body.WriteString("  " + m.spinner.View() + " No update in progress; waiting...")
+	default:
+		body.WriteString(fmt.Sprintf("  %s %s\n\n", m.spinner.View(), m.state.Message))
+		body.WriteString("  " + progressBar(m.state.Progress, 40))
+	}
+	if len(m.logs) > 0 {
+		body.WriteString("\n\n")
+		for _, line := range m.logs {
+			body.WriteString(components.SubtleStyle.Render("  "+line) + "\n")
+		}
+	}
+	s.WriteString(components.BoxStyle.Render(body.String()))
+
+	s.WriteString("\n\n")
+	s.WriteString(components.SubtleStyle.Render("  q: quit"))
+	return s.String()
+}
+
+// progressBar renders percent as a fixed-width bar.
+func progressBar(percent, width int) string {
+	percent = max(0, min(percent, 100))
+	filled := width * percent / 100
+	return components.InfoStyle.Render(strings.Repeat("█", filled)) +
+		components.SubtleStyle.Render(strings.Repeat("░", width-filled)) +
+		fmt.Sprintf(" %3d%%", percent)
+}
@@ -0,0 +1,32 @@
+package updater
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// requireToken wraps a mutating handler so it only runs for requests that
+// carry the sidecar's bearer token. With no token configured every request
+// is refused: an unauthenticated sidecar can pull arbitrary images.
+func (s *Server) requireToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := ""
+		if s.cfg.Token != nil {
+			token = s.cfg.Token()
+		}
+		if token == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="kmp-updater"`)
+			writeJSONError(w, "updater token not configured; run `kmp updater rotate-token`", http.StatusUnauthorized)
+			return
+		}
+
+		presented, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(strings.TrimSpace(presented)), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="kmp-updater"`)
+			writeJSONError(w, "missing or invalid bearer token", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,216 @@
+package updater
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/jhandel/KMP/installer/internal/config"
+	"github.com/jhandel/KMP/installer/internal/cron"
+	"golang.org/x/mod/semver"
+)
+
+// autoUpdateCheckInterval is how often the registry is asked for new
+// releases while the maintenance window is open.
+const autoUpdateCheckInterval = 15 * time.Minute
+
+// AutoUpdateRequester is the requestedBy of updates the policy starts and of
+// the decisions it records.
+const AutoUpdateRequester = "auto-update"
+
+// autoUpdater remembers what the auto-update loop did last. Only that loop
+// touches it.
+type autoUpdater struct {
+	lastCheck time.Time
+	lastErr   string // the last policy error logged
+}
+
+// runAutoUpdater evaluates Config.AutoUpdate at the start of every minute,
+// so however long a check takes no minute of the window is stepped over.
+func (s *Server) runAutoUpdater(ctx context.Context) {
+	var au autoUpdater
+	for {
+		s.checkAutoUpdate(ctx, &au)
+		now := s.now()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(nextMinute(now).Sub(now)):
+		}
+	}
+}
+
+// nextMinute returns the start of the minute after t.
+func nextMinute(t time.Time) time.Time {
+	return t.Truncate(time.Minute).Add(time.Minute)
+}
+
+// checkAutoUpdate applies the newest release the policy allows when its
+// maintenance window is open, or records in the history why it did not. The
+// registry is asked at most every autoUpdateCheckInterval.
+func (s *Server) checkAutoUpdate(ctx context.Context, au *autoUpdater) {
+	policy := s.cfg.AutoUpdate()
+	if !policy.Enabled {
+		return
+	}
+	now := s.now()
+	open, err := windowOpen(policy, now)
+	if err != nil {
+		if err.Error() != au.lastErr {
+			log.Printf("[auto-update] not checking for releases: %v", err)
+			au.lastErr = err.Error()
+		}
+		return
+	}
+	au.lastErr = ""
+	if !open || (!au.lastCheck.IsZero() && now.Sub(au.lastCheck) < autoUpdateCheckInterval) {
+		return
+	}
+	au.lastCheck = now
+
+	s.mu.Lock()
+	busy := s.state.Busy()
+	s.mu.Unlock()
+	if busy {
+		return
+	}
+
+	channel := policy.Channel
+	if channel == "" {
+		channel = "release"
+	}
+	tags, err := s.cfg.ListTags(ctx, channel)
+	if err != nil {
+		log.Printf("[auto-update] listing %s tags: %v", channel, err)
+		return
+	}
+	current := s.readCurrentTag()
+	target, skipped := planAutoUpdate(current, tags, policy.MaxBump)
+	if skipped != "" {
+		s.recordSkip(current, target, skipped)
+		return
+	}
+	if target == "" {
+		return
+	}
+
+	if _, ok := s.reserveUpdate(target, "Automatic update queued"); !ok {
+		return
+	}
+	log.Printf("[auto-update] updating %s to %s (%s channel)", current, target, channel)
+	entry := HistoryEntry{Operation: "update", PreviousTag: current, TargetTag: target, RequestedBy: AutoUpdateRequester}
+	s.runAsync(func() {
+		s.recordOperation(entry, func() {
+			s.runUpdateWith(target, updateOptions{requireBackup: policy.RequireBackup})
+		})
+	})
+}
+
+// recordSkip adds a skipped decision to the history unless the last entry
+// there already records it, so a release is skipped once however often it is
+// seen and however often the sidecar restarts.
+func (s *Server) recordSkip(current, target, reason string) {
+	if s.cfg.StateDir == "" {
+		return
+	}
+	entries, err := ReadHistory(s.cfg.StateDir)
+	if err != nil {
+		log.Printf("Warning: could not read update history: %v", err)
+		return
+	}
+	if n := len(entries); n > 0 {
+		last := entries[n-1]
+		if last.Status == "skipped" && last.TargetTag == target && last.Message == reason {
+			return
+		}
+	}
+	log.Printf("[auto-update] %s -> %s %s", current, target, reason)
+
+	now := s.now().UTC()
+	entry := HistoryEntry{Operation: "update", StartedAt: now, FinishedAt: now, PreviousTag: current, TargetTag: target,
+		Status: "skipped", Message: reason, RequestedBy: AutoUpdateRequester}
+	if err := AppendHistory(s.cfg.StateDir, entry); err != nil {
+		log.Printf("Warning: could not record update history: %v", err)
+	}
+}
+
+// windowOpen reports whether now falls in the policy's maintenance window.
+func windowOpen(policy config.AutoUpdatePolicy, now time.Time) (bool, error) {
+	if strings.TrimSpace(policy.Window) == "" {
+		return true, nil
+	}
+	sched, err := cron.Parse(policy.Window)
+	if err != nil {
+		return false, fmt.Errorf("maintenance window: %w", err)
+	}
+	loc, err := time.LoadLocation(policy.Timezone)
+	if err != nil {
+		return false, fmt.Errorf("maintenance window timezone: %w", err)
+	}
+	return sched.Matches(now.In(loc)), nil
+}
+
+// planAutoUpdate picks the tag to update current to: the newest version in
+// tags at most maxBump above it. A bigger step available at the same time is
+// not reported; once the allowed update has been applied, the next check
+// finds only the bigger step. When every newer version is too big a step,
+// target is the newest of them and skipped says why it is not applied. Tags
+// that are not semantic versions, like latest, are ignored.
+func planAutoUpdate(current string, tags []string, maxBump string) (target, skipped string) {
+	cur := canonicalVersion(current)
+	if !semver.IsValid(cur) {
+		return "", ""
+	}
+
+	var newest, allowed string
+	for _, tag := range tags {
+		v := canonicalVersion(tag)
+		if !semver.IsValid(v) || semver.Compare(v, cur) <= 0 {
+			continue
+		}
+		if newest == "" || semver.Compare(v, canonicalVersion(newest)) > 0 {
+			newest = tag
+		}
+		if bumpAllowed(bumpLevel(cur, v), maxBump) && (allowed == "" || semver.Compare(v, canonicalVersion(allowed)) > 0) {
+			allowed = tag
+		}
+	}
+	switch {
+	case allowed != "":
+		return allowed, ""
+	case newest != "":
+		return newest, fmt.Sprintf("skipped: %s bump", bumpLevel(cur, canonicalVersion(newest)))
+	}
+	return "", ""
+}
+
+// bumpLevel classifies the step from one version to a newer one.
+func bumpLevel(from, to string) string {
+	switch {
+	case semver.Major(from) != semver.Major(to):
+		return config.BumpMajor
+	case semver.MajorMinor(from) != semver.MajorMinor(to):
+		return config.BumpMinor
+	}
+	return config.BumpPatch
+}
+
+// bumpAllowed reports whether a bump of level is within maxBump, which
+// defaults to patch.
+func bumpAllowed(level, maxBump string) bool {
+	rank := map[string]int{config.BumpPatch: 0, config.BumpMinor: 1, config.BumpMajor: 2}
+	limit, ok := rank[maxBump]
+	if !ok {
+		limit = rank[config.BumpPatch]
+	}
+	return rank[level] <= limit
+}
+
+func canonicalVersion(tag string) string {
+	if !strings.HasPrefix(tag, "v") {
+		return "v" + tag
+	}
+	return tag
+}
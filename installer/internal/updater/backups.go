@@ -0,0 +1,223 @@
+package updater
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jhandel/KMP/installer/internal/cron"
+	"github.com/jhandel/KMP/installer/internal/notify"
+)
+
+// maxBackupRuns bounds the run history kept in memory and in backups.json.
+const maxBackupRuns = 20
+
+// BackupOutcome describes a backup taken by Config.RunBackup.
+type BackupOutcome struct {
+	ID       string
+	Size     int64
+	Location string
+	Remote   string
+	Pruned   int // backups removed by retention afterwards
+}
+
+// BackupRun records one scheduled backup attempt.
+type BackupRun struct {
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+	Status     string    `json:"status"` // succeeded, failed, skipped
+	BackupID   string    `json:"backupId,omitempty"`
+	Size       int64     `json:"size,omitempty"`
+	Location   string    `json:"location,omitempty"`
+	Remote     string    `json:"remote,omitempty"`
+	Pruned     int       `json:"pruned,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// BackupStatus is the GET /updater/backups response.
+type BackupStatus struct {
+	Enabled  bool        `json:"enabled"`
+	Schedule string      `json:"schedule"`
+	Error    string      `json:"error,omitempty"` // why the schedule is not active
+	Running  bool        `json:"running"`
+	NextRun  *time.Time  `json:"nextRun,omitempty"`
+	LastRun  *BackupRun  `json:"lastRun,omitempty"`
+	Runs     []BackupRun `json:"runs"` // newest first
+}
+
+func (s *Server) handleBackups(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	status := s.backups
+	status.Runs = append([]BackupRun(nil), s.backups.Runs...)
+	s.mu.Unlock()
+
+	if status.Runs == nil {
+		status.Runs = []BackupRun{}
+	}
+	if len(status.Runs) > 0 {
+		status.LastRun = &status.Runs[0]
+	}
+	writeJSON(w, status)
+}
+
+// runBackupScheduler fires Config.RunBackup on the configured cron schedule.
+// The plan is re-read every minute so `kmp backup schedule` takes effect
+// without restarting the sidecar.
+func (s *Server) runBackupScheduler(ctx context.Context) {
+	s.loadBackupRuns()
+
+	var (
+		planned string
+		next    time.Time
+	)
+	for {
+		enabled, expr := s.cfg.BackupPlan()
+		var schedErr error
+		var sched *cron.Schedule
+		if enabled {
+			sched, schedErr = cron.Parse(expr)
+		}
+
+		if !enabled || schedErr != nil {
+			planned, next = "", time.Time{}
+		} else if expr != planned || next.IsZero() {
+			planned, next = expr, sched.Next(s.now())
+		}
+
+		if !next.IsZero() && !s.now().Before(next) {
+			s.runScheduledBackup(ctx)
+			next = sched.Next(s.now())
+		}
+
+		s.mu.Lock()
+		s.backups.Enabled = enabled
+		s.backups.Schedule = expr
+		s.backups.Error = ""
+		if schedErr != nil {
+			s.backups.Error = schedErr.Error()
+		}
+		s.backups.NextRun = nil
+		if !next.IsZero() {
+			n := next
+			s.backups.NextRun = &n
+		}
+		s.mu.Unlock()
+
+		wait := time.Minute
+		if !next.IsZero() && time.Until(next) < wait {
+			wait = time.Until(next)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// runScheduledBackup takes one backup unless an update is in progress, and
+// records the outcome.
+func (s *Server) runScheduledBackup(ctx context.Context) {
+	run := BackupRun{StartedAt: s.now().UTC()}
+
+	s.mu.Lock()
+	busy := s.state.Busy()
+	if !busy {
+		s.backups.Running = true
+	}
+	s.mu.Unlock()
+
+	if busy {
+		run.Status = "skipped"
+		run.Error = "update in progress"
+	} else {
+		log.Printf("[backup] starting scheduled backup")
+		outcome, err := s.cfg.RunBackup(ctx)
+		run.BackupID = outcome.ID
+		run.Size = outcome.Size
+		run.Location = outcome.Location
+		run.Remote = outcome.Remote
+		run.Pruned = outcome.Pruned
+		if err != nil {
+			run.Status = "failed"
+			run.Error = err.Error()
+		} else {
+			run.Status = "succeeded"
+		}
+	}
+	run.FinishedAt = s.now().UTC()
+	log.Printf("[backup] %s %s %s", run.Status, run.BackupID, run.Error)
+	switch run.Status {
+	case "succeeded":
+		s.notify(notify.Event{Type: notify.EventBackupSucceeded, BackupID: run.BackupID, Message: run.Location})
+	case "failed":
+		s.notify(notify.Event{Type: notify.EventBackupFailed, BackupID: run.BackupID, Error: run.Error})
+	}
+
+	s.mu.Lock()
+	if run.Status == "succeeded" {
+		s.metrics.observeBackup(run.FinishedAt)
+	}
+	s.backups.Running = false
+	s.backups.Runs = append([]BackupRun{run}, s.backups.Runs...)
+	if len(s.backups.Runs) > maxBackupRuns {
+		s.backups.Runs = s.backups.Runs[:maxBackupRuns]
+	}
+	runs := append([]BackupRun(nil), s.backups.Runs...)
+	s.mu.Unlock()
+
+	if err := s.saveBackupRuns(runs); err != nil {
+		log.Printf("Warning: could not persist backup history: %v", err)
+	}
+}
+
+func (s *Server) backupRunsPath() string {
+	return filepath.Join(s.cfg.StateDir, "backups.json")
+}
+
+// loadBackupRuns restores the run history saved by a previous sidecar.
+func (s *Server) loadBackupRuns() {
+	if s.cfg.StateDir == "" {
+		return
+	}
+	data, err := os.ReadFile(s.backupRunsPath())
+	if err != nil {
+		return
+	}
+	var runs []BackupRun
+	if err := json.Unmarshal(data, &runs); err != nil {
+		log.Printf("Warning: ignoring unreadable %s: %v", s.backupRunsPath(), err)
+		return
+	}
+	s.mu.Lock()
+	s.backups.Runs = runs
+	for _, run := range runs {
+		if run.Status == "succeeded" {
+			s.metrics.observeBackup(run.FinishedAt)
+		}
+	}
+	s.mu.Unlock()
+}
+
+func (s *Server) saveBackupRuns(runs []BackupRun) error {
+	if s.cfg.StateDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(s.cfg.StateDir, 0750); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(runs, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.backupRunsPath() + ".partial"
+	if err := os.WriteFile(tmp, data, 0640); err != nil {
+		return fmt.Errorf("writing backup history: %w", err)
+	}
+	return os.Rename(tmp, s.backupRunsPath())
+}
@@ -0,0 +1,222 @@
+package updater
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+const (
+	// primaryContainer serves traffic between updates.
+	primaryContainer = "kmp-app"
+	// candidateContainer runs the new tag during a blue/green update.
+	candidateContainer = "kmp-app-next"
+
+	// defaultDrainPeriod is how long requests already sent to a container
+	// get to finish after Caddy stops routing to it.
+	defaultDrainPeriod = 10 * time.Second
+)
+
+// upstreamPattern matches the app upstream in the generated Caddyfile.
+var upstreamPattern = regexp.MustCompile(`(reverse_proxy\s+)kmp-app(?:-next)?(:\d+)`)
+
+// blueGreen reports whether updates use the blue/green strategy.
+func (s *Server) blueGreen() bool {
+	return s.cfg.BlueGreen != nil && s.cfg.BlueGreen()
+}
+
+// runBlueGreen finishes an update, after the image is pulled, without taking
+// the app offline:
+// 1. Start the new tag as kmp-app-next next to kmp-app
+// 2. Health-check kmp-app-next directly; if it fails, remove it and stop
+// 3. Point Caddy at kmp-app-next and drain kmp-app
+// 4. Recreate kmp-app on the new tag and health-check it
+// 5. Point Caddy back at kmp-app, drain and remove kmp-app-next
+//
+// Until step 3 kmp-app keeps serving the previous tag, so a failure or a
+// cancel only has to discard the candidate. From step 3 on the update runs
+// to the end and cannot be cancelled.
+func (s *Server) runBlueGreen(ctx context.Context, targetTag, previousTag, backupID string) {
+	s.setState("candidate_starting", fmt.Sprintf("Starting %s alongside %s...", candidateContainer, primaryContainer), 40)
+	if err := s.removeContainerByName(candidateContainer); err != nil {
+		log.Printf("Warning: failed to remove leftover %s: %v", candidateContainer, err)
+	}
+	err := s.dockerComposeWithImageTag(ctx, targetTag, "run", "-d", "--no-deps", "--name", candidateContainer, s.cfg.AppServiceName)
+	if err != nil || ctx.Err() != nil {
+		s.discardCandidate(ctx, targetTag, previousTag, backupID, fmt.Sprintf("Starting %s failed: %v", targetTag, err))
+		return
+	}
+
+	s.setState("candidate_health_check", fmt.Sprintf("Waiting for %s to pass its health check...", candidateContainer), 50)
+	if err := s.waitForCandidate(ctx, 120*time.Second); err != nil {
+		s.discardCandidate(ctx, targetTag, previousTag, backupID, fmt.Sprintf("Health check of %s failed: %v", candidateContainer, err))
+		return
+	}
+
+	s.mu.Lock()
+	s.cancelOp = nil
+	s.mu.Unlock()
+	if ctx.Err() != nil {
+		// Cancelled between the health check and now
+		s.discardCandidate(ctx, targetTag, previousTag, backupID, "")
+		return
+	}
+
+	s.setState("switching", fmt.Sprintf("Switching traffic to %s...", candidateContainer), 60)
+	if err := s.switchUpstream(candidateContainer); err != nil {
+		s.discardCandidate(ctx, targetTag, previousTag, backupID, fmt.Sprintf("Switching Caddy to %s failed: %v", candidateContainer, err))
+		return
+	}
+	s.drain(primaryContainer)
+
+	s.setState("starting", fmt.Sprintf("Recreating %s on %s...", primaryContainer, targetTag), 70)
+	if err := s.updateEnvTag(targetTag); err != nil {
+		log.Printf("Warning: could not persist KMP_IMAGE_TAG to .env; continuing with runtime override: %v", err)
+	}
+	if err := s.recreateAppContainer(context.Background(), targetTag); err != nil {
+		s.failAfterSwitch(fmt.Sprintf("Recreating %s on %s failed: %v", primaryContainer, targetTag, err))
+		return
+	}
+	s.setState("health_check", "Waiting for health check...", 80)
+	if err := s.waitForHealthy(context.Background(), 120*time.Second); err != nil {
+		s.failAfterSwitch(fmt.Sprintf("Health check of %s failed: %v", primaryContainer, err))
+		return
+	}
+
+	s.setState("switching", fmt.Sprintf("Switching traffic back to %s...", primaryContainer), 90)
+	if err := s.switchUpstream(primaryContainer); err != nil {
+		s.failAfterSwitch(fmt.Sprintf("Switching Caddy back to %s failed: %v", primaryContainer, err))
+		return
+	}
+	s.drain(candidateContainer)
+	if err := s.removeContainerByName(candidateContainer); err != nil {
+		log.Printf("Warning: failed to remove %s: %v", candidateContainer, err)
+	}
+
+	s.setState("completed", fmt.Sprintf("Updated to %s without downtime", targetTag), 100)
+}
+
+// discardCandidate removes a candidate that never received traffic and ends
+// the update with kmp-app still serving the previous tag. An empty reason
+// means the update was cancelled.
+func (s *Server) discardCandidate(ctx context.Context, targetTag, previousTag, backupID, reason string) {
+	if err := s.removeContainerByName(candidateContainer); err != nil {
+		log.Printf("Warning: failed to remove %s: %v", candidateContainer, err)
+	}
+	cancelled := ctx.Err() != nil
+	if !cancelled {
+		// Not switching is the rollback
+		s.mu.Lock()
+		s.outcome.rolledBack = true
+		s.mu.Unlock()
+		reason += fmt.Sprintf("; %s never received traffic", candidateContainer)
+	}
+	s.abortUpdate(cancelled, targetTag, previousTag, backupID, reason)
+}
+
+// failAfterSwitch ends an update whose candidate is already serving. The
+// candidate runs the new tag and passed its health check, so traffic stays
+// on it rather than going back to a container that failed. The next update
+// starts by moving traffic back; see reclaimTraffic.
+func (s *Server) failAfterSwitch(reason string) {
+	s.noteFailure(reason)
+	s.setState("failed", fmt.Sprintf("%s; traffic left on %s, intervention required", reason, candidateContainer), 0)
+}
+
+// reclaimTraffic makes sure kmp-app is serving before an update starts.
+// After failAfterSwitch Caddy is left on kmp-app-next, and the next update
+// would otherwise remove that container as a leftover while it carries the
+// traffic. Traffic goes back to kmp-app when it is healthy; otherwise the
+// update is refused.
+func (s *Server) reclaimTraffic(ctx context.Context) error {
+	data, err := os.ReadFile(filepath.Join(s.cfg.ComposeDir, "Caddyfile"))
+	if err != nil || !bytes.Contains(upstreamPattern.Find(data), []byte(candidateContainer)) {
+		return nil
+	}
+	log.Printf("[update] Caddy still proxies to %s from an earlier update; checking %s", candidateContainer, primaryContainer)
+	if err := s.waitForHealthy(ctx, 30*time.Second); err != nil {
+		return fmt.Errorf("traffic is still on %s and %s is not healthy (%v); not updating until %s is repaired", candidateContainer, primaryContainer, err, primaryContainer)
+	}
+	if err := s.switchUpstream(primaryContainer); err != nil {
+		return fmt.Errorf("switching Caddy back to %s: %w", primaryContainer, err)
+	}
+	s.drain(candidateContainer)
+	if err := s.removeContainerByName(candidateContainer); err != nil {
+		log.Printf("Warning: failed to remove %s: %v", candidateContainer, err)
+	}
+	return nil
+}
+
+// retireCandidate points Caddy back at kmp-app and removes kmp-app-next. It
+// cleans up after a blue/green update interrupted by a sidecar restart.
+func (s *Server) retireCandidate() {
+	if err := s.switchUpstream(primaryContainer); err != nil {
+		log.Printf("Warning: could not switch Caddy back to %s: %v", primaryContainer, err)
+	}
+	if err := s.removeContainerByName(candidateContainer); err != nil {
+		log.Printf("Warning: failed to remove %s: %v", candidateContainer, err)
+	}
+}
+
+// switchUpstream points Caddy's reverse_proxy at host and reloads it. The
+// Caddyfile is a single-file bind mount into Caddy, so it is rewritten in
+// place rather than replaced by a rename.
+func (s *Server) switchUpstream(host string) error {
+	path := filepath.Join(s.cfg.ComposeDir, "Caddyfile")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading Caddyfile: %w", err)
+	}
+	if !upstreamPattern.Match(data) {
+		return fmt.Errorf("no reverse_proxy %s upstream in %s", primaryContainer, path)
+	}
+	updated := upstreamPattern.ReplaceAll(data, []byte("${1}"+host+"${2}"))
+	if bytes.Equal(updated, data) {
+		return nil
+	}
+
+	if err := os.WriteFile(path, updated, 0644); err != nil {
+		return fmt.Errorf("writing Caddyfile: %w", err)
+	}
+	if err := s.dockerCompose("exec", "-T", "caddy", "caddy", "reload", "--config", "/etc/caddy/Caddyfile", "--adapter", "caddyfile"); err != nil {
+		// Caddy keeps its old config; keep the file in step with it
+		_ = os.WriteFile(path, data, 0644)
+		return fmt.Errorf("reloading Caddy: %w", err)
+	}
+	log.Printf("[update] Caddy now proxies to %s", host)
+	return nil
+}
+
+// drain gives requests in flight to container time to finish.
+func (s *Server) drain(container string) {
+	if s.drainPeriod <= 0 {
+		return
+	}
+	log.Printf("[update] draining %s for %s", container, s.drainPeriod)
+	time.Sleep(s.drainPeriod)
+}
+
+// waitForCandidate polls kmp-app-next's health endpoint: HealthURL with the
+// host swapped for the candidate's container name.
+func (s *Server) waitForCandidate(ctx context.Context, timeout time.Duration) error {
+	if s.waitForCandidateFn != nil {
+		return s.waitForCandidateFn(timeout)
+	}
+
+	u, err := url.Parse(s.cfg.HealthURL)
+	if err != nil {
+		return fmt.Errorf("parsing health URL: %w", err)
+	}
+	host := candidateContainer
+	if port := u.Port(); port != "" {
+		host += ":" + port
+	}
+	u.Host = host
+	return s.pollHealth(ctx, u.String(), timeout)
+}
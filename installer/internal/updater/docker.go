@@ -1,7 +1,10 @@
 package updater
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -11,91 +14,289 @@ import (
 	"path/filepath"
 	"strings"
 	"time"
+
+	"github.com/jhandel/KMP/installer/internal/dockerapi"
 )
 
 // runUpdate executes the full update sequence:
 // 1. Record previous tag
-// 2. Pull new image
-// 3. Update .env with new tag
-// 4. Recreate app container
-// 5. Wait for health check
-// 6. Auto-rollback on failure
+// 2. Back up the database
+// 3. Pull new image
+// 4. Run database migrations in a one-off container of the new image
+// 5. Update .env with new tag
+// 6. Recreate app container
+// 7. Wait for health check
+// 8. Auto-rollback on failure, restoring the backup if the policy says so
+//
+// POST /updater/cancel cancels the context of steps 2-7. Before step 5 the
+// running app is untouched; after it a cancel rolls back like a failure.
+// With the blue/green strategy steps 5-8 are replaced by runBlueGreen.
 func (s *Server) runUpdate(targetTag string) {
+	s.runUpdateWith(targetTag, updateOptions{})
+}
+
+// updateOptions adjust runUpdate for updates nobody is watching.
+type updateOptions struct {
+	// requireBackup stops the update when the pre-update backup was taken
+	// but not copied off-host
+	requireBackup bool
+	// digest, when set, is pulled and tagged as the target tag instead of
+	// pulling the tag, which may have been pushed again since
+	digest string
+}
+
+func (s *Server) runUpdateWith(targetTag string, opts updateOptions) {
 	imageRef := fmt.Sprintf("%s:%s", s.cfg.ImageRepo, targetTag)
 
 	// Determine current tag from .env
 	previousTag := s.readCurrentTag()
 
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
 	s.mu.Lock()
 	s.state.TargetTag = targetTag
 	s.state.PreviousTag = previousTag
+	s.state.BackupID = ""
+	s.state.Recovered = false
+	s.outcome = operationOutcome{}
+	s.cancelOp = cancel
 	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.cancelOp = nil
+		s.mu.Unlock()
+	}()
+
+	// A failed blue/green update may have left traffic on the candidate
+	if err := s.reclaimTraffic(ctx); err != nil {
+		s.setState("failed", err.Error(), 0)
+		return
+	}
+
+	// Step 0: Snapshot the database so a bad migration can be undone
+	backupID, err := s.preUpdateBackup(ctx, previousTag, targetTag, opts.requireBackup)
+	if ctx.Err() != nil {
+		s.setState("cancelled", fmt.Sprintf("Update to %s cancelled during backup; still on %s", targetTag, previousTag), 0)
+		return
+	}
+	if err != nil {
+		s.setState("failed", fmt.Sprintf("Pre-update backup failed, not updating: %v", err), 0)
+		return
+	}
 
 	// Step 1: Pull new image
-	s.setState("pulling", fmt.Sprintf("Pulling %s...", imageRef), 10)
-	if err := s.dockerComposeWithImageTag(targetTag, "pull", s.cfg.AppServiceName); err != nil {
+	pullRef := imageRef
+	if opts.digest != "" {
+		pullRef = s.cfg.ImageRepo + "@" + opts.digest
+	}
+	s.setState("pulling", fmt.Sprintf("Pulling %s...", pullRef), 10)
+	err = s.pullImage(ctx, pullRef)
+	if err == nil && opts.digest != "" {
+		err = s.tagImage(ctx, pullRef, targetTag)
+	}
+	if ctx.Err() != nil {
+		s.setState("cancelled", fmt.Sprintf("Update to %s cancelled during pull; still on %s", targetTag, previousTag), 0)
+		return
+	}
+	if err != nil {
 		s.setState("failed", fmt.Sprintf("Pull failed: %v", err), 0)
 		return
 	}
 
-	// Step 2: Update .env
+	// Step 2: Migrate the database while the previous tag keeps serving
+	err = s.runMigrations(ctx, targetTag)
+	if ctx.Err() != nil {
+		s.abortUpdate(true, targetTag, previousTag, backupID, "")
+		return
+	}
+	if err != nil {
+		s.abortUpdate(false, targetTag, previousTag, backupID, err.Error())
+		return
+	}
+
+	if s.blueGreen() {
+		s.runBlueGreen(ctx, targetTag, previousTag, backupID)
+		return
+	}
+
+	// Step 3: Update .env
 	s.setState("stopping", "Updating image tag...", 30)
 	if err := s.updateEnvTag(targetTag); err != nil {
 		log.Printf("Warning: could not persist KMP_IMAGE_TAG to .env; continuing with runtime override: %v", err)
 	}
 
-	// Step 3: Recreate app container with new image
+	// Step 4: Recreate app container with new image
 	s.setState("starting", "Recreating app container...", 50)
-	if err := s.recreateAppContainer(targetTag); err != nil {
-		log.Printf("Failed to start new container, rolling back to %s", previousTag)
-		s.rollbackTag(previousTag)
+	if err := s.recreateAppContainer(ctx, targetTag); err != nil || ctx.Err() != nil {
+		if ctx.Err() != nil {
+			s.setState("rolling_back", "Update cancelled, rolling back...", 80)
+		} else {
+			log.Printf("Failed to start new container, rolling back to %s", previousTag)
+			s.noteFailure(fmt.Sprintf("Starting %s failed: %v", targetTag, err))
+		}
+		s.rollbackFailedUpdate(previousTag, backupID)
 		return
 	}
 
-	// Step 4: Wait for health check
+	// Step 5: Wait for health check
 	s.setState("health_check", "Waiting for health check...", 70)
-	if err := s.waitForHealthy(120 * time.Second); err != nil {
-		log.Printf("Health check failed, rolling back to %s: %v", previousTag, err)
-		s.setState("rolling_back", "Health check failed, rolling back...", 80)
-		s.rollbackTag(previousTag)
+	if err := s.waitForHealthy(ctx, 120*time.Second); err != nil {
+		if ctx.Err() != nil {
+			s.setState("rolling_back", "Update cancelled, rolling back...", 80)
+		} else {
+			log.Printf("Health check failed, rolling back to %s: %v", previousTag, err)
+			s.setState("rolling_back", "Health check failed, rolling back...", 80)
+			s.noteFailure(fmt.Sprintf("Health check failed: %v", err))
+		}
+		s.rollbackFailedUpdate(previousTag, backupID)
 		return
 	}
 
 	s.setState("completed", fmt.Sprintf("Updated to %s", targetTag), 100)
 }
 
-// rollbackTag reverts to a previous image tag.
-func (s *Server) rollbackTag(tag string) {
+// preUpdateBackup takes the database snapshot an update can fall back to.
+// It returns an empty ID when no backup hook is configured. A backup whose
+// off-host copy failed is enough unless strict is set.
+func (s *Server) preUpdateBackup(ctx context.Context, previousTag, targetTag string, strict bool) (string, error) {
+	if s.cfg.PreUpdateBackup == nil {
+		return "", nil
+	}
+	s.setState("backing_up", "Backing up database before update...", 5)
+	outcome, err := s.cfg.PreUpdateBackup(ctx, fmt.Sprintf("pre-update %s -> %s", previousTag, targetTag))
+	if err != nil && outcome.ID == "" {
+		return "", err
+	}
+	if err != nil && strict {
+		return "", fmt.Errorf("backup %s was not copied off-host: %w", outcome.ID, err)
+	}
+	if err != nil {
+		// Written locally; only the off-host copy failed
+		log.Printf("Warning: pre-update backup %s was not copied off-host: %v", outcome.ID, err)
+	}
+	s.mu.Lock()
+	s.state.BackupID = outcome.ID
+	s.metrics.observeBackup(s.now().UTC())
+	s.mu.Unlock()
+	return outcome.ID, nil
+}
+
+// abortUpdate ends an update that failed or was cancelled before the app
+// container was touched. Only the database can have changed, so the
+// pre-update backup is restored when RestoreOnFailure says so; otherwise the
+// app keeps serving the previous tag as it is.
+func (s *Server) abortUpdate(cancelled bool, targetTag, previousTag, backupID, reason string) {
+	if !cancelled {
+		s.noteFailure(reason)
+	}
+	if backupID != "" && s.cfg.RestoreBackup != nil && s.cfg.RestoreOnFailure != nil && s.cfg.RestoreOnFailure() {
+		s.setState("rolling_back", fmt.Sprintf("Update to %s abandoned, rolling back...", targetTag), 80)
+		s.rollbackFailedUpdate(previousTag, backupID)
+		return
+	}
+
+	detail := ""
+	if backupID != "" {
+		detail = fmt.Sprintf("; database not restored (pre-update backup %s)", backupID)
+	}
+	if cancelled {
+		s.setState("cancelled", fmt.Sprintf("Update to %s cancelled; %s is still serving %s%s", targetTag, primaryContainer, previousTag, detail), 0)
+		return
+	}
+	s.setState("failed", fmt.Sprintf("%s; %s is still serving %s%s", reason, primaryContainer, previousTag, detail), 0)
+}
+
+// rollbackFailedUpdate reverts to the previous tag, first restoring the
+// pre-update backup when RestoreOnFailure allows it so the old code never
+// starts against a schema it does not know.
+func (s *Server) rollbackFailedUpdate(previousTag, backupID string) {
+	if backupID == "" {
+		s.rollbackTag(previousTag, "")
+		return
+	}
+	if s.cfg.RestoreBackup == nil || s.cfg.RestoreOnFailure == nil || !s.cfg.RestoreOnFailure() {
+		s.rollbackTag(previousTag, fmt.Sprintf("; database not restored (pre-update backup %s)", backupID))
+		return
+	}
+
+	s.setState("restoring", fmt.Sprintf("Restoring database from pre-update backup %s...", backupID), 85)
+	if err := s.dockerCompose("stop", s.cfg.AppServiceName); err != nil {
+		log.Printf("Warning: failed to stop app service before restore: %v", err)
+	}
+	if err := s.cfg.RestoreBackup(context.Background(), backupID); err != nil {
+		s.setState("failed", fmt.Sprintf("Restoring pre-update backup %s failed, app left stopped: %v", backupID, err), 0)
+		return
+	}
+	s.rollbackTag(previousTag, fmt.Sprintf("; database restored from %s", backupID))
+}
+
+// rollbackTag reverts to a previous image tag; detail is appended to the
+// final status message.
+func (s *Server) rollbackTag(tag, detail string) {
 	if err := s.updateEnvTag(tag); err != nil {
 		log.Printf("Warning: could not persist rollback tag to .env; continuing with runtime override: %v", err)
 	}
-	if err := s.recreateAppContainer(tag); err != nil {
+	if err := s.recreateAppContainer(context.Background(), tag); err != nil {
 		s.setState("failed", fmt.Sprintf("Rollback container restart failed: %v", err), 0)
 		return
 	}
-	s.setState("failed", fmt.Sprintf("Rolled back to %s after update failure", tag), 0)
+	s.mu.Lock()
+	s.outcome.rolledBack = true
+	cancelled := s.outcome.cancelled
+	s.mu.Unlock()
+	if cancelled {
+		s.setState("cancelled", fmt.Sprintf("Rolled back to %s after the update was cancelled%s", tag, detail), 0)
+		return
+	}
+	s.setState("failed", fmt.Sprintf("Rolled back to %s after update failure%s", tag, detail), 0)
 }
 
-func (s *Server) recreateAppContainer(imageTag string) error {
+// noteFailure records why the running operation is being rolled back; the
+// final state only says that it was.
+func (s *Server) noteFailure(reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.outcome.failure = reason
+}
+
+func (s *Server) recreateAppContainer(ctx context.Context, imageTag string) error {
 	if err := s.dockerCompose("stop", s.cfg.AppServiceName); err != nil {
 		log.Printf("Warning: failed to stop app service before recreate: %v", err)
 	}
 	if err := s.dockerCompose("rm", "-f", s.cfg.AppServiceName); err != nil {
 		log.Printf("Warning: failed to remove app service before recreate: %v", err)
 	}
-	err := s.dockerComposeWithImageTag(imageTag, "up", "-d", "--no-deps", s.cfg.AppServiceName)
+	err := s.dockerComposeWithImageTag(ctx, imageTag, "up", "-d", "--no-deps", s.cfg.AppServiceName)
 	if err == nil {
 		return nil
 	}
-	if !isContainerNameConflict(err) {
+	if !s.strayContainer(primaryContainer, err) {
 		return err
 	}
 
-	log.Printf("Detected container name conflict for kmp-app, force-removing and retrying once")
-	if rmErr := s.removeContainerByName("kmp-app"); rmErr != nil {
-		return fmt.Errorf("%v (also failed to remove kmp-app: %w)", err, rmErr)
+	log.Printf("A %s container outside the compose service is in the way, force-removing it and retrying once", primaryContainer)
+	if rmErr := s.removeContainerByName(primaryContainer); rmErr != nil {
+		return fmt.Errorf("%v (also failed to remove %s: %w)", err, primaryContainer, rmErr)
 	}
-	return s.dockerComposeWithImageTag(imageTag, "up", "-d", "--no-deps", s.cfg.AppServiceName)
+	return s.dockerComposeWithImageTag(ctx, imageTag, "up", "-d", "--no-deps", s.cfg.AppServiceName)
+}
+
+// strayContainer reports whether a container called name exists that does
+// not belong to the app service of this compose project, such as one left by
+// an older installer or created by hand. Compose cannot take the name over.
+// When the container cannot be inspected, compose's error upErr decides.
+func (s *Server) strayContainer(name string, upErr error) bool {
+	c, err := s.inspectContainer(name)
+	if err != nil {
+		if errors.Is(err, dockerapi.ErrNotFound) {
+			return false
+		}
+		log.Printf("Warning: could not inspect %s: %v", name, err)
+		return isContainerNameConflict(upErr)
+	}
+	labels := c.Config.Labels
+	return labels[dockerapi.LabelComposeProject] != s.composeProjectName() || labels[dockerapi.LabelComposeService] != s.cfg.AppServiceName
 }
 
 func isContainerNameConflict(err error) bool {
@@ -106,44 +307,131 @@ func isContainerNameConflict(err error) bool {
 	return strings.Contains(msg, "container name") && strings.Contains(msg, "is already in use by container")
 }
 
+// removeContainerByName force-removes a container; one that does not exist
+// is already gone.
 func (s *Server) removeContainerByName(name string) error {
 	if s.removeContainerFn != nil {
 		return s.removeContainerFn(name)
 	}
 
-	cmd := exec.Command("docker", "rm", "-f", name)
-	cmd.Env = s.composeEnv()
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err := s.docker.RemoveContainer(ctx, name, dockerapi.RemoveOptions{Force: true}); err != nil && !errors.Is(err, dockerapi.ErrNotFound) {
+		return err
 	}
 	return nil
 }
 
+// inspectContainer returns the Engine API inspect data of a container.
+func (s *Server) inspectContainer(name string) (*dockerapi.Container, error) {
+	if s.inspectContainerFn != nil {
+		return s.inspectContainerFn(name)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return s.docker.InspectContainer(ctx, name)
+}
+
+// tagImage names the local image source ImageRepo:tag, the reference the
+// compose file runs.
+func (s *Server) tagImage(ctx context.Context, source, tag string) error {
+	if s.tagImageFn != nil {
+		return s.tagImageFn(source, tag)
+	}
+	return s.docker.TagImage(ctx, source, s.cfg.ImageRepo, tag)
+}
+
+// pullImage pulls ref through the Engine API. Layer status changes go to
+// GET /updater/events like compose output does, and the share of bytes
+// downloaded moves the progress of the pulling step.
+func (s *Server) pullImage(ctx context.Context, ref string) error {
+	if s.pullImageFn != nil {
+		return s.pullImageFn(ref)
+	}
+
+	var (
+		status      = map[string]string{}
+		size        = map[string]int64{}
+		done        = map[string]int64{}
+		lastPercent = -1
+	)
+	return s.docker.PullImage(ctx, ref, func(p dockerapi.PullProgress) {
+		if p.Layer == "" {
+			s.publishLog(p.Status)
+			return
+		}
+		if status[p.Layer] != p.Status {
+			status[p.Layer] = p.Status
+			s.publishLog(p.Layer + ": " + p.Status)
+		}
+		switch p.Status {
+		case "Downloading":
+			size[p.Layer], done[p.Layer] = p.Total, p.Current
+		case "Download complete", "Pull complete":
+			done[p.Layer] = size[p.Layer]
+		default:
+			return
+		}
+
+		var total, current int64
+		for layer, n := range size {
+			total += n
+			current += done[layer]
+		}
+		if total == 0 {
+			return
+		}
+		// Progress in steps of 10% so the state and journal are not
+		// rewritten for every chunk
+		percent := int(current * 100 / total)
+		if percent/10 == lastPercent/10 {
+			return
+		}
+		lastPercent = percent
+		s.setState("pulling", fmt.Sprintf("Pulling %s... %d%%", ref, percent/10*10), 10+percent*15/100)
+	})
+}
+
 // dockerCompose runs a docker compose command in the compose directory.
 func (s *Server) dockerCompose(args ...string) error {
-	return s.dockerComposeWithImageTag("", args...)
+	return s.dockerComposeWithImageTag(context.Background(), "", args...)
+}
+
+// dockerComposeWithImageTag runs docker compose with an optional KMP_IMAGE_TAG
+// override. Cancelling ctx kills the command.
+func (s *Server) dockerComposeWithImageTag(ctx context.Context, imageTag string, args ...string) error {
+	out, err := s.dockerComposeOutput(ctx, imageTag, args...)
+	if err != nil && s.dockerComposeFn == nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(out))
+	}
+	return err
 }
 
-// dockerComposeWithImageTag runs docker compose with an optional KMP_IMAGE_TAG override.
-func (s *Server) dockerComposeWithImageTag(imageTag string, args ...string) error {
+// dockerComposeOutput is dockerComposeWithImageTag returning the command's
+// combined output separately from its exit status.
+func (s *Server) dockerComposeOutput(ctx context.Context, imageTag string, args ...string) (string, error) {
 	if s.dockerComposeFn != nil {
-		return s.dockerComposeFn(args...)
+		return "", s.dockerComposeFn(args...)
 	}
 
 	fullArgs := append([]string{"compose"}, args...)
-	cmd := exec.Command("docker", fullArgs...)
+	cmd := exec.CommandContext(ctx, "docker", fullArgs...)
 	cmd.Dir = s.cfg.ComposeDir
 	cmd.Env = s.composeEnv()
 	if imageTag != "" {
 		cmd.Env = append(cmd.Env, fmt.Sprintf("KMP_IMAGE_TAG=%s", imageTag))
 	}
 
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
-	}
-	return nil
+	// Output goes to GET /updater/events as it is produced and is kept for
+	// the error message
+	var out bytes.Buffer
+	lines := &lineWriter{fn: s.publishLog}
+	cmd.Stdout = io.MultiWriter(&out, lines)
+	cmd.Stderr = cmd.Stdout
+	err := cmd.Run()
+	lines.Flush()
+	return out.String(), err
 }
 
 // readCurrentTag reads the current image tag from the running app container,
@@ -172,13 +460,12 @@ func (s *Server) readCurrentTag() string {
 }
 
 func (s *Server) readRunningTag() (string, error) {
-	inspectCmd := exec.Command("docker", "inspect", "--format", "{{.Config.Image}}", "kmp-app")
-	inspectOut, err := inspectCmd.Output()
+	c, err := s.inspectContainer(primaryContainer)
 	if err != nil {
 		return "", err
 	}
 
-	imageRef := strings.TrimSpace(string(inspectOut))
+	imageRef := c.Config.Image
 	if imageRef == "" {
 		return "", fmt.Errorf("image ref not found")
 	}
@@ -231,12 +518,11 @@ func (s *Server) composeProjectName() string {
 }
 
 func (s *Server) inspectComposeProject(containerName string) (string, error) {
-	inspectCmd := exec.Command("docker", "inspect", "--format", "{{ index .Config.Labels \"com.docker.compose.project\" }}", containerName)
-	inspectOut, err := inspectCmd.Output()
+	c, err := s.inspectContainer(containerName)
 	if err != nil {
 		return "", err
 	}
-	return strings.TrimSpace(string(inspectOut)), nil
+	return c.Config.Labels[dockerapi.LabelComposeProject], nil
 }
 
 // updateEnvTag updates the KMP_IMAGE_TAG in .env to the given tag.
@@ -267,39 +553,61 @@ func (s *Server) updateEnvTag(tag string) error {
 	return os.WriteFile(envPath, []byte(strings.Join(lines, "\n")), 0644)
 }
 
-// waitForHealthy polls the health endpoint until it returns healthy or timeout.
-func (s *Server) waitForHealthy(timeout time.Duration) error {
+// waitForHealthy polls the health endpoint until it returns healthy, timeout
+// elapses or ctx is cancelled.
+func (s *Server) waitForHealthy(ctx context.Context, timeout time.Duration) error {
 	if s.waitForHealthyFn != nil {
 		return s.waitForHealthyFn(timeout)
 	}
+	return s.pollHealth(ctx, s.cfg.HealthURL, timeout)
+}
 
+// pollHealth polls healthURL until it reports ok with a database connection.
+func (s *Server) pollHealth(ctx context.Context, healthURL string, timeout time.Duration) error {
 	client := &http.Client{Timeout: 5 * time.Second}
 	deadline := time.Now().Add(timeout)
 
 	for time.Now().Before(deadline) {
-		resp, err := client.Get(s.cfg.HealthURL)
-		if err == nil {
-			healthy := false
-			if resp.StatusCode == http.StatusOK {
-				var health struct {
-					Status string `json:"status"`
-					DB     bool   `json:"db"`
-					Cache  bool   `json:"cache"`
-				}
-				if json.NewDecoder(resp.Body).Decode(&health) == nil {
-					if health.Status == "ok" && health.DB {
-						healthy = true
-					}
-				}
-			}
-			_, _ = io.Copy(io.Discard, resp.Body)
-			_ = resp.Body.Close()
-			if healthy {
-				return nil
-			}
+		if checkHealth(ctx, client, healthURL) == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(3 * time.Second):
 		}
-		time.Sleep(3 * time.Second)
 	}
 
 	return fmt.Errorf("health check timed out after %s", timeout)
 }
+
+// checkHealth makes one request to healthURL; nil means the app reported ok
+// with a database connection.
+func checkHealth(ctx context.Context, client *http.Client, healthURL string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, healthURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	defer io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("health endpoint returned HTTP %d", resp.StatusCode)
+	}
+	var health struct {
+		Status string `json:"status"`
+		DB     bool   `json:"db"`
+		Cache  bool   `json:"cache"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&health); err != nil {
+		return fmt.Errorf("decoding health response: %w", err)
+	}
+	if health.Status != "ok" || !health.DB {
+		return fmt.Errorf("app reports status %q (db: %t)", health.Status, health.DB)
+	}
+	return nil
+}
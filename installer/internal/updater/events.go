@@ -0,0 +1,278 @@
+package updater
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxBufferedEvents bounds the replay buffer a reconnecting client can
+	// resume from.
+	maxBufferedEvents = 1000
+	// subscriberBuffer is how far a slow client may fall behind before it is
+	// disconnected; it resumes from the replay buffer on reconnect.
+	subscriberBuffer = 256
+	// eventKeepAlive is the interval of SSE comments that keep idle
+	// connections (and proxies) from timing out.
+	eventKeepAlive = 15 * time.Second
+)
+
+// Event types sent on GET /updater/events.
+const (
+	EventState = "state" // a State transition
+	EventLog   = "log"   // one line of docker compose output
+)
+
+// Event is one entry in the updater's event stream. IDs increase
+// monotonically for the lifetime of the sidecar process.
+type Event struct {
+	ID    uint64    `json:"id"`
+	Type  string    `json:"type"`
+	Time  time.Time `json:"time"`
+	State *State    `json:"state,omitempty"`
+	Line  string    `json:"line,omitempty"`
+}
+
+// eventLog fans events out to subscribers and keeps the most recent ones
+// for clients that reconnect with Last-Event-ID.
+type eventLog struct {
+	mu     sync.Mutex
+	lastID uint64
+	buf    []Event
+	subs   map[chan Event]struct{}
+}
+
+func newEventLog() *eventLog {
+	return &eventLog{subs: map[chan Event]struct{}{}}
+}
+
+// publish assigns ev the next ID and delivers it.
+func (l *eventLog) publish(ev Event) Event {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.lastID++
+	ev.ID = l.lastID
+	l.buf = append(l.buf, ev)
+	if len(l.buf) > maxBufferedEvents {
+		l.buf = append([]Event(nil), l.buf[len(l.buf)-maxBufferedEvents:]...)
+	}
+	for ch := range l.subs {
+		select {
+		case ch <- ev:
+		default:
+			// Too slow; drop it rather than block the update
+			delete(l.subs, ch)
+			close(ch)
+		}
+	}
+	return ev
+}
+
+// subscribe returns the buffered events after since and a channel of live
+// events. gap reports that events after since have already been evicted.
+func (l *eventLog) subscribe(since uint64) (backlog []Event, live chan Event, gap bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, ev := range l.buf {
+		if ev.ID > since {
+			backlog = append(backlog, ev)
+		}
+	}
+	// A since beyond lastID comes from before a sidecar restart
+	gap = since > l.lastID || (since < l.lastID && (len(l.buf) == 0 || l.buf[0].ID > since+1))
+	live = make(chan Event, subscriberBuffer)
+	l.subs[live] = struct{}{}
+	return backlog, live, gap
+}
+
+func (l *eventLog) unsubscribe(ch chan Event) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.subs[ch]; ok {
+		delete(l.subs, ch)
+		close(ch)
+	}
+}
+
+// latestID returns the ID of the most recent event.
+func (l *eventLog) latestID() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.lastID
+}
+
+// publishState sends a snapshot of the current state. The caller holds s.mu.
+func (s *Server) publishState() {
+	state := s.state
+	s.events.publish(Event{Type: EventState, Time: s.now().UTC(), State: &state})
+}
+
+// publishLog sends one line of command output.
+func (s *Server) publishLog(line string) {
+	s.events.publish(Event{Type: EventLog, Time: s.now().UTC(), Line: line})
+}
+
+// handleEvents streams Events as Server-Sent Events. A client that sends
+// Last-Event-ID (or ?lastEventId= where headers cannot be set) gets the
+// buffered events it missed; a new client, or one that fell too far behind,
+// starts from a snapshot of the current state.
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSONError(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("lastEventId")
+	}
+	since, err := strconv.ParseUint(lastID, 10, 64)
+	resume := err == nil
+	if lastID != "" && !resume {
+		writeJSONError(w, "invalid Last-Event-ID", http.StatusBadRequest)
+		return
+	}
+
+	backlog, live, gap := s.events.subscribe(since)
+	defer s.events.unsubscribe(live)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	if !resume || gap {
+		// The snapshot carries the latest ID so a reconnect resumes after
+		// it. Reading the ID first means nothing published meanwhile is lost.
+		snapshot := Event{ID: s.events.latestID(), Type: EventState}
+		s.mu.Lock()
+		state := s.state
+		s.mu.Unlock()
+		snapshot.Time, snapshot.State = s.now().UTC(), &state
+		if err := writeEvent(w, snapshot); err != nil {
+			return
+		}
+		backlog = nil
+		since = snapshot.ID
+	}
+	for _, ev := range backlog {
+		if err := writeEvent(w, ev); err != nil {
+			return
+		}
+		since = ev.ID
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev, ok := <-live:
+			if !ok {
+				// Dropped for falling behind; the client reconnects
+				return
+			}
+			if ev.ID <= since {
+				continue
+			}
+			if err := writeEvent(w, ev); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-keepAlive.C:
+			if _, err := io.WriteString(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// writeEvent writes ev in SSE framing with its JSON encoding as data.
+func writeEvent(w io.Writer, ev Event) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.ID, ev.Type, data)
+	return err
+}
+
+// ReadEvents parses an SSE stream from GET /updater/events, calling fn for
+// each event until the stream ends or fn returns false. It returns the ID of
+// the last event seen, which a reconnecting client sends as Last-Event-ID.
+func ReadEvents(r io.Reader, fn func(Event) bool) (uint64, error) {
+	var (
+		lastID uint64
+		data   strings.Builder
+	)
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case line == "":
+			if data.Len() == 0 {
+				continue
+			}
+			var ev Event
+			if err := json.Unmarshal([]byte(data.String()), &ev); err != nil {
+				return lastID, fmt.Errorf("parsing updater event: %w", err)
+			}
+			data.Reset()
+			lastID = ev.ID
+			if !fn(ev) {
+				return lastID, nil
+			}
+		case strings.HasPrefix(line, "data:"):
+			if data.Len() > 0 {
+				data.WriteByte('\n')
+			}
+			data.WriteString(strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+		// id:, event: and comment lines are redundant with the JSON payload
+	}
+	return lastID, sc.Err()
+}
+
+// lineWriter calls fn for every line written to it. Carriage returns end a
+// line too, so progress output that redraws in place is streamed.
+type lineWriter struct {
+	fn      func(string)
+	partial []byte
+}
+
+func (lw *lineWriter) Write(p []byte) (int, error) {
+	for _, b := range p {
+		if b == '\n' || b == '\r' {
+			lw.emit()
+			continue
+		}
+		lw.partial = append(lw.partial, b)
+	}
+	return len(p), nil
+}
+
+// Flush emits a trailing line that had no terminator.
+func (lw *lineWriter) Flush() {
+	lw.emit()
+}
+
+func (lw *lineWriter) emit() {
+	if line := strings.TrimSpace(string(lw.partial)); line != "" {
+		lw.fn(line)
+	}
+	lw.partial = lw.partial[:0]
+}
@@ -0,0 +1,251 @@
+package updater
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jhandel/KMP/installer/internal/notify"
+)
+
+const (
+	// DefaultStateDir is the sidecar's state directory, relative to the
+	// compose directory.
+	DefaultStateDir = ".kmp-updater"
+	// HistoryFile is the append-only operation log inside the state dir.
+	HistoryFile = "history.jsonl"
+
+	defaultHistoryLimit = 20
+	maxHistoryLimit     = 200
+)
+
+// HistoryEntry records one finished update or rollback, or an automatic
+// update the policy decided against.
+type HistoryEntry struct {
+	Operation   string    `json:"operation"` // update, rollback
+	StartedAt   time.Time `json:"startedAt"`
+	FinishedAt  time.Time `json:"finishedAt"`
+	PreviousTag string    `json:"previousTag,omitempty"`
+	TargetTag   string    `json:"targetTag"`
+	Status      string    `json:"status"` // completed, failed, cancelled, rolled_back, skipped
+	Message     string    `json:"message,omitempty"`
+	Error       string    `json:"error,omitempty"` // why the operation failed
+	RequestedBy string    `json:"requestedBy,omitempty"`
+	BackupID    string    `json:"backupId,omitempty"`
+	Recovered   bool      `json:"recovered,omitempty"` // finished after a sidecar restart
+
+	MigrationOutput string `json:"migrationOutput,omitempty"` // tail of the migrating step's output
+}
+
+// HistoryPage is the GET /updater/history response.
+type HistoryPage struct {
+	Entries []HistoryEntry `json:"entries"` // newest first
+	Total   int            `json:"total"`
+	Limit   int            `json:"limit"`
+	Offset  int            `json:"offset"`
+}
+
+// historyMu serialises appends from this process; each entry is a single
+// O_APPEND write, so other writers (the kmp CLI) interleave whole lines.
+var historyMu sync.Mutex
+
+// AppendHistory adds e to the history file in stateDir.
+func AppendHistory(stateDir string, e HistoryEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	historyMu.Lock()
+	defer historyMu.Unlock()
+
+	if err := os.MkdirAll(stateDir, 0750); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(stateDir, HistoryFile), os.O_RDWR|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	line := append(data, '\n')
+	// Start on a fresh line when a crash cut the last write short, so only
+	// the broken entry is lost
+	if info, err := f.Stat(); err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := f.ReadAt(last, info.Size()-1); err == nil && last[0] != '\n' {
+			line = append([]byte{'\n'}, line...)
+		}
+	}
+	if _, err := f.Write(line); err != nil {
+		f.Close()
+		return fmt.Errorf("writing update history: %w", err)
+	}
+	return f.Close()
+}
+
+// ReadHistory returns the entries in stateDir's history file, oldest first.
+// A missing file is an empty history; unreadable lines (a write cut short by
+// a crash) are skipped.
+func ReadHistory(stateDir string) ([]HistoryEntry, error) {
+	f, err := os.Open(filepath.Join(stateDir, HistoryFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []HistoryEntry
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		var e HistoryEntry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries, sc.Err()
+}
+
+// PageHistory returns limit entries, newest first, skipping the offset
+// newest ones.
+func PageHistory(entries []HistoryEntry, limit, offset int) HistoryPage {
+	if limit <= 0 {
+		limit = defaultHistoryLimit
+	}
+	limit = min(limit, maxHistoryLimit)
+	offset = max(offset, 0)
+
+	page := HistoryPage{Entries: []HistoryEntry{}, Total: len(entries), Limit: limit, Offset: offset}
+	for i := len(entries) - 1 - offset; i >= 0 && len(page.Entries) < limit; i-- {
+		page.Entries = append(page.Entries, entries[i])
+	}
+	return page
+}
+
+func (s *Server) handleHistory(w http.ResponseWriter, r *http.Request) {
+	limit, offset := 0, 0
+	for name, dst := range map[string]*int{"limit": &limit, "offset": &offset} {
+		v := r.URL.Query().Get(name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeJSONError(w, name+" must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		*dst = n
+	}
+
+	var entries []HistoryEntry
+	if s.cfg.StateDir != "" {
+		var err error
+		if entries, err = ReadHistory(s.cfg.StateDir); err != nil {
+			writeJSONError(w, fmt.Sprintf("reading update history: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+	writeJSON(w, PageHistory(entries, limit, offset))
+}
+
+// requester identifies who asked for an operation: the requestedBy field of
+// the body, the X-Requested-By header, or the client address.
+func requester(r *http.Request, requestedBy string) string {
+	if requestedBy = strings.TrimSpace(requestedBy); requestedBy != "" {
+		return requestedBy
+	}
+	if h := strings.TrimSpace(r.Header.Get("X-Requested-By")); h != "" {
+		return h
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "api (" + host + ")"
+}
+
+// recordOperation runs an update or rollback, journaling it while it runs,
+// and appends its outcome to the history file.
+func (s *Server) recordOperation(entry HistoryEntry, run func()) {
+	if entry.StartedAt.IsZero() {
+		entry.StartedAt = s.now().UTC()
+	}
+	s.beginJournal(entry)
+	defer s.endJournal()
+	s.mu.Lock()
+	s.metrics.observeStart(entry.Operation)
+	s.mu.Unlock()
+	if !entry.Recovered {
+		// A recovered operation was announced before the restart
+		s.notify(notify.Event{Type: notify.EventUpdateStarted, Operation: entry.Operation,
+			PreviousTag: entry.PreviousTag, TargetTag: entry.TargetTag, RequestedBy: entry.RequestedBy})
+	}
+	run()
+	entry.FinishedAt = s.now().UTC()
+
+	s.mu.Lock()
+	state, outcome := s.state, s.outcome
+	s.mu.Unlock()
+	if state.PreviousTag != "" {
+		entry.PreviousTag = state.PreviousTag
+	}
+	if state.BackupID != "" {
+		entry.BackupID = state.BackupID
+	}
+	entry.Status = state.Status
+	entry.Message = state.Message
+	entry.MigrationOutput = outcome.migrationOutput
+	if state.Status == "failed" {
+		entry.Error = state.Message
+		if outcome.failure != "" {
+			entry.Error = outcome.failure
+		}
+		if outcome.rolledBack {
+			entry.Status = "rolled_back"
+		}
+	}
+
+	s.mu.Lock()
+	s.metrics.observeFinish(entry)
+	s.mu.Unlock()
+
+	s.notify(notify.Event{Type: operationEvent(entry.Status), Operation: entry.Operation,
+		PreviousTag: entry.PreviousTag, TargetTag: entry.TargetTag, BackupID: entry.BackupID,
+		RequestedBy: entry.RequestedBy, Message: entry.Message, Error: entry.Error})
+
+	s.recordVersion(entry)
+	if s.cfg.StateDir == "" {
+		return
+	}
+	if err := AppendHistory(s.cfg.StateDir, entry); err != nil {
+		log.Printf("Warning: could not record update history: %v", err)
+	}
+}
+
+// operationEvent maps a history status to its webhook event type.
+func operationEvent(status string) string {
+	switch status {
+	case "completed":
+		return notify.EventUpdateCompleted
+	case "rolled_back":
+		return notify.EventUpdateRolledBack
+	case "cancelled":
+		return notify.EventUpdateCancelled
+	default:
+		return notify.EventUpdateFailed
+	}
+}
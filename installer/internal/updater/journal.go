@@ -0,0 +1,242 @@
+package updater
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// journalFile records the operation in progress so a restarted sidecar can
+// tell an update was cut short.
+const journalFile = "journal.json"
+
+// operationJournal is the on-disk record of a running update or rollback.
+// Step is the last State.Status reached.
+type operationJournal struct {
+	Operation   string    `json:"operation"`
+	RequestedBy string    `json:"requestedBy,omitempty"`
+	StartedAt   time.Time `json:"startedAt"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+	TargetTag   string    `json:"targetTag"`
+	PreviousTag string    `json:"previousTag,omitempty"`
+	BackupID    string    `json:"backupId,omitempty"`
+	Step        string    `json:"step"`
+	Message     string    `json:"message,omitempty"`
+}
+
+func (s *Server) journalPath() string {
+	return filepath.Join(s.cfg.StateDir, journalFile)
+}
+
+// beginJournal starts journaling the operation described by entry. A
+// journal being recovered is kept as is, so a second restart still knows
+// how far the first run got.
+func (s *Server) beginJournal(entry HistoryEntry) {
+	if s.cfg.StateDir == "" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.journal != nil {
+		return
+	}
+	s.journal = &operationJournal{
+		Operation:   entry.Operation,
+		RequestedBy: entry.RequestedBy,
+		StartedAt:   entry.StartedAt,
+		TargetTag:   entry.TargetTag,
+		PreviousTag: entry.PreviousTag,
+		BackupID:    entry.BackupID,
+		Step:        "queued",
+	}
+	s.saveJournal()
+}
+
+// journalStep records the current state in the journal. The caller holds
+// s.mu.
+func (s *Server) journalStep() {
+	if s.journal == nil {
+		return
+	}
+	s.journal.Step = s.state.Status
+	s.journal.Message = s.state.Message
+	s.journal.TargetTag = s.state.TargetTag
+	if s.state.PreviousTag != "" {
+		s.journal.PreviousTag = s.state.PreviousTag
+	}
+	if s.state.BackupID != "" {
+		s.journal.BackupID = s.state.BackupID
+	}
+	s.saveJournal()
+}
+
+// saveJournal writes the journal atomically. The caller holds s.mu.
+func (s *Server) saveJournal() {
+	s.journal.UpdatedAt = s.now().UTC()
+	data, err := json.MarshalIndent(s.journal, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(s.cfg.StateDir, 0750)
+	}
+	if err == nil {
+		tmp := s.journalPath() + ".partial"
+		if err = os.WriteFile(tmp, data, 0640); err == nil {
+			err = os.Rename(tmp, s.journalPath())
+		}
+	}
+	if err != nil {
+		log.Printf("Warning: could not journal update step %s: %v", s.journal.Step, err)
+	}
+}
+
+// endJournal removes the journal once the operation's outcome is recorded.
+func (s *Server) endJournal() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.journal == nil {
+		return
+	}
+	s.journal = nil
+	if err := os.Remove(s.journalPath()); err != nil && !os.IsNotExist(err) {
+		log.Printf("Warning: could not remove update journal: %v", err)
+	}
+}
+
+// loadJournal returns the journal left by a sidecar that stopped mid-update.
+func (s *Server) loadJournal() *operationJournal {
+	if s.cfg.StateDir == "" {
+		return nil
+	}
+	data, err := os.ReadFile(s.journalPath())
+	if err != nil {
+		return nil
+	}
+	var j operationJournal
+	if err := json.Unmarshal(data, &j); err != nil || j.TargetTag == "" {
+		log.Printf("Warning: ignoring unreadable %s: %v", s.journalPath(), err)
+		_ = os.Remove(s.journalPath())
+		return nil
+	}
+	return &j
+}
+
+// startRecovery checks for an interrupted operation and, if there is one,
+// reserves the state and reconciles it in the background. It runs before
+// the API is served so nothing can start an update in the meantime.
+func (s *Server) startRecovery() {
+	j := s.loadJournal()
+	if j == nil {
+		return
+	}
+	log.Printf("[recovery] found %s to %s interrupted at step %s", j.Operation, j.TargetTag, j.Step)
+
+	s.mu.Lock()
+	s.state = State{
+		Status:      "recovering",
+		Message:     fmt.Sprintf("Recovering %s to %s interrupted at step %s...", j.Operation, j.TargetTag, j.Step),
+		Progress:    1,
+		TargetTag:   j.TargetTag,
+		PreviousTag: j.PreviousTag,
+		BackupID:    j.BackupID,
+		Recovered:   true,
+	}
+	s.journal = j
+	s.publishState()
+	s.mu.Unlock()
+
+	entry := HistoryEntry{
+		Operation:   j.Operation,
+		StartedAt:   j.StartedAt,
+		TargetTag:   j.TargetTag,
+		PreviousTag: j.PreviousTag,
+		BackupID:    j.BackupID,
+		RequestedBy: j.RequestedBy,
+		Recovered:   true,
+	}
+	s.runAsync(func() {
+		s.recordOperation(entry, func() { s.resumeOperation(j) })
+	})
+}
+
+// resumeOperation reconciles the deployment with an interrupted journal:
+// before the image tag could have changed nothing needs undoing; after it,
+// the update is finished, rolling back as usual if the new version is
+// unhealthy; an interrupted rollback is run again. A blue/green candidate
+// left behind is removed once Caddy points at kmp-app again.
+func (s *Server) resumeOperation(j *operationJournal) {
+	if s.blueGreen() {
+		defer s.retireCandidate()
+	}
+
+	s.mu.Lock()
+	s.state.TargetTag = j.TargetTag
+	s.state.PreviousTag = j.PreviousTag
+	s.state.BackupID = j.BackupID
+	s.outcome = operationOutcome{}
+	s.mu.Unlock()
+
+	previousKnown := j.PreviousTag != "" && j.PreviousTag != "unknown"
+
+	switch j.Step {
+	case "completed", "failed", "cancelled":
+		// Finished; only the journal cleanup was lost
+		progress := 0
+		if j.Step == "completed" {
+			progress = 100
+		}
+		s.setState(j.Step, j.Message, progress)
+
+	case "queued", "backing_up", "pulling", "candidate_starting", "candidate_health_check":
+		s.setState("failed", fmt.Sprintf("%s to %s was interrupted while %s, before the running version was touched; nothing to undo",
+			j.Operation, j.TargetTag, j.Step), 0)
+
+	case "migrating":
+		detail := ""
+		if j.BackupID != "" {
+			detail = fmt.Sprintf(" (pre-update backup %s)", j.BackupID)
+		}
+		s.setState("failed", fmt.Sprintf("%s to %s was interrupted while migrating; the app was not touched but the database may be partly migrated%s",
+			j.Operation, j.TargetTag, detail), 0)
+
+	case "rolling_back", "restoring":
+		if !previousKnown {
+			s.setState("failed", fmt.Sprintf("Rollback after a failed update to %s was interrupted and the previous tag is unknown; intervention required", j.TargetTag), 0)
+			return
+		}
+		s.noteFailure(fmt.Sprintf("Sidecar restarted while rolling back from %s", j.TargetTag))
+		s.setState("rolling_back", fmt.Sprintf("Resuming interrupted rollback to %s...", j.PreviousTag), 80)
+		s.rollbackFailedUpdate(j.PreviousTag, j.BackupID)
+
+	default:
+		// stopping, starting, health_check, switching: the image is pulled
+		// and .env may already name it, so finish the update
+		s.setState("starting", fmt.Sprintf("Resuming interrupted update to %s...", j.TargetTag), 50)
+		if err := s.updateEnvTag(j.TargetTag); err != nil {
+			log.Printf("Warning: could not persist KMP_IMAGE_TAG to .env; continuing with runtime override: %v", err)
+		}
+		if err := s.recreateAppContainer(context.Background(), j.TargetTag); err != nil {
+			s.failResumedUpdate(j, previousKnown, fmt.Sprintf("Starting %s failed: %v", j.TargetTag, err))
+			return
+		}
+		s.setState("health_check", "Waiting for health check...", 70)
+		if err := s.waitForHealthy(context.Background(), 120*time.Second); err != nil {
+			s.failResumedUpdate(j, previousKnown, fmt.Sprintf("Health check failed: %v", err))
+			return
+		}
+		s.setState("completed", fmt.Sprintf("Updated to %s (resumed after sidecar restart)", j.TargetTag), 100)
+	}
+}
+
+// failResumedUpdate rolls back a resumed update that did not come up.
+func (s *Server) failResumedUpdate(j *operationJournal, previousKnown bool, reason string) {
+	s.noteFailure(reason)
+	if !previousKnown {
+		s.setState("failed", reason+"; previous tag unknown, not rolling back", 0)
+		return
+	}
+	s.setState("rolling_back", "Resumed update failed, rolling back...", 80)
+	s.rollbackFailedUpdate(j.PreviousTag, j.BackupID)
+}
@@ -0,0 +1,254 @@
+package updater
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// healthProbeInterval is how often the sidecar probes HealthURL for the
+// kmp_app_healthy gauge.
+const healthProbeInterval = 30 * time.Second
+
+// durationBuckets are the upper bounds, in seconds, of the update duration
+// histogram: from a quick restart to a long migration.
+var durationBuckets = []float64{30, 60, 120, 300, 600, 1200, 1800, 3600}
+
+// metrics holds what GET /metrics reports that the State does not. It is
+// guarded by Server.mu.
+type metrics struct {
+	attempts  map[string]uint64            // by operation
+	results   map[string]map[string]uint64 // by final status, then operation
+	durations map[string]*histogram        // by final status
+
+	imageTag   string
+	lastBackup time.Time
+
+	probed       time.Time
+	healthy      bool
+	probeSeconds float64
+}
+
+type histogram struct {
+	buckets []uint64 // cumulative counts per durationBuckets entry
+	count   uint64
+	sum     float64
+}
+
+func newMetrics() metrics {
+	return metrics{
+		attempts:  map[string]uint64{},
+		results:   map[string]map[string]uint64{},
+		durations: map[string]*histogram{},
+	}
+}
+
+// observeStart counts an update or rollback attempt. The caller holds s.mu.
+func (m *metrics) observeStart(operation string) {
+	m.attempts[operation]++
+}
+
+// observeFinish counts how an operation ended and how long it took. The
+// caller holds s.mu.
+func (m *metrics) observeFinish(entry HistoryEntry) {
+	if m.results[entry.Status] == nil {
+		m.results[entry.Status] = map[string]uint64{}
+	}
+	m.results[entry.Status][entry.Operation]++
+	h := m.durations[entry.Status]
+	if h == nil {
+		h = &histogram{buckets: make([]uint64, len(durationBuckets))}
+		m.durations[entry.Status] = h
+	}
+	seconds := entry.FinishedAt.Sub(entry.StartedAt).Seconds()
+	for i, bound := range durationBuckets {
+		if seconds <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+// observeBackup records a successful backup. The caller holds s.mu.
+func (m *metrics) observeBackup(at time.Time) {
+	if at.After(m.lastBackup) {
+		m.lastBackup = at
+	}
+}
+
+// runHealthProbes checks HealthURL, the running image tag and the newest
+// backup every healthProbeInterval.
+func (s *Server) runHealthProbes(ctx context.Context) {
+	for {
+		s.probeHealth(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(healthProbeInterval):
+		}
+	}
+}
+
+// probeHealth makes one health check and refreshes the image tag and the
+// time of the newest backup.
+func (s *Server) probeHealth(ctx context.Context) {
+	start := s.now()
+	var err error
+	if s.probeHealthFn != nil {
+		err = s.probeHealthFn()
+	} else {
+		err = checkHealth(ctx, &http.Client{Timeout: 5 * time.Second}, s.cfg.HealthURL)
+	}
+	elapsed := s.now().Sub(start)
+	tag := s.readCurrentTag()
+	if err != nil {
+		log.Printf("[metrics] health probe failed: %v", err)
+	}
+	var lastBackup time.Time
+	if s.cfg.LastBackup != nil {
+		var backupErr error
+		if lastBackup, backupErr = s.cfg.LastBackup(ctx); backupErr != nil {
+			log.Printf("[metrics] reading the backup catalog failed: %v", backupErr)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.metrics.probed = start
+	s.metrics.healthy = err == nil
+	s.metrics.probeSeconds = elapsed.Seconds()
+	if tag != "" && tag != "unknown" {
+		s.metrics.imageTag = tag
+	}
+	s.metrics.observeBackup(lastBackup)
+}
+
+// handleMetrics serves the Prometheus text exposition format.
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	state := s.state
+	m := s.metrics
+	attempts := maps.Clone(m.attempts)
+	results := map[string]map[string]uint64{}
+	for status, ops := range m.results {
+		results[status] = maps.Clone(ops)
+	}
+	durations := map[string]histogram{}
+	for result, h := range m.durations {
+		durations[result] = histogram{buckets: append([]uint64(nil), h.buckets...), count: h.count, sum: h.sum}
+	}
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	p := &promWriter{w: w}
+
+	p.family("kmp_app_info", "gauge", "Image tag of the running KMP app.")
+	if m.imageTag != "" {
+		p.sample("kmp_app_info", labels("image_tag", m.imageTag), 1)
+	}
+
+	p.family("kmp_app_healthy", "gauge", "Whether the last probe of the app's health endpoint succeeded.")
+	if !m.probed.IsZero() {
+		p.sample("kmp_app_healthy", "", boolValue(m.healthy))
+		p.family("kmp_app_health_probe_timestamp_seconds", "gauge", "When the app's health endpoint was last probed.")
+		p.sample("kmp_app_health_probe_timestamp_seconds", "", unixSeconds(m.probed))
+		p.family("kmp_app_health_probe_duration_seconds", "gauge", "How long the last health probe took.")
+		p.sample("kmp_app_health_probe_duration_seconds", "", m.probeSeconds)
+	}
+
+	p.family("kmp_updater_operation_in_progress", "gauge", "Whether an update or rollback is running.")
+	p.sample("kmp_updater_operation_in_progress", "", boolValue(state.Busy()))
+
+	p.family("kmp_updater_update_attempts_total", "counter", "Updates and rollbacks started.")
+	for _, op := range slices.Sorted(maps.Keys(attempts)) {
+		p.sample("kmp_updater_update_attempts_total", labels("operation", op), float64(attempts[op]))
+	}
+	for _, c := range []struct{ name, status, help string }{
+		{"kmp_updater_update_successes_total", "completed", "Updates and rollbacks that completed."},
+		{"kmp_updater_update_failures_total", "failed", "Updates and rollbacks that failed without rolling back."},
+		{"kmp_updater_update_rollbacks_total", "rolled_back", "Updates that failed and were rolled back to the previous tag."},
+		{"kmp_updater_update_cancellations_total", "cancelled", "Updates cancelled through POST /updater/cancel."},
+	} {
+		p.family(c.name, "counter", c.help)
+		ops := results[c.status]
+		for _, op := range slices.Sorted(maps.Keys(ops)) {
+			p.sample(c.name, labels("operation", op), float64(ops[op]))
+		}
+	}
+
+	p.family("kmp_updater_update_duration_seconds", "histogram", "How long updates and rollbacks took, by final status.")
+	for _, result := range slices.Sorted(maps.Keys(durations)) {
+		h := durations[result]
+		for i, bound := range durationBuckets {
+			p.sample("kmp_updater_update_duration_seconds_bucket",
+				labels("result", result, "le", strconv.FormatFloat(bound, 'g', -1, 64)), float64(h.buckets[i]))
+		}
+		p.sample("kmp_updater_update_duration_seconds_bucket", labels("result", result, "le", "+Inf"), float64(h.count))
+		p.sample("kmp_updater_update_duration_seconds_sum", labels("result", result), h.sum)
+		p.sample("kmp_updater_update_duration_seconds_count", labels("result", result), float64(h.count))
+	}
+
+	p.family("kmp_backup_last_success_timestamp_seconds", "gauge", "When the last successful backup finished.")
+	if !m.lastBackup.IsZero() {
+		p.sample("kmp_backup_last_success_timestamp_seconds", "", unixSeconds(m.lastBackup))
+	}
+
+	if p.err != nil {
+		log.Printf("Warning: writing metrics: %v", p.err)
+	}
+}
+
+// promWriter writes metric families, remembering the first write error.
+type promWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (p *promWriter) family(name, kind, help string) {
+	p.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func (p *promWriter) sample(name, labels string, value float64) {
+	p.printf("%s%s %s\n", name, labels, strconv.FormatFloat(value, 'f', -1, 64))
+}
+
+func (p *promWriter) printf(format string, args ...any) {
+	if p.err == nil {
+		_, p.err = fmt.Fprintf(p.w, format, args...)
+	}
+}
+
+// labels renders name/value pairs as a Prometheus label set.
+func labels(pairs ...string) string {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(pairs[i] + `="` + labelEscaper.Replace(pairs[i+1]) + `"`)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func unixSeconds(t time.Time) float64 {
+	return float64(t.UnixNano()) / 1e9
+}
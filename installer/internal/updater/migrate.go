@@ -0,0 +1,69 @@
+package updater
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// DefaultMigrateCommand applies the CakePHP migrations of the app and its
+// plugins. It runs through the image's entrypoint, which configures the
+// database connection, with the entrypoint's own migrations switched off.
+const DefaultMigrateCommand = "cd /var/www/html && CACHE_ENGINE=apcu bin/cake migrations migrate && CACHE_ENGINE=apcu bin/cake update_database"
+
+// maxMigrationOutput bounds the migration output kept in the history; the
+// end of the output, where errors are, is what is kept.
+const maxMigrationOutput = 16 << 10
+
+// MigrateArgs returns the docker compose arguments that run command in a
+// one-off container of service. The container starts nothing else, serves
+// no traffic and is removed when the command exits.
+func MigrateArgs(service, command string) []string {
+	return []string{
+		"run", "--rm", "--no-deps", "-T",
+		"-e", "KMP_SKIP_MIGRATIONS=true",
+		"-e", "KMP_SKIP_CRON=true",
+		service, "sh", "-c", command,
+	}
+}
+
+// TrimMigrationOutput keeps the last maxMigrationOutput bytes of out.
+func TrimMigrationOutput(out string) string {
+	out = strings.TrimSpace(out)
+	if len(out) <= maxMigrationOutput {
+		return out
+	}
+	out = out[len(out)-maxMigrationOutput:]
+	if i := strings.IndexByte(out, '\n'); i >= 0 {
+		out = out[i+1:]
+	}
+	return "...\n" + out
+}
+
+// runMigrations applies the target tag's migrations in a one-off container
+// while the running app keeps serving. The output is kept for the history
+// entry whether or not the migrations succeed.
+func (s *Server) runMigrations(ctx context.Context, targetTag string) error {
+	if s.cfg.MigrateCommand == "" {
+		return nil
+	}
+	s.setState("migrating", fmt.Sprintf("Running database migrations for %s...", targetTag), 25)
+
+	var (
+		out string
+		err error
+	)
+	if s.runMigrationsFn != nil {
+		out, err = s.runMigrationsFn(targetTag)
+	} else {
+		out, err = s.dockerComposeOutput(ctx, targetTag, MigrateArgs(s.cfg.AppServiceName, s.cfg.MigrateCommand)...)
+	}
+
+	s.mu.Lock()
+	s.outcome.migrationOutput = TrimMigrationOutput(out)
+	s.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("migrations failed: %w", err)
+	}
+	return nil
+}
@@ -1,12 +1,21 @@
 package updater
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"sync"
 	"time"
+
+	"github.com/jhandel/KMP/installer/internal/config"
+	"github.com/jhandel/KMP/installer/internal/dockerapi"
+	"github.com/jhandel/KMP/installer/internal/notify"
+	"github.com/jhandel/KMP/installer/internal/registry"
+	"golang.org/x/mod/semver"
 )
 
 // Config holds the updater sidecar configuration.
@@ -17,15 +26,80 @@ type Config struct {
 	HealthURL      string
 	ListenAddr     string
 	ImageRepo      string
+	StateDir       string // where the sidecar persists its own state
+	MigrateCommand string // shell command applying migrations; empty skips the migrating step
+	DockerHost     string // Engine API socket; empty means dockerapi.DefaultHost
+
+	// Token returns the bearer token required by mutating endpoints. It is
+	// called per request so a rotated token takes effect without a restart.
+	Token func() string
+
+	// BackupPlan returns whether scheduled backups are enabled and their
+	// cron expression. It is re-read every minute.
+	BackupPlan func() (enabled bool, schedule string)
+	// RunBackup takes one backup and applies retention. Scheduled backups
+	// are disabled when nil.
+	RunBackup func(ctx context.Context) (BackupOutcome, error)
+	// LastBackup returns when the newest backup in the catalog was taken,
+	// by the sidecar or not, and the zero time when there is none. It seeds
+	// and refreshes kmp_backup_last_success_timestamp_seconds.
+	LastBackup func(ctx context.Context) (time.Time, error)
+
+	// PreUpdateBackup snapshots the database before every update; updates
+	// run without a snapshot when nil.
+	PreUpdateBackup func(ctx context.Context, reason string) (BackupOutcome, error)
+	// RestoreBackup restores a snapshot taken by PreUpdateBackup.
+	RestoreBackup func(ctx context.Context, id string) error
+	// RestoreOnFailure reports whether a failed update restores its
+	// snapshot before starting the previous tag. It is re-read per update.
+	RestoreOnFailure func() bool
+
+	// BlueGreen reports whether updates start the new tag alongside the
+	// running app and switch Caddy over once it is healthy, instead of
+	// recreating the app in place. It is re-read per update.
+	BlueGreen func() bool
+
+	// Notify receives update and backup events for the configured webhooks.
+	// It must not block.
+	Notify func(notify.Event)
+
+	// AutoUpdate returns the policy under which the sidecar applies new
+	// releases by itself. It is re-read every minute; ListTags returns the
+	// image tags published on a channel. Both are needed for auto-updates.
+	AutoUpdate func() config.AutoUpdatePolicy
+	ListTags   func(ctx context.Context, channel string) ([]string, error)
+
+	// ResolveTag looks a requested tag up in the registry before an update
+	// pulls it. Tags are only checked for their form when nil. Channel
+	// returns the deployment's channel; unless forced, an update to a tag on
+	// a less stable channel is refused.
+	ResolveTag func(ctx context.Context, tag string) (registry.Tag, error)
+	Channel    func() string
 }
 
 // State tracks the current update operation.
 type State struct {
-	Status      string `json:"status"` // idle, pulling, stopping, starting, health_check, completed, failed, rolling_back
+	Status      string `json:"status"` // idle, backing_up, pulling, migrating, candidate_starting, candidate_health_check, switching, stopping, starting, health_check, completed, failed, cancelled, rolling_back, restoring, recovering
 	Message     string `json:"message"`
 	Progress    int    `json:"progress"` // 0-100
 	TargetTag   string `json:"targetTag"`
 	PreviousTag string `json:"previousTag"`
+	BackupID    string `json:"backupId,omitempty"`  // pre-update database snapshot
+	Recovered   bool   `json:"recovered,omitempty"` // reconciled after a sidecar restart
+}
+
+// Busy reports whether an update or rollback is in progress.
+func (st State) Busy() bool {
+	return st.Status != "idle" && st.Status != "completed" && st.Status != "failed" && st.Status != "cancelled"
+}
+
+// operationOutcome is what the final State of an operation does not say.
+type operationOutcome struct {
+	failure    string // the error that triggered a rollback
+	rolledBack bool   // the previous tag was restarted successfully
+	cancelled  bool   // POST /updater/cancel stopped the operation
+
+	migrationOutput string // what the migrating step printed
 }
 
 // Server is the HTTP API server for the updater sidecar.
@@ -40,6 +114,30 @@ type Server struct {
 	dockerComposeFn   func(args ...string) error
 	removeContainerFn func(string) error
 	waitForHealthyFn  func(time.Duration) error
+	// inspectContainerFn, pullImageFn and tagImageFn replace Engine API calls
+	inspectContainerFn func(string) (*dockerapi.Container, error)
+	pullImageFn        func(string) error
+	tagImageFn         func(source, tag string) error
+	// waitForCandidateFn replaces the blue/green candidate's health check
+	waitForCandidateFn func(time.Duration) error
+	runMigrationsFn    func(string) (string, error)
+	probeHealthFn      func() error
+	imageDigestFn      func(string) string
+
+	docker  *dockerapi.Client
+	backups BackupStatus
+	events  *eventLog
+	outcome operationOutcome
+	metrics metrics
+	journal *operationJournal // nil unless an operation is running
+	now     func() time.Time
+
+	// drainPeriod is how long a container keeps in-flight requests after
+	// Caddy is switched away from it
+	drainPeriod time.Duration
+
+	// cancelOp cancels the running update; nil when nothing can be cancelled
+	cancelOp context.CancelFunc
 
 	resolvedComposeProject string
 }
@@ -52,17 +150,41 @@ func NewServer(cfg Config) *Server {
 		runAsync: func(fn func()) {
 			go fn()
 		},
+		docker:      dockerapi.New(cfg.DockerHost),
+		events:      newEventLog(),
+		metrics:     newMetrics(),
+		now:         time.Now,
+		drainPeriod: defaultDrainPeriod,
 	}
 }
 
 // Run starts the HTTP server.
 func (s *Server) Run() error {
+	s.startRecovery()
+	if s.cfg.RunBackup != nil && s.cfg.BackupPlan != nil {
+		go s.runBackupScheduler(context.Background())
+	}
+	go s.runHealthProbes(context.Background())
+	if s.cfg.AutoUpdate != nil && s.cfg.ListTags != nil {
+		go s.runAutoUpdater(context.Background())
+	}
+
+	return http.ListenAndServe(s.cfg.ListenAddr, s.routes())
+}
+
+// routes returns the updater API. Read-only endpoints are open to the compose
+// network; anything that changes the deployment requires the bearer token.
+func (s *Server) routes() http.Handler {
 	mux := http.NewServeMux()
 	mux.HandleFunc("GET /updater/status", s.handleStatus)
-	mux.HandleFunc("POST /updater/update", s.handleUpdate)
-	mux.HandleFunc("POST /updater/rollback", s.handleRollback)
-
-	return http.ListenAndServe(s.cfg.ListenAddr, mux)
+	mux.HandleFunc("POST /updater/update", s.requireToken(s.handleUpdate))
+	mux.HandleFunc("POST /updater/rollback", s.requireToken(s.handleRollback))
+	mux.HandleFunc("POST /updater/cancel", s.requireToken(s.handleCancel))
+	mux.HandleFunc("GET /updater/backups", s.handleBackups)
+	mux.HandleFunc("GET /updater/events", s.handleEvents)
+	mux.HandleFunc("GET /updater/history", s.handleHistory)
+	mux.HandleFunc("GET /metrics", s.handleMetrics)
+	return mux
 }
 
 func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
@@ -75,44 +197,128 @@ func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
 
 func (s *Server) handleUpdate(w http.ResponseWriter, r *http.Request) {
 	var req struct {
-		TargetTag string `json:"targetTag"`
+		TargetTag   string `json:"targetTag"`
+		RequestedBy string `json:"requestedBy"`
+		Force       bool   `json:"force"` // allow a downgrade
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.TargetTag == "" {
 		writeJSONError(w, "targetTag is required", http.StatusBadRequest)
 		return
 	}
+	if code, err := s.checkTargetTag(r.Context(), req.TargetTag, req.Force); err != nil {
+		writeJSONError(w, err.Error(), code)
+		return
+	}
 
-	s.mu.Lock()
-	if s.state.Status != "idle" && s.state.Status != "completed" && s.state.Status != "failed" {
-		s.mu.Unlock()
-		writeJSONError(w, fmt.Sprintf("update already in progress: %s", s.state.Status), http.StatusConflict)
+	if status, ok := s.reserveUpdate(req.TargetTag, "Update queued"); !ok {
+		writeJSONError(w, fmt.Sprintf("update already in progress: %s", status), http.StatusConflict)
 		return
 	}
-	s.state.Status = "pulling"
-	s.state.Message = "Update queued"
-	s.state.Progress = 1
-	s.state.TargetTag = req.TargetTag
-	s.mu.Unlock()
 
 	// Run update in background
+	entry := HistoryEntry{Operation: "update", TargetTag: req.TargetTag, RequestedBy: requester(r, req.RequestedBy)}
 	s.runAsync(func() {
-		s.runUpdate(req.TargetTag)
+		s.recordOperation(entry, func() { s.runUpdate(req.TargetTag) })
 	})
 
 	writeJSON(w, map[string]string{"status": "started", "message": "Update initiated"})
 }
 
+// checkTargetTag refuses an update to a tag that is malformed, is not an app
+// tag, is missing from the registry or, unless force is set, is on a less
+// stable channel than the deployment or older than the running version. It
+// returns the HTTP status to answer with.
+func (s *Server) checkTargetTag(ctx context.Context, tag string, force bool) (int, error) {
+	if err := registry.CheckTag(tag); err != nil {
+		return http.StatusUnprocessableEntity, err
+	}
+	var resolved registry.Tag
+	if s.cfg.ResolveTag != nil {
+		var err error
+		if resolved, err = s.cfg.ResolveTag(ctx, tag); err != nil {
+			if errors.Is(err, registry.ErrTagNotFound) || errors.Is(err, registry.ErrNotAppTag) || errors.Is(err, registry.ErrInvalidTag) {
+				return http.StatusUnprocessableEntity, err
+			}
+			return http.StatusBadGateway, fmt.Errorf("checking %s against the registry: %w", tag, err)
+		}
+	}
+	if force {
+		return 0, nil
+	}
+	// Deployments that predate the channel in sidecar.env are not checked
+	if channel := s.channel(); channel != "" && resolved.Channel != "" &&
+		registry.ChannelRank(resolved.Channel) > registry.ChannelRank(channel) {
+		return http.StatusUnprocessableEntity, fmt.Errorf("%s is a %s tag, less stable than this deployment's %s channel; set force to switch", tag, resolved.Channel, channel)
+	}
+	current := s.readCurrentTag()
+	cur, target := canonicalVersion(current), canonicalVersion(tag)
+	if semver.IsValid(cur) && semver.IsValid(target) && semver.Compare(target, cur) < 0 {
+		return http.StatusUnprocessableEntity, fmt.Errorf("%s is older than the running %s; set force to downgrade", tag, current)
+	}
+	return 0, nil
+}
+
+// channel returns the deployment's channel, or "" when it is not known.
+func (s *Server) channel() string {
+	if s.cfg.Channel == nil {
+		return ""
+	}
+	return s.cfg.Channel()
+}
+
+// reserveUpdate marks an update to targetTag as queued so that no other
+// operation can start. When one is already running it returns that
+// operation's status instead.
+func (s *Server) reserveUpdate(targetTag, message string) (busy string, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.state.Busy() {
+		return s.state.Status, false
+	}
+	s.state.Status = "pulling"
+	s.state.Message = message
+	s.state.Progress = 1
+	s.state.TargetTag = targetTag
+	s.publishState()
+	return "", true
+}
+
 func (s *Server) handleRollback(w http.ResponseWriter, r *http.Request) {
 	var req struct {
-		PreviousTag string `json:"previousTag"`
+		PreviousTag string `json:"previousTag"` // empty = the tag the last update replaced
+		RequestedBy string `json:"requestedBy"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		writeJSONError(w, "invalid request body", http.StatusBadRequest)
+		return
 	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.PreviousTag == "" {
-		writeJSONError(w, "previousTag is required", http.StatusBadRequest)
+	var stack []config.DeployedVersion
+	if s.cfg.StateDir != "" {
+		var err error
+		if stack, err = ReadVersions(s.cfg.StateDir); err != nil {
+			writeJSONError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	// A version on the stack comes back as the image it was, by digest
+	var opts updateOptions
+	if req.PreviousTag == "" {
+		top, _, err := PopVersion(stack, "")
+		if err != nil {
+			writeJSONError(w, err.Error()+"; give previousTag", http.StatusConflict)
+			return
+		}
+		req.PreviousTag, opts.digest = top.Tag, top.Digest
+	} else if v, _, err := PopVersion(stack, req.PreviousTag); err == nil {
+		opts.digest = v.Digest
+	}
+	if err := registry.CheckTag(req.PreviousTag); err != nil {
+		writeJSONError(w, err.Error(), http.StatusUnprocessableEntity)
 		return
 	}
 
 	s.mu.Lock()
-	if s.state.Status != "idle" && s.state.Status != "completed" && s.state.Status != "failed" {
+	if s.state.Busy() {
 		s.mu.Unlock()
 		writeJSONError(w, "operation in progress", http.StatusConflict)
 		return
@@ -121,13 +327,40 @@ func (s *Server) handleRollback(w http.ResponseWriter, r *http.Request) {
 	s.state.Message = "Rollback queued"
 	s.state.Progress = 1
 	s.state.TargetTag = req.PreviousTag
+	s.publishState()
 	s.mu.Unlock()
 
+	entry := HistoryEntry{Operation: "rollback", TargetTag: req.PreviousTag, RequestedBy: requester(r, req.RequestedBy)}
 	s.runAsync(func() {
-		s.runUpdate(req.PreviousTag)
+		s.recordOperation(entry, func() { s.runUpdateWith(req.PreviousTag, opts) })
 	})
 
-	writeJSON(w, map[string]string{"status": "started", "message": "Rollback initiated"})
+	writeJSON(w, map[string]string{"status": "started", "message": "Rollback initiated", "targetTag": req.PreviousTag})
+}
+
+// handleCancel stops the running update. Once the update has started
+// rolling back there is nothing left to cancel.
+func (s *Server) handleCancel(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	status := s.state.Status
+	switch {
+	case !s.state.Busy():
+		s.mu.Unlock()
+		writeJSONError(w, "no update in progress", http.StatusConflict)
+		return
+	case s.cancelOp == nil || status == "rolling_back" || status == "restoring":
+		s.mu.Unlock()
+		writeJSONError(w, fmt.Sprintf("cannot cancel while %s", status), http.StatusConflict)
+		return
+	}
+	s.outcome.cancelled = true
+	s.cancelOp()
+	s.state.Message = "Cancelling..."
+	s.publishState()
+	s.mu.Unlock()
+
+	log.Printf("[update] cancel requested during %s", status)
+	writeJSON(w, map[string]string{"status": "cancelling", "message": fmt.Sprintf("Cancelling update during %s", status)})
 }
 
 func writeJSON(w http.ResponseWriter, data interface{}) {
@@ -141,11 +374,22 @@ func writeJSONError(w http.ResponseWriter, msg string, code int) {
 	json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": msg})
 }
 
+// notify hands ev to Config.Notify, if set.
+func (s *Server) notify(ev notify.Event) {
+	if s.cfg.Notify == nil {
+		return
+	}
+	ev.Time = s.now().UTC()
+	s.cfg.Notify(ev)
+}
+
 func (s *Server) setState(status, message string, progress int) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	s.state.Status = status
 	s.state.Message = message
 	s.state.Progress = progress
+	s.publishState()
+	s.journalStep()
 	log.Printf("[update] %s: %s (%d%%)", status, message, progress)
 }
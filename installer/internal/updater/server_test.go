@@ -2,8 +2,11 @@ package updater
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -12,6 +15,11 @@ import (
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/jhandel/KMP/installer/internal/config"
+	"github.com/jhandel/KMP/installer/internal/dockerapi"
+	"github.com/jhandel/KMP/installer/internal/notify"
+	"github.com/jhandel/KMP/installer/internal/registry"
 )
 
 func TestHandleUpdateRequiresTargetTag(t *testing.T) {
@@ -28,6 +36,7 @@ func TestHandleUpdateRequiresTargetTag(t *testing.T) {
 
 func TestHandleUpdateConflictWhenBusy(t *testing.T) {
 	s := NewServer(Config{})
+	s.readCurrentTagFn = func() string { return "v1.0.0" }
 	s.setState("pulling", "busy", 10)
 
 	req := httptest.NewRequest(http.MethodPost, "/updater/update", bytes.NewBufferString(`{"targetTag":"v1.2.3"}`))
@@ -46,6 +55,7 @@ func TestHandleUpdateRunsToCompletion(t *testing.T) {
 	s.readCurrentTagFn = func() string { return "v1.0.0" }
 	s.updateEnvTagFn = func(string) error { return nil }
 	s.dockerComposeFn = func(args ...string) error { return nil }
+	s.pullImageFn = func(string) error { return nil }
 	s.waitForHealthyFn = func(time.Duration) error { return nil }
 
 	req := httptest.NewRequest(http.MethodPost, "/updater/update", bytes.NewBufferString(`{"targetTag":"v1.1.0"}`))
@@ -71,6 +81,7 @@ func TestHandleUpdateRunsToCompletion(t *testing.T) {
 
 func TestHandleUpdateReservesStateBeforeAsyncRun(t *testing.T) {
 	s := NewServer(Config{})
+	s.readCurrentTagFn = func() string { return "v1.0.0" }
 	runAsyncCalled := false
 	s.runAsync = func(fn func()) {
 		runAsyncCalled = true
@@ -146,6 +157,7 @@ func TestRunUpdateRollsBackOnHealthFailure(t *testing.T) {
 		return nil
 	}
 	s.dockerComposeFn = func(args ...string) error { return nil }
+	s.pullImageFn = func(string) error { return nil }
 	s.waitForHealthyFn = func(time.Duration) error { return errors.New("health failed") }
 
 	s.runUpdate("v1.1.0")
@@ -167,6 +179,7 @@ func TestRunUpdateContinuesWhenEnvWriteFails(t *testing.T) {
 	s.readCurrentTagFn = func() string { return "v1.0.0" }
 	s.updateEnvTagFn = func(string) error { return errors.New("read-only file system") }
 	s.dockerComposeFn = func(args ...string) error { return nil }
+	s.pullImageFn = func(string) error { return nil }
 	s.waitForHealthyFn = func(time.Duration) error { return nil }
 
 	s.runUpdate("v1.1.0")
@@ -185,7 +198,7 @@ func TestRecreateAppContainerStopsAndRemovesBeforeUp(t *testing.T) {
 		return nil
 	}
 
-	if err := s.recreateAppContainer("v1.2.3"); err != nil {
+	if err := s.recreateAppContainer(context.Background(), "v1.2.3"); err != nil {
 		t.Fatalf("recreateAppContainer failed: %v", err)
 	}
 
@@ -201,6 +214,9 @@ func TestRecreateAppContainerStopsAndRemovesBeforeUp(t *testing.T) {
 
 func TestRecreateAppContainerRetriesAfterNameConflict(t *testing.T) {
 	s := NewServer(Config{AppServiceName: "app"})
+	s.inspectContainerFn = func(string) (*dockerapi.Container, error) {
+		return nil, fmt.Errorf("inspect container: %w", dockerapi.ErrUnavailable)
+	}
 	var calls [][]string
 	upAttempts := 0
 	s.dockerComposeFn = func(args ...string) error {
@@ -219,7 +235,7 @@ func TestRecreateAppContainerRetriesAfterNameConflict(t *testing.T) {
 		return nil
 	}
 
-	if err := s.recreateAppContainer("v1.2.3"); err != nil {
+	if err := s.recreateAppContainer(context.Background(), "v1.2.3"); err != nil {
 		t.Fatalf("recreateAppContainer failed: %v", err)
 	}
 	if removed != "kmp-app" {
@@ -230,6 +246,54 @@ func TestRecreateAppContainerRetriesAfterNameConflict(t *testing.T) {
 	}
 }
 
+func TestRecreateAppContainerRemovesOnlyAStrayContainer(t *testing.T) {
+	s := NewServer(Config{AppServiceName: "app", ComposeProject: "kmp"})
+	upAttempts := 0
+	s.dockerComposeFn = func(args ...string) error {
+		if len(args) > 0 && args[0] == "up" {
+			upAttempts++
+			if upAttempts == 1 {
+				return errors.New("exit status 1: Conflict")
+			}
+		}
+		return nil
+	}
+	var inspected string
+	s.inspectContainerFn = func(name string) (*dockerapi.Container, error) {
+		inspected = name
+		return &dockerapi.Container{Name: name, Config: dockerapi.ContainerConfig{Image: "ghcr.io/jhandel/kmp:v1.0.0"}}, nil
+	}
+	var removed string
+	s.removeContainerFn = func(name string) error {
+		removed = name
+		return nil
+	}
+
+	if err := s.recreateAppContainer(context.Background(), "v1.2.3"); err != nil {
+		t.Fatalf("recreateAppContainer failed: %v", err)
+	}
+	if inspected != "kmp-app" || removed != "kmp-app" || upAttempts != 2 {
+		t.Fatalf("expected the stray kmp-app to be inspected and removed before a retry, got %q, %q and %d up attempts", inspected, removed, upAttempts)
+	}
+
+	// The service's own container is compose's to deal with
+	upAttempts, removed = 0, ""
+	s.inspectContainerFn = func(name string) (*dockerapi.Container, error) {
+		labels := map[string]string{dockerapi.LabelComposeProject: "kmp", dockerapi.LabelComposeService: "app"}
+		return &dockerapi.Container{Name: name, Config: dockerapi.ContainerConfig{Labels: labels}}, nil
+	}
+	if err := s.recreateAppContainer(context.Background(), "v1.2.3"); err == nil || removed != "" || upAttempts != 1 {
+		t.Fatalf("expected the error without a retry, got %v (removed %q, %d up attempts)", err, removed, upAttempts)
+	}
+
+	// Without a container there is nothing to remove
+	upAttempts = 0
+	s.inspectContainerFn = func(string) (*dockerapi.Container, error) { return nil, dockerapi.ErrNotFound }
+	if err := s.recreateAppContainer(context.Background(), "v1.2.3"); err == nil || removed != "" || upAttempts != 1 {
+		t.Fatalf("expected the error without a retry, got %v (removed %q, %d up attempts)", err, removed, upAttempts)
+	}
+}
+
 func TestComposeProjectNameUsesConfig(t *testing.T) {
 	s := NewServer(Config{ComposeProject: "kmp-d7d1ec11"})
 	if got := s.composeProjectName(); got != "kmp-d7d1ec11" {
@@ -269,11 +333,1163 @@ func TestWaitForHealthySuccess(t *testing.T) {
 	defer ts.Close()
 
 	s := NewServer(Config{HealthURL: ts.URL})
-	if err := s.waitForHealthy(1 * time.Second); err != nil {
+	if err := s.waitForHealthy(context.Background(), 1*time.Second); err != nil {
 		t.Fatalf("expected healthy response, got error: %v", err)
 	}
 }
 
+func TestScheduledBackupRecordsRunsAndServesThem(t *testing.T) {
+	stateDir := t.TempDir()
+	calls := 0
+	s := NewServer(Config{
+		StateDir: stateDir,
+		RunBackup: func(ctx context.Context) (BackupOutcome, error) {
+			calls++
+			if calls == 2 {
+				return BackupOutcome{}, errors.New("dump failed")
+			}
+			return BackupOutcome{ID: "20240101-030000", Size: 42, Pruned: 1}, nil
+		},
+	})
+	s.now = func() time.Time { return time.Date(2024, 1, 1, 3, 0, 0, 0, time.UTC) }
+
+	s.runScheduledBackup(context.Background())
+	s.runScheduledBackup(context.Background())
+	s.setState("pulling", "busy", 10)
+	s.runScheduledBackup(context.Background())
+
+	if calls != 2 {
+		t.Fatalf("expected backup to be skipped during an update, got %d calls", calls)
+	}
+
+	rec := httptest.NewRecorder()
+	s.handleBackups(rec, httptest.NewRequest(http.MethodGet, "/updater/backups", nil))
+	var status BackupStatus
+	if err := json.NewDecoder(rec.Body).Decode(&status); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if len(status.Runs) != 3 || status.LastRun == nil || status.LastRun.Status != "skipped" {
+		t.Fatalf("unexpected backup status %+v", status)
+	}
+	if status.Runs[1].Status != "failed" || status.Runs[1].Error != "dump failed" {
+		t.Fatalf("expected failed run to be recorded, got %+v", status.Runs[1])
+	}
+	if status.Runs[2].Status != "succeeded" || status.Runs[2].BackupID != "20240101-030000" || status.Runs[2].Pruned != 1 {
+		t.Fatalf("expected successful run to be recorded, got %+v", status.Runs[2])
+	}
+
+	// A restarted sidecar picks the history back up
+	restarted := NewServer(Config{StateDir: stateDir})
+	restarted.loadBackupRuns()
+	if len(restarted.backups.Runs) != 3 {
+		t.Fatalf("expected persisted runs to be reloaded, got %d", len(restarted.backups.Runs))
+	}
+}
+
+func TestRunUpdateRestoresPreUpdateBackupOnHealthFailure(t *testing.T) {
+	var steps []string
+	s := NewServer(Config{
+		AppServiceName: "app",
+		PreUpdateBackup: func(ctx context.Context, reason string) (BackupOutcome, error) {
+			steps = append(steps, "backup "+reason)
+			return BackupOutcome{ID: "20240101-030000"}, nil
+		},
+		RestoreBackup: func(ctx context.Context, id string) error {
+			steps = append(steps, "restore "+id)
+			return nil
+		},
+		RestoreOnFailure: func() bool { return true },
+	})
+	s.readCurrentTagFn = func() string { return "v1.0.0" }
+	s.updateEnvTagFn = func(tag string) error {
+		steps = append(steps, "env "+tag)
+		return nil
+	}
+	s.dockerComposeFn = func(args ...string) error { return nil }
+	s.pullImageFn = func(string) error { return nil }
+	s.waitForHealthyFn = func(time.Duration) error { return errors.New("health failed") }
+
+	s.runUpdate("v1.1.0")
+
+	want := []string{"backup pre-update v1.0.0 -> v1.1.0", "env v1.1.0", "restore 20240101-030000", "env v1.0.0"}
+	if !reflect.DeepEqual(steps, want) {
+		t.Fatalf("expected steps %v, got %v", want, steps)
+	}
+	st := readState(s)
+	if st.Status != "failed" || st.BackupID != "20240101-030000" || !strings.Contains(st.Message, "database restored from 20240101-030000") {
+		t.Fatalf("unexpected state %+v", st)
+	}
+}
+
+func TestRunUpdateKeepsDatabaseWhenRestorePolicyIsOff(t *testing.T) {
+	restored := false
+	s := NewServer(Config{
+		AppServiceName: "app",
+		PreUpdateBackup: func(ctx context.Context, reason string) (BackupOutcome, error) {
+			return BackupOutcome{ID: "20240101-030000"}, nil
+		},
+		RestoreBackup: func(ctx context.Context, id string) error {
+			restored = true
+			return nil
+		},
+		RestoreOnFailure: func() bool { return false },
+	})
+	s.readCurrentTagFn = func() string { return "v1.0.0" }
+	s.updateEnvTagFn = func(string) error { return nil }
+	s.dockerComposeFn = func(args ...string) error { return nil }
+	s.pullImageFn = func(string) error { return nil }
+	s.waitForHealthyFn = func(time.Duration) error { return errors.New("health failed") }
+
+	s.runUpdate("v1.1.0")
+
+	st := readState(s)
+	if restored || !strings.Contains(st.Message, "database not restored (pre-update backup 20240101-030000)") {
+		t.Fatalf("expected the backup to be offered, not restored: %+v", st)
+	}
+}
+
+func TestRunUpdateAbortsWhenPreUpdateBackupFails(t *testing.T) {
+	pulled := false
+	s := NewServer(Config{
+		AppServiceName: "app",
+		PreUpdateBackup: func(ctx context.Context, reason string) (BackupOutcome, error) {
+			return BackupOutcome{}, errors.New("disk full")
+		},
+	})
+	s.readCurrentTagFn = func() string { return "v1.0.0" }
+	s.pullImageFn = func(string) error {
+		pulled = true
+		return nil
+	}
+
+	s.runUpdate("v1.1.0")
+
+	st := readState(s)
+	if pulled || st.Status != "failed" || !strings.Contains(st.Message, "disk full") {
+		t.Fatalf("expected update to stop before pulling, got %+v (pulled=%v)", st, pulled)
+	}
+}
+
+func TestMutatingEndpointsRequireBearerToken(t *testing.T) {
+	token := "s3cret"
+	s := NewServer(Config{Token: func() string { return token }})
+	handler := s.routes()
+
+	do := func(method, path, auth string) int {
+		req := httptest.NewRequest(method, path, bytes.NewBufferString(`{}`))
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// With the token, the handlers themselves answer the empty body: an
+	// update needs a tag, and there is no previous version to roll back to
+	for path, want := range map[string]int{"/updater/update": http.StatusBadRequest, "/updater/rollback": http.StatusConflict} {
+		if code := do(http.MethodPost, path, ""); code != http.StatusUnauthorized {
+			t.Fatalf("%s without token: expected 401, got %d", path, code)
+		}
+		if code := do(http.MethodPost, path, "Bearer wrong"); code != http.StatusUnauthorized {
+			t.Fatalf("%s with wrong token: expected 401, got %d", path, code)
+		}
+		if code := do(http.MethodPost, path, "Bearer s3cret"); code != want {
+			t.Fatalf("%s with token: expected the handler's %d, got %d", path, want, code)
+		}
+	}
+	if code := do(http.MethodGet, "/updater/status", ""); code != http.StatusOK {
+		t.Fatalf("status should stay open, got %d", code)
+	}
+
+	// Without a configured token nothing mutating is allowed
+	token = ""
+	if code := do(http.MethodPost, "/updater/update", "Bearer "); code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 with no token configured, got %d", code)
+	}
+}
+
+func TestEventsStreamStateAndComposeOutputAndResume(t *testing.T) {
+	s := NewServer(Config{})
+	ts := httptest.NewServer(s.routes())
+	defer ts.Close()
+
+	// collect reads n events from a fresh connection
+	collect := func(lastID string, n int) []Event {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/updater/events", nil)
+		if lastID != "" {
+			req.Header.Set("Last-Event-ID", lastID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+			t.Fatalf("unexpected content type %q", ct)
+		}
+		var got []Event
+		if _, err := ReadEvents(resp.Body, func(ev Event) bool {
+			got = append(got, ev)
+			return len(got) < n
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+
+	// A new client starts from a snapshot of the current state
+	got := collect("", 1)
+	if got[0].Type != EventState || got[0].State.Status != "idle" || got[0].ID != 0 {
+		t.Fatalf("expected an idle snapshot, got %+v", got[0])
+	}
+
+	s.setState("pulling", "Pulling...", 10)
+	lines := &lineWriter{fn: s.publishLog}
+	lines.Write([]byte("Pulling app ... \r\nPulled app\npartial"))
+	lines.Flush()
+	s.setState("completed", "Updated to v1.1.0", 100)
+
+	got = collect("0", 5)
+	var summary []string
+	for i, ev := range got {
+		if ev.ID != uint64(i+1) {
+			t.Fatalf("expected monotonically increasing IDs from 1, got %d at %d", ev.ID, i)
+		}
+		if ev.Type == EventLog {
+			summary = append(summary, ev.Line)
+		} else {
+			summary = append(summary, ev.State.Status)
+		}
+	}
+	want := []string{"pulling", "Pulling app ...", "Pulled app", "partial", "completed"}
+	if !reflect.DeepEqual(summary, want) {
+		t.Fatalf("events = %q, want %q", summary, want)
+	}
+
+	// Resuming skips what the client already saw, then follows live events
+	done := make(chan []Event)
+	go func() { done <- collect("4", 2) }()
+	time.Sleep(50 * time.Millisecond)
+	s.setState("idle", "Ready", 0)
+	got = <-done
+	if got[0].ID != 5 || got[1].ID != 6 || got[1].State.Status != "idle" {
+		t.Fatalf("unexpected resumed events %+v", got)
+	}
+
+	// An ID from before a sidecar restart falls back to a snapshot
+	got = collect("99", 1)
+	if got[0].ID != 6 || got[0].State.Status != "idle" {
+		t.Fatalf("expected a snapshot after an unknown ID, got %+v", got[0])
+	}
+}
+
+func TestUpdatesAreRecordedInHistoryAndPaginated(t *testing.T) {
+	dir := t.TempDir()
+	s := NewServer(Config{AppServiceName: "app", StateDir: dir, Token: func() string { return "t" }})
+	s.runAsync = func(fn func()) { fn() }
+	tag := "v1.0.0"
+	s.readCurrentTagFn = func() string { return tag }
+	s.updateEnvTagFn = func(t string) error { tag = t; return nil }
+	s.dockerComposeFn = func(args ...string) error { return nil }
+	s.pullImageFn = func(string) error { return nil }
+	healthy := true
+	s.waitForHealthyFn = func(time.Duration) error {
+		if healthy {
+			return nil
+		}
+		return errors.New("app returned 500")
+	}
+	handler := s.routes()
+
+	post := func(body string, header http.Header) {
+		req := httptest.NewRequest(http.MethodPost, "/updater/update", bytes.NewBufferString(body))
+		req.Header.Set("Authorization", "Bearer t")
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("update: %d %s", rec.Code, rec.Body)
+		}
+	}
+	post(`{"targetTag":"v1.1.0","requestedBy":"admin@example.org"}`, nil)
+	healthy = false
+	post(`{"targetTag":"v1.2.0"}`, http.Header{"X-Requested-By": {"kmp web UI"}})
+
+	// A cut-short line from a crash is skipped, not fatal
+	f, _ := os.OpenFile(filepath.Join(dir, HistoryFile), os.O_APPEND|os.O_WRONLY, 0)
+	f.WriteString(`{"operation":"upd`)
+	f.Close()
+
+	get := func(query string) HistoryPage {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/updater/history"+query, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("history: %d %s", rec.Code, rec.Body)
+		}
+		var page HistoryPage
+		if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+			t.Fatal(err)
+		}
+		return page
+	}
+
+	page := get("")
+	if page.Total != 2 || len(page.Entries) != 2 {
+		t.Fatalf("expected both updates, got %+v", page)
+	}
+	failed, done := page.Entries[0], page.Entries[1]
+	if done.Status != "completed" || done.PreviousTag != "v1.0.0" || done.TargetTag != "v1.1.0" || done.RequestedBy != "admin@example.org" || done.StartedAt.IsZero() || done.FinishedAt.IsZero() {
+		t.Fatalf("unexpected first entry %+v", done)
+	}
+	if failed.Status != "rolled_back" || failed.PreviousTag != "v1.1.0" || failed.RequestedBy != "kmp web UI" || !strings.Contains(failed.Error, "app returned 500") {
+		t.Fatalf("unexpected second entry %+v", failed)
+	}
+
+	page = get("?limit=1&offset=1")
+	if page.Total != 2 || len(page.Entries) != 1 || page.Entries[0].TargetTag != "v1.1.0" {
+		t.Fatalf("unexpected second page %+v", page)
+	}
+
+	// The next entry starts on its own line rather than joining the broken one
+	if err := AppendHistory(dir, HistoryEntry{Operation: "rollback", Status: "completed", TargetTag: "v1.0.0"}); err != nil {
+		t.Fatal(err)
+	}
+	page = get("")
+	if page.Total != 3 || page.Entries[0].Operation != "rollback" || page.Entries[0].TargetTag != "v1.0.0" {
+		t.Fatalf("expected the entry after the broken line to read back, got %+v", page)
+	}
+}
+
+func TestUpdateStepsAreJournaledUntilFinished(t *testing.T) {
+	dir := t.TempDir()
+	s := NewServer(Config{AppServiceName: "app", StateDir: dir})
+	s.readCurrentTagFn = func() string { return "v1.0.0" }
+	s.updateEnvTagFn = func(string) error { return nil }
+	var journaled operationJournal
+	s.dockerComposeFn = func(args ...string) error {
+		if args[0] == "up" {
+			data, err := os.ReadFile(filepath.Join(dir, journalFile))
+			if err != nil {
+				t.Fatalf("expected a journal while the app is recreated: %v", err)
+			}
+			json.Unmarshal(data, &journaled)
+		}
+		return nil
+	}
+	s.pullImageFn = func(string) error { return nil }
+	s.waitForHealthyFn = func(time.Duration) error { return nil }
+
+	s.recordOperation(HistoryEntry{Operation: "update", TargetTag: "v1.1.0", RequestedBy: "admin"}, func() { s.runUpdate("v1.1.0") })
+
+	if journaled.Step != "starting" || journaled.PreviousTag != "v1.0.0" || journaled.TargetTag != "v1.1.0" || journaled.RequestedBy != "admin" {
+		t.Fatalf("unexpected journal %+v", journaled)
+	}
+	if _, err := os.Stat(filepath.Join(dir, journalFile)); !os.IsNotExist(err) {
+		t.Fatalf("expected the journal to be removed, got %v", err)
+	}
+}
+
+func TestStartupRecoversInterruptedUpdate(t *testing.T) {
+	tests := []struct {
+		name       string
+		step       string
+		healthy    bool
+		wantStatus string
+		wantEnv    []string
+		wantEntry  string
+	}{
+		{name: "finishes after the tag changed", step: "health_check", healthy: true, wantStatus: "completed", wantEnv: []string{"v1.1.0"}, wantEntry: "completed"},
+		{name: "rolls back when still unhealthy", step: "starting", healthy: false, wantStatus: "failed", wantEnv: []string{"v1.1.0", "v1.0.0"}, wantEntry: "rolled_back"},
+		{name: "reruns an interrupted rollback", step: "rolling_back", healthy: true, wantStatus: "failed", wantEnv: []string{"v1.0.0"}, wantEntry: "rolled_back"},
+		{name: "leaves an unstarted update alone", step: "pulling", wantStatus: "failed", wantEntry: "failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			j := operationJournal{Operation: "update", RequestedBy: "admin", StartedAt: time.Now().UTC(), TargetTag: "v1.1.0", PreviousTag: "v1.0.0", Step: tt.step}
+			data, _ := json.Marshal(j)
+			if err := os.WriteFile(filepath.Join(dir, journalFile), data, 0o640); err != nil {
+				t.Fatal(err)
+			}
+
+			s := NewServer(Config{AppServiceName: "app", StateDir: dir})
+			var queued func()
+			s.runAsync = func(fn func()) { queued = fn }
+			var env []string
+			s.updateEnvTagFn = func(tag string) error {
+				env = append(env, tag)
+				return nil
+			}
+			s.dockerComposeFn = func(args ...string) error { return nil }
+			s.waitForHealthyFn = func(time.Duration) error {
+				if tt.healthy {
+					return nil
+				}
+				return errors.New("unhealthy")
+			}
+
+			s.startRecovery()
+			if st := readState(s); st.Status != "recovering" || !st.Busy() {
+				t.Fatalf("expected the state to be reserved before serving, got %+v", st)
+			}
+			queued()
+
+			st := readState(s)
+			if st.Status != tt.wantStatus || !st.Recovered {
+				t.Fatalf("unexpected state %+v", st)
+			}
+			if !reflect.DeepEqual(env, tt.wantEnv) {
+				t.Fatalf("expected .env writes %v, got %v", tt.wantEnv, env)
+			}
+			entries, err := ReadHistory(dir)
+			if err != nil || len(entries) != 1 {
+				t.Fatalf("expected one history entry, got %+v (%v)", entries, err)
+			}
+			if e := entries[0]; e.Status != tt.wantEntry || !e.Recovered || e.RequestedBy != "admin" || !e.StartedAt.Equal(j.StartedAt) {
+				t.Fatalf("unexpected history entry %+v", e)
+			}
+			if _, err := os.Stat(filepath.Join(dir, journalFile)); !os.IsNotExist(err) {
+				t.Fatalf("expected the journal to be removed, got %v", err)
+			}
+		})
+	}
+}
+
+func TestCancelStopsUpdateAndLandsOnPreviousTag(t *testing.T) {
+	newServer := func() (*Server, *[]string) {
+		s := NewServer(Config{AppServiceName: "app", Token: func() string { return "t" }})
+		var env []string
+		s.readCurrentTagFn = func() string { return "v1.0.0" }
+		s.updateEnvTagFn = func(tag string) error {
+			env = append(env, tag)
+			return nil
+		}
+		s.dockerComposeFn = func(args ...string) error { return nil }
+		s.pullImageFn = func(string) error { return nil }
+		s.waitForHealthyFn = func(time.Duration) error { return nil }
+		return s, &env
+	}
+	cancel := func(s *Server) int {
+		req := httptest.NewRequest(http.MethodPost, "/updater/cancel", nil)
+		req.Header.Set("Authorization", "Bearer t")
+		rec := httptest.NewRecorder()
+		s.routes().ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	t.Run("nothing to cancel", func(t *testing.T) {
+		s, _ := newServer()
+		if code := cancel(s); code != http.StatusConflict {
+			t.Fatalf("expected 409 when idle, got %d", code)
+		}
+	})
+
+	t.Run("backup context is cancelled", func(t *testing.T) {
+		s, env := newServer()
+		started := make(chan struct{})
+		s.cfg.PreUpdateBackup = func(ctx context.Context, reason string) (BackupOutcome, error) {
+			close(started)
+			<-ctx.Done()
+			return BackupOutcome{}, ctx.Err()
+		}
+		done := make(chan struct{})
+		go func() {
+			s.runUpdate("v1.1.0")
+			close(done)
+		}()
+		<-started
+		if code := cancel(s); code != http.StatusOK {
+			t.Fatalf("expected cancel to be accepted, got %d", code)
+		}
+		<-done
+		if st := readState(s); st.Status != "cancelled" || st.Busy() || len(*env) != 0 {
+			t.Fatalf("expected a cancelled update that changed nothing, got %+v (env %v)", st, *env)
+		}
+	})
+
+	t.Run("pull is abandoned", func(t *testing.T) {
+		s, env := newServer()
+		s.pullImageFn = func(string) error {
+			if code := cancel(s); code != http.StatusOK {
+				t.Fatalf("expected cancel to be accepted, got %d", code)
+			}
+			return context.Canceled
+		}
+		s.runUpdate("v1.1.0")
+		if st := readState(s); st.Status != "cancelled" || !strings.Contains(st.Message, "still on v1.0.0") || len(*env) != 0 {
+			t.Fatalf("unexpected state %+v (env %v)", st, *env)
+		}
+	})
+
+	t.Run("health check rolls back", func(t *testing.T) {
+		s, env := newServer()
+		s.waitForHealthyFn = func(time.Duration) error {
+			cancel(s)
+			return context.Canceled
+		}
+		s.runUpdate("v1.1.0")
+		st := readState(s)
+		if st.Status != "cancelled" || !strings.Contains(st.Message, "Rolled back to v1.0.0") {
+			t.Fatalf("unexpected state %+v", st)
+		}
+		if !reflect.DeepEqual(*env, []string{"v1.1.0", "v1.0.0"}) {
+			t.Fatalf("expected .env to be rolled back, got %v", *env)
+		}
+		if code := cancel(s); code != http.StatusConflict {
+			t.Fatalf("cancelled is terminal; expected 409, got %d", code)
+		}
+	})
+}
+
+func TestBlueGreenSwitchesCaddyOnlyOnceTheCandidateIsHealthy(t *testing.T) {
+	newServer := func(t *testing.T, candidateHealthy bool) (*Server, *[]string, string) {
+		dir := t.TempDir()
+		caddyfile := filepath.Join(dir, "Caddyfile")
+		if err := os.WriteFile(caddyfile, []byte("localhost {\n    reverse_proxy kmp-app:80\n}\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		s := NewServer(Config{AppServiceName: "app", ComposeDir: dir, ImageRepo: "ghcr.io/jhandel/kmp", BlueGreen: func() bool { return true }})
+		s.drainPeriod = 0
+		s.readCurrentTagFn = func() string { return "v1.0.0" }
+		s.updateEnvTagFn = func(string) error { return nil }
+		var calls []string
+		s.dockerComposeFn = func(args ...string) error {
+			call := strings.Join(args, " ")
+			if args[0] == "exec" {
+				// Record which upstream Caddy was reloaded with
+				data, _ := os.ReadFile(caddyfile)
+				call = "reload " + upstreamPattern.FindString(string(data))
+			}
+			calls = append(calls, call)
+			return nil
+		}
+		s.pullImageFn = func(ref string) error {
+			calls = append(calls, "pull "+ref)
+			return nil
+		}
+		s.removeContainerFn = func(name string) error {
+			calls = append(calls, "docker rm -f "+name)
+			return nil
+		}
+		s.waitForCandidateFn = func(time.Duration) error {
+			if candidateHealthy {
+				return nil
+			}
+			return errors.New("unhealthy")
+		}
+		s.waitForHealthyFn = func(time.Duration) error { return nil }
+		return s, &calls, caddyfile
+	}
+
+	t.Run("healthy candidate takes traffic while kmp-app is replaced", func(t *testing.T) {
+		s, calls, caddyfile := newServer(t, true)
+		s.runUpdate("v1.1.0")
+
+		if st := readState(s); st.Status != "completed" {
+			t.Fatalf("expected completed, got %+v", st)
+		}
+		want := []string{
+			"pull ghcr.io/jhandel/kmp:v1.1.0",
+			"docker rm -f kmp-app-next",
+			"run -d --no-deps --name kmp-app-next app",
+			"reload reverse_proxy kmp-app-next:80",
+			"stop app",
+			"rm -f app",
+			"up -d --no-deps app",
+			"reload reverse_proxy kmp-app:80",
+			"docker rm -f kmp-app-next",
+		}
+		if !reflect.DeepEqual(*calls, want) {
+			t.Fatalf("unexpected docker calls:\n got %q\nwant %q", *calls, want)
+		}
+		if data, _ := os.ReadFile(caddyfile); !strings.Contains(string(data), "reverse_proxy kmp-app:80") {
+			t.Fatalf("expected Caddy to end on kmp-app, got %s", data)
+		}
+	})
+
+	t.Run("unhealthy candidate never receives traffic", func(t *testing.T) {
+		s, calls, _ := newServer(t, false)
+		s.runUpdate("v1.1.0")
+
+		st := readState(s)
+		if st.Status != "failed" || !strings.Contains(st.Message, "kmp-app is still serving v1.0.0") || !s.outcome.rolledBack {
+			t.Fatalf("unexpected state %+v", st)
+		}
+		for _, call := range *calls {
+			if strings.HasPrefix(call, "reload") || call == "stop app" {
+				t.Fatalf("expected the running app and Caddy to be left alone, got %q", *calls)
+			}
+		}
+		if last := (*calls)[len(*calls)-1]; last != "docker rm -f kmp-app-next" {
+			t.Fatalf("expected the candidate to be removed, got %q", *calls)
+		}
+	})
+
+	t.Run("traffic left on the candidate goes back to a healthy kmp-app first", func(t *testing.T) {
+		s, calls, caddyfile := newServer(t, true)
+		if err := os.WriteFile(caddyfile, []byte("localhost {\n    reverse_proxy kmp-app-next:80\n}\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		s.runUpdate("v1.1.0")
+
+		if st := readState(s); st.Status != "completed" {
+			t.Fatalf("expected completed, got %+v", st)
+		}
+		if want := []string{"reload reverse_proxy kmp-app:80", "docker rm -f kmp-app-next", "pull ghcr.io/jhandel/kmp:v1.1.0"}; !reflect.DeepEqual((*calls)[:3], want) {
+			t.Fatalf("expected traffic to move back before the candidate is removed:\n got %q\nwant %q", *calls, want)
+		}
+	})
+
+	t.Run("traffic left on the candidate with kmp-app unhealthy refuses the update", func(t *testing.T) {
+		s, calls, caddyfile := newServer(t, true)
+		if err := os.WriteFile(caddyfile, []byte("localhost {\n    reverse_proxy kmp-app-next:80\n}\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		s.waitForHealthyFn = func(time.Duration) error { return errors.New("app returned 500") }
+		s.runUpdate("v1.1.0")
+
+		if st := readState(s); st.Status != "failed" || !strings.Contains(st.Message, "traffic is still on kmp-app-next") {
+			t.Fatalf("expected the update to be refused, got %+v", st)
+		}
+		if len(*calls) != 0 {
+			t.Fatalf("expected the serving candidate to be left alone, got %q", *calls)
+		}
+		if data, _ := os.ReadFile(caddyfile); !strings.Contains(string(data), "reverse_proxy kmp-app-next:80") {
+			t.Fatalf("expected Caddy to stay on kmp-app-next, got %s", data)
+		}
+	})
+}
+
+func TestMigrationsRunBeforeTheSwapAndAreRecorded(t *testing.T) {
+	newServer := func(t *testing.T, migrate func() (string, error)) (*Server, *[]string) {
+		s := NewServer(Config{AppServiceName: "app", StateDir: t.TempDir(), ImageRepo: "ghcr.io/jhandel/kmp", MigrateCommand: DefaultMigrateCommand})
+		s.readCurrentTagFn = func() string { return "v1.0.0" }
+		s.updateEnvTagFn = func(string) error { return nil }
+		var calls []string
+		s.dockerComposeFn = func(args ...string) error {
+			calls = append(calls, strings.Join(args, " "))
+			return nil
+		}
+		s.pullImageFn = func(ref string) error {
+			calls = append(calls, "pull "+ref)
+			return nil
+		}
+		s.runMigrationsFn = func(tag string) (string, error) {
+			calls = append(calls, "migrate "+tag)
+			if st := readState(s); st.Status != "migrating" {
+				t.Fatalf("expected the migrating state, got %q", st.Status)
+			}
+			return migrate()
+		}
+		s.waitForHealthyFn = func(time.Duration) error { return nil }
+		return s, &calls
+	}
+	history := func(t *testing.T, s *Server) HistoryEntry {
+		entries, err := ReadHistory(s.cfg.StateDir)
+		if err != nil || len(entries) != 1 {
+			t.Fatalf("expected one history entry, got %+v (%v)", entries, err)
+		}
+		return entries[0]
+	}
+
+	t.Run("success", func(t *testing.T) {
+		s, calls := newServer(t, func() (string, error) { return "== 20260101000000 AddWidgets: migrated\n", nil })
+		s.recordOperation(HistoryEntry{Operation: "update", TargetTag: "v1.1.0"}, func() { s.runUpdate("v1.1.0") })
+
+		want := []string{"pull ghcr.io/jhandel/kmp:v1.1.0", "migrate v1.1.0", "stop app", "rm -f app", "up -d --no-deps app"}
+		if !reflect.DeepEqual(*calls, want) {
+			t.Fatalf("expected migrations between pull and recreate:\n got %q\nwant %q", *calls, want)
+		}
+		if e := history(t, s); e.Status != "completed" || !strings.Contains(e.MigrationOutput, "AddWidgets: migrated") {
+			t.Fatalf("unexpected history entry %+v", e)
+		}
+	})
+
+	t.Run("failure keeps the old container serving", func(t *testing.T) {
+		s, calls := newServer(t, func() (string, error) {
+			return "SQLSTATE[42S01]: Base table or view already exists", errors.New("exit status 1")
+		})
+		s.recordOperation(HistoryEntry{Operation: "update", TargetTag: "v1.1.0"}, func() { s.runUpdate("v1.1.0") })
+
+		if want := []string{"pull ghcr.io/jhandel/kmp:v1.1.0", "migrate v1.1.0"}; !reflect.DeepEqual(*calls, want) {
+			t.Fatalf("expected the app to be left alone, got %q", *calls)
+		}
+		if st := readState(s); st.Status != "failed" || !strings.Contains(st.Message, "kmp-app is still serving v1.0.0") {
+			t.Fatalf("unexpected state %+v", st)
+		}
+		e := history(t, s)
+		if e.Status != "failed" || !strings.Contains(e.Error, "migrations failed") || !strings.Contains(e.MigrationOutput, "SQLSTATE[42S01]") {
+			t.Fatalf("unexpected history entry %+v", e)
+		}
+	})
+}
+
+func TestOperationsAndBackupsAreNotified(t *testing.T) {
+	var events []notify.Event
+	s := NewServer(Config{
+		AppServiceName: "app",
+		Notify:         func(ev notify.Event) { events = append(events, ev) },
+		RunBackup: func(ctx context.Context) (BackupOutcome, error) {
+			return BackupOutcome{}, errors.New("dump failed")
+		},
+	})
+	s.readCurrentTagFn = func() string { return "v1.0.0" }
+	s.updateEnvTagFn = func(string) error { return nil }
+	s.dockerComposeFn = func(args ...string) error { return nil }
+	s.pullImageFn = func(string) error { return nil }
+	s.waitForHealthyFn = func(time.Duration) error { return errors.New("health failed") }
+
+	s.recordOperation(HistoryEntry{Operation: "update", TargetTag: "v1.1.0", RequestedBy: "admin"}, func() { s.runUpdate("v1.1.0") })
+	s.runScheduledBackup(context.Background())
+
+	var types []string
+	for _, ev := range events {
+		types = append(types, ev.Type)
+	}
+	want := []string{notify.EventUpdateStarted, notify.EventUpdateRolledBack, notify.EventBackupFailed}
+	if !reflect.DeepEqual(types, want) {
+		t.Fatalf("expected events %v, got %v", want, types)
+	}
+	if ev := events[1]; ev.PreviousTag != "v1.0.0" || ev.TargetTag != "v1.1.0" || ev.RequestedBy != "admin" || !strings.Contains(ev.Error, "health failed") {
+		t.Fatalf("unexpected rollback event %+v", ev)
+	}
+	if ev := events[2]; ev.Error != "dump failed" || ev.Time.IsZero() {
+		t.Fatalf("unexpected backup event %+v", ev)
+	}
+}
+
+func TestMetricsExposeOperationsBackupsAndHealth(t *testing.T) {
+	s := NewServer(Config{
+		AppServiceName: "app",
+		RunBackup: func(ctx context.Context) (BackupOutcome, error) {
+			return BackupOutcome{ID: "20240101-030000"}, nil
+		},
+	})
+	clock := time.Date(2024, 1, 1, 3, 0, 0, 0, time.UTC)
+	s.now = func() time.Time {
+		clock = clock.Add(45 * time.Second)
+		return clock
+	}
+	tag := "v1.0.0"
+	s.readCurrentTagFn = func() string { return tag }
+	s.updateEnvTagFn = func(t string) error {
+		tag = t
+		return nil
+	}
+	s.dockerComposeFn = func(args ...string) error { return nil }
+	s.pullImageFn = func(string) error { return nil }
+	healthy := errors.New("unhealthy")
+	s.waitForHealthyFn = func(time.Duration) error { return healthy }
+	s.probeHealthFn = func() error { return healthy }
+
+	s.recordOperation(HistoryEntry{Operation: "update", TargetTag: "v1.1.0"}, func() { s.runUpdate("v1.1.0") })
+	healthy = nil
+	s.recordOperation(HistoryEntry{Operation: "update", TargetTag: "v1.1.0"}, func() { s.runUpdate("v1.1.0") })
+	s.runScheduledBackup(context.Background())
+	s.probeHealth(context.Background())
+
+	rec := httptest.NewRecorder()
+	s.routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Fatalf("unexpected response %d %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	body := rec.Body.String()
+	for _, want := range []string{
+		`kmp_app_info{image_tag="v1.1.0"} 1`,
+		"kmp_app_healthy 1",
+		`kmp_updater_update_attempts_total{operation="update"} 2`,
+		`kmp_updater_update_successes_total{operation="update"} 1`,
+		`kmp_updater_update_rollbacks_total{operation="update"} 1`,
+		"# TYPE kmp_updater_update_duration_seconds histogram",
+		`kmp_updater_update_duration_seconds_bucket{result="completed",le="30"} 0`,
+		`kmp_updater_update_duration_seconds_bucket{result="completed",le="+Inf"} 1`,
+		`kmp_updater_update_duration_seconds_count{result="rolled_back"} 1`,
+		"kmp_updater_operation_in_progress 0",
+		"kmp_backup_last_success_timestamp_seconds 1704",
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("expected %q in metrics:\n%s", want, body)
+		}
+	}
+}
+
+func TestMetricsTakeTheLastBackupFromTheCatalog(t *testing.T) {
+	newest := time.Date(2024, 1, 1, 3, 0, 0, 0, time.UTC)
+	var catalogErr error
+	s := NewServer(Config{
+		AppServiceName: "app",
+		LastBackup: func(context.Context) (time.Time, error) {
+			return newest, catalogErr
+		},
+	})
+	s.readCurrentTagFn = func() string { return "v1.0.0" }
+	s.probeHealthFn = func() error { return nil }
+	gauge := func() string {
+		rec := httptest.NewRecorder()
+		s.routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		for _, line := range strings.Split(rec.Body.String(), "\n") {
+			if strings.HasPrefix(line, "kmp_backup_last_success_timestamp_seconds ") {
+				return line
+			}
+		}
+		return ""
+	}
+
+	// A backup taken with kmp backup before the sidecar started
+	s.probeHealth(context.Background())
+	if got := gauge(); got != "kmp_backup_last_success_timestamp_seconds 1704078000" {
+		t.Fatalf("expected the gauge to be seeded from the catalog, got %q", got)
+	}
+
+	// A pre-update snapshot taken by the CLI, then a catalog that cannot be read
+	newest = newest.Add(time.Hour)
+	s.probeHealth(context.Background())
+	newest, catalogErr = time.Time{}, errors.New("catalog locked")
+	s.probeHealth(context.Background())
+	if got := gauge(); got != "kmp_backup_last_success_timestamp_seconds 1704081600" {
+		t.Fatalf("expected the gauge to follow the catalog's newest backup, got %q", got)
+	}
+}
+
+func TestPullGoesThroughTheEngineAPIWithLayerProgress(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "docker.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pulled string
+	daemon := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pulled = r.URL.Path + "?" + r.URL.RawQuery
+		enc := json.NewEncoder(w)
+		for _, msg := range []map[string]any{
+			{"status": "Pulling fs layer", "id": "a1"},
+			{"status": "Downloading", "id": "a1", "progressDetail": map[string]int64{"current": 10, "total": 100}},
+			{"status": "Downloading", "id": "a1", "progressDetail": map[string]int64{"current": 60, "total": 100}},
+			{"status": "Pull complete", "id": "a1"},
+			{"status": "Digest: sha256:abc"},
+		} {
+			_ = enc.Encode(msg)
+		}
+	}))
+	daemon.Listener = ln
+	daemon.Start()
+	defer daemon.Close()
+
+	s := NewServer(Config{DockerHost: "unix://" + socket})
+	if err := s.pullImage(context.Background(), "ghcr.io/jhandel/kmp:v1.1.0"); err != nil {
+		t.Fatalf("pullImage: %v", err)
+	}
+	if pulled != "/v1.41/images/create?fromImage=ghcr.io%2Fjhandel%2Fkmp&tag=v1.1.0" {
+		t.Fatalf("unexpected pull request %q", pulled)
+	}
+
+	backlog, _, _ := s.events.subscribe(0)
+	var (
+		lines    []string
+		progress []int
+	)
+	for _, ev := range backlog {
+		if ev.Type == EventLog {
+			lines = append(lines, ev.Line)
+		} else {
+			progress = append(progress, ev.State.Progress)
+		}
+	}
+	want := []string{"a1: Pulling fs layer", "a1: Downloading", "a1: Pull complete", "Digest: sha256:abc"}
+	if !reflect.DeepEqual(lines, want) {
+		t.Fatalf("log lines = %q, want %q", lines, want)
+	}
+	if !reflect.DeepEqual(progress, []int{11, 19, 25}) {
+		t.Fatalf("expected progress at 10%%, 60%% and 100%% of the pull, got %v", progress)
+	}
+}
+
+func TestAutoUpdateFollowsPolicyWindowAndBumpLevel(t *testing.T) {
+	dir := t.TempDir()
+	policy := config.AutoUpdatePolicy{Enabled: true, MaxBump: config.BumpMinor, Window: "* 2-3 * * *", Timezone: "America/New_York"}
+	var listed []string
+	s := NewServer(Config{
+		AppServiceName: "app",
+		StateDir:       dir,
+		AutoUpdate:     func() config.AutoUpdatePolicy { return policy },
+		ListTags: func(ctx context.Context, channel string) ([]string, error) {
+			listed = append(listed, channel)
+			return []string{"latest", "v1.0.1", "v1.1.0", "v2.0.0", "nightly-20240101"}, nil
+		},
+	})
+	s.runAsync = func(fn func()) { fn() }
+	tag := "v1.0.0"
+	s.readCurrentTagFn = func() string { return tag }
+	s.updateEnvTagFn = func(t string) error { tag = t; return nil }
+	s.dockerComposeFn = func(args ...string) error { return nil }
+	s.pullImageFn = func(string) error { return nil }
+	s.waitForHealthyFn = func(time.Duration) error { return nil }
+	now := time.Date(2024, 6, 1, 5, 30, 0, 0, time.UTC) // 01:30 in New York
+	s.now = func() time.Time { return now }
+	var au autoUpdater
+
+	s.checkAutoUpdate(context.Background(), &au)
+	if len(listed) != 0 || tag != "v1.0.0" {
+		t.Fatalf("expected nothing outside the window, listed %v and updated to %s", listed, tag)
+	}
+
+	now = now.Add(time.Hour)
+	s.checkAutoUpdate(context.Background(), &au)
+	if !reflect.DeepEqual(listed, []string{"release"}) || tag != "v1.1.0" {
+		t.Fatalf("expected the minor release to be applied, listed %v and updated to %s", listed, tag)
+	}
+
+	// v2.0.0 is a major bump: recorded once, however often it is seen
+	now = now.Add(5 * time.Minute)
+	s.checkAutoUpdate(context.Background(), &au)
+	if len(listed) != 1 {
+		t.Fatalf("expected the registry to be asked at most every %s, listed %v", autoUpdateCheckInterval, listed)
+	}
+	for range 2 {
+		now = now.Add(autoUpdateCheckInterval)
+		s.checkAutoUpdate(context.Background(), &au)
+	}
+	// Nor again after the sidecar restarts
+	now = now.Add(time.Minute)
+	s.checkAutoUpdate(context.Background(), &autoUpdater{})
+	entries, err := ReadHistory(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || len(listed) != 4 || tag != "v1.1.0" {
+		t.Fatalf("expected one update and one skip after %d checks, got %+v (tag %s)", len(listed), entries, tag)
+	}
+	done, skipped := entries[0], entries[1]
+	if done.Status != "completed" || done.PreviousTag != "v1.0.0" || done.TargetTag != "v1.1.0" || done.RequestedBy != AutoUpdateRequester {
+		t.Fatalf("unexpected update entry %+v", done)
+	}
+	if skipped.Status != "skipped" || skipped.Message != "skipped: major bump" || skipped.PreviousTag != "v1.1.0" || skipped.TargetTag != "v2.0.0" || skipped.RequestedBy != AutoUpdateRequester {
+		t.Fatalf("unexpected skip entry %+v", skipped)
+	}
+}
+
+func TestPlanAutoUpdatePicksTheNewestAllowedVersion(t *testing.T) {
+	tags := []string{"latest", "v1.0.1", "v1.0.2", "v1.1.0", "v2.0.0"}
+	for _, tt := range []struct {
+		current, maxBump, target, skipped string
+	}{
+		{"v1.0.0", config.BumpPatch, "v1.0.2", ""},
+		{"v1.0.0", config.BumpMinor, "v1.1.0", ""},
+		{"v1.0.0", config.BumpMajor, "v2.0.0", ""},
+		{"v1.1.0", config.BumpMinor, "v2.0.0", "skipped: major bump"},
+		{"v2.0.0", config.BumpPatch, "", ""},
+		{"latest", config.BumpMajor, "", ""},
+	} {
+		target, skipped := planAutoUpdate(tt.current, tags, tt.maxBump)
+		if target != tt.target || skipped != tt.skipped {
+			t.Errorf("planAutoUpdate(%s, %s) = %q, %q; want %q, %q", tt.current, tt.maxBump, target, skipped, tt.target, tt.skipped)
+		}
+	}
+}
+
+func TestAutoUpdaterWakesAtTheStartOfEachMinute(t *testing.T) {
+	slow := time.Date(2024, 6, 1, 2, 59, 59, 900_000_000, time.UTC) // a check that ran long
+	if got := nextMinute(slow); !got.Equal(time.Date(2024, 6, 1, 3, 0, 0, 0, time.UTC)) {
+		t.Fatalf("nextMinute(%s) = %s", slow, got)
+	}
+	onTime := time.Date(2024, 6, 1, 3, 0, 0, 0, time.UTC)
+	if got := nextMinute(onTime); !got.Equal(onTime.Add(time.Minute)) {
+		t.Fatalf("nextMinute(%s) = %s", onTime, got)
+	}
+}
+
+func TestAutoUpdateRequiringBackupStopsWithoutAnOffHostCopy(t *testing.T) {
+	pulled := false
+	s := NewServer(Config{
+		AppServiceName: "app",
+		AutoUpdate: func() config.AutoUpdatePolicy {
+			return config.AutoUpdatePolicy{Enabled: true, RequireBackup: true}
+		},
+		ListTags: func(ctx context.Context, channel string) ([]string, error) {
+			return []string{"1.0.1"}, nil
+		},
+		PreUpdateBackup: func(ctx context.Context, reason string) (BackupOutcome, error) {
+			return BackupOutcome{ID: "20240101-030000"}, errors.New("s3: access denied")
+		},
+	})
+	s.runAsync = func(fn func()) { fn() }
+	s.readCurrentTagFn = func() string { return "1.0.0" }
+	s.pullImageFn = func(string) error {
+		pulled = true
+		return nil
+	}
+
+	s.checkAutoUpdate(context.Background(), &autoUpdater{})
+
+	st := readState(s)
+	if pulled || st.Status != "failed" || st.TargetTag != "1.0.1" || !strings.Contains(st.Message, "not copied off-host") {
+		t.Fatalf("expected the update to stop before pulling, got %+v (pulled=%v)", st, pulled)
+	}
+}
+
+func TestHandleUpdateRejectsTagsTheRegistryDoesNotOffer(t *testing.T) {
+	var resolved []string
+	s := NewServer(Config{
+		ResolveTag: func(ctx context.Context, tag string) (registry.Tag, error) {
+			resolved = append(resolved, tag)
+			switch tag {
+			case "v1.1.0", "v1.0.1":
+				return registry.Tag{Name: tag, Channel: "release"}, nil
+			case "nightly-20260101":
+				return registry.Tag{Name: tag, Channel: "nightly"}, nil
+			case "v9.9.9":
+				return registry.Tag{}, fmt.Errorf("ghcr.io/jhandel/kmp:%s: %w", tag, registry.ErrTagNotFound)
+			}
+			return registry.Tag{}, errors.New("GHCR API returned 503")
+		},
+		Channel: func() string { return "release" },
+	})
+	s.readCurrentTagFn = func() string { return "v1.0.5" }
+	started := 0
+	s.runAsync = func(fn func()) { started++ }
+
+	for _, tt := range []struct {
+		body string
+		code int
+		msg  string
+	}{
+		{`{"targetTag":"v9.9.9"}`, http.StatusUnprocessableEntity, "tag not found"},
+		{`{"targetTag":"installer-v1.1.0"}`, http.StatusUnprocessableEntity, "not an app image tag"},
+		{`{"targetTag":"php8.3"}`, http.StatusUnprocessableEntity, "not an app image tag"},
+		{`{"targetTag":"v1.1.0\nKMP_IMAGE_TAG=evil"}`, http.StatusUnprocessableEntity, "not a valid image tag"},
+		{`{"targetTag":"v1.0.1"}`, http.StatusUnprocessableEntity, "older than the running v1.0.5"},
+		{`{"targetTag":"nightly-20260101"}`, http.StatusUnprocessableEntity, "less stable than this deployment's release channel"},
+		{`{"targetTag":"v2.0.0"}`, http.StatusBadGateway, "GHCR API returned 503"},
+	} {
+		rec := httptest.NewRecorder()
+		s.handleUpdate(rec, httptest.NewRequest(http.MethodPost, "/updater/update", bytes.NewBufferString(tt.body)))
+		if rec.Code != tt.code || !strings.Contains(rec.Body.String(), tt.msg) {
+			t.Fatalf("%s: expected %d mentioning %q, got %d %s", tt.body, tt.code, tt.msg, rec.Code, rec.Body)
+		}
+		if st := readState(s); st.Status != "idle" || started != 0 {
+			t.Fatalf("%s: expected no state change, got %+v (started %d)", tt.body, st, started)
+		}
+	}
+	if want := []string{"v9.9.9", "v1.0.1", "nightly-20260101", "v2.0.0"}; !reflect.DeepEqual(resolved, want) {
+		t.Fatalf("expected only well-formed app tags to reach the registry, got %v", resolved)
+	}
+
+	for _, body := range []string{`{"targetTag":"v1.0.1","force":true}`, `{"targetTag":"nightly-20260101","force":true}`, `{"targetTag":"v1.1.0"}`} {
+		s.state = State{Status: "idle"}
+		rec := httptest.NewRecorder()
+		s.handleUpdate(rec, httptest.NewRequest(http.MethodPost, "/updater/update", bytes.NewBufferString(body)))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: expected the update to start, got %d %s", body, rec.Code, rec.Body)
+		}
+	}
+	if started != 3 {
+		t.Fatalf("expected three updates to start, got %d", started)
+	}
+}
+
+func TestRollbackWithoutATagReturnsToTheVersionTheLastUpdateReplaced(t *testing.T) {
+	dir := t.TempDir()
+	s := NewServer(Config{AppServiceName: "app", StateDir: dir, ImageRepo: "ghcr.io/jhandel/kmp", Token: func() string { return "t" }})
+	s.runAsync = func(fn func()) { fn() }
+	tag := "v1.0.0"
+	s.readCurrentTagFn = func() string { return tag }
+	s.updateEnvTagFn = func(t string) error { tag = t; return nil }
+	s.dockerComposeFn = func(args ...string) error { return nil }
+	var pulls []string
+	s.pullImageFn = func(ref string) error { pulls = append(pulls, ref); return nil }
+	s.tagImageFn = func(source, tag string) error { pulls = append(pulls, "tag "+source+" "+tag); return nil }
+	healthy := true
+	s.waitForHealthyFn = func(time.Duration) error {
+		if healthy {
+			return nil
+		}
+		return errors.New("app returned 500")
+	}
+	s.imageDigestFn = func(tag string) string { return "sha256:" + strings.ReplaceAll(tag, ".", "") }
+	handler := s.routes()
+
+	post := func(path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, bytes.NewBufferString(body))
+		req.Header.Set("Authorization", "Bearer t")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	stackTags := func() []string {
+		versions, err := ReadVersions(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var tags []string
+		for _, v := range versions {
+			tags = append(tags, v.Tag)
+		}
+		return tags
+	}
+
+	post("/updater/update", `{"targetTag":"v1.1.0"}`)
+	post("/updater/update", `{"targetTag":"v1.2.0"}`)
+	healthy = false
+	post("/updater/update", `{"targetTag":"v1.3.0"}`)
+	healthy = true
+	if got := stackTags(); !reflect.DeepEqual(got, []string{"v1.0.0", "v1.1.0"}) || tag != "v1.2.0" {
+		t.Fatalf("expected the completed updates' previous tags on the stack, got %v on %s", got, tag)
+	}
+	versions, _ := ReadVersions(dir)
+	if versions[1].Digest != "sha256:v110" || versions[1].ReplacedAt.IsZero() {
+		t.Fatalf("expected the digest and time to be recorded, got %+v", versions[1])
+	}
+
+	pulls = nil
+	rec := post("/updater/rollback", "")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"targetTag":"v1.1.0"`) {
+		t.Fatalf("rollback: %d %s", rec.Code, rec.Body)
+	}
+	if want := []string{"ghcr.io/jhandel/kmp@sha256:v110", "tag ghcr.io/jhandel/kmp@sha256:v110 v1.1.0"}; !reflect.DeepEqual(pulls, want) {
+		t.Fatalf("expected the recorded digest to come back as v1.1.0, got %q", pulls)
+	}
+	if got := stackTags(); tag != "v1.1.0" || !reflect.DeepEqual(got, []string{"v1.0.0"}) {
+		t.Fatalf("expected to be back on v1.1.0 with v1.0.0 left, got %s and %v", tag, got)
+	}
+	if rec := post("/updater/rollback", `{}`); rec.Code != http.StatusOK || tag != "v1.0.0" || len(stackTags()) != 0 {
+		t.Fatalf("second rollback: %d %s (on %s)", rec.Code, rec.Body, tag)
+	}
+	if rec := post("/updater/rollback", ""); rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), "no previous version") {
+		t.Fatalf("expected 409 with nothing left to roll back to, got %d %s", rec.Code, rec.Body)
+	}
+
+	page, _ := ReadHistory(dir)
+	if last := page[len(page)-1]; last.Operation != "rollback" || last.PreviousTag != "v1.1.0" || last.TargetTag != "v1.0.0" {
+		t.Fatalf("unexpected history entry %+v", last)
+	}
+}
+
+func TestPopVersionGoesBackToANamedTag(t *testing.T) {
+	stack := []config.DeployedVersion{{Tag: "v1.0.0"}, {Tag: "v1.1.0"}, {Tag: "v1.2.0"}}
+	v, rest, err := PopVersion(stack, "v1.1.0")
+	if err != nil || v.Tag != "v1.1.0" || len(rest) != 1 || rest[0].Tag != "v1.0.0" {
+		t.Fatalf("PopVersion = %+v, %+v, %v", v, rest, err)
+	}
+	if _, _, err := PopVersion(stack, "v0.9.0"); err == nil || !strings.Contains(err.Error(), "have v1.2.0, v1.1.0, v1.0.0") {
+		t.Fatalf("expected the known versions to be listed, got %v", err)
+	}
+	if _, _, err := PopVersion(nil, ""); !errors.Is(err, ErrNoPreviousVersion) {
+		t.Fatalf("expected ErrNoPreviousVersion, got %v", err)
+	}
+
+	for i := range maxVersions + 2 {
+		stack = PushVersion(stack, config.DeployedVersion{Tag: fmt.Sprintf("v2.%d.0", i)})
+	}
+	stack = PushVersion(stack, config.DeployedVersion{Tag: "v2.11.0", Digest: "sha256:new"})
+	if len(stack) != maxVersions || stack[0].Tag != "v2.2.0" || stack[maxVersions-1].Digest != "sha256:new" {
+		t.Fatalf("expected the newest %d versions without duplicates, got %+v", maxVersions, stack)
+	}
+}
+
 func readState(s *Server) State {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -0,0 +1,140 @@
+package updater
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jhandel/KMP/installer/internal/config"
+)
+
+const (
+	// VersionsFile is the stack of previously deployed tags inside the state
+	// dir. Both the sidecar and kmp update push to it.
+	VersionsFile = "versions.json"
+
+	// maxVersions is how many previous tags the stack keeps.
+	maxVersions = 10
+)
+
+// ErrNoPreviousVersion means nothing has been recorded to roll back to.
+var ErrNoPreviousVersion = errors.New("no previous version recorded")
+
+// ReadVersions returns the version stack in stateDir, newest last. A missing
+// file is an empty stack.
+func ReadVersions(stateDir string) ([]config.DeployedVersion, error) {
+	data, err := os.ReadFile(filepath.Join(stateDir, VersionsFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var versions []config.DeployedVersion
+	if err := json.Unmarshal(data, &versions); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", VersionsFile, err)
+	}
+	return versions, nil
+}
+
+// WriteVersions replaces the version stack in stateDir.
+func WriteVersions(stateDir string, versions []config.DeployedVersion) error {
+	if err := os.MkdirAll(stateDir, 0750); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(versions, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(stateDir, VersionsFile)
+	tmp := path + ".partial"
+	if err := os.WriteFile(tmp, data, 0640); err != nil {
+		return fmt.Errorf("writing %s: %w", VersionsFile, err)
+	}
+	return os.Rename(tmp, path)
+}
+
+// PushVersion adds v on top of stack, dropping the oldest entries beyond
+// maxVersions. Pushing the tag already on top only refreshes it.
+func PushVersion(stack []config.DeployedVersion, v config.DeployedVersion) []config.DeployedVersion {
+	if n := len(stack); n > 0 && stack[n-1].Tag == v.Tag {
+		stack = stack[:n-1]
+	}
+	stack = append(stack, v)
+	if len(stack) > maxVersions {
+		stack = stack[len(stack)-maxVersions:]
+	}
+	return stack
+}
+
+// PopVersion takes the version to roll back to off stack: the top one, or
+// with tag set the newest entry for that tag, along with everything above it.
+// It returns that version and the remaining stack.
+func PopVersion(stack []config.DeployedVersion, tag string) (config.DeployedVersion, []config.DeployedVersion, error) {
+	if len(stack) == 0 {
+		return config.DeployedVersion{}, nil, ErrNoPreviousVersion
+	}
+	if tag == "" {
+		return stack[len(stack)-1], stack[:len(stack)-1], nil
+	}
+	for i := len(stack) - 1; i >= 0; i-- {
+		if stack[i].Tag == tag {
+			return stack[i], stack[:i], nil
+		}
+	}
+	tags := make([]string, len(stack))
+	for i, v := range stack {
+		tags[len(stack)-1-i] = v.Tag
+	}
+	return config.DeployedVersion{}, stack, fmt.Errorf("%s is not a previous version (have %s)", tag, strings.Join(tags, ", "))
+}
+
+// recordVersion keeps the version stack in step with a finished operation:
+// a completed update pushes the tag it replaced, a completed rollback pops
+// the tag it went back to.
+func (s *Server) recordVersion(entry HistoryEntry) {
+	if s.cfg.StateDir == "" || entry.Status != "completed" || entry.PreviousTag == "" || entry.PreviousTag == "unknown" {
+		return
+	}
+	stack, err := ReadVersions(s.cfg.StateDir)
+	if err != nil {
+		log.Printf("Warning: could not read version stack: %v", err)
+		return
+	}
+	switch entry.Operation {
+	case "update":
+		stack = PushVersion(stack, config.DeployedVersion{
+			Tag:        entry.PreviousTag,
+			Digest:     s.imageDigest(entry.PreviousTag),
+			ReplacedAt: entry.FinishedAt,
+		})
+	case "rollback":
+		if _, rest, err := PopVersion(stack, entry.TargetTag); err == nil {
+			stack = rest
+		}
+	}
+	if err := WriteVersions(s.cfg.StateDir, stack); err != nil {
+		log.Printf("Warning: could not record version stack: %v", err)
+	}
+}
+
+// imageDigest returns the registry digest of the local image for tag, or ""
+// when it cannot be inspected.
+func (s *Server) imageDigest(tag string) string {
+	if s.imageDigestFn != nil {
+		return s.imageDigestFn(tag)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	img, err := s.docker.InspectImage(ctx, s.cfg.ImageRepo+":"+tag)
+	if err != nil {
+		return ""
+	}
+	return img.RepoDigest(s.cfg.ImageRepo)
+}